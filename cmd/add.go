@@ -19,14 +19,39 @@ passed directly as an argument. Make sure the URL is a full URL with all
 components, and note that you might need to quote the URL depending on the 
 contents of the URL and what environment you're running in.
 
-ex: feeder add "https://rowehl.com/feed.xml"`,
+If the URL is a page that lists more than one feed you'll be asked which one
+to add. Use --pick to choose one up front (starting from 1). If the page
+doesn't list any feeds a few common feed locations on the site are tried.
+
+Feeds can also come from this machine: a file:// URL reads a feed written
+by some other tool, and exec: followed by a shell command runs the command
+each fetch and reads the feed from its output. Use --filter to pipe the
+content of any feed through a command before it's parsed, for turning
+something that isn't quite a feed into one. Filters get the feed URL in
+the FEEDER_URL environment variable.
+
+ex: feeder add "https://rowehl.com/feed.xml"
+    feeder add --pick 2 "https://rowehl.com/"
+    feeder add "file:///home/me/reports/feed.xml"
+    feeder add "exec:~/bin/build-status --rss"
+    feeder add --filter "~/bin/fix-dates" "https://example.com/broken.xml"`,
 		Args: cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			feedUrl := args[0]
+			pick, err := cmd.Flags().GetInt("pick")
+			if err != nil {
+				return err
+			}
+			filter, err := cmd.Flags().GetString("filter")
+			if err != nil {
+				return err
+			}
 			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
-			return f.Add(feedUrl)
+			return f.AddPick(cmd.Context(), feedUrl, pick, filter)
 		},
 	}
+	addCmd.Flags().Int("pick", 0, "which discovered feed to add when a page lists several")
+	addCmd.Flags().String("filter", "", "shell command to pipe the feed through before parsing")
 	return addCmd
 }
 
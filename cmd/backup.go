@@ -0,0 +1,54 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/mikerowehl/feeder/internal/feeder"
+	"github.com/spf13/cobra"
+)
+
+func NewBackupCmd() *cobra.Command {
+	backupCmd := &cobra.Command{
+		Use:   "backup FILE",
+		Short: "Writes everything in the database, including read state, to a backup file",
+		Long: `Writes all the feeds with their settings, all the items along with which ones
+are read or starred, and the rules to a compressed backup file. Use the
+restore command to load it back in, into this database or a new one. Give -
+as the file to write to standard output.
+
+With --snapshot a copy of the SQLite database file itself is written
+instead. It's taken in one go, so it's consistent even while another feeder
+process is fetching, and the copy can be used directly with --db-file.
+
+ex: feeder backup feeds.backup
+    feeder backup --snapshot feeder-copy.db`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
+			snapshot, err := cmd.Flags().GetBool("snapshot")
+			if err != nil {
+				return err
+			}
+			if snapshot {
+				err = f.Snapshot(cmd.Context(), args[0])
+			} else {
+				err = f.Backup(cmd.Context(), args[0])
+			}
+			if err != nil {
+				return fmt.Errorf("error writing backup: %w", err)
+			}
+			return nil
+		},
+	}
+	backupCmd.Flags().Bool("snapshot", false, "copy the SQLite database file instead of writing a backup archive")
+	return backupCmd
+}
+
+func init() {
+	RegisterSubcommand(NewBackupCmd)
+}
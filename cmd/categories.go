@@ -0,0 +1,36 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/mikerowehl/feeder/internal/feeder"
+	"github.com/spf13/cobra"
+)
+
+func NewCategoriesCmd() *cobra.Command {
+	categoriesCmd := &cobra.Command{
+		Use:   "categories",
+		Short: "List the categories used by items and how many items have each",
+		Long: `Outputs each category name that feeds have assigned to items, along with the
+number of items in that category. Any of the names can be passed to
+read --category to write a page with just the unread items in that category.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
+			err := f.Categories(cmd.Context())
+			if err != nil {
+				return fmt.Errorf("error listing categories: %w", err)
+			}
+			return nil
+		},
+	}
+	return categoriesCmd
+}
+
+func init() {
+	RegisterSubcommand(NewCategoriesCmd)
+}
@@ -18,34 +18,48 @@ func NewDailyCmd() *cobra.Command {
 		Use:   "daily",
 		Short: "Fetches all the feeds, makes a page of posts, and marks all read",
 		Long: `Just a convenience wrapper around fetch, read, and mark. Just checks at each
-operation and only goes to the next if everything is okay.`,
+operation and only goes to the next if everything is okay.
+
+New items send notifications the same as with fetch, see fetch --help for
+how they're set up.
+
+ex: feeder daily --notify-webhook ntfy=https://ntfy.sh/my-releases`,
+		Annotations: map[string]string{storeLock: lockNone},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
+			notifier, err := newNotifier(cmd, f.Client)
+			if err != nil {
+				cmd.SilenceUsage = true
+				return err
+			}
+			f.Notifier = notifier
 			f.Out("Fetching feeds\n")
-			err := f.Fetch()
+			err = f.Fetch(cmd.Context())
 			if err != nil {
+				skipUsageIfInterrupted(cmd, err)
 				return fmt.Errorf("error fetching feeds: %w", err)
 			}
 			f.Out("Writing HTML file\n")
-			outFile := defaultedOutput()
-			err = f.WriteUnread(outFile)
+			outFile := defaultedOutput(feeder.FormatHTML)
+			err = f.WriteUnread(cmd.Context(), outFile, readOptions())
 			if err != nil {
 				return fmt.Errorf("error writing out unread: %w", err)
 			}
 			f.Out("Updating read state\n")
-			err = f.MarkAll()
+			err = f.MarkAll(cmd.Context())
 			if err != nil {
 				return fmt.Errorf("error marking feeds: %w", err)
 			}
 			f.Out("Cleaning up database\n")
 			maxItems := viper.GetInt("max-items")
-			err = f.Trim(maxItems)
+			err = f.Trim(cmd.Context(), maxItems)
 			if err != nil {
 				fmt.Println("Problem trimming database: " + err.Error())
 			}
 			return f.Open(outFile)
 		},
 	}
+	addNotifyFlags(dailyCmd)
 	return dailyCmd
 }
 
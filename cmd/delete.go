@@ -28,7 +28,7 @@ ex: feeder delete 5`,
 			}
 			feedId := uint(u64)
 			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
-			return f.Delete(feedId)
+			return f.Delete(cmd.Context(), feedId)
 		},
 	}
 	return deleteCmd
@@ -0,0 +1,51 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/mikerowehl/feeder/internal/feeder"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewDownloadCmd() *cobra.Command {
+	downloadCmd := &cobra.Command{
+		Use:   "download",
+		Short: "Downloads the media files attached to unread items",
+		Long: `Fetches the enclosures (podcast episodes, videos, and so on) for all the items
+not yet marked as read into a local directory. Files that are already there
+are skipped, and interrupted downloads pick up where they left off on the
+next run. Anything bigger than the max size is skipped.
+
+ex: feeder download --dir ~/Podcasts --max-size 200`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
+			dir := feeder.ExpandPath(viper.GetString("download-dir"))
+			maxBytes := viper.GetInt64("max-download-size") * 1024 * 1024
+			err := f.Download(cmd.Context(), dir, maxBytes)
+			if err != nil {
+				return fmt.Errorf("error downloading enclosures: %w", err)
+			}
+			return nil
+		},
+	}
+	downloadCmd.Flags().String("dir", ".", "directory to download files into")
+	downloadCmd.Flags().Int64("max-size", 500, "maximum size of a single download in MB (0 for no limit)")
+	if err := viper.BindPFlag("download-dir", downloadCmd.Flags().Lookup("dir")); err != nil {
+		log.Printf("Error binding dir flag\n")
+	}
+	if err := viper.BindPFlag("max-download-size", downloadCmd.Flags().Lookup("max-size")); err != nil {
+		log.Printf("Error binding max-size flag\n")
+	}
+	return downloadCmd
+}
+
+func init() {
+	RegisterSubcommand(NewDownloadCmd)
+}
@@ -17,12 +17,12 @@ func NewExportCmd() *cobra.Command {
 		Use:   "export",
 		Short: "Writes the list of feeds from the database out to standard output",
 		Long: `Very minimal output just written to standard output. This can be captured and then
-fed back into the import command when rebuilding the database. There isn't
-currently any way to capture the read/unread status. So I normally get the
-feeds caught up, export and import, and just mark everything read.`,
+fed back into the import command when rebuilding the database. Only the URLs
+are written, to carry over read/unread status and everything else use the
+backup and restore commands instead.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
-			err := f.Export()
+			err := f.Export(cmd.Context())
 			if err != nil {
 				return fmt.Errorf("error exporting feeds: %w", err)
 			}
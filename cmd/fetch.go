@@ -7,9 +7,13 @@ package cmd
 
 import (
 	"fmt"
+	"log"
+	"net/http"
 
 	"github.com/mikerowehl/feeder/internal/feeder"
+	"github.com/mikerowehl/feeder/internal/notify"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 func NewFetchCmd() *cobra.Command {
@@ -17,20 +21,97 @@ func NewFetchCmd() *cobra.Command {
 		Use:   "fetch",
 		Short: "Fetch the content from feeds and update the local set of items",
 		Long: `For the set of feeds in the local database this fetches the content from
-each of the URLs and updates the items associated with the feed.`,
+each of the URLs and updates the items associated with the feed.
+
+New items can also send notifications: every item from a feed with
+"feeder set ID --notify", and any item a rule with "--action notify"
+matches. Notifications go to each --notify-webhook as JSON, in the generic
+shape or the one Slack, Discord, or ntfy expects (given as format=URL), and
+to --notify-command, which gets the details in FEEDER_TITLE, FEEDER_FEED,
+FEEDER_LINK, FEEDER_AUTHOR, FEEDER_PUBLISHED, FEEDER_ITEM_ID, FEEDER_COUNT,
+and FEEDER_MESSAGE. Up to --notify-batch items from one fetch get a
+notification each, more are summed up in one, and no more than
+--notify-max-per-hour go out in an hour. These can all go in the config
+file too, with the webhooks as a list under notify-webhooks.
+
+ex: feeder fetch --notify-command 'notify-send "$FEEDER_TITLE" "$FEEDER_MESSAGE"'
+    feeder fetch --notify-webhook slack=https://hooks.slack.com/services/T0/B0/XXXX
+    feeder fetch --notify-webhook ntfy=https://ntfy.sh/my-releases`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
-			err := f.Fetch()
+			notifier, err := newNotifier(cmd, f.Client)
 			if err != nil {
+				cmd.SilenceUsage = true
+				return err
+			}
+			f.Notifier = notifier
+			err = f.Fetch(cmd.Context())
+			if err != nil {
+				skipUsageIfInterrupted(cmd, err)
 				return fmt.Errorf("error fetching feeds: %w", err)
 			}
 			fmt.Println("fetch finished")
 			return nil
 		},
 	}
+	addNotifyFlags(fetchCmd)
 	return fetchCmd
 }
 
+// The flags for the notifications new items send, for the commands that
+// fetch.
+func addNotifyFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("notify-webhook", nil,
+		"URL to POST notifications to, as [json|slack|discord|ntfy=]URL (repeatable)")
+	cmd.Flags().String("notify-command", "", "shell command to run for each notification")
+	cmd.Flags().Int("notify-batch", notify.DefaultBatchSize,
+		"most items from one fetch to notify about one at a time, more are sent as a summary")
+	cmd.Flags().Int("notify-max-per-hour", notify.DefaultMaxPerHour,
+		"most notifications to send in an hour, 0 for no limit")
+	bindNotifyFlags(cmd)
+}
+
+// More than one command has the notify flags, and the last one bound gets
+// the config keys, so the command that's running binds them again.
+func bindNotifyFlags(cmd *cobra.Command) {
+	if err := viper.BindPFlag("notify-webhooks", cmd.Flags().Lookup("notify-webhook")); err != nil {
+		log.Printf("Error binding notify-webhook flag\n")
+	}
+	if err := viper.BindPFlag("notify-command", cmd.Flags().Lookup("notify-command")); err != nil {
+		log.Printf("Error binding notify-command flag\n")
+	}
+	if err := viper.BindPFlag("notify-batch", cmd.Flags().Lookup("notify-batch")); err != nil {
+		log.Printf("Error binding notify-batch flag\n")
+	}
+	if err := viper.BindPFlag("notify-max-per-hour", cmd.Flags().Lookup("notify-max-per-hour")); err != nil {
+		log.Printf("Error binding notify-max-per-hour flag\n")
+	}
+}
+
+// Build the notifier from the running command's flags and the config, nil
+// if there's nowhere to send notifications. The times notifications went
+// out are kept next to the database so the hourly limit holds across runs.
+func newNotifier(cmd *cobra.Command, client *http.Client) (*notify.Notifier, error) {
+	bindNotifyFlags(cmd)
+	cfg := notify.Config{
+		Command:    viper.GetString("notify-command"),
+		BatchSize:  viper.GetInt("notify-batch"),
+		MaxPerHour: viper.GetInt("notify-max-per-hour"),
+		StatePath:  dbPath() + ".notified",
+	}
+	for _, spec := range viper.GetStringSlice("notify-webhooks") {
+		hook, err := notify.ParseWebhook(spec)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Webhooks = append(cfg.Webhooks, hook)
+	}
+	if len(cfg.Webhooks) == 0 && cfg.Command == "" {
+		return nil, nil
+	}
+	return notify.New(cfg, client), nil
+}
+
 func init() {
 	RegisterSubcommand(NewFetchCmd)
 }
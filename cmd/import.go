@@ -20,7 +20,7 @@ func NewImportCmd() *cobra.Command {
 the urls and add each one to the database.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
-			err := f.Import()
+			err := f.Import(cmd.Context())
 			if err != nil {
 				return fmt.Errorf("error importing feeds: %w", err)
 			}
@@ -19,7 +19,7 @@ func NewListCmd() *cobra.Command {
 		Long:  `Outputs the title and URL of each feed from the database onto standard output.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
-			err := f.List()
+			err := f.List(cmd.Context())
 			if err != nil {
 				return fmt.Errorf("error fetching feeds: %w", err)
 			}
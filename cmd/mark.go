@@ -25,10 +25,20 @@ of posts to read:
 feeder fetch # retrieve the latest from the feed
 feeder read  # generate a local file with all the posts to read
 feeder mark  # mark everything in the database as read
-feeder open  # open the genereated file in your default browser`,
+feeder open  # open the genereated file in your default browser
+
+Use --item to mark just one item read instead. If the item is a story that
+was also covered by other feeds, all of the copies are marked read.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
-			err := f.MarkAll()
+			itemId, err := cmd.Flags().GetUint("item")
+			if err != nil {
+				return err
+			}
+			if itemId != 0 {
+				return f.MarkItem(cmd.Context(), itemId)
+			}
+			err = f.MarkAll(cmd.Context())
 			if err != nil {
 				return fmt.Errorf("Error marking feeds: %w", err)
 			}
@@ -36,6 +46,7 @@ feeder open  # open the genereated file in your default browser`,
 			return nil
 		},
 	}
+	markCmd.Flags().Uint("item", 0, "mark only the item with this ID (and its duplicates) read")
 	return markCmd
 }
 
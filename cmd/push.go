@@ -0,0 +1,67 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/mikerowehl/feeder/internal/feeder"
+	lib "github.com/mikerowehl/feeder/pkg/feeder"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewPushCmd() *cobra.Command {
+	pushCmd := &cobra.Command{
+		Use:   "push",
+		Short: "Listens for new items pushed by the hubs feeds publish through",
+		Long: `Some feeds publish through a WebSub (PubSubHubbub) hub, which pushes new
+entries out as soon as they're published. This subscribes to every feed that
+names a hub, either in the feed or in the headers it's served with, and
+keeps running to take the items the hubs push, saving them just like fetch
+does. Subscriptions are renewed before they run out. Feeds without a hub are
+skipped, keep fetching those as usual.
+
+The hubs need to reach the listener over the network, at the URL given with
+--callback. Behind a reverse proxy that's the public URL the proxy forwards
+to the listen address. It can only be left out when listening on a
+particular address the hubs can reach, like --listen feeds.example.com:8080.
+The hubs are only given a secret to sign what they push with when the
+callback is HTTPS, so over plain HTTP the pushes can't be checked.
+
+Stop it with Ctrl-C, the hubs stop pushing once the subscriptions run out.
+
+ex: feeder push --listen :8080 --callback https://feeds.example.com/websub/`,
+		Annotations: map[string]string{storeLock: lockNone},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
+			err := f.Push(cmd.Context(), viper.GetString("push-listen"), viper.GetString("push-callback"),
+				viper.GetDuration("push-lease"))
+			if err != nil {
+				return fmt.Errorf("error listening for pushes: %w", err)
+			}
+			return nil
+		},
+	}
+	pushCmd.Flags().String("listen", ":8080", "address to listen on for the hubs")
+	pushCmd.Flags().String("callback", "", "public URL the hubs reach the listener at (default the listen address, if it isn't all addresses)")
+	pushCmd.Flags().Duration("lease", lib.DefaultPushLease, "how long to ask the hubs to keep each subscription")
+	if err := viper.BindPFlag("push-listen", pushCmd.Flags().Lookup("listen")); err != nil {
+		log.Printf("Error binding listen flag\n")
+	}
+	if err := viper.BindPFlag("push-callback", pushCmd.Flags().Lookup("callback")); err != nil {
+		log.Printf("Error binding callback flag\n")
+	}
+	if err := viper.BindPFlag("push-lease", pushCmd.Flags().Lookup("lease")); err != nil {
+		log.Printf("Error binding lease flag\n")
+	}
+	return pushCmd
+}
+
+func init() {
+	RegisterSubcommand(NewPushCmd)
+}
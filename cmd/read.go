@@ -7,6 +7,7 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/mikerowehl/feeder/internal/feeder"
 	"github.com/spf13/cobra"
@@ -15,32 +16,95 @@ import (
 
 // defaultedOutput checks to see if the user has provided an explicit output
 // location. If the user has provided one we use that, if not default to a
-// filename that includes the current date.
-func defaultedOutput() string {
+// filename that includes the current date, with the extension for the
+// format.
+func defaultedOutput(format string) string {
 	outputArg := viper.GetString("output")
 	if outputArg != "" {
 		return outputArg
 	}
+	if format == feeder.FormatEpub {
+		return strings.TrimSuffix(feeder.TodayFile(), ".html") + ".epub"
+	}
 	return feeder.TodayFile()
 }
 
+// readOptions collects the settings for writing the page of unread items
+// that are shared between the read and daily commands.
+func readOptions() feeder.ReadOptions {
+	return feeder.ReadOptions{
+		Offline:       viper.GetBool("offline"),
+		OfflineAssets: viper.GetBool("offline-assets"),
+		MaxImageBytes: viper.GetInt64("max-image-size") * 1024,
+		MaxImageWidth: viper.GetInt("max-image-width"),
+	}
+}
+
 func NewReadCmd() *cobra.Command {
 	readCmd := &cobra.Command{
 		Use:   "read",
 		Short: "Write a page with all unread items",
 		Long: `Searches through the local database for any items not yet marked as read (so
 the feeds must have already been pulled with fetch) and writes out a single
-page in the current directory with a table of all the unread items.`,
+page in the current directory with a table of all the unread items.
+
+Use --author, --category, or --search to only include some of the unread
+items. Author matches any part of the name, category needs to match a whole
+category (the categories command lists them), and search looks through the
+titles and content including full articles. Case doesn't matter for any.
+
+With --offline the images in the page are downloaded and put directly into
+the page (or into a directory next to it with --offline-assets), tracking
+pixels are removed, and nothing else is loaded from remote sites. The page
+then works without a network connection.
+
+Use --format epub to write an EPUB book for e-readers instead of a page, with
+a chapter for each feed (or each item with --chapters item) and the images
+included in the book. --starred writes out the starred items, whether they've
+been read or not, instead of the unread ones.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
-			outfile := defaultedOutput()
-			err := f.WriteUnread(outfile)
+			opts := readOptions()
+			var err error
+			if opts.Format, err = cmd.Flags().GetString("format"); err != nil {
+				return err
+			}
+			if opts.Format != feeder.FormatHTML && opts.Format != feeder.FormatEpub {
+				return fmt.Errorf("unknown format %q, use html or epub", opts.Format)
+			}
+			chapters, err := cmd.Flags().GetString("chapters")
+			if err != nil {
+				return err
+			}
+			if chapters != "feed" && chapters != "item" {
+				return fmt.Errorf("unknown chapters setting %q, use feed or item", chapters)
+			}
+			opts.EpubPerItem = chapters == "item"
+			if opts.StarredOnly, err = cmd.Flags().GetBool("starred"); err != nil {
+				return err
+			}
+			if opts.Filter.Author, err = cmd.Flags().GetString("author"); err != nil {
+				return err
+			}
+			if opts.Filter.Category, err = cmd.Flags().GetString("category"); err != nil {
+				return err
+			}
+			if opts.Filter.Search, err = cmd.Flags().GetString("search"); err != nil {
+				return err
+			}
+			err = f.WriteUnread(cmd.Context(), defaultedOutput(opts.Format), opts)
 			if err != nil {
 				return fmt.Errorf("error writing out unread: %w", err)
 			}
 			return nil
 		},
 	}
+	readCmd.Flags().String("author", "", "only include items by a matching author")
+	readCmd.Flags().String("category", "", "only include items in this category")
+	readCmd.Flags().String("search", "", "only include items containing this text")
+	readCmd.Flags().String("format", feeder.FormatHTML, "output format, html or epub")
+	readCmd.Flags().String("chapters", "feed", "with epub, make a chapter for each feed or item")
+	readCmd.Flags().Bool("starred", false, "write the starred items instead of the unread ones")
 	return readCmd
 }
 
@@ -0,0 +1,51 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/mikerowehl/feeder/internal/feeder"
+	"github.com/spf13/cobra"
+)
+
+func NewRestoreCmd() *cobra.Command {
+	restoreCmd := &cobra.Command{
+		Use:   "restore FILE",
+		Short: "Loads a file written by the backup command into the database",
+		Long: `Reads a backup file and loads it into the database. By default the backup is
+merged in: feeds, items, and rules that aren't in the database yet are added,
+and items that are already there get their read and starred state and tags
+from the backup. So after rebuilding a database and fetching the feeds again,
+restoring a backup brings back what had been read.
+
+With --replace everything in the database is thrown away first and the
+backup is loaded exactly as it was. Give - as the file to read from
+standard input.
+
+ex: feeder restore feeds.backup
+    feeder restore --replace feeds.backup`,
+		Args:        cobra.ExactArgs(1),
+		Annotations: map[string]string{storeLock: lockExclusive},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
+			replace, err := cmd.Flags().GetBool("replace")
+			if err != nil {
+				return err
+			}
+			if err := f.Restore(cmd.Context(), args[0], replace); err != nil {
+				return fmt.Errorf("error restoring backup: %w", err)
+			}
+			return nil
+		},
+	}
+	restoreCmd.Flags().Bool("replace", false, "replace everything in the database instead of merging")
+	return restoreCmd
+}
+
+func init() {
+	RegisterSubcommand(NewRestoreCmd)
+}
@@ -13,12 +13,19 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/mikerowehl/feeder/internal/feeder"
+	lib "github.com/mikerowehl/feeder/pkg/feeder"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -27,6 +34,41 @@ type feederKeyType struct{}
 
 var feederKey = feederKeyType{}
 
+// The lock taken for the running command. Cobra skips PersistentPostRunE
+// when a command fails, so this gets let go of by a finalizer instead,
+// which runs either way.
+var (
+	heldLockMu sync.Mutex
+	heldLock   *lib.StoreLock
+)
+
+func init() {
+	cobra.OnFinalize(releaseLock)
+}
+
+func releaseLock() {
+	heldLockMu.Lock()
+	defer heldLockMu.Unlock()
+	if heldLock != nil {
+		if err := heldLock.Release(); err != nil {
+			log.Printf("Error releasing database lock: %v\n", err)
+		}
+		heldLock = nil
+	}
+}
+
+// Commands hold the database lock shared while they run, so a VACUUM in
+// another process waits for them. This annotation changes that: lockExclusive
+// holds it exclusively, waiting for other feeder processes to finish and
+// keeping new ones out, and lockNone doesn't take it at all. Long running
+// commands use lockNone so they don't hold up a trim for as long as they're
+// open, as do the ones that trim, since the VACUUM takes the lock itself.
+const (
+	storeLock     = "store-lock"
+	lockExclusive = "exclusive"
+	lockNone      = "none"
+)
+
 // In a simple Cobra app there's a root command and the init() for each
 // subcommand adds itself to the root. But we want to be able to create new
 // rootCmd instances on the fly for testing. So instead we have the
@@ -56,14 +98,36 @@ func NewRootCommand(skipConfig bool) *cobra.Command {
 		Long: `Use the add command to build up a list of feeds to process. The fetch
 command then pulls down the feeds and merges them into a summary page.`,
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-			dbDir := feeder.ExpandPath(viper.GetString("db-dir"))
-			dbFile := viper.GetString("db-file")
-			filename := filepath.Join(dbDir, dbFile)
-			f, err := feeder.NewFeeder(filename, cmd.OutOrStdout(), cmd.ErrOrStderr(), cmd.InOrStdin())
+			lock, err := lockStore(cmd)
 			if err != nil {
 				return err
 			}
+			heldLockMu.Lock()
+			heldLock = lock
+			heldLockMu.Unlock()
+			creds, err := lib.LoadCredentials(credentialsPath())
+			if err != nil {
+				cmd.SilenceUsage = true
+				return err
+			}
+			client, err := httpClient()
+			if err != nil {
+				cmd.SilenceUsage = true
+				return err
+			}
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			f := feeder.NewFeederWithStore(store, cmd.OutOrStdout(), cmd.ErrOrStderr(), cmd.InOrStdin())
 			f.Verbose = viper.GetBool("verbose")
+			f.Client = client
+			f.MaxFeedSize = viper.GetInt64("max-feed-size") * 1024 * 1024
+			if viper.GetString("db-dsn") == "" {
+				f.LockPath = dbPath()
+				f.LockTimeout = viper.GetDuration("lock-timeout")
+			}
+			f.UseCredentials(creds)
 
 			ctx := context.WithValue(cmd.Context(), feederKey, f)
 			cmd.SetContext(ctx)
@@ -96,21 +160,78 @@ command then pulls down the feeds and merges them into a summary page.`,
 	configHelp := fmt.Sprintf("config file (default %s/config.yaml)", defaultConfigDir)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", configHelp)
 
+	credentialsHelp := fmt.Sprintf("file with credentials for private feeds (default %s/credentials.yaml)",
+		defaultConfigDir)
+	rootCmd.PersistentFlags().String("credentials", "", credentialsHelp)
+
+	rootCmd.PersistentFlags().Duration("http-timeout", lib.DefaultHTTPConfig().Timeout,
+		"How long to wait for each web request")
+	rootCmd.PersistentFlags().Int("http-max-redirects", lib.DefaultHTTPConfig().MaxRedirects,
+		"Most redirects to follow for one request, 0 to not follow any")
+	rootCmd.PersistentFlags().String("user-agent", "",
+		fmt.Sprintf("User-Agent for web requests (default %q)", lib.DefaultUserAgent))
+	rootCmd.PersistentFlags().String("http-proxy", "",
+		"Proxy URL (http, https, or socks5) for web requests, or \"direct\" to ignore HTTP_PROXY and HTTPS_PROXY")
+	rootCmd.PersistentFlags().String("http-ca-bundle", "",
+		"PEM file of certificate authorities to trust along with the system ones")
+	rootCmd.PersistentFlags().String("http-client-cert", "",
+		"PEM certificate file to present to servers that ask for one")
+	rootCmd.PersistentFlags().String("http-client-key", "",
+		"PEM key file for --http-client-cert")
+	rootCmd.PersistentFlags().Bool("http-insecure-skip-verify", false,
+		"Don't check server certificates, only for servers with broken certificates")
+	rootCmd.PersistentFlags().Float64("http-host-rate", lib.DefaultHTTPConfig().HostRate,
+		"Most feed fetches per second from any one site once the burst is used up, 0 for no limit")
+	rootCmd.PersistentFlags().Int("http-host-burst", lib.DefaultHTTPConfig().HostBurst,
+		"Feed fetches from one site that can go out back to back before --http-host-rate applies")
+
 	defaultDataDir := feeder.GetDataDir()
 	dataDirHelp := fmt.Sprintf("database file directory (default %s)", defaultDataDir)
 	rootCmd.PersistentFlags().String("db-dir", defaultDataDir, dataDirHelp)
 	rootCmd.PersistentFlags().String("db-file", "feeder.db",
 		"database file name (default feeder.db)")
+	rootCmd.PersistentFlags().String("db-dsn", "",
+		"PostgreSQL connection string, used instead of the database file when set")
+	rootCmd.PersistentFlags().Duration("lock-timeout", 30*time.Second,
+		"How long to wait for other feeder processes using the database file")
 	rootCmd.PersistentFlags().Int("max-items", 100,
 		"Maximum number of items to store per feed")
+	rootCmd.PersistentFlags().Int64("max-feed-size", lib.DefaultMaxFeedSize/(1024*1024),
+		"Biggest feed to read in MB, after decompressing")
 	rootCmd.PersistentFlags().String("output", "", "filename to output HTML")
 	rootCmd.PersistentFlags().Bool("verbose", false, "Output additional info during run")
+	rootCmd.PersistentFlags().Bool("offline", false,
+		"Pull images into the HTML output and strip tracking pixels")
+	rootCmd.PersistentFlags().Bool("offline-assets", false,
+		"With --offline, write images to a directory next to the output instead of inlining")
+	rootCmd.PersistentFlags().Int64("max-image-size", 512,
+		"With --offline, leave out images bigger than this many KB")
+	rootCmd.PersistentFlags().Int("max-image-width", 1200,
+		"With --offline, scale down images wider than this many pixels")
 
+	checkedBinding("credentials", rootCmd)
+	checkedBinding("http-timeout", rootCmd)
+	checkedBinding("http-max-redirects", rootCmd)
+	checkedBinding("user-agent", rootCmd)
+	checkedBinding("http-proxy", rootCmd)
+	checkedBinding("http-ca-bundle", rootCmd)
+	checkedBinding("http-client-cert", rootCmd)
+	checkedBinding("http-client-key", rootCmd)
+	checkedBinding("http-insecure-skip-verify", rootCmd)
+	checkedBinding("http-host-rate", rootCmd)
+	checkedBinding("http-host-burst", rootCmd)
 	checkedBinding("db-dir", rootCmd)
 	checkedBinding("db-file", rootCmd)
+	checkedBinding("db-dsn", rootCmd)
+	checkedBinding("lock-timeout", rootCmd)
 	checkedBinding("max-items", rootCmd)
+	checkedBinding("max-feed-size", rootCmd)
 	checkedBinding("output", rootCmd)
 	checkedBinding("verbose", rootCmd)
+	checkedBinding("offline", rootCmd)
+	checkedBinding("offline-assets", rootCmd)
+	checkedBinding("max-image-size", rootCmd)
+	checkedBinding("max-image-width", rootCmd)
 
 	for _, factory := range subcommands {
 		rootCmd.AddCommand(factory())
@@ -119,9 +240,87 @@ command then pulls down the feeds and merges them into a summary page.`,
 	return rootCmd
 }
 
+// Being interrupted isn't a problem with how the command was used, so don't
+// follow the error with the usage text.
+func skipUsageIfInterrupted(cmd *cobra.Command, err error) {
+	if errors.Is(err, context.Canceled) {
+		cmd.SilenceUsage = true
+	}
+}
+
+// The database is a local SQLite file unless a PostgreSQL DSN is configured.
+func openStore() (lib.Store, error) {
+	if dsn := viper.GetString("db-dsn"); dsn != "" {
+		return lib.OpenPostgresStore(dsn)
+	}
+	return lib.OpenStore(dbPath())
+}
+
+func dbPath() string {
+	dbDir := feeder.ExpandPath(viper.GetString("db-dir"))
+	dbFile := viper.GetString("db-file")
+	return filepath.Join(dbDir, dbFile)
+}
+
+func credentialsPath() string {
+	if path := viper.GetString("credentials"); path != "" {
+		return feeder.ExpandPath(path)
+	}
+	return filepath.Join(feeder.GetConfigDir(), "credentials.yaml")
+}
+
+// Build the client for web requests from the config. Proxies for particular
+// feeds only come from the config file, as a list under http-proxies:
+//
+//	http-proxies:
+//	  - match: https://intranet.example.com/
+//	    proxy: socks5://localhost:1080
+func httpClient() (*http.Client, error) {
+	cfg := lib.HTTPConfig{
+		Timeout:            viper.GetDuration("http-timeout"),
+		MaxRedirects:       viper.GetInt("http-max-redirects"),
+		UserAgent:          viper.GetString("user-agent"),
+		Proxy:              viper.GetString("http-proxy"),
+		CABundle:           feeder.ExpandPath(viper.GetString("http-ca-bundle")),
+		ClientCert:         feeder.ExpandPath(viper.GetString("http-client-cert")),
+		ClientKey:          feeder.ExpandPath(viper.GetString("http-client-key")),
+		InsecureSkipVerify: viper.GetBool("http-insecure-skip-verify"),
+		HostRate:           viper.GetFloat64("http-host-rate"),
+		HostBurst:          viper.GetInt("http-host-burst"),
+	}
+	if err := viper.UnmarshalKey("http-proxies", &cfg.Proxies); err != nil {
+		return nil, fmt.Errorf("error reading http-proxies: %w", err)
+	}
+	return lib.NewHTTPClient(cfg)
+}
+
+// Take the lock file next to the SQLite database, shared unless the command
+// asks for it exclusively or not at all. PostgreSQL handles its own locking,
+// so there the lock doesn't do anything.
+func lockStore(cmd *cobra.Command) (*lib.StoreLock, error) {
+	if viper.GetString("db-dsn") != "" || cmd.Annotations[storeLock] == lockNone {
+		return &lib.StoreLock{}, nil
+	}
+	exclusive := cmd.Annotations[storeLock] == lockExclusive
+	lock, err := lib.LockStore(cmd.Context(), dbPath(), exclusive, viper.GetDuration("lock-timeout"))
+	if errors.Is(err, lib.ErrStoreLocked) {
+		cmd.SilenceUsage = true
+	}
+	return lock, err
+}
+
+// Execute runs the command line. Ctrl-C (or a SIGTERM) cancels the context
+// the commands run with, so a fetch in progress can stop cleanly. A second
+// Ctrl-C exits straight away.
 func Execute() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 	rootCmd := NewRootCommand(false)
-	err := rootCmd.Execute()
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
 	if err != nil {
 		os.Exit(1)
 	}
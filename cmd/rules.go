@@ -0,0 +1,150 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package cmd
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/mikerowehl/feeder/internal/feeder"
+	lib "github.com/mikerowehl/feeder/pkg/feeder"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// Add the flags used to describe a rule, shared by add and test.
+func addRuleFlags(flags *pflag.FlagSet) {
+	flags.Uint("feed", 0, "only apply to the feed with this ID (default all feeds)")
+	flags.String("field", lib.FieldAny, "field to match: "+strings.Join(lib.RuleFields(), ", "))
+	flags.String("match", "", "substring to look for, or /regex/flags")
+	flags.Bool("regex", false, "treat --match as a regular expression")
+	flags.Bool("not", false, "take the action on items that don't match")
+	flags.String("action", lib.ActionSkip, "what to do with matches: "+strings.Join(lib.RuleActions(), ", "))
+	flags.String("tag", "", "tag name for the tag action")
+}
+
+func ruleFromFlags(flags *pflag.FlagSet) (*lib.Rule, error) {
+	var rule lib.Rule
+	var err error
+	if rule.FeedID, err = flags.GetUint("feed"); err != nil {
+		return nil, err
+	}
+	if rule.Field, err = flags.GetString("field"); err != nil {
+		return nil, err
+	}
+	if rule.Pattern, err = flags.GetString("match"); err != nil {
+		return nil, err
+	}
+	if rule.Regex, err = flags.GetBool("regex"); err != nil {
+		return nil, err
+	}
+	if rule.Negate, err = flags.GetBool("not"); err != nil {
+		return nil, err
+	}
+	if rule.Action, err = flags.GetString("action"); err != nil {
+		return nil, err
+	}
+	if rule.Tag, err = flags.GetString("tag"); err != nil {
+		return nil, err
+	}
+	if pattern, isRegex := lib.ParsePattern(rule.Pattern); isRegex {
+		rule.Pattern = pattern
+		rule.Regex = true
+	}
+	return &rule, nil
+}
+
+func NewRulesCmd() *cobra.Command {
+	rulesCmd := &cobra.Command{
+		Use:   "rules",
+		Short: "Manage rules that hide, mark, star, tag, or notify about new items",
+		Long: `Rules are checked against each new item as feeds are fetched. A rule matches
+one field of an item (feed title, item title, content, author, link, or any
+of them) against a substring or a regular expression, and when it matches
+takes an action: skip the item entirely, mark it read, star it, tag it, or
+send a notification about it (see fetch for where notifications go).
+Substring matches ignore case. Regular expressions can be given as
+/pattern/flags, so /sponsored/i works.
+
+ex: feeder rules add --feed 12 --match /sponsored/i
+    feeder rules add --feed 3 --field title --match Go --not
+    feeder rules add --match "our product" --action star
+    feeder rules add --field title --match /security|CVE-/i --action notify
+    feeder rules test --field author --match alice --action read`,
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add",
+		Short: "Add a new rule",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			rule, err := ruleFromFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
+			if err := f.AddRule(cmd.Context(), rule); err != nil {
+				return err
+			}
+			f.Out("%d: %s\n", rule.ID, rule.Describe())
+			return nil
+		},
+	}
+	addRuleFlags(addCmd.Flags())
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List all the rules",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
+			return f.ListRules(cmd.Context())
+		},
+	}
+
+	deleteCmd := &cobra.Command{
+		Use:   "delete ID",
+		Short: "Remove a rule using the ID from rules list",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			u64, err := strconv.ParseUint(args[0], 10, 32)
+			if err != nil {
+				return err
+			}
+			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
+			return f.DeleteRule(cmd.Context(), uint(u64))
+		},
+	}
+
+	testCmd := &cobra.Command{
+		Use:   "test",
+		Short: "Preview which stored items the rules match",
+		Long: `Runs the rules against the items already in the database and lists the ones
+that match, without changing anything. With no flags all the stored rules
+are tried. Pass the same flags as rules add to try out a rule before adding
+it.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
+			if !cmd.Flags().Changed("match") {
+				return f.TestRules(cmd.Context(), nil)
+			}
+			rule, err := ruleFromFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			return f.TestRules(cmd.Context(), rule)
+		},
+	}
+	addRuleFlags(testCmd.Flags())
+
+	rulesCmd.AddCommand(addCmd, listCmd, deleteCmd, testCmd)
+	return rulesCmd
+}
+
+func init() {
+	RegisterSubcommand(NewRulesCmd)
+}
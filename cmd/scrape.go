@@ -0,0 +1,100 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package cmd
+
+import (
+	"github.com/mikerowehl/feeder/internal/feeder"
+	lib "github.com/mikerowehl/feeder/pkg/feeder"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// Add the flags for the scraper selectors, shared by add and test.
+func addScrapeFlags(flags *pflag.FlagSet) {
+	flags.String("item", "", "selector for the element holding each item (required)")
+	flags.String("title", "", "selector for the title inside an item (default first heading or link)")
+	flags.String("link", "", "selector for the link inside an item (default first link)")
+	flags.String("date", "", "selector for the date inside an item (default the time of the fetch)")
+	flags.String("content", "", "selector for the content inside an item (default the whole item)")
+}
+
+func scraperFromFlags(flags *pflag.FlagSet) (lib.Scraper, error) {
+	var scraper lib.Scraper
+	var err error
+	for _, f := range []struct {
+		name string
+		dest *string
+	}{
+		{"item", &scraper.Item},
+		{"title", &scraper.Title},
+		{"link", &scraper.Link},
+		{"date", &scraper.Date},
+		{"content", &scraper.Content},
+	} {
+		if *f.dest, err = flags.GetString(f.name); err != nil {
+			return scraper, err
+		}
+	}
+	return scraper, scraper.Validate()
+}
+
+func NewScrapeCmd() *cobra.Command {
+	scrapeCmd := &cobra.Command{
+		Use:   "scrape",
+		Short: "Follow web pages that don't have a feed",
+		Long: `Turns a web page without a feed, like a changelog or a status page, into a
+feed by picking items out of it with CSS selectors. --item selects the
+element holding each item, and the other selectors are looked for inside
+it. Any selector can end in @name to take an attribute instead of the
+text, like --date "time@datetime". Scraped items go through rules and
+duplicate detection the same as items from any other feed.
+
+Use scrape test to try out selectors, then scrape add with the same flags
+to follow the page. The selectors of a scraped feed can be changed later
+with set.
+
+ex: feeder scrape test https://example.com/changelog --item "section.release" --title h2
+    feeder scrape add https://example.com/changelog --item "section.release" --title h2 --date "time@datetime"
+    feeder set 7 --scrape-title h3`,
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add URL",
+		Short: "Add a page to scrape as a feed",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			scraper, err := scraperFromFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
+			return f.AddScrape(cmd.Context(), args[0], scraper)
+		},
+	}
+	addScrapeFlags(addCmd.Flags())
+
+	testCmd := &cobra.Command{
+		Use:   "test URL",
+		Short: "Preview the items selectors find on a page",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			scraper, err := scraperFromFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
+			return f.TestScrape(cmd.Context(), args[0], scraper)
+		},
+	}
+	addScrapeFlags(testCmd.Flags())
+
+	scrapeCmd.AddCommand(addCmd, testCmd)
+	return scrapeCmd
+}
+
+func init() {
+	RegisterSubcommand(NewScrapeCmd)
+}
@@ -0,0 +1,96 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package cmd
+
+import (
+	"strconv"
+
+	"github.com/mikerowehl/feeder/internal/feeder"
+	"github.com/spf13/cobra"
+)
+
+// Flags for the set command and the feed column each one changes. Only the
+// flags given on the command line are changed.
+var feedSettings = []struct {
+	flag   string
+	column string
+	usage  string
+}{
+	{"updated-unread", "mark_updated_unread", "mark items unread again when the feed changes them"},
+	{"full-content", "fetch_full_content", "fetch the linked page for new items and extract the article"},
+	{"notify", "notify", "send a notification for each new item, see fetch"},
+}
+
+// Same as feedSettings, for settings that take text
+var feedTextSettings = []struct {
+	flag   string
+	column string
+	usage  string
+}{
+	{"filter", "filter", "shell command to pipe the feed through before parsing, empty for none"},
+	{"scrape-item", "scrape_item", "selector for each item of a scraped page, see scrape"},
+	{"scrape-title", "scrape_title", "selector for the title of a scraped item"},
+	{"scrape-link", "scrape_link", "selector for the link of a scraped item"},
+	{"scrape-date", "scrape_date", "selector for the date of a scraped item"},
+	{"scrape-content", "scrape_content", "selector for the content of a scraped item"},
+}
+
+func NewSetCmd() *cobra.Command {
+	setCmd := &cobra.Command{
+		Use:   "set ID",
+		Short: "Change the settings for a feed using its ID",
+		Long: `Changes per-feed settings for the feed with the internal ID given by the list
+command. Only the settings passed as flags are changed.
+
+ex: feeder set 5 --updated-unread
+    feeder set 5 --updated-unread=false
+    feeder set 5 --full-content
+    feeder set 5 --notify
+    feeder set 5 --filter "~/bin/fix-dates"`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			u64, err := strconv.ParseUint(args[0], 10, 32)
+			if err != nil {
+				return err
+			}
+			feedId := uint(u64)
+			values := make(map[string]any)
+			for _, setting := range feedSettings {
+				if !cmd.Flags().Changed(setting.flag) {
+					continue
+				}
+				value, err := cmd.Flags().GetBool(setting.flag)
+				if err != nil {
+					return err
+				}
+				values[setting.column] = value
+			}
+			for _, setting := range feedTextSettings {
+				if !cmd.Flags().Changed(setting.flag) {
+					continue
+				}
+				value, err := cmd.Flags().GetString(setting.flag)
+				if err != nil {
+					return err
+				}
+				values[setting.column] = value
+			}
+			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
+			return f.SetFeedOptions(cmd.Context(), feedId, values)
+		},
+	}
+	for _, setting := range feedSettings {
+		setCmd.Flags().Bool(setting.flag, false, setting.usage)
+	}
+	for _, setting := range feedTextSettings {
+		setCmd.Flags().String(setting.flag, "", setting.usage)
+	}
+	return setCmd
+}
+
+func init() {
+	RegisterSubcommand(NewSetCmd)
+}
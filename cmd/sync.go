@@ -0,0 +1,66 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/mikerowehl/feeder/internal/feeder"
+	lib "github.com/mikerowehl/feeder/pkg/feeder"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewSyncCmd() *cobra.Command {
+	syncCmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Shares subscriptions and read state with other devices through a directory",
+		Long: `Keeps feeds, read items, and starred items in step between devices using a
+directory they all share, like a Syncthing or Dropbox folder. Each device
+writes the changes made on it to its own file in the directory, and merges in
+the files from all the others. When the same item was changed on two
+devices, the most recent change wins.
+
+Feeds subscribed to on another device are added here, and get their items on
+the next fetch. Read and starred changes for items that haven't been fetched
+here yet are kept and applied once they have been. Each device needs its own
+name, which defaults to the host name.
+
+ex: feeder sync --dir ~/Sync/feeder
+    feeder sync --dir ~/Dropbox/feeder --device laptop`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
+			dir := viper.GetString("sync-dir")
+			if dir == "" {
+				return errors.New("no sync directory, give one with --dir or sync-dir in the config file")
+			}
+			device := viper.GetString("sync-device")
+			if device == "" {
+				device = lib.DefaultSyncDevice()
+			}
+			err := f.Sync(cmd.Context(), feeder.ExpandPath(dir), device)
+			if err != nil {
+				return fmt.Errorf("error syncing: %w", err)
+			}
+			return nil
+		},
+	}
+	syncCmd.Flags().String("dir", "", "directory shared between devices")
+	syncCmd.Flags().String("device", "", "name for this device (default the host name)")
+	if err := viper.BindPFlag("sync-dir", syncCmd.Flags().Lookup("dir")); err != nil {
+		log.Printf("Error binding dir flag\n")
+	}
+	if err := viper.BindPFlag("sync-device", syncCmd.Flags().Lookup("device")); err != nil {
+		log.Printf("Error binding device flag\n")
+	}
+	return syncCmd
+}
+
+func init() {
+	RegisterSubcommand(NewSyncCmd)
+}
@@ -18,10 +18,11 @@ func NewTrimCmd() *cobra.Command {
 		Long: `Keeps only the most recent items for each feed. This keeps the local database
 from getting too large and keeps things running quickly. Also runs some
 housekeeping on the database file to optimize performance.`,
+		Annotations: map[string]string{storeLock: lockNone},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
 			maxItems := viper.GetInt("max-items")
-			return f.Trim(maxItems)
+			return f.Trim(cmd.Context(), maxItems)
 		},
 	}
 	return trimCmd
@@ -0,0 +1,52 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/mikerowehl/feeder/internal/feeder"
+	"github.com/mikerowehl/feeder/internal/tui"
+	"github.com/spf13/cobra"
+)
+
+func NewTuiCmd() *cobra.Command {
+	tuiCmd := &cobra.Command{
+		Use:   "tui",
+		Short: "Browse and read feeds in a full screen terminal interface",
+		Long: `Opens a full screen reader in the terminal. The first screen lists the feeds
+with the number of unread items in each, enter opens a feed to list its
+items, and enter again shows the text of an item. Reading an item marks it
+read, the same as mark --item.
+
+Keys:
+  j/k or arrows   move around, space/b page through an item
+  enter, esc      go into a feed or item, and back out again
+  n/p             next or previous item while reading
+  m               toggle read and unread
+  s               star or unstar the item
+  o               open the item link in the browser
+  r               fetch all the feeds, the same as the fetch command
+  q               quit
+
+Changes go straight to the database, so they show up in read and daily.`,
+		Annotations: map[string]string{storeLock: lockNone},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f := cmd.Context().Value(feederKey).(*feeder.Feeder)
+			err := tui.Run(cmd.Context(), f, tea.WithInput(cmd.InOrStdin()), tea.WithOutput(cmd.OutOrStdout()))
+			if err != nil {
+				return fmt.Errorf("error running reader: %w", err)
+			}
+			return nil
+		},
+	}
+	return tuiCmd
+}
+
+func init() {
+	RegisterSubcommand(NewTuiCmd)
+}
@@ -0,0 +1,117 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+// Reads and writes backup archives of the whole database. An archive is
+// gzip compressed, and holds a one line JSON header followed by the JSON
+// encoded contents. The header has the format version and a SHA-256 of the
+// contents, so a truncated or damaged archive is caught before anything
+// gets restored from it.
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/repository"
+)
+
+// Format identifies a feeder backup, to give a clear error when pointed at
+// some other gzip file.
+const Format = "feeder-backup"
+
+// Version is the version of the archive format written. Bump it when the
+// contents change in a way older versions can't read.
+const Version = 1
+
+var (
+	ErrFormat   = errors.New("not a feeder backup")
+	ErrVersion  = errors.New("unsupported backup version")
+	ErrChecksum = errors.New("backup checksum doesn't match, the file may be damaged")
+)
+
+// Header is the first line of an archive.
+type Header struct {
+	Format   string    `json:"format"`
+	Version  int       `json:"version"`
+	Created  time.Time `json:"created"`
+	Feeds    int       `json:"feeds"`
+	Items    int       `json:"items"`
+	Checksum string    `json:"sha256"`
+}
+
+// Write writes the contents of the database out to w as an archive.
+func Write(w io.Writer, data repository.Backup) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	header := Header{
+		Format:   Format,
+		Version:  Version,
+		Created:  time.Now().UTC(),
+		Feeds:    len(data.Feeds),
+		Checksum: hex.EncodeToString(sum[:]),
+	}
+	for _, feed := range data.Feeds {
+		header.Items += len(feed.Items)
+	}
+	headerLine, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(append(headerLine, '\n')); err != nil {
+		return err
+	}
+	if _, err := zw.Write(content); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Read reads an archive written by Write, checking the format, version,
+// and checksum before decoding the contents.
+func Read(r io.Reader) (Header, repository.Backup, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return Header{}, repository.Backup{}, fmt.Errorf("%w: %w", ErrFormat, err)
+	}
+	defer zr.Close()
+	br := bufio.NewReader(zr)
+	headerLine, err := br.ReadBytes('\n')
+	if err != nil {
+		return Header{}, repository.Backup{}, fmt.Errorf("%w: %w", ErrFormat, err)
+	}
+	var header Header
+	if err := json.Unmarshal(headerLine, &header); err != nil || header.Format != Format {
+		return Header{}, repository.Backup{}, ErrFormat
+	}
+	if header.Version < 1 || header.Version > Version {
+		return header, repository.Backup{}, fmt.Errorf("%w %d, this feeder reads up to version %d",
+			ErrVersion, header.Version, Version)
+	}
+	content, err := io.ReadAll(br)
+	if err != nil {
+		return header, repository.Backup{}, fmt.Errorf("%w: %w", ErrChecksum, err)
+	}
+	sum := sha256.Sum256(content)
+	if hex.EncodeToString(sum[:]) != header.Checksum {
+		return header, repository.Backup{}, ErrChecksum
+	}
+	var data repository.Backup
+	if err := json.Unmarshal(content, &data); err != nil {
+		return header, repository.Backup{}, err
+	}
+	return header, data, nil
+}
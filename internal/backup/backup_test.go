@@ -0,0 +1,107 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package backup_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/backup"
+	"github.com/mikerowehl/feeder/internal/repository"
+	"github.com/mikerowehl/feeder/internal/rss"
+	"github.com/mikerowehl/feeder/internal/rules"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sampleBackup() repository.Backup {
+	published := time.Date(2025, 3, 4, 12, 0, 0, 0, time.UTC)
+	return repository.Backup{
+		Feeds: []rss.Feed{
+			{Title: "Tech", URL: "https://example.com/tech.rss", MarkUpdatedUnread: true, Items: []rss.Item{
+				{Title: "Read one", GUID: "tech-1", Read: true, Published: published},
+				{Title: "Starred one", GUID: "tech-2", Starred: true, Published: published,
+					Tags: []rss.Tag{{Name: "later"}}},
+			}},
+			{Title: "Empty", URL: "https://example.com/empty.rss"},
+		},
+		Rules: []rules.Rule{{Field: rules.FieldTitle, Pattern: "sponsored", Action: rules.ActionSkip}},
+	}
+}
+
+// Decompress an archive, change it, and compress it again
+func rewrite(t *testing.T, archive []byte, change func(string) string) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(archive))
+	require.NoError(t, err)
+	content, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	var out bytes.Buffer
+	zw := gzip.NewWriter(&out)
+	_, err = zw.Write([]byte(change(string(content))))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return out.Bytes()
+}
+
+func TestBackup_RoundTrip(t *testing.T) {
+	var archive bytes.Buffer
+	require.NoError(t, backup.Write(&archive, sampleBackup()))
+
+	header, data, err := backup.Read(&archive)
+	require.NoError(t, err)
+	assert.Equal(t, backup.Format, header.Format)
+	assert.Equal(t, backup.Version, header.Version)
+	assert.Equal(t, 2, header.Feeds)
+	assert.Equal(t, 2, header.Items)
+	assert.WithinDuration(t, time.Now(), header.Created, time.Minute)
+	assert.Equal(t, sampleBackup(), data)
+}
+
+func TestBackup_Damaged(t *testing.T) {
+	var archive bytes.Buffer
+	require.NoError(t, backup.Write(&archive, sampleBackup()))
+
+	damaged := rewrite(t, archive.Bytes(), func(content string) string {
+		return strings.Replace(content, `"Read":true`, `"Read":false`, 1)
+	})
+	_, _, err := backup.Read(bytes.NewReader(damaged))
+	assert.ErrorIs(t, err, backup.ErrChecksum)
+
+	truncated := rewrite(t, archive.Bytes(), func(content string) string {
+		return content[:len(content)-10]
+	})
+	_, _, err = backup.Read(bytes.NewReader(truncated))
+	assert.ErrorIs(t, err, backup.ErrChecksum)
+}
+
+func TestBackup_NewerVersion(t *testing.T) {
+	var archive bytes.Buffer
+	require.NoError(t, backup.Write(&archive, sampleBackup()))
+	newer := rewrite(t, archive.Bytes(), func(content string) string {
+		return strings.Replace(content, `"version":1`, `"version":99`, 1)
+	})
+	_, _, err := backup.Read(bytes.NewReader(newer))
+	assert.ErrorIs(t, err, backup.ErrVersion)
+}
+
+func TestBackup_NotABackup(t *testing.T) {
+	_, _, err := backup.Read(strings.NewReader("https://example.com/feed.rss\n"))
+	assert.ErrorIs(t, err, backup.ErrFormat)
+
+	var other bytes.Buffer
+	zw := gzip.NewWriter(&other)
+	_, err = zw.Write([]byte(`{"some":"json"}` + "\n"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	_, _, err = backup.Read(&other)
+	assert.ErrorIs(t, err, backup.ErrFormat)
+}
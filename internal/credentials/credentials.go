@@ -0,0 +1,235 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+// Credentials for private feeds, kept in their own file rather than the
+// database so they don't end up in exports, backups, or sync files. Each
+// entry applies to every URL starting with its match prefix, and can add
+// basic auth, a bearer token, extra headers, and cookies to the requests.
+// Any of the values can refer to an environment variable (env:NAME) or a
+// file holding the secret (file:PATH) instead of being written out.
+//
+//	feeds:
+//	  - match: https://gitlab.example.com/
+//	    username: me
+//	    password: env:GITLAB_PASSWORD
+//	  - match: https://www.patreon.com/rss/
+//	    token: file:~/.secrets/patreon
+//	    headers:
+//	      X-Api-Version: "2"
+//	    cookies:
+//	      session_id: env:PATREON_SESSION
+package credentials
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// Entry is the credentials for the URLs starting with Match.
+type Entry struct {
+	Match    string            `yaml:"match"`
+	Username string            `yaml:"username"`
+	Password string            `yaml:"password"`
+	Token    string            `yaml:"token"`
+	Headers  map[string]string `yaml:"headers"`
+	Cookies  map[string]string `yaml:"cookies"`
+}
+
+// Credentials is the contents of a credentials file.
+type Credentials struct {
+	Feeds []Entry `yaml:"feeds"`
+}
+
+// ErrPermissions is returned by Load for a credentials file other users can
+// read.
+var ErrPermissions = errors.New("credentials file can be read by other users, chmod it to 600")
+
+// Load reads a credentials file, resolving any references to environment
+// variables or secret files. A file that doesn't exist is the same as an
+// empty one.
+func Load(path string) (*Credentials, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &Credentials{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode().Perm()&0o077 != 0 {
+			return nil, fmt.Errorf("%w: %s", ErrPermissions, path)
+		}
+	}
+	var creds Credentials
+	if err := yaml.Unmarshal(content, &creds); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	if err := creds.resolve(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return &creds, nil
+}
+
+func (c *Credentials) resolve(dir string) error {
+	for i := range c.Feeds {
+		entry := &c.Feeds[i]
+		match, err := url.Parse(entry.Match)
+		if err != nil || (match.Scheme != "http" && match.Scheme != "https") || match.Host == "" {
+			return fmt.Errorf("match %q has to be an http or https URL", entry.Match)
+		}
+		for _, value := range []*string{&entry.Username, &entry.Password, &entry.Token} {
+			if *value, err = secret(*value, dir); err != nil {
+				return err
+			}
+		}
+		for _, values := range []map[string]string{entry.Headers, entry.Cookies} {
+			for name, value := range values {
+				if values[name], err = secret(value, dir); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Look up an env: or file: reference, anything else is the value itself.
+// Relative file paths are from the directory the credentials file is in.
+func secret(value string, dir string) (string, error) {
+	if name, ok := strings.CutPrefix(value, "env:"); ok {
+		resolved, set := os.LookupEnv(name)
+		if !set {
+			return "", fmt.Errorf("environment variable %s isn't set", name)
+		}
+		return resolved, nil
+	}
+	if path, ok := strings.CutPrefix(value, "file:"); ok {
+		if rest, ok := strings.CutPrefix(path, "~/"); ok {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", err
+			}
+			path = filepath.Join(home, rest)
+		} else if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	return value, nil
+}
+
+// For finds the entry for a URL, the one with the longest matching prefix
+// if there's more than one. Prefixes only match at a path boundary, so
+// https://example.com doesn't match https://example.com.evil.net/.
+func (c *Credentials) For(u *url.URL) *Entry {
+	target := u.String()
+	if u.User != nil {
+		stripped := *u
+		stripped.User = nil
+		target = stripped.String()
+	}
+	var best *Entry
+	for i := range c.Feeds {
+		entry := &c.Feeds[i]
+		if !matches(entry.Match, target) {
+			continue
+		}
+		if best == nil || len(entry.Match) > len(best.Match) {
+			best = entry
+		}
+	}
+	return best
+}
+
+func matches(prefix string, target string) bool {
+	rest, ok := strings.CutPrefix(target, prefix)
+	if !ok {
+		return false
+	}
+	return rest == "" || strings.HasSuffix(prefix, "/") || strings.ContainsRune("/?#", rune(rest[0]))
+}
+
+// Apply adds the entry's credentials to a request.
+func (e *Entry) Apply(req *http.Request) {
+	if e.Username != "" || e.Password != "" {
+		req.SetBasicAuth(e.Username, e.Password)
+	}
+	if e.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.Token)
+	}
+	for name, value := range e.Headers {
+		req.Header.Set(name, value)
+	}
+	for name, value := range e.Cookies {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+}
+
+// Transport adds credentials to the requests going through it. Each request
+// is checked on its own, so a redirect to another site doesn't carry the
+// credentials along with it.
+type Transport struct {
+	Credentials *Credentials
+	// The transport requests are passed on to, http.DefaultTransport if nil
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	entry := t.Credentials.For(req.URL)
+	if entry == nil {
+		return base.RoundTrip(req)
+	}
+	// A RoundTripper isn't allowed to change the request it's given
+	req = req.Clone(req.Context())
+	entry.Apply(req)
+	return base.RoundTrip(req)
+}
+
+// Redact takes any username and password out of a URL, for showing it
+// somewhere credentials shouldn't end up.
+func Redact(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err == nil {
+		if u.User == nil {
+			return rawURL
+		}
+		u.User = nil
+		return u.String()
+	}
+	// Not a URL we can parse, so cut out anything that looks like userinfo
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return rawURL
+	}
+	authority, path, _ := strings.Cut(rest, "/")
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		authority = authority[at+1:]
+	}
+	if path == "" && !strings.Contains(rest, "/") {
+		return scheme + "://" + authority
+	}
+	return scheme + "://" + authority + "/" + path
+}
@@ -0,0 +1,159 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+// Finds items from different feeds that are about the same story. Two items
+// are duplicates if their links point to the same place once tracking junk
+// is stripped off, or if their titles are close enough. Duplicates get
+// grouped into a cluster, identified by the ID of the first item in it.
+package dedup
+
+import (
+	"net/url"
+	"strings"
+	"unicode"
+
+	"github.com/mikerowehl/feeder/internal/rss"
+)
+
+// Titles need to share at least this fraction of their words to count as the
+// same story.
+const TitleThreshold = 0.6
+
+// Titles with fewer words than this are too short to compare reliably, like
+// "Weekly update" or "Links".
+const minTitleWords = 4
+
+// Query parameters that are only there to track where a click came from.
+// Anything starting with utm_ is dropped as well.
+var trackingParams = map[string]bool{
+	"fbclid":   true,
+	"gclid":    true,
+	"dclid":    true,
+	"yclid":    true,
+	"msclkid":  true,
+	"igshid":   true,
+	"mc_cid":   true,
+	"mc_eid":   true,
+	"_hsenc":   true,
+	"_hsmi":    true,
+	"mkt_tok":  true,
+	"ref":      true,
+	"ref_src":  true,
+	"ref_url":  true,
+	"cmpid":    true,
+	"ocid":     true,
+	"smid":     true,
+	"sr_share": true,
+}
+
+var hostPrefixes = []string{"www.", "m.", "mobile.", "amp."}
+
+var stopWords = map[string]bool{
+	"a": true, "an": true, "the": true, "of": true, "to": true, "in": true,
+	"for": true, "on": true, "and": true, "or": true, "is": true, "are": true,
+	"was": true, "with": true, "at": true, "by": true, "from": true, "as": true,
+	"it": true, "its": true, "be": true, "this": true, "that": true,
+}
+
+// NormalizeLink canonicalizes a link so the same article reached through
+// different share links compares equal. Scheme and host case are dropped,
+// common host prefixes like www. are removed, tracking parameters and
+// fragments are stripped, and the remaining query is sorted.
+func NormalizeLink(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Host == "" {
+		return strings.TrimSpace(link)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, prefix := range hostPrefixes {
+		host = strings.TrimPrefix(host, prefix)
+	}
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+	query := u.Query()
+	for key := range query {
+		lower := strings.ToLower(key)
+		if strings.HasPrefix(lower, "utm_") || trackingParams[lower] {
+			query.Del(key)
+		}
+	}
+	path := strings.TrimSuffix(u.EscapedPath(), "/")
+	path = strings.TrimSuffix(path, "/amp")
+	normalized := host + path
+	if encoded := query.Encode(); encoded != "" {
+		normalized += "?" + encoded
+	}
+	return normalized
+}
+
+func titleWords(title string) map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if !stopWords[word] {
+			words[word] = true
+		}
+	}
+	return words
+}
+
+// TitleSimilarity gives the fraction of distinct words the two titles share
+// (the Jaccard index), ignoring case, punctuation and very common words.
+func TitleSimilarity(a, b string) float64 {
+	wordsA := titleWords(a)
+	wordsB := titleWords(b)
+	if len(wordsA) == 0 || len(wordsB) == 0 {
+		return 0
+	}
+	shared := 0
+	for word := range wordsA {
+		if wordsB[word] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(wordsA)+len(wordsB)-shared)
+}
+
+// IsDuplicate decides whether two items are the same story.
+func IsDuplicate(a, b *rss.Item) bool {
+	if a.Link != "" && b.Link != "" && NormalizeLink(a.Link) == NormalizeLink(b.Link) {
+		return true
+	}
+	if len(titleWords(a.Title)) < minTitleWords || len(titleWords(b.Title)) < minTitleWords {
+		return false
+	}
+	return TitleSimilarity(a.Title, b.Title) >= TitleThreshold
+}
+
+// Assign works out the clusters for newly fetched items. Each fresh item is
+// compared against the existing items and the fresh items before it, but
+// only ones from other feeds, since a feed repeating itself isn't a story
+// being covered more than once. The result maps item IDs to the cluster ID
+// they should now have, for every item whose cluster changed (including
+// existing items that start a new cluster).
+func Assign(existing []rss.Item, fresh []rss.Item) map[uint]uint {
+	changes := make(map[uint]uint)
+	candidates := make([]rss.Item, 0, len(existing)+len(fresh))
+	candidates = append(candidates, existing...)
+	for _, item := range fresh {
+		for i := range candidates {
+			candidate := &candidates[i]
+			if candidate.FeedID == item.FeedID || candidate.ID == item.ID || !IsDuplicate(candidate, &item) {
+				continue
+			}
+			if candidate.ClusterID == 0 {
+				candidate.ClusterID = candidate.ID
+				changes[candidate.ID] = candidate.ID
+			}
+			item.ClusterID = candidate.ClusterID
+			changes[item.ID] = item.ClusterID
+			break
+		}
+		candidates = append(candidates, item)
+	}
+	return changes
+}
@@ -0,0 +1,68 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package dedup_test
+
+import (
+	"testing"
+
+	"github.com/mikerowehl/feeder/internal/dedup"
+	"github.com/mikerowehl/feeder/internal/rss"
+	"gorm.io/gorm"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedup_NormalizeLink(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"https://www.example.com/story/", "http://example.com/story"},
+		{"https://example.com/story?utm_source=rss&utm_medium=feed", "https://example.com/story"},
+		{"https://example.com/story?id=5&fbclid=abc", "https://example.com/story?id=5"},
+		{"https://example.com/story?b=2&a=1", "https://EXAMPLE.com/story?a=1&b=2"},
+		{"https://m.example.com/story#comments", "https://example.com/story"},
+		{"https://example.com:443/story/amp", "https://example.com/story"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, dedup.NormalizeLink(tt.b), dedup.NormalizeLink(tt.a), tt.a)
+	}
+	assert.NotEqual(t, dedup.NormalizeLink("https://example.com/story?id=5"),
+		dedup.NormalizeLink("https://example.com/story?id=6"))
+}
+
+func TestDedup_TitleSimilarity(t *testing.T) {
+	assert.InDelta(t, 1.0, dedup.TitleSimilarity("Go 1.26 Released!", "go 1.26 released"), 0.001)
+	assert.Greater(t, dedup.TitleSimilarity(
+		"Google releases Go 1.26 with new garbage collector",
+		"Go 1.26 released with new garbage collector"), dedup.TitleThreshold)
+	assert.Less(t, dedup.TitleSimilarity(
+		"Google releases Go 1.26 with new garbage collector",
+		"Rust 2.0 ships with new borrow checker"), dedup.TitleThreshold)
+}
+
+func item(id, feedID uint, title, link string) rss.Item {
+	return rss.Item{Model: gorm.Model{ID: id}, FeedID: feedID, Title: title, Link: link}
+}
+
+func TestDedup_Assign(t *testing.T) {
+	existing := []rss.Item{
+		item(1, 1, "Go 1.26 released with new garbage collector", "https://go.dev/blog/go1.26"),
+		item(2, 1, "Weekly links", "https://a.example.com/weekly"),
+		item(3, 4, "Rust 2.0 ships with new borrow checker", "https://rust.example.com/2.0"),
+	}
+	fresh := []rss.Item{
+		// Same link with tracking junk, from another feed
+		item(10, 2, "The Go team ships 1.26", "https://go.dev/blog/go1.26?utm_source=hn"),
+		// Similar title, third feed
+		item(11, 3, "Google releases Go 1.26 with new garbage collector", "https://news.example.com/go"),
+		// Short titles don't get matched on title alone
+		item(12, 2, "Weekly links", "https://b.example.com/weekly"),
+		// Same feed as the original doesn't count
+		item(13, 4, "Rust 2.0 ships with the new borrow checker", "https://rust.example.com/2.0-again"),
+	}
+	clusters := dedup.Assign(existing, fresh)
+	assert.Equal(t, map[uint]uint{1: 1, 10: 1, 11: 1}, clusters)
+}
@@ -0,0 +1,104 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+// Fetches files like podcast episodes to local disk. Transfers go to a
+// partial file next to the destination first and get renamed when finished,
+// so an interrupted download can pick up where it left off using a range
+// request the next time around.
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+const partialSuffix = ".part"
+
+var ErrTooLarge = errors.New("download exceeds max size")
+
+// File downloads url into dest. If dest already exists the download is
+// skipped. If a partial file from an earlier attempt exists we ask the server
+// for just the rest of the file. A maxBytes of zero or less means no cap,
+// otherwise anything larger than maxBytes is abandoned with ErrTooLarge.
+// Cancelling the context stops the transfer, keeping the partial file.
+func File(ctx context.Context, client *http.Client, url string, dest string, maxBytes int64) error {
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+	partial := dest + partialSuffix
+
+	var offset int64
+	if info, err := os.Stat(partial); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			log.Printf("failed to close download body: %v", closeErr)
+		}
+	}()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// Server ignored the range (or there wasn't one), start over
+		offset = 0
+		flags |= os.O_TRUNC
+	case http.StatusRequestedRangeNotSatisfiable:
+		// We already have everything the server has
+		return os.Rename(partial, dest)
+	default:
+		return fmt.Errorf("unexpected http status: %v", resp.Status)
+	}
+
+	if maxBytes > 0 && resp.ContentLength > 0 && offset+resp.ContentLength > maxBytes {
+		return fmt.Errorf("%w: %d bytes", ErrTooLarge, offset+resp.ContentLength)
+	}
+
+	out, err := os.OpenFile(partial, flags, 0o644)
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader = resp.Body
+	if maxBytes > 0 {
+		// Read one past the cap so we can tell if the server sent too much
+		body = io.LimitReader(resp.Body, maxBytes-offset+1)
+	}
+	written, copyErr := io.Copy(out, body)
+	if closeErr := out.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	if copyErr != nil {
+		return copyErr
+	}
+	if maxBytes > 0 && offset+written > maxBytes {
+		if err := os.Remove(partial); err != nil {
+			log.Printf("failed to remove oversized download: %v", err)
+		}
+		return fmt.Errorf("%w: more than %d bytes", ErrTooLarge, maxBytes)
+	}
+	return os.Rename(partial, dest)
+}
@@ -0,0 +1,75 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package download_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/download"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var episode = strings.Repeat("0123456789", 100)
+
+// Serve the episode with range support, keeping track of the last Range
+// header we were sent.
+func startServer(t *testing.T, lastRange *string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*lastRange = r.Header.Get("Range")
+		http.ServeContent(w, r, "ep.mp3", time.Time{}, bytes.NewReader([]byte(episode)))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDownload_File(t *testing.T) {
+	var lastRange string
+	server := startServer(t, &lastRange)
+	dest := filepath.Join(t.TempDir(), "ep.mp3")
+
+	err := download.File(t.Context(), server.Client(), server.URL+"/ep.mp3", dest, 0)
+	require.NoError(t, err)
+	content, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, episode, string(content))
+	assert.Empty(t, lastRange)
+}
+
+func TestDownload_Resume(t *testing.T) {
+	var lastRange string
+	server := startServer(t, &lastRange)
+	dest := filepath.Join(t.TempDir(), "ep.mp3")
+	err := os.WriteFile(dest+".part", []byte(episode[:250]), 0o644)
+	require.NoError(t, err)
+
+	err = download.File(t.Context(), server.Client(), server.URL+"/ep.mp3", dest, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "bytes=250-", lastRange)
+	content, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, episode, string(content))
+	assert.NoFileExists(t, dest+".part")
+}
+
+func TestDownload_MaxSize(t *testing.T) {
+	var lastRange string
+	server := startServer(t, &lastRange)
+	dest := filepath.Join(t.TempDir(), "ep.mp3")
+
+	err := download.File(t.Context(), server.Client(), server.URL+"/ep.mp3", dest, 100)
+	require.ErrorIs(t, err, download.ErrTooLarge)
+	assert.NoFileExists(t, dest)
+}
@@ -0,0 +1,333 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+// Pulls the main article content out of a web page, along the same lines as
+// the readability approach. Paragraphs of text add to the score of the
+// elements that contain them, class and id names that look like content
+// (or like sidebars and comments) push the score up or down, and link heavy
+// blocks get penalized. The best scoring element, plus any siblings that
+// look like part of the same article, is what gets returned.
+package extract
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/mikerowehl/feeder/internal/httpclient"
+	"github.com/mikerowehl/feeder/internal/rss"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var ErrNoContent = errors.New("no article content found")
+
+var (
+	unlikelyPattern = regexp.MustCompile(`(?i)banner|breadcrumb|combx|comment|community|cookie|disqus|extra|foot|header|legends|menu|modal|nav|popup|promo|related|remark|replies|rss|share|shoutbox|sidebar|skyscraper|social|sponsor|subscribe|tags|toolbar|widget|ad-break|agegate|pagination|pager`)
+	maybePattern    = regexp.MustCompile(`(?i)and|article|body|column|content|main|shadow|story|entry|post`)
+	positivePattern = regexp.MustCompile(`(?i)article|body|content|entry|hentry|h-entry|main|page|post|text|blog|story`)
+	negativePattern = regexp.MustCompile(`(?i)hidden|banner|combx|comment|com-|contact|foot|footer|footnote|masthead|media|meta|outbrain|promo|related|scroll|share|shoutbox|sidebar|skyscraper|sponsor|shopping|tags|tool|widget`)
+)
+
+// Elements that never have article content in them.
+var stripTags = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Noscript: true,
+	atom.Iframe:   true,
+	atom.Form:     true,
+	atom.Nav:      true,
+	atom.Header:   true,
+	atom.Footer:   true,
+	atom.Aside:    true,
+	atom.Svg:      true,
+	atom.Button:   true,
+	atom.Input:    true,
+	atom.Select:   true,
+	atom.Textarea: true,
+	atom.Link:     true,
+	atom.Meta:     true,
+}
+
+// Elements whose text counts toward the score of their ancestors.
+var scoreTags = map[atom.Atom]bool{
+	atom.P:          true,
+	atom.Pre:        true,
+	atom.Td:         true,
+	atom.Blockquote: true,
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func textContent(n *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// Fraction of the text in a node that's inside links.
+func linkDensity(n *html.Node) float64 {
+	total := len(textContent(n))
+	if total == 0 {
+		return 0
+	}
+	linked := 0
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.A {
+			linked += len(textContent(n))
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return float64(linked) / float64(total)
+}
+
+func classWeight(n *html.Node) float64 {
+	weight := 0.0
+	for _, name := range []string{attr(n, "class"), attr(n, "id")} {
+		if name == "" {
+			continue
+		}
+		if negativePattern.MatchString(name) {
+			weight -= 25
+		}
+		if positivePattern.MatchString(name) {
+			weight += 25
+		}
+	}
+	return weight
+}
+
+func baseScore(n *html.Node) float64 {
+	score := classWeight(n)
+	switch n.DataAtom {
+	case atom.Article:
+		score += 10
+	case atom.Div, atom.Main, atom.Section:
+		score += 5
+	case atom.Pre, atom.Td, atom.Blockquote:
+		score += 3
+	case atom.Address, atom.Ol, atom.Ul, atom.Dl, atom.Dd, atom.Dt, atom.Li:
+		score -= 3
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Th:
+		score -= 5
+	}
+	return score
+}
+
+// Remove everything that can't be part of the article, so it doesn't get in
+// the way of scoring.
+func prune(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		switch c.Type {
+		case html.CommentNode:
+			n.RemoveChild(c)
+		case html.ElementNode:
+			names := attr(c, "class") + " " + attr(c, "id")
+			unlikely := unlikelyPattern.MatchString(names) && !maybePattern.MatchString(names) &&
+				c.DataAtom != atom.Body && c.DataAtom != atom.A && c.DataAtom != atom.Article
+			if stripTags[c.DataAtom] || unlikely {
+				n.RemoveChild(c)
+			} else {
+				prune(c)
+			}
+		}
+		c = next
+	}
+}
+
+// Main finds the main content of a parsed page and returns the node for it
+// along with any siblings that should come along. Returns nil if nothing
+// scored well enough to be an article.
+func Main(doc *html.Node) []*html.Node {
+	prune(doc)
+
+	scores := make(map[*html.Node]float64)
+	var candidates []*html.Node
+	addScore := func(n *html.Node, score float64) {
+		if n == nil || n.Type != html.ElementNode {
+			return
+		}
+		if _, ok := scores[n]; !ok {
+			scores[n] = baseScore(n)
+			candidates = append(candidates, n)
+		}
+		scores[n] += score
+	}
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && scoreTags[n.DataAtom] {
+			text := textContent(n)
+			if len(text) >= 25 {
+				score := 1 + float64(strings.Count(text, ","))
+				score += min(float64(len(text))/100, 3)
+				addScore(n.Parent, score)
+				if n.Parent != nil {
+					addScore(n.Parent.Parent, score/2)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	var top *html.Node
+	topScore := 0.0
+	for _, n := range candidates {
+		scores[n] *= 1 - linkDensity(n)
+		if top == nil || scores[n] > topScore {
+			top = n
+			topScore = scores[n]
+		}
+	}
+	if top == nil || topScore <= 0 {
+		return nil
+	}
+
+	if top.Parent == nil {
+		return []*html.Node{top}
+	}
+	threshold := max(10, topScore*0.2)
+	var result []*html.Node
+	for s := top.Parent.FirstChild; s != nil; s = s.NextSibling {
+		if s.Type != html.ElementNode {
+			continue
+		}
+		if s == top {
+			result = append(result, s)
+			continue
+		}
+		if score, ok := scores[s]; ok && score >= threshold {
+			result = append(result, s)
+			continue
+		}
+		// Plain paragraphs next to the top candidate are often part of the
+		// article too
+		if s.DataAtom == atom.P {
+			text := textContent(s)
+			if len(text) > 80 && linkDensity(s) < 0.25 {
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
+
+// Make links and images absolute, since the content will be shown somewhere
+// other than the page it came from.
+func resolveLinks(n *html.Node, base *url.URL) {
+	if n.Type == html.ElementNode {
+		for i, a := range n.Attr {
+			if a.Key != "href" && a.Key != "src" {
+				continue
+			}
+			ref, err := url.Parse(strings.TrimSpace(a.Val))
+			if err != nil {
+				continue
+			}
+			n.Attr[i].Val = base.ResolveReference(ref).String()
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		resolveLinks(c, base)
+	}
+}
+
+// Extract parses an HTML page and returns the HTML for the main article
+// content. Relative links are resolved against base if it isn't nil.
+func Extract(r io.Reader, base *url.URL) (string, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return "", err
+	}
+	nodes := Main(doc)
+	if len(nodes) == 0 {
+		return "", ErrNoContent
+	}
+	var b bytes.Buffer
+	for _, n := range nodes {
+		if base != nil {
+			resolveLinks(n, base)
+		}
+		if err := html.Render(&b, n); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// FetchArticle retrieves a page and extracts the article content from it.
+// Links are resolved against the final URL after any redirects. The page is
+// converted to UTF-8 from whatever charset it's in, and pages bigger than
+// the limit set with rss.WithMaxBodySize fail with rss.ErrBodyTooLarge.
+func FetchArticle(ctx context.Context, link string, client *http.Client) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.5")
+	req.Header.Set("User-Agent", httpclient.DefaultUserAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			log.Printf("failed to close article body: %v", closeErr)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected http status: %v", resp.Status)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType != "" && !strings.Contains(contentType, "html") {
+		return "", fmt.Errorf("not an html page: %s", contentType)
+	}
+
+	base := resp.Request.URL
+	if base == nil {
+		if base, err = url.Parse(link); err != nil {
+			return "", err
+		}
+	}
+	page, err := rss.ReadBody(ctx, resp)
+	if err != nil {
+		return "", err
+	}
+	return Extract(bytes.NewReader(page), base)
+}
@@ -0,0 +1,72 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package extract_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mikerowehl/feeder/internal/extract"
+	"github.com/mikerowehl/feeder/internal/rss"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startArticleServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.FileServer(http.Dir("../../test/feeds")))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestExtract_FetchArticle(t *testing.T) {
+	server := startArticleServer(t)
+	article, err := extract.FetchArticle(context.Background(), server.URL+"/article.html", server.Client())
+	require.NoError(t, err)
+	assert.Contains(t, article, "first paragraph of the article")
+	assert.Contains(t, article, "third paragraph wraps things up")
+	assert.Contains(t, article, `href="`+server.URL+`/related"`)
+	assert.Contains(t, article, `src="`+server.URL+`/images/figure.png"`)
+	assert.NotContains(t, article, "Popular")
+	assert.NotContains(t, article, "First! This comment")
+	assert.NotContains(t, article, "Copyright")
+	assert.NotContains(t, article, "tracker")
+}
+
+// Pages in other charsets are converted, and big ones are turned away
+func TestExtract_FetchArticleBody(t *testing.T) {
+	page, err := os.ReadFile("../../test/feeds/article.html")
+	require.NoError(t, err)
+	latin1 := strings.Replace(string(page), "first paragraph", "first paragraph, about a caf\xe9,", 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=iso-8859-1")
+		_, _ = w.Write([]byte(latin1))
+	}))
+	t.Cleanup(server.Close)
+
+	article, err := extract.FetchArticle(context.Background(), server.URL, server.Client())
+	require.NoError(t, err)
+	assert.Contains(t, article, "about a café,")
+
+	_, err = extract.FetchArticle(rss.WithMaxBodySize(context.Background(), 1000), server.URL, server.Client())
+	assert.ErrorIs(t, err, rss.ErrBodyTooLarge)
+}
+
+func TestExtract_NoContent(t *testing.T) {
+	_, err := extract.Extract(strings.NewReader("<html><body><a href='/'>Home</a></body></html>"), nil)
+	require.ErrorIs(t, err, extract.ErrNoContent)
+}
+
+func TestExtract_NotHTML(t *testing.T) {
+	server := startArticleServer(t)
+	_, err := extract.FetchArticle(context.Background(), server.URL+"/basic.xml", server.Client())
+	require.Error(t, err)
+}
@@ -7,49 +7,68 @@ package feeder
 
 import (
 	"bufio"
-	_ "embed"
+	"context"
+	"errors"
 	"fmt"
-	"html/template"
 	"io"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/mikerowehl/feeder/internal/output"
-	"github.com/mikerowehl/feeder/internal/repository"
+	"github.com/mikerowehl/feeder/internal/download"
+	"github.com/mikerowehl/feeder/internal/notify"
 	"github.com/mikerowehl/feeder/internal/rss"
+	"github.com/mikerowehl/feeder/internal/rules"
+	"github.com/mikerowehl/feeder/internal/websub"
+	lib "github.com/mikerowehl/feeder/pkg/feeder"
 )
 
 type Feeder struct {
-	Db      *repository.FeedRepository
+	Db      lib.Store
 	Client  *http.Client
 	Verbose bool
 	out     io.Writer
 	err     io.Writer
 	in      io.Reader
-}
 
-//go:embed templates/feed.html
-var feedTemplate string
+	// The biggest feed to read in bytes, the fetcher's default if 0
+	MaxFeedSize int64
+	// Where to send notifications about new items, none if nil
+	Notifier *notify.Notifier
+	// The SQLite database file to lock while the whole file is rewritten,
+	// and how long to wait for the lock. No locking if empty.
+	LockPath    string
+	LockTimeout time.Duration
+}
 
 const appName = "feeder"
-const maxItems = 100
 
 func NewFeeder(dbFile string, cmdOut io.Writer, cmdErr io.Writer, cmdIn io.Reader) (*Feeder, error) {
-	f := &Feeder{}
-	r, err := repository.NewFeedRepository(dbFile)
+	r, err := lib.OpenStore(dbFile)
 	if err != nil {
-		return f, err
+		return &Feeder{}, err
+	}
+	return NewFeederWithStore(r, cmdOut, cmdErr, cmdIn), nil
+}
+
+// NewFeederWithStore is NewFeeder for a store that's already open, like a
+// shared PostgreSQL database. The feeder closes the store when it's closed.
+func NewFeederWithStore(store lib.Store, cmdOut io.Writer, cmdErr io.Writer, cmdIn io.Reader) *Feeder {
+	return &Feeder{
+		Db:      store,
+		Client:  &http.Client{Timeout: 30 * time.Second},
+		Verbose: false,
+		out:     cmdOut,
+		err:     cmdErr,
+		in:      cmdIn,
 	}
-	f.Db = r
-	f.Client = &http.Client{Timeout: 30 * time.Second}
-	f.Verbose = false
-	f.out = cmdOut
-	f.err = cmdErr
-	f.in = cmdIn
-	return f, nil
 }
 
 func TodayFile() string {
@@ -64,55 +83,333 @@ func (f *Feeder) Close() {
 	}
 }
 
-func (f *Feeder) Add(url string) error {
-	feed, err := rss.FeedFromURL(url, f.Client)
+// UseCredentials adds the credentials for private feeds to every request
+// the feeder makes.
+func (f *Feeder) UseCredentials(creds *lib.Credentials) {
+	f.Client = lib.WithCredentials(f.Client, creds)
+}
+
+// All the network access goes through a fetcher using our client.
+func (f *Feeder) fetcher() *lib.Fetcher {
+	fetcher := lib.NewFetcher(f.Client)
+	if f.MaxFeedSize > 0 {
+		fetcher.MaxFeedSize = f.MaxFeedSize
+	}
+	return fetcher
+}
+
+// Add adds the feed at a URL, or the first feed listed by the page at it,
+// without asking which.
+func (f *Feeder) Add(ctx context.Context, url string) error {
+	return f.AddPick(ctx, url, pickFirst, "")
+}
+
+// The pick for AddPick that takes the first candidate instead of asking.
+const pickFirst = -1
+
+// AddPick adds a feed given a URL that might be a page listing several feeds.
+// If pick is greater than zero it selects that candidate (starting from 1).
+// Otherwise, if there's more than one candidate, the user is prompted on the
+// input reader to choose one, unless pick is pickFirst. A non-empty filter is
+// the command to pipe the feed through before parsing it. If the feeds
+// can't be discovered the URL is taken as the feed itself, except when a
+// pick was asked for, since there's nothing to pick from.
+func (f *Feeder) AddPick(ctx context.Context, url string, pick int, filter string) error {
+	candidates, err := f.fetcher().Candidates(ctx, url)
+	var link rss.FeedLink
+	switch {
+	case err != nil:
+		if pick > 0 || ctx.Err() != nil {
+			return fmt.Errorf("error finding feeds at %s: %w", url, err)
+		}
+		link = rss.FeedLink{URL: url, Title: url}
+	case pick > 0:
+		if pick > len(candidates) {
+			return fmt.Errorf("pick %d out of range, found %d feeds", pick, len(candidates))
+		}
+		link = candidates[pick-1]
+	case len(candidates) == 1 || pick == pickFirst:
+		link = candidates[0]
+	default:
+		link, err = f.promptCandidate(candidates)
+		if err != nil {
+			return err
+		}
+	}
+	link.Filter = filter
+	feed, err := f.fetcher().NewFeed(ctx, link)
 	if err != nil {
-		return fmt.Errorf("error creating feed from url %s: %w", url, err)
+		return fmt.Errorf("error creating feed from url %s: %w", link.URL, err)
 	}
-	err = f.Db.Save(&feed)
+	err = f.Db.Save(ctx, &feed)
 	if err != nil {
 		return fmt.Errorf("error adding feed: %w", err)
 	}
 	return nil
 }
 
-func (f *Feeder) Delete(id uint) error {
-	return f.Db.Delete(id)
+// AddScrape adds a web page that doesn't have a feed, with its items picked
+// out by the scraper's selectors.
+func (f *Feeder) AddScrape(ctx context.Context, url string, scraper lib.Scraper) error {
+	feed, err := f.fetcher().NewScrapedFeed(ctx, url, scraper)
+	if err != nil {
+		return fmt.Errorf("error scraping %s: %w", url, err)
+	}
+	if err := f.Db.Save(ctx, &feed); err != nil {
+		return fmt.Errorf("error adding feed: %w", err)
+	}
+	LoggedPrint(f.out, "%d: %s\n", feed.ID, feed.Title)
+	return nil
 }
 
-func (f *Feeder) Fetch() error {
-	feeds, err := f.Db.All()
+// TestScrape shows the items the scraper finds on a page, without saving
+// anything.
+func (f *Feeder) TestScrape(ctx context.Context, url string, scraper lib.Scraper) error {
+	items, err := f.fetcher().Scrape(ctx, url, scraper)
 	if err != nil {
-		return fmt.Errorf("Error fetching feeds: %w", err)
+		return fmt.Errorf("error scraping %s: %w", url, err)
 	}
-	for i := range feeds {
-		feed := &feeds[i]
-		err := feed.Fetch(f.Client, maxItems)
-		if err != nil {
-			LoggedPrint(f.out, "  Error fetching feed %s: %v", feed.URL, err)
-			continue
+	LoggedPrint(f.out, "Found %d items\n", len(items))
+	for i := range items {
+		item := &items[i]
+		LoggedPrint(f.out, "\n%d: %s\n", i+1, item.Title)
+		LoggedPrint(f.out, "  Link: %s\n", item.Link)
+		LoggedPrint(f.out, "  Date: %s\n", item.Published.Format(time.RFC1123))
+		text := []rune(strings.Join(strings.Fields(lib.RenderText(item.Content, 1000)), " "))
+		if len(text) > 200 {
+			text = append(text[:200], []rune("...")...)
 		}
-		err = f.Db.Save(feed)
-		if err != nil {
-			LoggedPrint(f.out, "  Error saving feed %s: %v", feed.URL, err)
-			continue
+		LoggedPrint(f.out, "  Content: %s\n", string(text))
+	}
+	return nil
+}
+
+// List the candidates on the output and read a choice from the input.
+func (f *Feeder) promptCandidate(candidates []rss.FeedLink) (rss.FeedLink, error) {
+	LoggedPrint(f.out, "Found %d feeds:\n", len(candidates))
+	for i, c := range candidates {
+		title := c.Title
+		if title == "" {
+			title = "(untitled)"
 		}
-		if f.Verbose {
-			LoggedPrint(f.out, "  Fetched: %s\n", feed.URL)
+		LoggedPrint(f.out, "%d: %s [%s] %s\n", i+1, title, c.Type, c.URL)
+	}
+	LoggedPrint(f.out, "Pick a feed [1-%d]: ", len(candidates))
+	scanner := bufio.NewScanner(f.in)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return rss.FeedLink{}, err
 		}
+		return rss.FeedLink{}, fmt.Errorf("no feed picked, use --pick to choose one")
+	}
+	choice, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+	if err != nil || choice < 1 || choice > len(candidates) {
+		return rss.FeedLink{}, fmt.Errorf("invalid choice %q", scanner.Text())
+	}
+	return candidates[choice-1], nil
+}
+
+// SetFeedOptions updates per-feed settings, using the column names as keys.
+func (f *Feeder) SetFeedOptions(ctx context.Context, id uint, values map[string]any) error {
+	if len(values) == 0 {
+		return fmt.Errorf("no settings given to change")
+	}
+	err := f.Db.UpdateFeed(ctx, id, values)
+	if err != nil {
+		return fmt.Errorf("error updating feed %d: %w", id, err)
 	}
 	return nil
 }
 
-func (f *Feeder) WriteUnread(outFilename string) error {
-	var w io.Writer
-	unread, err := f.Db.Unread()
+func (f *Feeder) Delete(ctx context.Context, id uint) error {
+	return f.Db.Delete(ctx, id)
+}
+
+// Fetch refreshes all the feeds, reporting any that fail along the way. If
+// the context is cancelled (like on Ctrl-C) the feeds fetched so far are kept
+// and the rest are left for next time.
+func (f *Feeder) Fetch(ctx context.Context) error {
+	result, err := f.fetcher().Refresh(ctx, f.Db)
+	if ctx.Err() != nil {
+		LoggedPrint(f.out, "Fetch interrupted, saved %d feeds\n", len(result.Fetched))
+	}
+	for _, problem := range result.Errors {
+		LoggedPrint(f.out, "  Error fetching feed %s: %v\n", problem.URL, problem.Err)
+	}
+	if f.Verbose {
+		for _, problem := range result.ArticleErrors {
+			LoggedPrint(f.out, "  Error extracting article %s: %v\n", problem.URL, problem.Err)
+		}
+		for _, url := range result.Fetched {
+			LoggedPrint(f.out, "  Fetched: %s\n", url)
+		}
+		for _, deferred := range result.Deferred {
+			LoggedPrint(f.out, "  Skipped until %s: %s\n", deferred.Until.Local().Format(time.DateTime), deferred.URL)
+		}
+		if result.Duplicates > 0 {
+			LoggedPrint(f.out, "  Grouped %d duplicate items\n", result.Duplicates)
+		}
+	}
+	if result.DedupErr != nil {
+		LoggedPrint(f.out, "  Error finding duplicate items: %v\n", result.DedupErr)
+	}
+	if err == nil {
+		f.notify(ctx, result.New)
+	}
+	return err
+}
+
+// Send notifications for the new items that want them. Problems are
+// reported without failing the fetch, the items are saved either way.
+func (f *Feeder) notify(ctx context.Context, items []rss.Item) {
+	if !f.Notifier.Enabled() || len(items) == 0 {
+		return
+	}
+	feeds, err := f.Db.AllFeeds(ctx)
+	if err != nil {
+		LoggedPrint(f.out, "  Error reading feeds for notifications: %v\n", err)
+		return
+	}
+	ruleset, err := f.Db.Rules(ctx)
+	if err != nil {
+		LoggedPrint(f.out, "  Error loading rules for notifications: %v\n", err)
+		return
+	}
+	result, err := f.Notifier.Send(ctx, notify.Select(ruleset, feeds, items))
+	for _, problem := range result.Errors {
+		LoggedPrint(f.out, "  Error sending notification: %v\n", problem)
+	}
+	if err != nil {
+		LoggedPrint(f.out, "  Error sending notifications: %v\n", err)
+	}
+	if result.Dropped > 0 {
+		LoggedPrint(f.out, "  Hourly notification limit reached, left out %d items\n", result.Dropped)
+	}
+	if f.Verbose && result.Sent > 0 {
+		LoggedPrint(f.out, "  Sent %d notifications\n", result.Sent)
+	}
+}
+
+func (f *Feeder) AddRule(ctx context.Context, rule *rules.Rule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	if err := f.Db.AddRule(ctx, rule); err != nil {
+		return fmt.Errorf("error adding rule: %w", err)
+	}
+	return nil
+}
+
+func (f *Feeder) ListRules(ctx context.Context) error {
+	ruleset, err := f.Db.Rules(ctx)
+	if err != nil {
+		return fmt.Errorf("Error loading rules: %w", err)
+	}
+	for i := range ruleset {
+		LoggedPrint(f.out, "%d: %s\n", ruleset[i].ID, ruleset[i].Describe())
+	}
+	return nil
+}
+
+func (f *Feeder) DeleteRule(ctx context.Context, id uint) error {
+	return f.Db.DeleteRule(ctx, id)
+}
+
+// TestRules previews what the rules would do against the items already in
+// the database, without changing anything. If rule is nil all of the stored
+// rules are tried, otherwise just the one given.
+func (f *Feeder) TestRules(ctx context.Context, rule *rules.Rule) error {
+	var ruleset []rules.Rule
+	if rule != nil {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+		ruleset = []rules.Rule{*rule}
+	} else {
+		var err error
+		ruleset, err = f.Db.Rules(ctx)
+		if err != nil {
+			return fmt.Errorf("Error loading rules: %w", err)
+		}
+	}
+	feeds, err := f.Db.AllFeeds(ctx)
 	if err != nil {
 		return fmt.Errorf("Error fetching feeds: %w", err)
 	}
-	tmpl, err := template.New("feed").Parse(feedTemplate)
+	feedsByID := make(map[uint]*rss.Feed)
+	for i := range feeds {
+		feedsByID[feeds[i].ID] = &feeds[i]
+	}
+	items, err := f.Db.AllItems(ctx)
 	if err != nil {
-		return fmt.Errorf("Error opening template: %v", err)
+		return fmt.Errorf("Error fetching items: %w", err)
+	}
+	for i := range ruleset {
+		r := &ruleset[i]
+		LoggedPrint(f.out, "%d: %s\n", r.ID, r.Describe())
+		matched := 0
+		for j := range items {
+			item := &items[j]
+			feed := feedsByID[item.FeedID]
+			if !r.Matches(feed, item) {
+				continue
+			}
+			matched++
+			feedTitle := ""
+			if feed != nil {
+				feedTitle = feed.Title
+			}
+			LoggedPrint(f.out, "  %s: %s (%s)\n", r.Action, item.Title, feedTitle)
+		}
+		LoggedPrint(f.out, "  %d of %d items matched\n", matched, len(items))
+	}
+	return nil
+}
+
+// Output formats for WriteUnread
+const (
+	FormatHTML = "html"
+	FormatEpub = "epub"
+)
+
+// ReadOptions control what goes into the page of unread items and how it's
+// written.
+type ReadOptions struct {
+	Filter lib.ItemFilter
+	// FormatHTML (the default if empty) or FormatEpub
+	Format string
+	// Include the starred items, read or not, instead of the unread ones
+	StarredOnly bool
+	// With FormatEpub, make a chapter for each item instead of each feed
+	EpubPerItem bool
+	// Pull remote images into the page and strip out tracking pixels, so
+	// the page works without a network connection.
+	Offline bool
+	// With Offline, write images to a directory next to the output file
+	// instead of inlining them in the page.
+	OfflineAssets bool
+	MaxImageBytes int64
+	MaxImageWidth int
+}
+
+// Directory the images for an offline page go into, next to the page itself.
+func assetsDir(outFilename string) string {
+	return strings.TrimSuffix(outFilename, filepath.Ext(outFilename)) + "_assets"
+}
+
+// WriteUnread renders all the unread items matching the filter into an HTML
+// page or an EPUB book. An outFilename of "-" writes to the command output.
+func (f *Feeder) WriteUnread(ctx context.Context, outFilename string, opts ReadOptions) error {
+	var w io.Writer
+	var unread []rss.Feed
+	var err error
+	if opts.StarredOnly {
+		unread, err = f.Db.Starred(ctx, opts.Filter)
+	} else {
+		unread, err = f.Db.UnreadFiltered(ctx, opts.Filter)
+	}
+	if err != nil {
+		return fmt.Errorf("Error fetching feeds: %w", err)
 	}
 	if outFilename == "-" {
 		w = f.out
@@ -128,15 +425,86 @@ func (f *Feeder) WriteUnread(outFilename string) error {
 		}()
 		w = outFile
 	}
-	err = tmpl.Execute(w, output.SanitizeFeeds(unread))
+	images := lib.ImageOptions{
+		Client:   f.Client,
+		MaxBytes: opts.MaxImageBytes,
+		MaxWidth: opts.MaxImageWidth,
+	}
+	if opts.Format == FormatEpub {
+		title := "Feeder " + time.Now().Format(time.DateOnly)
+		if opts.StarredOnly {
+			title = "Feeder starred items " + time.Now().Format(time.DateOnly)
+		}
+		err = lib.RenderEpub(ctx, w, unread, lib.EpubOptions{
+			Title:   title,
+			PerItem: opts.EpubPerItem,
+			Images:  images,
+		})
+		if err != nil {
+			return fmt.Errorf("Error writing epub: %w", err)
+		}
+		return nil
+	}
+	html := lib.HTMLOptions{Offline: opts.Offline, Images: images}
+	if opts.Offline && opts.OfflineAssets && outFilename != "-" {
+		html.AssetsDir = assetsDir(outFilename)
+		html.AssetsRef = filepath.Base(html.AssetsDir)
+	}
+	err = lib.RenderHTML(ctx, w, unread, html)
 	if err != nil {
-		return fmt.Errorf("Error executing template: %w", err)
+		return fmt.Errorf("Error writing page: %w", err)
 	}
 	return nil
 }
 
-func (f *Feeder) List() error {
-	feeds, err := f.Db.AllFeeds()
+// Download fetches the enclosures for all the unread items into dir. Files
+// over maxBytes (if greater than zero) are skipped. A failed download is
+// reported and left as a partial file so the next run can resume it.
+func (f *Feeder) Download(ctx context.Context, dir string, maxBytes int64) error {
+	unread, err := f.Db.Unread(ctx)
+	if err != nil {
+		return fmt.Errorf("Error fetching feeds: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("Error creating download directory %s: %w", dir, err)
+	}
+	for i := range unread {
+		for j := range unread[i].Items {
+			item := &unread[i].Items[j]
+			for k := range item.Enclosures {
+				enclosure := &item.Enclosures[k]
+				if maxBytes > 0 && enclosure.Length > maxBytes {
+					LoggedPrint(f.out, "  Skipping %s, %d bytes is over the limit\n", enclosure.URL, enclosure.Length)
+					continue
+				}
+				dest := filepath.Join(dir, enclosureFilename(item, enclosure))
+				if f.Verbose {
+					LoggedPrint(f.out, "  Downloading %s\n", enclosure.URL)
+				}
+				err := download.File(ctx, f.Client, enclosure.URL, dest, maxBytes)
+				if err != nil {
+					LoggedPrint(f.out, "  Error downloading %s: %v\n", enclosure.URL, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Build a local filename for an enclosure. The item and enclosure IDs go in
+// front so two feeds that both call their files episode.mp3 don't collide.
+func enclosureFilename(item *rss.Item, enclosure *rss.Enclosure) string {
+	name := "enclosure"
+	if u, err := neturl.Parse(enclosure.URL); err == nil {
+		if base := path.Base(u.Path); base != "." && base != "/" {
+			name = base
+		}
+	}
+	return fmt.Sprintf("%d-%d-%s", item.ID, enclosure.ID, name)
+}
+
+func (f *Feeder) List(ctx context.Context) error {
+	feeds, err := f.Db.AllFeeds(ctx)
 	if err != nil {
 		return fmt.Errorf("Error fetching feeds: %w", err)
 	}
@@ -147,8 +515,27 @@ func (f *Feeder) List() error {
 	return nil
 }
 
-func (f *Feeder) MarkAll() error {
-	return f.Db.MarkAll()
+// Categories prints all the item categories in use, with the number of
+// items in each.
+func (f *Feeder) Categories(ctx context.Context) error {
+	counts, err := f.Db.Categories(ctx)
+	if err != nil {
+		return fmt.Errorf("Error fetching categories: %w", err)
+	}
+	for _, c := range counts {
+		LoggedPrint(f.out, "%s (%d)\n", c.Name, c.Count)
+	}
+	return nil
+}
+
+func (f *Feeder) MarkAll(ctx context.Context) error {
+	return f.Db.MarkAll(ctx)
+}
+
+// MarkItem marks a single item read, along with any duplicates of it from
+// other feeds.
+func (f *Feeder) MarkItem(ctx context.Context, id uint) error {
+	return f.Db.MarkRead(ctx, id)
 }
 
 func (f *Feeder) Open(filename string) error {
@@ -165,34 +552,225 @@ func (f *Feeder) Open(filename string) error {
 	return fmt.Errorf("unable find suitable open command")
 }
 
-func (f *Feeder) Export() error {
-	feeds, err := f.Db.AllFeeds()
+func (f *Feeder) Export(ctx context.Context) error {
+	feeds, err := f.Db.AllFeeds(ctx)
 	if err != nil {
 		return fmt.Errorf("Error fetching feeds: %w", err)
 	}
 	for i := range feeds {
 		feed := &feeds[i]
-		LoggedPrint(f.out, "%s\n", feed.URL)
+		// Credentials belong in the credentials file, not in a list that
+		// gets shared around
+		LoggedPrint(f.out, "%s\n", lib.RedactURL(feed.URL))
 	}
 	return nil
 }
 
-func (f *Feeder) Import() error {
+func (f *Feeder) Import(ctx context.Context) error {
 	scanner := bufio.NewScanner(f.in)
 	for scanner.Scan() {
 		url := strings.TrimSpace(scanner.Text())
 		if url == "" {
 			continue
 		}
-		if err := f.Add(url); err != nil {
+		if err := f.Add(ctx, url); err != nil {
 			return err
 		}
 	}
 	return scanner.Err()
 }
 
-func (f *Feeder) Trim(maxItems int) error {
-	feeds, err := f.Db.AllFeeds()
+// Backup writes everything in the database, read state included, to an
+// archive at path, or to standard output for "-". The archive is written to
+// a temporary file first so a failed backup doesn't leave a partial one.
+func (f *Feeder) Backup(ctx context.Context, path string) error {
+	data, err := f.Db.Dump(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading database: %w", err)
+	}
+	if path == "-" {
+		return lib.WriteBackup(f.out, data)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := lib.WriteBackup(tmp, data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	items := 0
+	for _, feed := range data.Feeds {
+		items += len(feed.Items)
+	}
+	LoggedPrint(f.out, "Backed up %d feeds, %d items, and %d rules to %s\n",
+		len(data.Feeds), items, len(data.Rules), path)
+	return nil
+}
+
+// Restore loads an archive written by Backup from path, or standard input
+// for "-". See Store.Restore for how replace and merge differ.
+func (f *Feeder) Restore(ctx context.Context, path string, replace bool) error {
+	r := f.in
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	header, data, err := lib.ReadBackup(r)
+	if err != nil {
+		return err
+	}
+	if f.Verbose {
+		LoggedPrint(f.out, "Backup from %s, version %d\n", header.Created.Local().Format(time.DateTime), header.Version)
+	}
+	stats, err := f.Db.Restore(ctx, data, replace)
+	if err != nil {
+		return fmt.Errorf("error restoring backup: %w", err)
+	}
+	if replace {
+		LoggedPrint(f.out, "Restored %d feeds, %d items, and %d rules\n", stats.Feeds, stats.Items, stats.Rules)
+	} else {
+		LoggedPrint(f.out, "Added %d feeds, %d items, and %d rules, updated %d items\n",
+			stats.Feeds, stats.Items, stats.Rules, stats.Updated)
+	}
+	return nil
+}
+
+// Snapshot copies the database file to path while it's in use, see
+// Store.Snapshot.
+func (f *Feeder) Snapshot(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	if err := f.Db.Snapshot(ctx, path); err != nil {
+		return err
+	}
+	LoggedPrint(f.out, "Wrote snapshot to %s\n", path)
+	return nil
+}
+
+// Sync exchanges subscription, read, and starred changes with other
+// devices through the shared directory dir, see lib.Sync.
+func (f *Feeder) Sync(ctx context.Context, dir string, device string) error {
+	result, err := lib.Sync(ctx, f.Db, dir, device)
+	for name, skipErr := range result.Skipped {
+		LoggedPrint(f.err, "Skipping sync file %s: %v\n", name, skipErr)
+	}
+	if err != nil {
+		return err
+	}
+	if f.Verbose {
+		LoggedPrint(f.out, "Wrote %d changes as %s\n", result.Exported, device)
+	}
+	if len(result.Devices) == 0 {
+		LoggedPrint(f.out, "No other devices have synced to %s yet\n", dir)
+		return nil
+	}
+	LoggedPrint(f.out, "Merged %d changes from %s\n", result.Merged, strings.Join(result.Devices, ", "))
+	if result.Pending > 0 {
+		LoggedPrint(f.out, "%d changes are waiting for items that haven't been fetched yet\n", result.Pending)
+	}
+	return nil
+}
+
+// Push subscribes to every feed that publishes through a WebSub hub and
+// listens on addr for the hubs to push new items, until the context is
+// cancelled. Hubs reach us at callback, which defaults to the address
+// listened on for when the hubs are on the same network. Feeds without a
+// hub are left to be fetched as usual.
+func (f *Feeder) Push(ctx context.Context, addr string, callback string, lease time.Duration) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	// Without a callback the hubs are pointed at the listen address, which
+	// they can't reach when it's every address on the machine
+	if ip := net.ParseIP(host); callback == "" && (host == "" || ip != nil && ip.IsUnspecified()) {
+		return fmt.Errorf("listening on every address with %s, use --callback to give the URL the hubs can reach", addr)
+	}
+	feeds, err := f.Db.AllFeeds(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading feeds: %w", err)
+	}
+	// Listening first, as hubs can check the subscription before they've
+	// answered the request for it
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if callback == "" {
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		callback = "http://" + net.JoinHostPort(host, port) + "/"
+	}
+	if !websub.Secure(callback) {
+		LoggedPrint(f.err, "Callback %s isn't HTTPS, so the hubs aren't given a secret and pushes can't be checked\n", callback)
+	}
+	fetcher := f.fetcher()
+	sub := fetcher.NewPushSubscriber(f.Db, callback)
+	sub.Lease = lease
+	sub.Logf = func(format string, args ...any) {
+		LoggedPrint(f.out, format, args...)
+	}
+	server := &http.Server{Handler: sub, ReadHeaderTimeout: 30 * time.Second}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			LoggedPrint(f.err, "Error stopping push listener: %v\n", err)
+		}
+	}()
+
+	requested := 0
+	for _, feed := range feeds {
+		hub, err := fetcher.DiscoverHub(ctx, feed.URL)
+		if errors.Is(err, lib.ErrNoHub) {
+			if f.Verbose {
+				LoggedPrint(f.out, "  No hub for %s, it needs fetching\n", feed.URL)
+			}
+			continue
+		}
+		if err == nil {
+			err = sub.Subscribe(ctx, feed, hub)
+		}
+		if err != nil {
+			LoggedPrint(f.out, "  Error subscribing to %s: %v\n", feed.URL, err)
+			continue
+		}
+		requested++
+	}
+	if requested == 0 {
+		return errors.New("none of the feeds publish through a hub")
+	}
+	LoggedPrint(f.out, "Listening on %s for pushes to %d feeds\n", listener.Addr(), requested)
+
+	go func() {
+		_ = sub.Run(ctx)
+	}()
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-served:
+		return fmt.Errorf("push listener stopped: %w", err)
+	}
+}
+
+func (f *Feeder) Trim(ctx context.Context, maxItems int) error {
+	feeds, err := f.Db.AllFeeds(ctx)
 	if err != nil {
 		return fmt.Errorf("error reading feeds: %w", err)
 	}
@@ -201,7 +779,7 @@ func (f *Feeder) Trim(maxItems int) error {
 		if f.Verbose {
 			LoggedPrint(f.out, "Trimming feed %s\n", feed.URL)
 		}
-		err := f.Db.TrimItems(feed.ID, maxItems)
+		err := f.Db.TrimItems(ctx, feed.ID, maxItems)
 		if err != nil {
 			LoggedPrint(f.out, "  Error trimming feed %v", err)
 		}
@@ -209,7 +787,25 @@ func (f *Feeder) Trim(maxItems int) error {
 	if f.Verbose {
 		LoggedPrint(f.out, "Cleaning up database file\n")
 	}
-	return f.Db.Vacuum()
+	return f.vacuum(ctx)
+}
+
+// VACUUM rewrites the whole database file, so it waits for other feeder
+// processes to finish with it and keeps new ones out while it runs.
+func (f *Feeder) vacuum(ctx context.Context) error {
+	if f.LockPath == "" {
+		return f.Db.Vacuum(ctx)
+	}
+	lock, err := lib.LockStore(ctx, f.LockPath, true, f.LockTimeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Release(); err != nil {
+			LoggedPrint(f.err, "Error releasing database lock: %v\n", err)
+		}
+	}()
+	return f.Db.Vacuum(ctx)
 }
 
 func (f *Feeder) Out(format string, args ...any) {
@@ -219,3 +815,13 @@ func (f *Feeder) Out(format string, args ...any) {
 func (f *Feeder) Err(format string, args ...any) {
 	LoggedPrint(f.err, format, args...)
 }
+
+// SetOutput swaps where messages go, for when something else owns the
+// terminal. It returns a function that puts the old writers back.
+func (f *Feeder) SetOutput(out io.Writer, err io.Writer) func() {
+	oldOut, oldErr := f.out, f.err
+	f.out, f.err = out, err
+	return func() {
+		f.out, f.err = oldOut, oldErr
+	}
+}
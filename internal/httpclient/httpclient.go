@@ -0,0 +1,222 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+// Builds the HTTP client all of feeder's requests go through, set up with
+// the proxy, TLS, timeout, redirect, and User-Agent settings from the
+// config, for networks that need more than the defaults.
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultUserAgent is sent with requests when no other User-Agent is set.
+const DefaultUserAgent = "Feeder/0.0 (+https://github.com/mikerowehl/feeder)"
+
+// Defaults for a Config
+const (
+	DefaultTimeout      = 30 * time.Second
+	DefaultMaxRedirects = 10
+	DefaultHostRate     = 1.0
+	DefaultHostBurst    = 5
+)
+
+// NoProxy as a proxy setting connects directly, ignoring the HTTP_PROXY and
+// HTTPS_PROXY environment variables.
+const NoProxy = "direct"
+
+// Config is the settings for the client. The zero value gives a client with
+// no timeout that follows no redirects, so start from DefaultConfig.
+type Config struct {
+	Timeout time.Duration
+	// Redirects followed before giving up, 0 to not follow any
+	MaxRedirects int
+	// Replaces the User-Agent on every request when set
+	UserAgent string
+	// Proxy URL for every request, http, https, or socks5. Empty uses the
+	// HTTP_PROXY and HTTPS_PROXY environment variables, NoProxy connects
+	// directly.
+	Proxy string
+	// Proxies for particular feeds, used instead of Proxy for the URLs they
+	// match
+	Proxies []FeedProxy
+	// PEM file of extra certificate authorities to trust along with the
+	// system ones
+	CABundle string
+	// PEM files of a certificate and its key to present to servers that ask
+	// for one
+	ClientCert string
+	ClientKey  string
+	// Skips checking server certificates, which leaves the connection open
+	// to anyone in the middle. Only for testing against servers with broken
+	// certificates.
+	InsecureSkipVerify bool
+	// Feed fetches per second to any one host, after the first HostBurst,
+	// so many feeds on one site aren't fetched back to back. 0 for no
+	// limit. Only requests with a context from WithHostLimit count.
+	HostRate  float64
+	HostBurst int
+}
+
+// FeedProxy is the proxy for the URLs starting with Match, with the same
+// values as Config.Proxy. The longest matching prefix wins.
+type FeedProxy struct {
+	Match string `mapstructure:"match"`
+	Proxy string `mapstructure:"proxy"`
+}
+
+// DefaultConfig is the config used when nothing is configured.
+func DefaultConfig() Config {
+	return Config{
+		Timeout:      DefaultTimeout,
+		MaxRedirects: DefaultMaxRedirects,
+		HostRate:     DefaultHostRate,
+		HostBurst:    DefaultHostBurst,
+	}
+}
+
+// New builds a client from the config, checking the proxy URLs and loading
+// any certificates up front so mistakes show up straight away.
+func New(cfg Config) (*http.Client, error) {
+	proxy, err := proxyFunc(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := tlsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.TLSClientConfig = tlsConfig
+
+	client := &http.Client{
+		Timeout:   cfg.Timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.MaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", cfg.MaxRedirects)
+			}
+			return nil
+		},
+	}
+	if cfg.MaxRedirects <= 0 {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	if cfg.HostRate > 0 {
+		client.Transport = newHostLimiter(cfg.HostRate, cfg.HostBurst, client.Transport)
+	}
+	if cfg.UserAgent != "" {
+		client.Transport = &userAgent{agent: cfg.UserAgent, base: client.Transport}
+	}
+	return client, nil
+}
+
+type proxyChoice func(*http.Request) (*url.URL, error)
+
+func parseProxy(setting string) (proxyChoice, error) {
+	switch setting {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case NoProxy:
+		return func(*http.Request) (*url.URL, error) { return nil, nil }, nil
+	}
+	u, err := url.Parse(setting)
+	if err != nil {
+		return nil, fmt.Errorf("bad proxy %q: %w", setting, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("bad proxy %q: has to be an http, https, or socks5 URL", setting)
+	}
+	return http.ProxyURL(u), nil
+}
+
+func proxyFunc(cfg Config) (proxyChoice, error) {
+	global, err := parseProxy(cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Proxies) == 0 {
+		return global, nil
+	}
+	perFeed := make([]proxyChoice, len(cfg.Proxies))
+	for i, p := range cfg.Proxies {
+		if p.Match == "" {
+			return nil, errors.New("feed proxy needs a match prefix")
+		}
+		if perFeed[i], err = parseProxy(p.Proxy); err != nil {
+			return nil, err
+		}
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		target := req.URL.String()
+		best := -1
+		for i, p := range cfg.Proxies {
+			if strings.HasPrefix(target, p.Match) && (best < 0 || len(p.Match) > len(cfg.Proxies[best].Match)) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return global(req)
+		}
+		return perFeed[best](req)
+	}, nil
+}
+
+func tlsConfig(cfg Config) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CABundle != "" {
+		pem, err := os.ReadFile(cfg.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", cfg.CABundle)
+		}
+		config.RootCAs = pool
+	}
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		if cfg.ClientCert == "" || cfg.ClientKey == "" {
+			return nil, errors.New("a client certificate needs both the certificate and key files")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Sets the configured User-Agent, over the top of whatever the request had.
+type userAgent struct {
+	agent string
+	base  http.RoundTripper
+}
+
+func (u *userAgent) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", u.agent)
+	return u.base.RoundTrip(req)
+}
@@ -0,0 +1,272 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package httpclient_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/httpclient"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, client *http.Client, url string) (*http.Response, error) {
+	t.Helper()
+	return getWith(t, t.Context(), client, url)
+}
+
+func getWith(t *testing.T, ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("User-Agent", httpclient.DefaultUserAgent)
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func writePEM(t *testing.T, name string, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+	return path
+}
+
+func TestNew_UserAgent(t *testing.T) {
+	var agent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agent = r.UserAgent()
+	}))
+	defer server.Close()
+
+	client, err := httpclient.New(httpclient.DefaultConfig())
+	require.NoError(t, err)
+	_, err = get(t, client, server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, httpclient.DefaultUserAgent, agent)
+
+	cfg := httpclient.DefaultConfig()
+	cfg.UserAgent = "Corporate/1.0"
+	client, err = httpclient.New(cfg)
+	require.NoError(t, err)
+	_, err = get(t, client, server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "Corporate/1.0", agent)
+}
+
+func TestNew_HostRate(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	busy := httptest.NewServer(handler)
+	defer busy.Close()
+	other := httptest.NewServer(handler)
+	defer other.Close()
+
+	cfg := httpclient.DefaultConfig()
+	cfg.HostRate = 10
+	cfg.HostBurst = 2
+	client, err := httpclient.New(cfg)
+	require.NoError(t, err)
+	feeds := httpclient.WithHostLimit(t.Context())
+
+	start := time.Now()
+	for range 2 {
+		_, err = getWith(t, feeds, client, busy.URL)
+		require.NoError(t, err)
+	}
+	assert.Less(t, time.Since(start), 80*time.Millisecond, "the burst goes straight through")
+	for range 3 {
+		_, err = getWith(t, feeds, client, busy.URL)
+		require.NoError(t, err)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond, "then one every 100ms")
+
+	start = time.Now()
+	_, err = getWith(t, feeds, client, other.URL)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 80*time.Millisecond, "other hosts aren't held up")
+
+	// Requests that aren't feed fetches go straight out, even to a host
+	// that's used up its burst
+	start = time.Now()
+	for range 10 {
+		_, err = get(t, client, busy.URL)
+		require.NoError(t, err)
+	}
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "unmarked requests aren't limited")
+
+	cfg.HostRate = 0
+	client, err = httpclient.New(cfg)
+	require.NoError(t, err)
+	start = time.Now()
+	for range 10 {
+		_, err = getWith(t, feeds, client, busy.URL)
+		require.NoError(t, err)
+	}
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "no limit")
+}
+
+func TestNew_MaxRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hops int
+		_, _ = fmt.Sscanf(r.URL.Path, "/%d", &hops)
+		if hops > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/%d", hops-1), http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	cfg := httpclient.DefaultConfig()
+	cfg.MaxRedirects = 2
+	client, err := httpclient.New(cfg)
+	require.NoError(t, err)
+	resp, err := get(t, client, server.URL+"/2")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = get(t, client, server.URL+"/3")
+	assert.ErrorContains(t, err, "stopped after 2 redirects")
+
+	cfg.MaxRedirects = 0
+	client, err = httpclient.New(cfg)
+	require.NoError(t, err)
+	resp, err = get(t, client, server.URL+"/1")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+}
+
+func TestNew_CABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client, err := httpclient.New(httpclient.DefaultConfig())
+	require.NoError(t, err)
+	_, err = get(t, client, server.URL)
+	require.Error(t, err, "the test server's certificate isn't trusted")
+
+	cfg := httpclient.DefaultConfig()
+	cfg.CABundle = writePEM(t, "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	client, err = httpclient.New(cfg)
+	require.NoError(t, err)
+	_, err = get(t, client, server.URL)
+	require.NoError(t, err)
+
+	cfg = httpclient.DefaultConfig()
+	cfg.InsecureSkipVerify = true
+	client, err = httpclient.New(cfg)
+	require.NoError(t, err)
+	_, err = get(t, client, server.URL)
+	require.NoError(t, err)
+
+	cfg = httpclient.DefaultConfig()
+	cfg.CABundle = filepath.Join(t.TempDir(), "missing.pem")
+	_, err = httpclient.New(cfg)
+	assert.Error(t, err)
+}
+
+func TestNew_ClientCert(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "feeder"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	cfg := httpclient.DefaultConfig()
+	cfg.CABundle = writePEM(t, "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	client, err := httpclient.New(cfg)
+	require.NoError(t, err)
+	_, err = get(t, client, server.URL)
+	require.Error(t, err, "the server wants a client certificate")
+
+	cfg.ClientCert = writePEM(t, "client.pem", "CERTIFICATE", der)
+	_, err = httpclient.New(cfg)
+	require.Error(t, err, "needs the key too")
+	cfg.ClientKey = writePEM(t, "client.key", "EC PRIVATE KEY", keyDER)
+	client, err = httpclient.New(cfg)
+	require.NoError(t, err)
+	_, err = get(t, client, server.URL)
+	require.NoError(t, err)
+}
+
+// A plain HTTP proxy gets the full URL of the request, so it can stand in
+// for the site as well.
+func startProxy(t *testing.T, name string, seen *[]string) *httptest.Server {
+	t.Helper()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*seen = append(*seen, name+" "+r.URL.String())
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestNew_Proxies(t *testing.T) {
+	var seen []string
+	global := startProxy(t, "global", &seen)
+	internal := startProxy(t, "internal", &seen)
+
+	cfg := httpclient.DefaultConfig()
+	cfg.Proxy = global.URL
+	cfg.Proxies = []httpclient.FeedProxy{
+		{Match: "http://intranet.example.com/", Proxy: internal.URL},
+		{Match: "http://intranet.example.com/public/", Proxy: global.URL},
+	}
+	client, err := httpclient.New(cfg)
+	require.NoError(t, err)
+	for _, url := range []string{
+		"http://example.com/feed.xml",
+		"http://intranet.example.com/feed.xml",
+		"http://intranet.example.com/public/feed.xml",
+	} {
+		_, err := get(t, client, url)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{
+		"global http://example.com/feed.xml",
+		"internal http://intranet.example.com/feed.xml",
+		"global http://intranet.example.com/public/feed.xml",
+	}, seen)
+
+	cfg.Proxy = "ftp://proxy.example.com"
+	_, err = httpclient.New(cfg)
+	assert.ErrorContains(t, err, "socks5")
+	cfg.Proxy = "socks5://localhost:1080"
+	_, err = httpclient.New(cfg)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,73 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package httpclient
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+type hostLimitKey struct{}
+
+// WithHostLimit marks requests made with the returned context as ones to
+// space out with the HostRate and HostBurst settings. Only feed fetches are
+// marked, so webhooks, hub subscriptions, image downloads and the like go
+// straight out.
+func WithHostLimit(ctx context.Context) context.Context {
+	return context.WithValue(ctx, hostLimitKey{}, true)
+}
+
+func hostLimited(ctx context.Context) bool {
+	limited, _ := ctx.Value(hostLimitKey{}).(bool)
+	return limited
+}
+
+// Spaces out the marked requests to each host with a token bucket per host,
+// so a burst of requests goes straight through and the rest wait their turn.
+// Requests to different hosts don't hold each other up.
+type hostLimiter struct {
+	limit rate.Limit
+	burst int
+	base  http.RoundTripper
+
+	mu    sync.Mutex
+	hosts map[string]*rate.Limiter
+}
+
+func newHostLimiter(perSecond float64, burst int, base http.RoundTripper) *hostLimiter {
+	return &hostLimiter{
+		limit: rate.Limit(perSecond),
+		burst: max(burst, 1),
+		base:  base,
+		hosts: make(map[string]*rate.Limiter),
+	}
+}
+
+func (h *hostLimiter) limiter(host string) *rate.Limiter {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	host = strings.ToLower(host)
+	l, ok := h.hosts[host]
+	if !ok {
+		l = rate.NewLimiter(h.limit, h.burst)
+		h.hosts[host] = l
+	}
+	return l
+}
+
+func (h *hostLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !hostLimited(req.Context()) {
+		return h.base.RoundTrip(req)
+	}
+	if err := h.limiter(req.URL.Host).Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return h.base.RoundTrip(req)
+}
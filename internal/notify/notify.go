@@ -0,0 +1,436 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+
+// Package notify sends alerts about new items as soon as they're fetched,
+// for the feeds and keywords someone wants to hear about right away. Alerts
+// go to webhooks, as JSON shaped for Slack, Discord, ntfy, or a generic
+// receiver, and to a command, which can pop up a desktop notification.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mikerowehl/feeder/internal/httpclient"
+	"github.com/mikerowehl/feeder/internal/rss"
+	"github.com/mikerowehl/feeder/internal/rules"
+)
+
+// Payload formats for webhooks
+const (
+	FormatJSON    = "json"
+	FormatSlack   = "slack"
+	FormatDiscord = "discord"
+	FormatNtfy    = "ntfy"
+)
+
+var Formats = []string{FormatJSON, FormatSlack, FormatDiscord, FormatNtfy}
+
+// Defaults for a Config
+const (
+	DefaultBatchSize  = 3
+	DefaultMaxPerHour = 20
+)
+
+// How long the command gets to run, how much of its output is kept for the
+// error when it fails, and how many items a summary lists
+const (
+	CommandTimeout   = 30 * time.Second
+	maxCommandOutput = 4 << 10
+	summaryItems     = 10
+)
+
+// The most characters Discord takes in a message
+const discordLimit = 2000
+
+// Webhook is a URL to POST notifications to, with the shape of JSON it
+// expects.
+type Webhook struct {
+	URL    string
+	Format string
+}
+
+// ParseWebhook reads a webhook written as [format=]URL, like
+// "slack=https://hooks.slack.com/services/...". Without a format the
+// generic JSON is sent.
+func ParseWebhook(s string) (Webhook, error) {
+	hook := Webhook{URL: s, Format: FormatJSON}
+	if format, rest, ok := strings.Cut(s, "="); ok && !strings.Contains(format, "/") {
+		if !slices.Contains(Formats, format) {
+			return hook, fmt.Errorf("unknown webhook format %q, should be one of %s", format, strings.Join(Formats, ", "))
+		}
+		hook.URL, hook.Format = rest, format
+	}
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return hook, fmt.Errorf("bad webhook URL %q", hook.URL)
+	}
+	if hook.Format == FormatNtfy && strings.Trim(u.Path, "/") == "" {
+		return hook, fmt.Errorf("ntfy webhook %q needs a topic, like https://ntfy.sh/mytopic", hook.URL)
+	}
+	return hook, nil
+}
+
+// Config says where notifications go and how many to send.
+type Config struct {
+	Webhooks []Webhook
+	// Shell command run for each notification, with the details in
+	// FEEDER_ environment variables
+	Command string
+	// Up to this many matching items from one fetch get a notification
+	// each, more than that are sent as one summary
+	BatchSize int
+	// The most notifications sent in an hour, counting earlier runs, zero
+	// for no limit. Once near the limit a fetch's items are summed up in
+	// one notification, and at it they're dropped.
+	MaxPerHour int
+	// File keeping track of when notifications went out, so the limit
+	// holds across runs. Without one the limit only counts this run.
+	StatePath string
+}
+
+// Notice is a new item someone wants to hear about.
+type Notice struct {
+	Feed string
+	Item rss.Item
+}
+
+// Select picks out the new items to send notifications for, the ones from
+// feeds with Notify set and the ones a notify rule matches.
+func Select(ruleset []rules.Rule, feeds []rss.Feed, items []rss.Item) []Notice {
+	byID := make(map[uint]*rss.Feed, len(feeds))
+	for i := range feeds {
+		byID[feeds[i].ID] = &feeds[i]
+	}
+	var notices []Notice
+	for i := range items {
+		item := &items[i]
+		feed := byID[item.FeedID]
+		if (feed != nil && feed.Notify) || rules.Notify(ruleset, feed, item) {
+			notice := Notice{Item: *item}
+			if feed != nil {
+				notice.Feed = feed.Title
+			}
+			notices = append(notices, notice)
+		}
+	}
+	return notices
+}
+
+// Result says what Send did.
+type Result struct {
+	// Notifications sent, a summary counts as one
+	Sent int
+	// Items left out because of the hourly limit
+	Dropped int
+	// Webhooks and commands that failed, the others still went out
+	Errors []error
+}
+
+// Notifier sends notifications as the Config says.
+type Notifier struct {
+	Config
+	Client *http.Client
+	// Sent notifications this run, when there's no state file
+	sent []time.Time
+}
+
+// New creates a Notifier, filling in the defaults for anything not set. A
+// nil client means http.DefaultClient.
+func New(cfg Config, client *http.Client) *Notifier {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	return &Notifier{Config: cfg, Client: client}
+}
+
+// Enabled reports whether there's anywhere to send notifications.
+func (n *Notifier) Enabled() bool {
+	return n != nil && (len(n.Webhooks) > 0 || n.Command != "")
+}
+
+// A notification about one item, or a summary of several
+type message struct {
+	Title string
+	Text  string
+	// Link for a single item, empty for a summary
+	Link    string
+	Notices []Notice
+}
+
+func single(notice Notice) message {
+	m := message{Title: notice.Item.Title, Link: notice.Item.Link, Notices: []Notice{notice}}
+	if m.Title == "" {
+		m.Title = "New item"
+	}
+	m.Text = notice.Feed
+	if notice.Item.Link != "" {
+		m.Text = strings.TrimSpace(m.Text + "\n" + notice.Item.Link)
+	}
+	return m
+}
+
+func summary(notices []Notice) message {
+	m := message{Title: fmt.Sprintf("%d new items", len(notices)), Notices: notices}
+	var lines []string
+	for i, notice := range notices {
+		if i == summaryItems {
+			lines = append(lines, fmt.Sprintf("and %d more", len(notices)-summaryItems))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%s (%s)", notice.Item.Title, notice.Feed))
+	}
+	m.Text = strings.Join(lines, "\n")
+	return m
+}
+
+// Send delivers notifications for the notices, one each for a small batch
+// and a summary for more, staying under the hourly limit.
+func (n *Notifier) Send(ctx context.Context, notices []Notice) (Result, error) {
+	var result Result
+	if len(notices) == 0 || !n.Enabled() {
+		return result, nil
+	}
+	now := time.Now()
+	sent, err := n.recent(now)
+	if err != nil {
+		return result, err
+	}
+	allowed := len(notices)
+	if n.MaxPerHour > 0 {
+		allowed = max(n.MaxPerHour-len(sent), 0)
+	}
+
+	var messages []message
+	switch {
+	case allowed == 0:
+		result.Dropped = len(notices)
+		return result, nil
+	case len(notices) <= n.BatchSize && len(notices) <= allowed:
+		for _, notice := range notices {
+			messages = append(messages, single(notice))
+		}
+	default:
+		messages = []message{summary(notices)}
+	}
+	for _, m := range messages {
+		if ctx.Err() != nil {
+			break
+		}
+		result.Errors = append(result.Errors, n.deliver(ctx, m)...)
+		sent = append(sent, now)
+		result.Sent++
+	}
+	return result, n.record(sent)
+}
+
+// Send a message to every webhook and the command.
+func (n *Notifier) deliver(ctx context.Context, m message) []error {
+	var errs []error
+	for _, hook := range n.Webhooks {
+		if err := n.post(ctx, hook, m); err != nil {
+			errs = append(errs, fmt.Errorf("webhook %s: %w", hook.URL, err))
+		}
+	}
+	if n.Command != "" {
+		if err := n.run(ctx, m); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// The item fields in the generic JSON
+type jsonItem struct {
+	ID        uint      `json:"id"`
+	Feed      string    `json:"feed"`
+	Title     string    `json:"title"`
+	Link      string    `json:"link,omitempty"`
+	Author    string    `json:"author,omitempty"`
+	Published time.Time `json:"published"`
+}
+
+// The JSON body to POST to a webhook, and the URL to POST it to.
+func payload(hook Webhook, m message) (string, any, error) {
+	switch hook.Format {
+	case FormatSlack:
+		text := "*" + m.Title + "*\n" + m.Text
+		if m.Link != "" {
+			text = fmt.Sprintf("*<%s|%s>*\n%s", m.Link, m.Title, m.Notices[0].Feed)
+		}
+		return hook.URL, map[string]string{"text": text}, nil
+	case FormatDiscord:
+		text := "**" + m.Title + "**\n" + m.Text
+		if utf8.RuneCountInString(text) > discordLimit {
+			text = string([]rune(text)[:discordLimit-3]) + "..."
+		}
+		return hook.URL, map[string]string{"content": text}, nil
+	case FormatNtfy:
+		// ntfy takes JSON at the server root, with the topic in the body
+		u, err := url.Parse(hook.URL)
+		if err != nil {
+			return "", nil, err
+		}
+		topic := path.Base(strings.TrimRight(u.Path, "/"))
+		u.Path = strings.TrimSuffix(strings.TrimRight(u.Path, "/"), topic)
+		body := map[string]string{"topic": topic, "title": m.Title, "message": m.Text}
+		if m.Link != "" {
+			body["click"] = m.Link
+		}
+		return u.String(), body, nil
+	default:
+		items := make([]jsonItem, 0, len(m.Notices))
+		for _, notice := range m.Notices {
+			items = append(items, jsonItem{
+				ID:        notice.Item.ID,
+				Feed:      notice.Feed,
+				Title:     notice.Item.Title,
+				Link:      notice.Item.Link,
+				Author:    notice.Item.Author,
+				Published: notice.Item.Published,
+			})
+		}
+		return hook.URL, map[string]any{"title": m.Title, "text": m.Text, "count": len(items), "items": items}, nil
+	}
+}
+
+func (n *Notifier) post(ctx context.Context, hook Webhook, m message) error {
+	target, body, err := payload(hook, m)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", httpclient.DefaultUserAgent)
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if text := strings.TrimSpace(string(msg)); text != "" {
+			return fmt.Errorf("unexpected http status: %v: %s", resp.Status, text)
+		}
+		return fmt.Errorf("unexpected http status: %v", resp.Status)
+	}
+	return nil
+}
+
+// Run the command with the message in the environment. A single item has
+// its fields in FEEDER_FEED, FEEDER_TITLE, FEEDER_LINK, FEEDER_AUTHOR,
+// FEEDER_PUBLISHED, and FEEDER_ITEM_ID. FEEDER_COUNT is the number of
+// items, and FEEDER_MESSAGE is the text of the notification, a list of
+// the items for a summary.
+func (n *Notifier) run(ctx context.Context, m message) error {
+	ctx, cancel := context.WithTimeout(ctx, CommandTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", n.Command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", n.Command)
+	}
+	env := []string{
+		"FEEDER_TITLE=" + m.Title,
+		"FEEDER_MESSAGE=" + m.Text,
+		"FEEDER_COUNT=" + strconv.Itoa(len(m.Notices)),
+	}
+	if len(m.Notices) == 1 {
+		item := m.Notices[0].Item
+		env = append(env,
+			"FEEDER_FEED="+m.Notices[0].Feed,
+			"FEEDER_LINK="+item.Link,
+			"FEEDER_AUTHOR="+item.Author,
+			"FEEDER_PUBLISHED="+item.Published.Format(time.RFC3339),
+			"FEEDER_ITEM_ID="+strconv.FormatUint(uint64(item.ID), 10),
+		)
+	}
+	cmd.Env = append(os.Environ(), env...)
+	output := &rss.HeadBuffer{Max: maxCommandOutput}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// Anything the command started that's still holding its output open
+	// doesn't keep us waiting once the command itself is gone
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("command %q didn't finish within %v", n.Command, CommandTimeout)
+		}
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			return fmt.Errorf("command %q failed: %w: %s", n.Command, err, msg)
+		}
+		return fmt.Errorf("command %q failed: %w", n.Command, err)
+	}
+	return nil
+}
+
+// What's kept in the state file
+type state struct {
+	Sent []time.Time `json:"sent"`
+}
+
+// When the notifications in the last hour went out.
+func (n *Notifier) recent(now time.Time) ([]time.Time, error) {
+	sent := n.sent
+	if n.StatePath != "" {
+		data, err := os.ReadFile(n.StatePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error reading notification state: %w", err)
+		}
+		var st state
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &st); err != nil {
+				return nil, fmt.Errorf("error reading notification state %s: %w", n.StatePath, err)
+			}
+		}
+		sent = st.Sent
+	}
+	cutoff := now.Add(-time.Hour)
+	return slices.DeleteFunc(slices.Clone(sent), func(t time.Time) bool {
+		return t.Before(cutoff)
+	}), nil
+}
+
+func (n *Notifier) record(sent []time.Time) error {
+	n.sent = sent
+	if n.StatePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(state{Sent: sent})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(n.StatePath, data, 0o600); err != nil {
+		return fmt.Errorf("error saving notification state: %w", err)
+	}
+	return nil
+}
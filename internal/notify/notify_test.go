@@ -0,0 +1,256 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package notify_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mikerowehl/feeder/internal/notify"
+	"github.com/mikerowehl/feeder/internal/rss"
+	"github.com/mikerowehl/feeder/internal/rules"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestParseWebhook(t *testing.T) {
+	hook, err := notify.ParseWebhook("https://example.com/hook?token=abc")
+	require.NoError(t, err)
+	assert.Equal(t, notify.Webhook{URL: "https://example.com/hook?token=abc", Format: notify.FormatJSON}, hook)
+
+	hook, err = notify.ParseWebhook("slack=https://hooks.slack.com/services/T0/B0/XXXX")
+	require.NoError(t, err)
+	assert.Equal(t, notify.Webhook{URL: "https://hooks.slack.com/services/T0/B0/XXXX", Format: notify.FormatSlack}, hook)
+
+	_, err = notify.ParseWebhook("teams=https://example.com/hook")
+	assert.ErrorContains(t, err, "unknown webhook format")
+	_, err = notify.ParseWebhook("ftp://example.com/hook")
+	assert.ErrorContains(t, err, "bad webhook URL")
+	_, err = notify.ParseWebhook("ntfy=https://ntfy.sh/")
+	assert.ErrorContains(t, err, "needs a topic")
+}
+
+func TestSelect(t *testing.T) {
+	feeds := []rss.Feed{
+		{Model: gorm.Model{ID: 1}, Title: "Releases", Notify: true},
+		{Model: gorm.Model{ID: 2}, Title: "News"},
+	}
+	ruleset := []rules.Rule{{Field: rules.FieldTitle, Pattern: "CVE-", Action: rules.ActionNotify}}
+	items := []rss.Item{
+		{FeedID: 1, Title: "v2.0"},
+		{FeedID: 2, Title: "Weather"},
+		{FeedID: 2, Title: "Patch for CVE-2026-1234"},
+	}
+	notices := notify.Select(ruleset, feeds, items)
+	require.Len(t, notices, 2)
+	assert.Equal(t, "Releases", notices[0].Feed)
+	assert.Equal(t, "v2.0", notices[0].Item.Title)
+	assert.Equal(t, "News", notices[1].Feed)
+	assert.Equal(t, "Patch for CVE-2026-1234", notices[1].Item.Title)
+}
+
+// A webhook receiver keeping the bodies posted to it, by path.
+type receiver struct {
+	mu     sync.Mutex
+	bodies map[string][]map[string]any
+}
+
+func startReceiver(t *testing.T) (*receiver, string) {
+	t.Helper()
+	r := &receiver{bodies: make(map[string][]map[string]any)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]any
+		data, _ := io.ReadAll(req.Body)
+		if req.Header.Get("Content-Type") != "application/json" || json.Unmarshal(data, &body) != nil {
+			http.Error(w, "want JSON", http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		r.bodies[req.URL.Path] = append(r.bodies[req.URL.Path], body)
+		r.mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return r, server.URL
+}
+
+func (r *receiver) posted(path string) []map[string]any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bodies[path]
+}
+
+func notices(n int) []notify.Notice {
+	var list []notify.Notice
+	for i := range n {
+		list = append(list, notify.Notice{Feed: "Releases", Item: rss.Item{
+			Model: gorm.Model{ID: uint(i + 1)},
+			Title: "Release " + string(rune('A'+i)),
+			Link:  "https://example.com/" + string(rune('a'+i)),
+		}})
+	}
+	return list
+}
+
+func TestNotifier_Formats(t *testing.T) {
+	r, base := startReceiver(t)
+	var hooks []notify.Webhook
+	for _, spec := range []string{base + "/generic", "slack=" + base + "/slack", "discord=" + base + "/discord", "ntfy=" + base + "/releases"} {
+		hook, err := notify.ParseWebhook(spec)
+		require.NoError(t, err)
+		hooks = append(hooks, hook)
+	}
+	n := notify.New(notify.Config{Webhooks: hooks}, nil)
+
+	result, err := n.Send(t.Context(), notices(1))
+	require.NoError(t, err)
+	assert.Empty(t, result.Errors)
+	assert.Equal(t, 1, result.Sent)
+
+	generic := r.posted("/generic")
+	require.Len(t, generic, 1)
+	assert.Equal(t, "Release A", generic[0]["title"])
+	assert.EqualValues(t, 1, generic[0]["count"])
+	items := generic[0]["items"].([]any)
+	require.Len(t, items, 1)
+	assert.Equal(t, "https://example.com/a", items[0].(map[string]any)["link"])
+	assert.Equal(t, "Releases", items[0].(map[string]any)["feed"])
+
+	slack := r.posted("/slack")
+	require.Len(t, slack, 1)
+	assert.Equal(t, "*<https://example.com/a|Release A>*\nReleases", slack[0]["text"])
+	discord := r.posted("/discord")
+	require.Len(t, discord, 1)
+	assert.Contains(t, discord[0]["content"], "**Release A**")
+	// ntfy gets the topic in the body, posted to the server root
+	ntfy := r.posted("/")
+	require.Len(t, ntfy, 1)
+	assert.Equal(t, "releases", ntfy[0]["topic"])
+	assert.Equal(t, "Release A", ntfy[0]["title"])
+	assert.Equal(t, "https://example.com/a", ntfy[0]["click"])
+}
+
+func TestNotifier_Batching(t *testing.T) {
+	r, base := startReceiver(t)
+	n := notify.New(notify.Config{Webhooks: []notify.Webhook{{URL: base + "/hook", Format: notify.FormatJSON}}, BatchSize: 2}, nil)
+
+	result, err := n.Send(t.Context(), notices(2))
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Sent, "a small batch gets one each")
+
+	result, err = n.Send(t.Context(), notices(12))
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Sent, "a big one is summed up")
+	posted := r.posted("/hook")
+	require.Len(t, posted, 3)
+	assert.Equal(t, "12 new items", posted[2]["title"])
+	assert.EqualValues(t, 12, posted[2]["count"])
+	assert.Contains(t, posted[2]["text"], "Release A (Releases)")
+	assert.Contains(t, posted[2]["text"], "and 2 more")
+}
+
+func TestNotifier_RateLimit(t *testing.T) {
+	r, base := startReceiver(t)
+	cfg := notify.Config{
+		Webhooks:   []notify.Webhook{{URL: base + "/hook", Format: notify.FormatJSON}},
+		BatchSize:  5,
+		MaxPerHour: 3,
+		StatePath:  filepath.Join(t.TempDir(), "notified"),
+	}
+
+	result, err := notify.New(cfg, nil).Send(t.Context(), notices(2))
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Sent)
+
+	// A later run only has room for one more, so it sends a summary
+	result, err = notify.New(cfg, nil).Send(t.Context(), notices(2))
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Sent)
+	assert.Equal(t, 0, result.Dropped)
+
+	result, err = notify.New(cfg, nil).Send(t.Context(), notices(1))
+	require.NoError(t, err)
+	assert.Equal(t, 0, result.Sent)
+	assert.Equal(t, 1, result.Dropped)
+	assert.Len(t, r.posted("/hook"), 3)
+
+	// Anything older than an hour doesn't count
+	old, err := json.Marshal(map[string]any{"sent": []time.Time{time.Now().Add(-2 * time.Hour)}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(cfg.StatePath, old, 0o600))
+	result, err = notify.New(cfg, nil).Send(t.Context(), notices(1))
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Sent)
+}
+
+func TestNotifier_Command(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("command is written for sh")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	n := notify.New(notify.Config{
+		Command: `printf '%s|%s|%s|%s|%s\n' "$FEEDER_COUNT" "$FEEDER_FEED" "$FEEDER_TITLE" "$FEEDER_LINK" "$FEEDER_ITEM_ID" >> ` + out,
+	}, nil)
+	result, err := n.Send(t.Context(), notices(1))
+	require.NoError(t, err)
+	assert.Empty(t, result.Errors)
+	result, err = n.Send(t.Context(), notices(4))
+	require.NoError(t, err)
+	assert.Empty(t, result.Errors)
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, []string{
+		"1|Releases|Release A|https://example.com/a|1",
+		"4||4 new items||",
+	}, lines)
+
+	n.Command = "echo broken >&2; exit 3"
+	result, err = n.Send(t.Context(), notices(1))
+	require.NoError(t, err)
+	require.Len(t, result.Errors, 1)
+	assert.ErrorContains(t, result.Errors[0], "broken")
+
+	// Only the start of the output is kept for the error
+	n.Command = "yes broken | head -c 10000000; exit 3"
+	result, err = n.Send(t.Context(), notices(1))
+	require.NoError(t, err)
+	require.Len(t, result.Errors, 1)
+	assert.ErrorContains(t, result.Errors[0], "broken")
+	assert.Less(t, len(result.Errors[0].Error()), 5000)
+}
+
+// Long Discord messages are cut short on a character boundary
+func TestNotifier_DiscordLimit(t *testing.T) {
+	r, base := startReceiver(t)
+	hook, err := notify.ParseWebhook("discord=" + base + "/discord")
+	require.NoError(t, err)
+	n := notify.New(notify.Config{Webhooks: []notify.Webhook{hook}}, nil)
+	long := notices(1)
+	long[0].Item.Title = strings.Repeat("é", 2100)
+	result, err := n.Send(t.Context(), long)
+	require.NoError(t, err)
+	require.Empty(t, result.Errors)
+
+	posted := r.posted("/discord")
+	require.Len(t, posted, 1)
+	content, _ := posted[0]["content"].(string)
+	assert.True(t, utf8.ValidString(content))
+	assert.Equal(t, 2000, utf8.RuneCountInString(content))
+	assert.True(t, strings.HasSuffix(content, "é..."))
+}
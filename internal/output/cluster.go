@@ -0,0 +1,48 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package output
+
+import (
+	"github.com/mikerowehl/feeder/internal/rss"
+)
+
+// AlsoIn points at another feed that covered the same story.
+type AlsoIn struct {
+	FeedTitle string
+	Link      string
+}
+
+// CollapseClusters keeps only one item from each cluster of duplicates, the
+// first one in feed order, and drops the rest. The returned map is keyed by
+// the ID of each item that was kept and lists where else the story showed
+// up. Links in the map are already sanitized.
+func CollapseClusters(feeds []rss.Feed) ([]rss.Feed, map[uint][]AlsoIn) {
+	alsoIn := make(map[uint][]AlsoIn)
+	kept := make(map[uint]uint)
+	collapsed := make([]rss.Feed, 0, len(feeds))
+	for _, feed := range feeds {
+		items := make([]rss.Item, 0, len(feed.Items))
+		for _, item := range feed.Items {
+			if item.ClusterID == 0 {
+				items = append(items, item)
+				continue
+			}
+			first, seen := kept[item.ClusterID]
+			if !seen {
+				kept[item.ClusterID] = item.ID
+				items = append(items, item)
+				continue
+			}
+			alsoIn[first] = append(alsoIn[first], AlsoIn{
+				FeedTitle: feed.Title,
+				Link:      SafeURL(item.Link),
+			})
+		}
+		feed.Items = items
+		collapsed = append(collapsed, feed)
+	}
+	return collapsed, alsoIn
+}
@@ -0,0 +1,42 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package output_test
+
+import (
+	"testing"
+
+	"github.com/mikerowehl/feeder/internal/output"
+	"github.com/mikerowehl/feeder/internal/rss"
+	"gorm.io/gorm"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCluster_Collapse(t *testing.T) {
+	feeds := []rss.Feed{
+		{Title: "Feed A", Items: []rss.Item{
+			{Model: gorm.Model{ID: 1}, Title: "Story", Link: "https://a.com/story", ClusterID: 1},
+			{Model: gorm.Model{ID: 2}, Title: "Other", Link: "https://a.com/other"},
+		}},
+		{Title: "Feed B", Items: []rss.Item{
+			{Model: gorm.Model{ID: 5}, Title: "Story too", Link: "https://b.com/story", ClusterID: 1},
+		}},
+		{Title: "Feed C", Items: []rss.Item{
+			{Model: gorm.Model{ID: 7}, Title: "Story three", Link: "javascript:alert(1)", ClusterID: 1},
+		}},
+	}
+	collapsed, alsoIn := output.CollapseClusters(feeds)
+	require.Len(t, collapsed, 3)
+	assert.Len(t, collapsed[0].Items, 2)
+	assert.Empty(t, collapsed[1].Items)
+	assert.Empty(t, collapsed[2].Items)
+	assert.Equal(t, []output.AlsoIn{
+		{FeedTitle: "Feed B", Link: "https://b.com/story"},
+		{FeedTitle: "Feed C", Link: "#"},
+	}, alsoIn[1])
+	assert.Empty(t, alsoIn[2])
+}
@@ -0,0 +1,343 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package output
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"embed"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/rss"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+//go:embed templates/epub
+var epubFiles embed.FS
+
+var epubTemplates = template.Must(template.New("epub").Funcs(template.FuncMap{
+	"x":    html.EscapeString,
+	"join": strings.Join,
+}).ParseFS(epubFiles, "templates/epub/*.opf", "templates/epub/*.xhtml"))
+
+// EpubOptions controls how WriteEpub lays out the book.
+type EpubOptions struct {
+	Title string
+	Date  time.Time
+	// One chapter for each item instead of one for each feed
+	PerItem bool
+	// Used to fetch and shrink the images pulled into the book. The assets
+	// directory is ignored, images always go into the book itself.
+	Images OfflineOptions
+}
+
+// Image types every EPUB reader has to support. Anything else is left as a
+// link instead of being put in the book.
+var epubImageTypes = map[string]bool{
+	"image/gif":     true,
+	"image/jpeg":    true,
+	"image/png":     true,
+	"image/svg+xml": true,
+	"image/webp":    true,
+}
+
+type epubImage struct {
+	ID        string
+	Href      string
+	MediaType string
+}
+
+type epubItem struct {
+	Anchor     string
+	Title      string
+	Link       string
+	Author     string
+	Date       string
+	Categories []string
+	AlsoIn     []AlsoIn
+	Content    string
+	Enclosures []rss.Enclosure
+}
+
+type epubChapter struct {
+	ID     string
+	File   string
+	Title  string
+	Feed   string
+	Single bool
+	Items  []epubItem
+}
+
+type epubFeed struct {
+	Title    string
+	Chapters []epubChapter
+}
+
+type epubBook struct {
+	ID       string
+	Title    string
+	Date     string
+	Modified string
+	PerItem  bool
+	Feeds    []epubFeed
+	Chapters []epubChapter
+	Images   []epubImage
+}
+
+type epubWriter struct {
+	zip    *zip.Writer
+	date   time.Time
+	book   epubBook
+	images *offliner
+}
+
+func (e *epubWriter) writeFile(name string, data []byte) error {
+	w, err := e.zip.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: e.date,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (e *epubWriter) writeTemplate(name string, tmpl string, data any) error {
+	var b bytes.Buffer
+	if err := epubTemplates.ExecuteTemplate(&b, tmpl, data); err != nil {
+		return err
+	}
+	return e.writeFile(name, b.Bytes())
+}
+
+// Images are written into the book as soon as they're fetched, and listed so
+// they can go in the manifest at the end.
+func (e *epubWriter) storeImage(name string, mediaType string, data []byte) (string, error) {
+	if !epubImageTypes[mediaType] {
+		return "", fmt.Errorf("unsupported image type in epub: %s", mediaType)
+	}
+	href := "images/" + name
+	if err := e.writeFile("OEBPS/"+href, data); err != nil {
+		return "", err
+	}
+	e.book.Images = append(e.book.Images, epubImage{
+		ID:        "img-" + strings.ReplaceAll(name, ".", "-"),
+		Href:      href,
+		MediaType: mediaType,
+	})
+	return href, nil
+}
+
+// Clean up nodes that are fine in a web page but not in an EPUB document.
+func fixEpubNodes(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		if c.DataAtom == atom.Img {
+			// Feeds put all sorts of things in these, and readers size
+			// images to the page anyway
+			removeAttrs(c, "width", "height")
+			if nodeAttr(c, "alt") == "" {
+				setAttr(c, "alt", "")
+			}
+		}
+		fixEpubNodes(c)
+	}
+}
+
+// Turn an item's HTML into XHTML that can go in the book, pulling in any
+// images along the way.
+func (e *epubWriter) content(s string) (string, error) {
+	clean, err := SanitizeNodes(s)
+	if err != nil {
+		return "", err
+	}
+	e.images.walk(clean)
+	fixEpubNodes(clean)
+	var b bytes.Buffer
+	for c := clean.FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(&b, c); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+func (e *epubWriter) item(item rss.Item, alsoIn []AlsoIn) (epubItem, error) {
+	body := item.FullContent
+	if body == "" {
+		body = item.Content
+	}
+	content, err := e.content(body)
+	if err != nil {
+		return epubItem{}, err
+	}
+	title := item.Title
+	if title == "" {
+		title = "Untitled"
+	}
+	categories := make([]string, 0, len(item.Categories))
+	for _, category := range item.Categories {
+		categories = append(categories, category.Name)
+	}
+	return epubItem{
+		Anchor:     fmt.Sprintf("item-%d", item.ID),
+		Title:      title,
+		Link:       item.Link,
+		Author:     item.Author,
+		Date:       item.Published.Format("Jan 2, 2006"),
+		Categories: categories,
+		AlsoIn:     alsoIn,
+		Content:    content,
+		Enclosures: item.Enclosures,
+	}, nil
+}
+
+// Build up the chapters for all the feeds, writing each one into the book.
+func (e *epubWriter) chapters(feeds []rss.Feed, alsoIn map[uint][]AlsoIn) error {
+	for _, feed := range feeds {
+		if len(feed.Items) == 0 {
+			continue
+		}
+		title := feed.Title
+		if title == "" {
+			title = "Untitled feed"
+		}
+		bookFeed := epubFeed{Title: title}
+		var items []epubItem
+		for _, item := range feed.Items {
+			bookItem, err := e.item(item, alsoIn[item.ID])
+			if err != nil {
+				return err
+			}
+			items = append(items, bookItem)
+		}
+		if e.book.PerItem {
+			for _, item := range items {
+				bookFeed.Chapters = append(bookFeed.Chapters, epubChapter{
+					Title:  item.Title,
+					Feed:   title,
+					Single: true,
+					Items:  []epubItem{item},
+				})
+			}
+		} else {
+			bookFeed.Chapters = []epubChapter{{Title: title, Items: items}}
+		}
+		for i := range bookFeed.Chapters {
+			id := fmt.Sprintf("chapter-%d", len(e.book.Chapters)+1)
+			bookFeed.Chapters[i].ID = id
+			bookFeed.Chapters[i].File = id + ".xhtml"
+			e.book.Chapters = append(e.book.Chapters, bookFeed.Chapters[i])
+		}
+		e.book.Feeds = append(e.book.Feeds, bookFeed)
+	}
+	if len(e.book.Chapters) == 0 {
+		// A book has to have something in it
+		empty := epubChapter{ID: "chapter-1", File: "chapter-1.xhtml", Title: "Nothing to read"}
+		e.book.Chapters = []epubChapter{empty}
+		e.book.Feeds = []epubFeed{{Title: empty.Title, Chapters: e.book.Chapters}}
+	}
+	for _, chapter := range e.book.Chapters {
+		if err := e.writeTemplate("OEBPS/"+chapter.File, "chapter.xhtml", chapter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A stable identifier for the book, so the same items on the same day end
+// up with the same id.
+func epubID(book epubBook) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s", book.Title, book.Date)
+	for _, chapter := range book.Chapters {
+		for _, item := range chapter.Items {
+			fmt.Fprintf(h, "\x00%s", item.Anchor)
+		}
+	}
+	s := h.Sum(nil)
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", s[0:4], s[4:6], s[6:8], s[8:10], s[10:16])
+}
+
+// WriteEpub writes the feeds out as an EPUB 3 book, with either one chapter
+// for each feed or one for each item, a table of contents, and the images
+// from the items inside the book. The feeds should already have been through
+// SanitizeFeeds. alsoIn lists the other feeds that had each item, as
+// returned by CollapseClusters. Image downloads stop when the context is
+// done, and its error is returned.
+func WriteEpub(ctx context.Context, w io.Writer, feeds []rss.Feed, alsoIn map[uint][]AlsoIn, opts EpubOptions) error {
+	date := opts.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	date = date.UTC().Truncate(time.Second)
+	e := &epubWriter{
+		zip:  zip.NewWriter(w),
+		date: date,
+		book: epubBook{
+			Title:    opts.Title,
+			Date:     date.Format(time.DateOnly),
+			Modified: date.Format("2006-01-02T15:04:05Z"),
+			PerItem:  opts.PerItem,
+		},
+	}
+	if e.book.Title == "" {
+		e.book.Title = "Feeder " + e.book.Date
+	}
+	images := opts.Images
+	images.AssetsDir = ""
+	e.images = newOffliner(ctx, images)
+	e.images.store = e.storeImage
+
+	// The mimetype has to come first, uncompressed and without any extra
+	// fields, which a modified time would add
+	mimetype, err := e.zip.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(mimetype, "application/epub+zip"); err != nil {
+		return err
+	}
+	container, err := epubFiles.ReadFile("templates/epub/container.xml")
+	if err != nil {
+		return err
+	}
+	if err := e.writeFile("META-INF/container.xml", container); err != nil {
+		return err
+	}
+	style, err := epubFiles.ReadFile("templates/epub/style.css")
+	if err != nil {
+		return err
+	}
+	if err := e.writeFile("OEBPS/style.css", style); err != nil {
+		return err
+	}
+	if err := e.chapters(feeds, alsoIn); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	e.book.ID = epubID(e.book)
+	if err := e.writeTemplate("OEBPS/nav.xhtml", "nav.xhtml", e.book); err != nil {
+		return err
+	}
+	if err := e.writeTemplate("OEBPS/content.opf", "content.opf", e.book); err != nil {
+		return err
+	}
+	return e.zip.Close()
+}
@@ -0,0 +1,316 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package output_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/output"
+	"github.com/mikerowehl/feeder/internal/rss"
+	"gorm.io/gorm"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type epubPackage struct {
+	Version    string `xml:"version,attr"`
+	UniqueID   string `xml:"unique-identifier,attr"`
+	Identifier []struct {
+		ID    string `xml:"id,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"metadata>identifier"`
+	Titles    []string `xml:"metadata>title"`
+	Languages []string `xml:"metadata>language"`
+	Subjects  []string `xml:"metadata>subject"`
+	Date      string   `xml:"metadata>date"`
+	Meta      []struct {
+		Property string `xml:"property,attr"`
+		Value    string `xml:",chardata"`
+	} `xml:"metadata>meta"`
+	Manifest []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine []struct {
+		IDRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+// A parsed XHTML document: the ids it defines and the local resources it
+// refers to.
+type xhtmlDoc struct {
+	ids  map[string]bool
+	refs []string
+	text string
+}
+
+func parseXHTML(t *testing.T, name string, data []byte) xhtmlDoc {
+	t.Helper()
+	doc := xhtmlDoc{ids: make(map[string]bool)}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = true
+	var text strings.Builder
+	first := true
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err, "%s is not well formed", name)
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if first {
+				assert.Equal(t, "html", tok.Name.Local, name)
+				assert.Equal(t, "http://www.w3.org/1999/xhtml", tok.Name.Space, name)
+				first = false
+			}
+			for _, a := range tok.Attr {
+				switch {
+				case a.Name.Local == "id":
+					assert.False(t, doc.ids[a.Value], "duplicate id %s in %s", a.Value, name)
+					doc.ids[a.Value] = true
+				case a.Name.Local == "src", a.Name.Local == "href":
+					u, err := url.Parse(a.Value)
+					require.NoError(t, err)
+					if u.Scheme == "" && a.Value != "#" {
+						doc.refs = append(doc.refs, a.Value)
+					}
+				}
+			}
+			if tok.Name.Local == "img" {
+				assert.NotEmpty(t, attrValue(tok, "src"), "img without src in %s", name)
+			}
+		case xml.CharData:
+			text.Write(tok)
+		}
+	}
+	doc.text = text.String()
+	return doc
+}
+
+func attrValue(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Check the parts of the EPUB 3 structure that readers depend on, and
+// return the XHTML documents keyed by their path in the book.
+func validateEpub(t *testing.T, data []byte) (epubPackage, map[string]xhtmlDoc) {
+	t.Helper()
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	require.NotEmpty(t, r.File)
+
+	mimetype := r.File[0]
+	assert.Equal(t, "mimetype", mimetype.Name)
+	assert.Equal(t, zip.Store, mimetype.Method)
+	assert.Empty(t, mimetype.Extra)
+
+	files := make(map[string][]byte)
+	for _, file := range r.File {
+		rc, err := file.Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		files[file.Name] = content
+	}
+	assert.Equal(t, "application/epub+zip", string(files["mimetype"]))
+
+	var container epubContainer
+	require.NoError(t, xml.Unmarshal(files["META-INF/container.xml"], &container))
+	require.Len(t, container.Rootfiles, 1)
+	assert.Equal(t, "application/oebps-package+xml", container.Rootfiles[0].MediaType)
+	opfPath := container.Rootfiles[0].FullPath
+	require.Contains(t, files, opfPath)
+	base := path.Dir(opfPath)
+
+	var pkg epubPackage
+	require.NoError(t, xml.Unmarshal(files[opfPath], &pkg))
+	assert.Equal(t, "3.0", pkg.Version)
+	require.Len(t, pkg.Identifier, 1)
+	assert.Equal(t, pkg.UniqueID, pkg.Identifier[0].ID)
+	assert.NotEmpty(t, pkg.Identifier[0].Value)
+	require.Len(t, pkg.Titles, 1)
+	assert.NotEmpty(t, pkg.Titles[0])
+	assert.NotEmpty(t, pkg.Languages)
+	modified := ""
+	for _, meta := range pkg.Meta {
+		if meta.Property == "dcterms:modified" {
+			modified = meta.Value
+		}
+	}
+	_, err = time.Parse("2006-01-02T15:04:05Z", modified)
+	assert.NoError(t, err, "dcterms:modified must be a UTC timestamp")
+
+	manifest := make(map[string]string)
+	hrefs := make(map[string]bool)
+	navs := 0
+	for _, item := range pkg.Manifest {
+		assert.NotContains(t, manifest, item.ID, "duplicate manifest id")
+		manifest[item.ID] = item.Href
+		full := path.Join(base, item.Href)
+		hrefs[full] = true
+		assert.Contains(t, files, full, "manifest item missing from book")
+		if strings.Contains(item.Properties, "nav") {
+			navs++
+			assert.Equal(t, "application/xhtml+xml", item.MediaType)
+		}
+	}
+	assert.Equal(t, 1, navs, "exactly one nav document")
+	for name := range files {
+		if name != "mimetype" && name != opfPath && !strings.HasPrefix(name, "META-INF/") {
+			assert.True(t, hrefs[name], "%s is not in the manifest", name)
+		}
+	}
+	require.NotEmpty(t, pkg.Spine)
+	for _, ref := range pkg.Spine {
+		assert.Contains(t, manifest, ref.IDRef, "spine item missing from manifest")
+	}
+
+	docs := make(map[string]xhtmlDoc)
+	for _, item := range pkg.Manifest {
+		if item.MediaType == "application/xhtml+xml" {
+			full := path.Join(base, item.Href)
+			docs[full] = parseXHTML(t, full, files[full])
+		}
+	}
+	for name, doc := range docs {
+		for _, ref := range doc.refs {
+			target, fragment, _ := strings.Cut(ref, "#")
+			full := name
+			if target != "" {
+				full = path.Join(path.Dir(name), target)
+			}
+			assert.True(t, hrefs[full], "%s refers to %s which isn't in the manifest", name, ref)
+			if fragment != "" {
+				assert.True(t, docs[full].ids[fragment], "%s refers to missing id %s", name, ref)
+			}
+		}
+	}
+	return pkg, docs
+}
+
+func epubFeeds(base string) []rss.Feed {
+	published := time.Date(2025, 3, 4, 10, 0, 0, 0, time.UTC)
+	return output.SanitizeFeeds([]rss.Feed{
+		{Title: "Photo Blog", Items: []rss.Item{
+			{Model: gorm.Model{ID: 1}, Title: "Big Picture", Link: "https://example.com/1",
+				Author: "Jane", Published: published,
+				Content: `<p>Look at this&nbsp;<img src="` + base + `/wide.png" width="400" height="200"><br>` +
+					`<img src="` + base + `/spacer.png" alt="pixel"></p>`,
+				Categories: []rss.Category{{Name: "Photos"}}},
+			{Model: gorm.Model{ID: 2}, Title: "Same Picture Again", Link: "https://example.com/2",
+				Published: published,
+				Content:   `<p>Again <img src="` + base + `/wide.png" alt="again"> and <img src="` + base + `/missing.png" alt="gone"></p>`},
+		}},
+		{Title: "Empty Feed"},
+		{Title: "Podcast", Items: []rss.Item{
+			{Model: gorm.Model{ID: 3}, Title: "Episode <1> & more", Link: "https://example.com/3",
+				Published:   published,
+				Content:     `<p>Summary</p>`,
+				FullContent: `<table><tr><td>Full & complete</td></tr></table><p>Ends here<p>Unclosed`,
+				Enclosures:  []rss.Enclosure{{URL: "https://example.com/3.mp3", Type: "audio/mpeg", Duration: "10:00"}}},
+		}},
+	})
+}
+
+func TestEpub_PerFeed(t *testing.T) {
+	server := imageServer(t)
+	var b bytes.Buffer
+	alsoIn := map[uint][]output.AlsoIn{1: {{FeedTitle: "Other Blog", Link: "https://other.example.com/1"}}}
+	err := output.WriteEpub(t.Context(), &b, epubFeeds(server.URL), alsoIn, output.EpubOptions{
+		Title: "Daily",
+		Date:  time.Date(2025, 3, 5, 8, 30, 0, 0, time.UTC),
+		Images: output.OfflineOptions{
+			Client:        server.Client(),
+			MaxImageWidth: 100,
+		},
+	})
+	require.NoError(t, err)
+	pkg, docs := validateEpub(t, b.Bytes())
+
+	assert.Equal(t, "Daily", pkg.Titles[0])
+	assert.Equal(t, "2025-03-05", pkg.Date)
+	assert.Equal(t, []string{"Photo Blog", "Podcast"}, pkg.Subjects)
+	assert.Len(t, pkg.Spine, 2, "one chapter per feed with items")
+
+	images := 0
+	for _, item := range pkg.Manifest {
+		if strings.HasPrefix(item.MediaType, "image/") {
+			images++
+			assert.Equal(t, "image/png", item.MediaType)
+		}
+	}
+	assert.Equal(t, 1, images, "the same image is only stored once and the pixel is dropped")
+
+	nav := docs["OEBPS/nav.xhtml"]
+	assert.Contains(t, nav.text, "Big Picture")
+	assert.Contains(t, nav.text, "Episode <1> & more")
+	assert.Contains(t, nav.refs, "chapter-1.xhtml#item-2")
+
+	first := docs["OEBPS/chapter-1.xhtml"]
+	assert.True(t, first.ids["item-1"])
+	assert.Contains(t, first.text, "Jane")
+	assert.Contains(t, first.text, "Photos")
+	assert.Contains(t, first.text, "Other Blog")
+	assert.Contains(t, first.text, "[gone]")
+	assert.NotContains(t, first.text, "pixel")
+
+	second := docs["OEBPS/chapter-2.xhtml"]
+	assert.Contains(t, second.text, "Full & complete", "full content is used when there is some")
+	assert.NotContains(t, second.text, "Summary")
+	assert.Contains(t, second.text, "audio attachment (10:00)")
+}
+
+func TestEpub_PerItem(t *testing.T) {
+	server := imageServer(t)
+	var b bytes.Buffer
+	err := output.WriteEpub(t.Context(), &b, epubFeeds(server.URL), nil, output.EpubOptions{
+		PerItem: true,
+		Images:  output.OfflineOptions{Client: server.Client()},
+	})
+	require.NoError(t, err)
+	pkg, docs := validateEpub(t, b.Bytes())
+
+	assert.True(t, strings.HasPrefix(pkg.Titles[0], "Feeder "))
+	assert.Len(t, pkg.Spine, 3, "one chapter per item")
+	nav := docs["OEBPS/nav.xhtml"]
+	assert.Contains(t, nav.text, "Photo Blog")
+	assert.Contains(t, nav.refs, "chapter-3.xhtml")
+	assert.Contains(t, docs["OEBPS/chapter-3.xhtml"].text, "Podcast")
+}
+
+func TestEpub_Empty(t *testing.T) {
+	var b bytes.Buffer
+	err := output.WriteEpub(t.Context(), &b, nil, nil, output.EpubOptions{Title: "Nothing"})
+	require.NoError(t, err)
+	pkg, docs := validateEpub(t, b.Bytes())
+	assert.Len(t, pkg.Spine, 1)
+	assert.Contains(t, docs["OEBPS/chapter-1.xhtml"].text, "Nothing to read")
+}
@@ -0,0 +1,182 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package output
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Elements allowed through SanitizeHTML, and the attributes each can keep.
+// Anything else is dropped but its children are kept, except for the
+// elements in dropContent which go away entirely.
+var allowedTags = map[atom.Atom][]string{
+	atom.A:          {"href", "title"},
+	atom.Abbr:       {"title"},
+	atom.B:          nil,
+	atom.Blockquote: nil,
+	atom.Br:         nil,
+	atom.Caption:    nil,
+	atom.Code:       nil,
+	atom.Dd:         nil,
+	atom.Del:        nil,
+	atom.Div:        nil,
+	atom.Dl:         nil,
+	atom.Dt:         nil,
+	atom.Em:         nil,
+	atom.Figcaption: nil,
+	atom.Figure:     nil,
+	atom.H1:         nil,
+	atom.H2:         nil,
+	atom.H3:         nil,
+	atom.H4:         nil,
+	atom.H5:         nil,
+	atom.H6:         nil,
+	atom.Hr:         nil,
+	atom.I:          nil,
+	atom.Img:        {"src", "alt", "title", "width", "height"},
+	atom.Ins:        nil,
+	atom.Li:         nil,
+	atom.Ol:         nil,
+	atom.P:          nil,
+	atom.Pre:        nil,
+	atom.S:          nil,
+	atom.Small:      nil,
+	atom.Span:       nil,
+	atom.Strong:     nil,
+	atom.Sub:        nil,
+	atom.Sup:        nil,
+	atom.Table:      nil,
+	atom.Tbody:      nil,
+	atom.Td:         {"colspan", "rowspan"},
+	atom.Tfoot:      nil,
+	atom.Th:         {"colspan", "rowspan"},
+	atom.Thead:      nil,
+	atom.Tr:         nil,
+	atom.U:          nil,
+	atom.Ul:         nil,
+}
+
+var dropContent = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Noscript: true,
+	atom.Iframe:   true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Template: true,
+	atom.Svg:      true,
+	atom.Math:     true,
+	atom.Head:     true,
+	atom.Title:    true,
+	atom.Form:     true,
+	atom.Button:   true,
+	atom.Select:   true,
+	atom.Textarea: true,
+}
+
+// Copy over only the allowed attributes, making sure any URLs are plain http
+// or https links.
+func sanitizeAttrs(n *html.Node) []html.Attribute {
+	allowed := allowedTags[n.DataAtom]
+	var attrs []html.Attribute
+	for _, a := range n.Attr {
+		if a.Namespace != "" {
+			continue
+		}
+		key := strings.ToLower(a.Key)
+		keep := false
+		for _, name := range allowed {
+			if key == name {
+				keep = true
+				break
+			}
+		}
+		if !keep {
+			continue
+		}
+		if key == "href" || key == "src" {
+			a.Val = SafeURL(strings.TrimSpace(a.Val))
+			if a.Val == "#" && key == "src" {
+				continue
+			}
+		}
+		attrs = append(attrs, html.Attribute{Key: key, Val: a.Val})
+	}
+	if n.DataAtom == atom.A {
+		attrs = append(attrs,
+			html.Attribute{Key: "target", Val: "_blank"},
+			html.Attribute{Key: "rel", Val: "noopener noreferrer"})
+	}
+	return attrs
+}
+
+// Build a clean copy of the children of src under dst.
+func sanitizeChildren(dst *html.Node, src *html.Node) {
+	for c := src.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.TextNode:
+			dst.AppendChild(&html.Node{Type: html.TextNode, Data: c.Data})
+		case html.ElementNode:
+			if dropContent[c.DataAtom] {
+				continue
+			}
+			if _, ok := allowedTags[c.DataAtom]; !ok {
+				sanitizeChildren(dst, c)
+				continue
+			}
+			if c.DataAtom == atom.Img && len(sanitizeAttrs(c)) == 0 {
+				continue
+			}
+			clean := &html.Node{
+				Type:     html.ElementNode,
+				Data:     c.DataAtom.String(),
+				DataAtom: c.DataAtom,
+				Attr:     sanitizeAttrs(c),
+			}
+			sanitizeChildren(clean, c)
+			dst.AppendChild(clean)
+		}
+	}
+}
+
+// SanitizeNodes parses an HTML fragment and returns a cleaned up copy of it
+// as nodes under a single container node. Only a known safe set of elements
+// and attributes is kept, and links are limited to http and https.
+func SanitizeNodes(s string) (*html.Node, error) {
+	container := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(s), container)
+	if err != nil {
+		return nil, err
+	}
+	src := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	for _, n := range nodes {
+		src.AppendChild(n)
+	}
+	clean := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	sanitizeChildren(clean, src)
+	return clean, nil
+}
+
+// SanitizeHTML cleans up an HTML fragment from a feed or a web page so it's
+// safe to include directly in our own pages. If the content can't be parsed
+// at all an empty string is returned.
+func SanitizeHTML(s string) string {
+	clean, err := SanitizeNodes(s)
+	if err != nil {
+		return ""
+	}
+	var b bytes.Buffer
+	for c := clean.FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(&b, c); err != nil {
+			return ""
+		}
+	}
+	return b.String()
+}
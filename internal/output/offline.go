@@ -0,0 +1,475 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package output
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// OfflineOptions controls how MakeOffline pulls remote resources into the
+// page.
+type OfflineOptions struct {
+	Client *http.Client
+	// If set, images are written into this directory and referenced using
+	// AssetsRef as the path prefix. Otherwise they're inlined as data URIs.
+	AssetsDir string
+	AssetsRef string
+	// Images bigger than this after resizing are left out. Zero for no limit.
+	MaxImageBytes int64
+	// Images wider than this are scaled down. Zero to leave them alone.
+	MaxImageWidth int
+}
+
+// Hosts that only serve tracking pixels and analytics beacons.
+var trackerHosts = []string{
+	"feeds.feedburner.com",
+	"feedproxy.google.com",
+	"pixel.wp.com",
+	"stats.wordpress.com",
+	"www.google-analytics.com",
+	"google-analytics.com",
+	"doubleclick.net",
+	"pixel.quantserve.com",
+	"feeds.feedblitz.com",
+	"list-manage.com",
+	"ct.sendgrid.net",
+	"pixel.substack.com",
+	"analytics.twitter.com",
+	"sb.scorecardresearch.com",
+	"pi.pardot.com",
+	"mailtrack.io",
+}
+
+var errTooLarge = errors.New("image too large")
+
+// Images with more pixels than this aren't decoded, since the decoded image
+// and its scaled copy take four bytes a pixel each however small the file.
+const maxImagePixels = 40_000_000
+
+// Decide whether an img is just there to track that the page was viewed.
+func isTrackingPixel(n *html.Node, src *url.URL) bool {
+	width, _ := strconv.Atoi(strings.TrimSuffix(nodeAttr(n, "width"), "px"))
+	height, _ := strconv.Atoi(strings.TrimSuffix(nodeAttr(n, "height"), "px"))
+	if nodeAttr(n, "width") != "" && nodeAttr(n, "height") != "" && width <= 1 && height <= 1 {
+		return true
+	}
+	host := strings.ToLower(src.Hostname())
+	for _, tracker := range trackerHosts {
+		if host == tracker || strings.HasSuffix(host, "."+tracker) {
+			return true
+		}
+	}
+	// Whole path segments only, so /pixel-art.png and the like are kept
+	segments := strings.Split(strings.ToLower(src.Path), "/")
+	for i, segment := range segments {
+		if trackerSegments[segment] || segment == "track" && i+1 < len(segments) && segments[i+1] == "open" {
+			return true
+		}
+	}
+	return false
+}
+
+// Path segments that mark an image as a tracking pixel wherever it's hosted.
+var trackerSegments = map[string]bool{
+	"pixel":     true,
+	"pixel.gif": true,
+	"pixel.png": true,
+	"1x1.gif":   true,
+	"blank.gif": true,
+}
+
+func nodeAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func setAttr(n *html.Node, key string, val string) {
+	for i := range n.Attr {
+		if n.Attr[i].Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
+
+func removeAttrs(n *html.Node, keys ...string) {
+	attrs := n.Attr[:0]
+	for _, a := range n.Attr {
+		remove := false
+		for _, key := range keys {
+			if a.Key == key {
+				remove = true
+			}
+		}
+		if !remove {
+			attrs = append(attrs, a)
+		}
+	}
+	n.Attr = attrs
+}
+
+type offliner struct {
+	ctx   context.Context
+	opts  OfflineOptions
+	cache map[string]string
+	// Keeps the image data somewhere and returns the reference to use for it
+	store func(name string, mediaType string, data []byte) (string, error)
+}
+
+func newOffliner(ctx context.Context, opts OfflineOptions) *offliner {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	o := &offliner{ctx: ctx, opts: opts, cache: make(map[string]string)}
+	if opts.AssetsDir != "" {
+		o.store = func(name string, mediaType string, data []byte) (string, error) {
+			if err := os.WriteFile(filepath.Join(opts.AssetsDir, name), data, 0o644); err != nil {
+				return "", err
+			}
+			return path.Join(opts.AssetsRef, name), nil
+		}
+	} else {
+		o.store = func(name string, mediaType string, data []byte) (string, error) {
+			return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+		}
+	}
+	return o
+}
+
+func (o *offliner) fetch(src string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(o.ctx, "GET", src, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := o.opts.Client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			log.Printf("failed to close image body: %v", closeErr)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected http status: %v", resp.Status)
+	}
+	// Originals can be bigger than the cap when we're resizing, since they
+	// might shrink enough, but there's still a hard limit
+	limit := int64(50 << 20)
+	if o.opts.MaxImageBytes > 0 && o.opts.MaxImageWidth == 0 {
+		limit = o.opts.MaxImageBytes
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > limit {
+		return nil, "", errTooLarge
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// Scale an image down to the given width using a simple box filter, which
+// is plenty good enough for photos in a digest.
+func scaleDown(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	rgba := image.NewRGBA(bounds)
+	draw.Draw(rgba, bounds, src, bounds.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(bounds.Min.Y+(y+1)*bounds.Dy()/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(bounds.Min.X+(x+1)*bounds.Dx()/width, x0+1)
+			var r, g, b, a, count uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					offset := rgba.PixOffset(sx, sy)
+					r += uint32(rgba.Pix[offset])
+					g += uint32(rgba.Pix[offset+1])
+					b += uint32(rgba.Pix[offset+2])
+					a += uint32(rgba.Pix[offset+3])
+					count++
+				}
+			}
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8(r / count)
+			dst.Pix[offset+1] = uint8(g / count)
+			dst.Pix[offset+2] = uint8(b / count)
+			dst.Pix[offset+3] = uint8(a / count)
+		}
+	}
+	return dst
+}
+
+// Shrink an image if it's wider than the max. Formats we can't decode are
+// passed through untouched. Returns the data and its media type, and
+// errTooLarge for an image with too many pixels to decode.
+func (o *offliner) resize(data []byte, mediaType string) ([]byte, string, bool, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return data, mediaType, false, nil
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return nil, "", false, errTooLarge
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data, mediaType, false, nil
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() <= 1 && bounds.Dy() <= 1 {
+		// A 1x1 image is a tracking pixel no matter where it came from
+		return nil, "", true, nil
+	}
+	if o.opts.MaxImageWidth <= 0 || bounds.Dx() <= o.opts.MaxImageWidth {
+		return data, "image/" + format, false, nil
+	}
+	scaled := scaleDown(img, o.opts.MaxImageWidth)
+	var b bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&b, scaled, &jpeg.Options{Quality: 80})
+	} else {
+		format = "png"
+		err = png.Encode(&b, scaled)
+	}
+	if err != nil {
+		return data, mediaType, false, nil
+	}
+	return b.Bytes(), "image/" + format, false, nil
+}
+
+var extensions = map[string]string{
+	"image/jpeg":    ".jpg",
+	"image/png":     ".png",
+	"image/gif":     ".gif",
+	"image/webp":    ".webp",
+	"image/svg+xml": ".svg",
+	"image/avif":    ".avif",
+}
+
+// Get the local reference for a remote image, downloading it the first time.
+// An empty string means the image should be dropped.
+func (o *offliner) localImage(src string) (string, error) {
+	if local, ok := o.cache[src]; ok {
+		return local, nil
+	}
+	data, mediaType, err := o.fetch(src)
+	if err != nil {
+		return "", err
+	}
+	data, mediaType, pixel, err := o.resize(data, mediaType)
+	if err != nil {
+		return "", err
+	}
+	if pixel {
+		o.cache[src] = ""
+		return "", nil
+	}
+	if o.opts.MaxImageBytes > 0 && int64(len(data)) > o.opts.MaxImageBytes {
+		return "", errTooLarge
+	}
+	mediaType, _, _ = strings.Cut(mediaType, ";")
+	if !strings.HasPrefix(mediaType, "image/") {
+		return "", fmt.Errorf("not an image: %s", mediaType)
+	}
+
+	sum := sha256.Sum256([]byte(src))
+	local, err := o.store(hex.EncodeToString(sum[:8])+extensions[mediaType], mediaType, data)
+	if err != nil {
+		return "", err
+	}
+	o.cache[src] = local
+	return local, nil
+}
+
+func newLink(href string) *html.Node {
+	return &html.Node{Type: html.ElementNode, Data: "a", DataAtom: atom.A, Attr: []html.Attribute{
+		{Key: "href", Val: href},
+		{Key: "target", Val: "_blank"},
+		{Key: "rel", Val: "noopener noreferrer"},
+	}}
+}
+
+// Replace an image we couldn't bring along with a plain link to it, so
+// nothing gets loaded unless someone clicks.
+func replaceWithLink(n *html.Node, src string) {
+	alt := nodeAttr(n, "alt")
+	if alt == "" {
+		alt = "image"
+	}
+	link := newLink(src)
+	link.AppendChild(&html.Node{Type: html.TextNode, Data: "[" + alt + "]"})
+	n.Parent.InsertBefore(link, n)
+	n.Parent.RemoveChild(n)
+}
+
+// The first remote URL a video or audio element plays, from its own src or
+// one of its sources.
+func remoteMedia(n *html.Node) string {
+	if src, err := url.Parse(nodeAttr(n, "src")); err == nil && isRemote(src) {
+		return src.String()
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.DataAtom != atom.Source {
+			continue
+		}
+		if src, err := url.Parse(nodeAttr(c, "src")); err == nil && isRemote(src) {
+			return src.String()
+		}
+	}
+	return ""
+}
+
+// Video and audio are too big to bring along, so players for remote media
+// become links to it, showing the poster if there is one.
+func (o *offliner) media(n *html.Node) {
+	var poster string
+	if u, err := url.Parse(nodeAttr(n, "poster")); err == nil && isRemote(u) {
+		if local, err := o.localImage(u.String()); err == nil {
+			poster = local
+		}
+		removeAttrs(n, "poster")
+	}
+	src := remoteMedia(n)
+	if src == "" {
+		if poster != "" {
+			setAttr(n, "poster", poster)
+		}
+		o.walk(n)
+		return
+	}
+	link := newLink(src)
+	if poster != "" {
+		link.AppendChild(&html.Node{Type: html.ElementNode, Data: "img", DataAtom: atom.Img, Attr: []html.Attribute{
+			{Key: "src", Val: poster},
+			{Key: "alt", Val: n.Data},
+		}})
+	} else {
+		link.AppendChild(&html.Node{Type: html.TextNode, Data: "[" + n.Data + "]"})
+	}
+	n.Parent.InsertBefore(link, n)
+	n.Parent.RemoveChild(n)
+}
+
+func isRemote(u *url.URL) bool {
+	return u.Scheme == "http" || u.Scheme == "https"
+}
+
+func (o *offliner) walk(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode {
+			o.element(c)
+		}
+		c = next
+	}
+}
+
+func (o *offliner) element(n *html.Node) {
+	switch n.DataAtom {
+	case atom.Script:
+		if nodeAttr(n, "src") != "" {
+			n.Parent.RemoveChild(n)
+			return
+		}
+	case atom.Link:
+		href, err := url.Parse(nodeAttr(n, "href"))
+		if err == nil && isRemote(href) {
+			n.Parent.RemoveChild(n)
+			return
+		}
+	case atom.Img:
+		removeAttrs(n, "srcset", "sizes")
+		src, err := url.Parse(nodeAttr(n, "src"))
+		if err != nil || !isRemote(src) {
+			break
+		}
+		if isTrackingPixel(n, src) {
+			n.Parent.RemoveChild(n)
+			return
+		}
+		local, err := o.localImage(src.String())
+		switch {
+		case err != nil:
+			replaceWithLink(n, src.String())
+			return
+		case local == "":
+			n.Parent.RemoveChild(n)
+			return
+		}
+		setAttr(n, "src", local)
+		removeAttrs(n, "loading")
+	case atom.Source:
+		// The img in a picture is the fallback, and gets brought along
+		// like any other
+		if n.Parent.DataAtom == atom.Picture {
+			n.Parent.RemoveChild(n)
+			return
+		}
+	case atom.Video, atom.Audio:
+		o.media(n)
+		return
+	}
+	o.walk(n)
+}
+
+// MakeOffline reads a complete HTML page and writes it back out with remote
+// images pulled in (either inline or into the assets directory), tracking
+// pixels removed, remote stylesheets and scripts dropped, and remote video
+// and audio turned into links. Links are left
+// alone, since those only load anything when clicked. If the context is
+// done part way through, the images not yet downloaded are left as links
+// and the context's error is returned.
+func MakeOffline(ctx context.Context, r io.Reader, w io.Writer, opts OfflineOptions) error {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return err
+	}
+	if opts.AssetsDir != "" {
+		if err := os.MkdirAll(opts.AssetsDir, 0o755); err != nil {
+			return err
+		}
+	}
+	newOffliner(ctx, opts).walk(doc)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return html.Render(w, doc)
+}
@@ -0,0 +1,234 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package output_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mikerowehl/feeder/internal/output"
+	"github.com/mikerowehl/feeder/test/mock"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pngImage(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var b bytes.Buffer
+	require.NoError(t, png.Encode(&b, img))
+	return b.Bytes()
+}
+
+func imageServer(t *testing.T) *httptest.Server {
+	wide := pngImage(t, 400, 200)
+	pixel := pngImage(t, 1, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wide.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(wide)
+	})
+	mux.HandleFunc("/spacer.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(pixel)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func offlinePage(base string) string {
+	return `<html><head>
+<link rel="stylesheet" href="https://cdn.example.com/site.css">
+<script src="https://cdn.example.com/tracker.js"></script>
+</head><body>
+<img src="` + base + `/wide.png" srcset="` + base + `/wide.png 2x" alt="wide">
+<img src="` + base + `/spacer.png" alt="spacer">
+<img src="` + base + `/open.gif" width="1" height="1">
+<img src="https://stats.wordpress.com/b.gif?v=1" alt="stats">
+<img src="` + base + `/missing.png" alt="gone">
+</body></html>`
+}
+
+func decodeDataURI(t *testing.T, uri string) image.Image {
+	prefix := "data:image/png;base64,"
+	require.True(t, strings.HasPrefix(uri, prefix), uri)
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(uri, prefix))
+	require.NoError(t, err)
+	img, _, err := image.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	return img
+}
+
+func TestOffline_Inline(t *testing.T) {
+	server := imageServer(t)
+	var out bytes.Buffer
+	err := output.MakeOffline(t.Context(), strings.NewReader(offlinePage(server.URL)), &out, output.OfflineOptions{
+		Client:        server.Client(),
+		MaxImageWidth: 100,
+	})
+	require.NoError(t, err)
+	page := out.String()
+
+	assert.NotContains(t, page, "cdn.example.com")
+	assert.NotContains(t, page, "srcset")
+	assert.NotContains(t, page, "spacer")
+	assert.NotContains(t, page, "open.gif")
+	assert.NotContains(t, page, "stats.wordpress.com")
+	assert.Contains(t, page, `<a href="`+server.URL+`/missing.png" target="_blank" rel="noopener noreferrer">[gone]</a>`)
+
+	start := strings.Index(page, `src="data:`)
+	require.NotEqual(t, -1, start)
+	uri := page[start+len(`src="`):]
+	uri = uri[:strings.Index(uri, `"`)]
+	img := decodeDataURI(t, uri)
+	assert.Equal(t, 100, img.Bounds().Dx())
+	assert.Equal(t, 50, img.Bounds().Dy())
+}
+
+func TestOffline_SizeLimit(t *testing.T) {
+	server := imageServer(t)
+	var out bytes.Buffer
+	err := output.MakeOffline(t.Context(), strings.NewReader(offlinePage(server.URL)), &out, output.OfflineOptions{
+		Client:        server.Client(),
+		MaxImageBytes: 100,
+	})
+	require.NoError(t, err)
+	assert.NotContains(t, out.String(), "data:")
+	assert.Contains(t, out.String(), "[wide]")
+}
+
+func TestOffline_AssetsDir(t *testing.T) {
+	server := imageServer(t)
+	dir := filepath.Join(t.TempDir(), "digest_assets")
+	var out bytes.Buffer
+	err := output.MakeOffline(t.Context(), strings.NewReader(offlinePage(server.URL)), &out, output.OfflineOptions{
+		Client:    server.Client(),
+		AssetsDir: dir,
+		AssetsRef: "digest_assets",
+	})
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	name := entries[0].Name()
+	assert.True(t, strings.HasSuffix(name, ".png"))
+	assert.Contains(t, out.String(), `src="digest_assets/`+name+`"`)
+	assert.NotContains(t, out.String(), server.URL+"/wide.png")
+}
+
+// Tracking pixels are only spotted by whole path segments, so images that
+// just have pixel in the name are kept. Pictures, video and audio don't
+// load anything remote either.
+func TestOffline_Media(t *testing.T) {
+	photo := pngImage(t, 40, 20)
+	var mu sync.Mutex
+	var requested []string
+	client := &http.Client{Transport: mock.MockRoundTripper(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		requested = append(requested, req.URL.String())
+		mu.Unlock()
+		header := make(http.Header)
+		header.Set("Content-Type", "image/png")
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(bytes.NewReader(photo))}, nil
+	})}
+	page := `<html><body>
+<img src="https://example.com/pixel-art.png" alt="art">
+<img src="https://example.com/pixels/photo.png" alt="photo">
+<img src="https://www.facebook.com/images/logo.png" alt="logo">
+<img src="https://example.com/pixel/abc123" alt="tracker">
+<img src="https://example.com/track/open/123" alt="opened">
+<picture><source srcset="https://example.com/big.webp 2x" type="image/webp"><img src="https://example.com/small.png" alt="picture"></picture>
+<video controls src="https://example.com/clip.mp4" poster="https://example.com/poster.png"></video>
+<audio controls><source src="https://example.com/episode.mp3" type="audio/mpeg"></audio>
+</body></html>`
+
+	var out bytes.Buffer
+	require.NoError(t, output.MakeOffline(t.Context(), strings.NewReader(page), &out, output.OfflineOptions{Client: client}))
+	result := out.String()
+
+	assert.ElementsMatch(t, []string{
+		"https://example.com/pixel-art.png",
+		"https://example.com/pixels/photo.png",
+		"https://www.facebook.com/images/logo.png",
+		"https://example.com/small.png",
+		"https://example.com/poster.png",
+	}, requested)
+	assert.Equal(t, 5, strings.Count(result, `src="data:image/png`))
+	assert.NotContains(t, result, "abc123")
+	assert.NotContains(t, result, "track/open")
+	assert.NotContains(t, result, "<source")
+	assert.NotContains(t, result, "<video")
+	assert.NotContains(t, result, "<audio")
+	assert.Contains(t, result, `<a href="https://example.com/clip.mp4" target="_blank" rel="noopener noreferrer"><img src="data:image/png`)
+	assert.Contains(t, result, `<a href="https://example.com/episode.mp3" target="_blank" rel="noopener noreferrer">[audio]</a>`)
+}
+
+// A PNG claiming to be far bigger than it is. Decoding it would need
+// gigabytes, so it's turned away after reading the header.
+func hugePNG(t *testing.T) []byte {
+	data := pngImage(t, 2, 2)
+	// The IHDR chunk follows the 8 byte signature: length, type, then the
+	// width and height, with a CRC over the type and data
+	ihdr := data[8+8 : 8+8+13]
+	binary.BigEndian.PutUint32(ihdr[0:4], 100000)
+	binary.BigEndian.PutUint32(ihdr[4:8], 100000)
+	binary.BigEndian.PutUint32(data[8+8+13:], crc32.ChecksumIEEE(data[8+4:8+8+13]))
+	return data
+}
+
+func TestOffline_PixelLimit(t *testing.T) {
+	huge := hugePNG(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(huge)
+	}))
+	t.Cleanup(server.Close)
+	var out bytes.Buffer
+	err := output.MakeOffline(t.Context(), strings.NewReader(`<img src="`+server.URL+`/bomb.png" alt="bomb">`), &out, output.OfflineOptions{
+		Client:        server.Client(),
+		MaxImageWidth: 100,
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "[bomb]")
+	assert.NotContains(t, out.String(), "data:")
+}
+
+func TestOffline_Cancelled(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	t.Cleanup(server.Close)
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	var out bytes.Buffer
+	err := output.MakeOffline(ctx, strings.NewReader(offlinePage(server.URL)), &out, output.OfflineOptions{
+		Client: server.Client(),
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Zero(t, requests)
+}
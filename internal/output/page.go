@@ -0,0 +1,37 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package output
+
+import (
+	_ "embed"
+	"html/template"
+	"io"
+
+	"github.com/mikerowehl/feeder/internal/rss"
+)
+
+//go:embed templates/feed.html
+var feedTemplate string
+
+// WritePage renders the feeds into the HTML page of items. Duplicate stories
+// are collapsed and everything is sanitized on the way out, so the feeds can
+// come straight from the database.
+func WritePage(w io.Writer, feeds []rss.Feed) error {
+	feeds, alsoIn := CollapseClusters(feeds)
+	tmpl, err := template.New("feed").Funcs(template.FuncMap{
+		"alsoIn": func(item rss.Item) []AlsoIn {
+			return alsoIn[item.ID]
+		},
+		// Only for content that's already been through SanitizeHTML
+		"sanitized": func(s string) template.HTML {
+			return template.HTML(s)
+		},
+	}).Parse(feedTemplate)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, SanitizeFeeds(feeds))
+}
@@ -9,6 +9,7 @@ import (
 	"net/url"
 
 	"github.com/mikerowehl/feeder/internal/rss"
+	"gorm.io/gorm"
 )
 
 // Ensure a url is actually just a parsable http or https url, don't allow
@@ -22,12 +23,65 @@ func SafeURL(s string) string {
 	return u.String()
 }
 
+// Same as SafeURL, but an empty string stays empty so templates can still
+// check whether there was a value at all.
+func OptionalURL(s string) string {
+	if s == "" {
+		return ""
+	}
+	return SafeURL(s)
+}
+
+func SanitizeEnclosures(raw []rss.Enclosure) []rss.Enclosure {
+	var sanitizedEnclosures []rss.Enclosure
+	for _, rawEnclosure := range raw {
+		sanitizedEnclosure := rss.Enclosure{
+			URL:      SafeURL(rawEnclosure.URL),
+			Type:     rawEnclosure.Type,
+			Length:   rawEnclosure.Length,
+			Duration: rawEnclosure.Duration,
+			Image:    OptionalURL(rawEnclosure.Image),
+		}
+		sanitizedEnclosures = append(sanitizedEnclosures, sanitizedEnclosure)
+	}
+	return sanitizedEnclosures
+}
+
+func SanitizeCategories(raw []rss.Category) []rss.Category {
+	var sanitizedCategories []rss.Category
+	for _, rawCategory := range raw {
+		sanitizedCategories = append(sanitizedCategories, rss.Category{Name: rawCategory.Name})
+	}
+	return sanitizedCategories
+}
+
+func SanitizeTags(raw []rss.Tag) []rss.Tag {
+	var sanitizedTags []rss.Tag
+	for _, rawTag := range raw {
+		sanitizedTags = append(sanitizedTags, rss.Tag{Name: rawTag.Name})
+	}
+	return sanitizedTags
+}
+
 func SanitizeItems(raw []rss.Item) []rss.Item {
 	var sanitizedItems []rss.Item
 	for _, rawItem := range raw {
 		sanitizedItem := rss.Item{
-			Title: rawItem.Title,
-			Link:  SafeURL(rawItem.Link),
+			Model:       gorm.Model{ID: rawItem.ID},
+			Title:       rawItem.Title,
+			Link:        SafeURL(rawItem.Link),
+			Content:     SanitizeHTML(rawItem.Content),
+			FullContent: SanitizeHTML(rawItem.FullContent),
+			Author:      rawItem.Author,
+			Image:       OptionalURL(rawItem.Image),
+			Published:   rawItem.Published,
+			Updated:     rawItem.Updated,
+			Revised:     rawItem.Revised,
+			ClusterID:   rawItem.ClusterID,
+			Starred:     rawItem.Starred,
+			Enclosures:  SanitizeEnclosures(rawItem.Enclosures),
+			Categories:  SanitizeCategories(rawItem.Categories),
+			Tags:        SanitizeTags(rawItem.Tags),
 		}
 		sanitizedItems = append(sanitizedItems, sanitizedItem)
 	}
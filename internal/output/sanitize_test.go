@@ -17,3 +17,23 @@ func TestSanitize_SafeURL(t *testing.T) {
 	assert.Equal(t, "http://rowehl.com", output.SafeURL("http://rowehl.com"))
 	assert.Equal(t, "#", output.SafeURL(`"><script>alert('XSS')</script>`))
 }
+
+func TestSanitize_SanitizeHTML(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`<p>Hello <b>there</b></p>`, `<p>Hello <b>there</b></p>`},
+		{`<p onclick="evil()">Text</p>`, `<p>Text</p>`},
+		{`<script>alert(1)</script><p>ok</p>`, `<p>ok</p>`},
+		{`<a href="javascript:alert(1)">x</a>`, `<a href="#" target="_blank" rel="noopener noreferrer">x</a>`},
+		{`<a href="https://example.com/">x</a>`, `<a href="https://example.com/" target="_blank" rel="noopener noreferrer">x</a>`},
+		{`<img src="data:image/png;base64,AAAA" onerror="x()">`, ``},
+		{`<img src="https://example.com/i.png" style="width:1px">`, `<img src="https://example.com/i.png"/>`},
+		{`<custom-tag><em>kept</em></custom-tag>`, `<em>kept</em>`},
+		{`<iframe src="https://example.com"></iframe>after`, `after`},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, output.SanitizeHTML(tt.in), tt.in)
+	}
+}
@@ -0,0 +1,247 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package output
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Narrowest we'll wrap text to, even in a tiny terminal.
+const minTextWidth = 20
+
+type textWriter struct {
+	out    strings.Builder
+	inline strings.Builder
+	width  int
+	// Written in front of every line, for quotes and nested lists
+	indent string
+	// Written in front of the next line only, for list bullets
+	bullet string
+	// How deep in lists we are, and how wide the current item's bullet is
+	lists     int
+	itemWidth int
+	links     []string
+}
+
+// Break words up into lines no wider than width. Words longer than a line
+// get a line to themselves.
+func wrapWords(words []string, width int) []string {
+	var lines []string
+	var line strings.Builder
+	for _, word := range words {
+		if line.Len() > 0 && utf8.RuneCountInString(line.String())+1+utf8.RuneCountInString(word) > width {
+			lines = append(lines, line.String())
+			line.Reset()
+		}
+		if line.Len() > 0 {
+			line.WriteByte(' ')
+		}
+		line.WriteString(word)
+	}
+	if line.Len() > 0 {
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+func (t *textWriter) writeLines(lines []string) {
+	hanging := strings.Repeat(" ", utf8.RuneCountInString(t.bullet))
+	for i, line := range lines {
+		prefix := t.indent + hanging
+		if i == 0 {
+			prefix = t.indent + t.bullet
+		}
+		t.out.WriteString(strings.TrimRight(prefix+line, " ") + "\n")
+	}
+	t.bullet = ""
+}
+
+// Wrap up whatever inline text has built up into lines.
+func (t *textWriter) flush() {
+	text := t.inline.String()
+	t.inline.Reset()
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	width := max(t.width-utf8.RuneCountInString(t.indent+t.bullet), minTextWidth)
+	var lines []string
+	for _, part := range strings.Split(text, "\n") {
+		wrapped := wrapWords(strings.Fields(part), width)
+		if len(wrapped) == 0 {
+			wrapped = []string{""}
+		}
+		lines = append(lines, wrapped...)
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	t.writeLines(lines)
+}
+
+// End a block with a blank line, unless there already is one.
+func (t *textWriter) blankLine() {
+	t.flush()
+	blank := strings.TrimRight(t.indent, " ") + "\n"
+	s := t.out.String()
+	if s != "" && !strings.HasSuffix(s, "\n\n") && !strings.HasSuffix(s, "\n"+blank) {
+		t.out.WriteString(blank)
+	}
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(textContent(c))
+	}
+	return b.String()
+}
+
+func (t *textWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		t.node(c)
+	}
+}
+
+func (t *textWriter) node(n *html.Node) {
+	if n.Type == html.TextNode {
+		t.inline.WriteString(n.Data)
+		return
+	}
+	if n.Type != html.ElementNode {
+		return
+	}
+	switch n.DataAtom {
+	case atom.Br:
+		t.inline.WriteString("\n")
+	case atom.Img:
+		alt := strings.TrimSpace(nodeAttr(n, "alt"))
+		if alt == "" {
+			t.inline.WriteString(" [image] ")
+		} else {
+			t.inline.WriteString(" [image: " + alt + "] ")
+		}
+	case atom.A:
+		t.children(n)
+		href := nodeAttr(n, "href")
+		if href != "" && href != "#" {
+			t.links = append(t.links, href)
+			fmt.Fprintf(&t.inline, " [%d]", len(t.links))
+		}
+	case atom.Hr:
+		t.blankLine()
+		t.writeLines([]string{strings.Repeat("-", min(t.width, 40))})
+		t.blankLine()
+	case atom.Pre:
+		t.blankLine()
+		text := strings.TrimRight(textContent(n), "\n ")
+		t.writeLines(strings.Split(strings.TrimPrefix(text, "\n"), "\n"))
+		t.blankLine()
+	case atom.Blockquote:
+		t.blankLine()
+		indent := t.indent
+		t.indent += "> "
+		t.children(n)
+		t.flush()
+		// Don't leave a quoted blank line at the end of the quote
+		if s := t.out.String(); strings.HasSuffix(s, "\n"+strings.TrimSpace(t.indent)+"\n") {
+			trimmed := strings.TrimSuffix(s, strings.TrimSpace(t.indent)+"\n")
+			t.out.Reset()
+			t.out.WriteString(trimmed)
+		}
+		t.indent = indent
+		t.blankLine()
+	case atom.Ul, atom.Ol:
+		if t.lists == 0 {
+			t.blankLine()
+		}
+		t.flush()
+		indent, itemWidth := t.indent, t.itemWidth
+		if t.lists > 0 {
+			// Line nested items up with the text of the item they're in
+			t.indent += strings.Repeat(" ", t.itemWidth)
+		}
+		t.lists++
+		number := 0
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || c.DataAtom != atom.Li {
+				t.node(c)
+				continue
+			}
+			number++
+			t.flush()
+			if n.DataAtom == atom.Ol {
+				t.bullet = fmt.Sprintf("%d. ", number)
+			} else {
+				t.bullet = "* "
+			}
+			t.itemWidth = utf8.RuneCountInString(t.bullet)
+			t.children(c)
+			t.flush()
+		}
+		t.lists--
+		t.indent, t.itemWidth = indent, itemWidth
+		if t.lists == 0 {
+			t.blankLine()
+		}
+	case atom.Tr:
+		t.flush()
+		first := true
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			if !first {
+				t.inline.WriteString(" | ")
+			}
+			first = false
+			t.inline.WriteString(strings.Join(strings.Fields(textContent(c)), " "))
+		}
+		t.flush()
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		t.blankLine()
+		t.children(n)
+		t.flush()
+		t.blankLine()
+	case atom.P, atom.Div, atom.Figure, atom.Figcaption, atom.Table, atom.Dl, atom.Dt, atom.Dd, atom.Caption:
+		t.blankLine()
+		t.children(n)
+		t.blankLine()
+	default:
+		t.children(n)
+	}
+}
+
+// HTMLToText renders an HTML fragment from a feed as plain text for reading
+// in a terminal, wrapped to width columns. Links are numbered in the text and
+// listed at the end.
+func HTMLToText(s string, width int) string {
+	clean, err := SanitizeNodes(s)
+	if err != nil {
+		return ""
+	}
+	t := &textWriter{width: width}
+	t.children(clean)
+	t.flush()
+	text := strings.Trim(t.out.String(), "\n")
+	if len(t.links) > 0 {
+		var b strings.Builder
+		b.WriteString(text)
+		b.WriteString("\n\n")
+		for i, link := range t.links {
+			fmt.Fprintf(&b, "[%d] %s\n", i+1, link)
+		}
+		text = strings.TrimRight(b.String(), "\n")
+	}
+	return text
+}
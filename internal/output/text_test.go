@@ -0,0 +1,42 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package output_test
+
+import (
+	"testing"
+
+	"github.com/mikerowehl/feeder/internal/output"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestText_HTMLToText(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		width int
+		want  string
+	}{
+		{"plain", "Just text", 40, "Just text"},
+		{"wrap", `<p>This paragraph has enough words in it to wrap</p>`, 20,
+			"This paragraph has\nenough words in it\nto wrap"},
+		{"paragraphs", `<p>One</p><p>Two<br>Three</p>`, 40, "One\n\nTwo\nThree"},
+		{"links", `<p>See <a href="https://example.com/">this</a> and <a href="#">that</a></p>`, 40,
+			"See this [1] and that\n\n[1] https://example.com/"},
+		{"lists", `<ul><li>One</li><li>Two<ol><li>Nested</li></ol></li></ul><p>After</p>`, 40,
+			"* One\n* Two\n  1. Nested\n\nAfter"},
+		{"quote", `<blockquote><p>Quoted</p><p>Again</p></blockquote>`, 40, "> Quoted\n>\n> Again"},
+		{"pre", "<pre>func main() {\n    return\n}</pre>", 10, "func main() {\n    return\n}"},
+		{"image", `<img src="https://example.com/a.png" alt="A cat">`, 40, "[image: A cat]"},
+		{"table", `<table><tr><th>A</th><th>B</th></tr><tr><td>1</td><td>2</td></tr></table>`, 40, "A | B\n1 | 2"},
+		{"script", `<script>alert(1)</script>Safe`, 40, "Safe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, output.HTMLToText(tt.in, tt.width))
+		})
+	}
+}
@@ -0,0 +1,344 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mikerowehl/feeder/internal/rss"
+	"github.com/mikerowehl/feeder/internal/rules"
+	"gorm.io/gorm"
+)
+
+// Backup is everything in the database: the feeds with their settings, all
+// their items along with read and starred state, and the rules.
+type Backup struct {
+	Feeds []rss.Feed
+	Rules []rules.Rule
+}
+
+// RestoreStats counts what a restore changed.
+type RestoreStats struct {
+	Feeds int
+	Items int
+	// Items that were already there and had their state changed to match
+	// the backup, only when merging
+	Updated int
+	Rules   int
+}
+
+// The tables in the order they have to be emptied in, attachments first.
+var backupModels = []any{&rss.Enclosure{}, &rss.Category{}, &rss.Tag{}, &rss.ItemRevision{}, &rss.Item{},
+	&rss.Feed{}, &rules.Rule{}}
+
+// Dump loads everything in the database for a backup.
+func (r *FeedRepository) Dump(ctx context.Context) (Backup, error) {
+	var backup Backup
+	byID := func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}
+	err := r.db.WithContext(ctx).
+		Preload("Items", byID).
+		Preload("Items.Enclosures", byID).
+		Preload("Items.Categories", byID).
+		Preload("Items.Tags", byID).
+		Preload("Items.Revisions", byID).
+		Order("id").
+		Find(&backup.Feeds).Error
+	if err != nil {
+		return Backup{}, err
+	}
+	err = r.db.WithContext(ctx).Order("id").Find(&backup.Rules).Error
+	if err != nil {
+		return Backup{}, err
+	}
+	return backup, nil
+}
+
+// Restore loads a backup into the database. With replace everything in the
+// database is thrown away first and the backup goes in exactly as it was,
+// IDs and all. Otherwise the backup is merged in: feeds and items that
+// aren't there yet get added, items that are get the read, starred, and tag
+// state from the backup, and rules that aren't there yet are added. Either
+// way it all happens in one transaction, so a failed restore leaves the
+// database as it was.
+func (r *FeedRepository) Restore(ctx context.Context, backup Backup, replace bool) (RestoreStats, error) {
+	var stats RestoreStats
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if replace {
+			stats, err = replaceAll(tx, backup)
+		} else {
+			stats, err = merge(tx, backup)
+		}
+		return err
+	})
+	if err != nil {
+		return RestoreStats{}, err
+	}
+	return stats, nil
+}
+
+func replaceAll(tx *gorm.DB, backup Backup) (RestoreStats, error) {
+	var stats RestoreStats
+	for _, model := range backupModels {
+		if err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(model).Error; err != nil {
+			return stats, err
+		}
+	}
+	for i := range backup.Feeds {
+		feed := backup.Feeds[i]
+		items := feed.Items
+		feed.Items = nil
+		if err := tx.Create(&feed).Error; err != nil {
+			return stats, fmt.Errorf("restoring feed %s: %w", feed.URL, err)
+		}
+		stats.Feeds++
+		if len(items) > 0 {
+			if err := tx.CreateInBatches(items, saveBatchSize).Error; err != nil {
+				return stats, fmt.Errorf("restoring items for %s: %w", feed.URL, err)
+			}
+			stats.Items += len(items)
+		}
+	}
+	if len(backup.Rules) > 0 {
+		if err := tx.Create(backup.Rules).Error; err != nil {
+			return stats, fmt.Errorf("restoring rules: %w", err)
+		}
+		stats.Rules = len(backup.Rules)
+	}
+	return stats, resetSequences(tx)
+}
+
+// PostgreSQL hands out IDs from a sequence that doesn't notice rows put in
+// with their own IDs, so move each one past the highest ID restored.
+func resetSequences(tx *gorm.DB) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+	for _, model := range backupModels {
+		stmt := &gorm.Statement{DB: tx}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+		table := stmt.Schema.Table
+		err := tx.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s",
+			table, tx.Statement.Quote(table))).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type itemState struct {
+	ID      uint
+	FeedID  uint
+	GUID    string
+	Read    bool
+	Starred bool
+}
+
+// GUIDs are only unique within a feed
+type itemKey struct {
+	feedID uint
+	guid   string
+}
+
+func merge(tx *gorm.DB, backup Backup) (RestoreStats, error) {
+	var stats RestoreStats
+	var feeds []rss.Feed
+	if err := tx.Find(&feeds).Error; err != nil {
+		return stats, err
+	}
+	byURL := make(map[string]uint, len(feeds))
+	for _, feed := range feeds {
+		byURL[feed.URL] = feed.ID
+	}
+	var states []itemState
+	if err := tx.Model(&rss.Item{}).Select("id", "feed_id", "guid", "read", "starred").Scan(&states).Error; err != nil {
+		return stats, err
+	}
+	byKey := make(map[itemKey]itemState, len(states))
+	for _, state := range states {
+		byKey[itemKey{state.FeedID, state.GUID}] = state
+	}
+
+	// IDs in the backup mapped to the IDs they end up with here, so feed
+	// specific rules and clusters still point at the right things.
+	feedIDs := make(map[uint]uint)
+	itemIDs := make(map[uint]uint)
+	var clustered []*rss.Item
+	for i := range backup.Feeds {
+		feed := backup.Feeds[i]
+		feedID, ok := byURL[feed.URL]
+		if !ok {
+			added := feed
+			added.ID = 0
+			added.Items = nil
+			if err := tx.Create(&added).Error; err != nil {
+				return stats, fmt.Errorf("adding feed %s: %w", feed.URL, err)
+			}
+			feedID = added.ID
+			stats.Feeds++
+		}
+		feedIDs[feed.ID] = feedID
+
+		var fresh []rss.Item
+		var backupIDs []uint
+		for _, item := range feed.Items {
+			state, ok := byKey[itemKey{feedID, item.GUID}]
+			if !ok {
+				fresh = append(fresh, detach(item, feedID))
+				backupIDs = append(backupIDs, item.ID)
+				continue
+			}
+			itemIDs[item.ID] = state.ID
+			updated, err := mergeState(tx, state, item)
+			if err != nil {
+				return stats, err
+			}
+			if updated {
+				stats.Updated++
+			}
+		}
+		if len(fresh) == 0 {
+			continue
+		}
+		if err := tx.CreateInBatches(fresh, saveBatchSize).Error; err != nil {
+			return stats, fmt.Errorf("adding items for %s: %w", feed.URL, err)
+		}
+		stats.Items += len(fresh)
+		for j := range fresh {
+			itemIDs[backupIDs[j]] = fresh[j].ID
+			if fresh[j].ClusterID != 0 {
+				clustered = append(clustered, &fresh[j])
+			}
+		}
+	}
+
+	for _, item := range clustered {
+		clusterID := itemIDs[item.ClusterID]
+		if err := tx.Model(&rss.Item{}).Where("id = ?", item.ID).Update("cluster_id", clusterID).Error; err != nil {
+			return stats, err
+		}
+	}
+
+	added, err := mergeRules(tx, backup.Rules, feedIDs)
+	stats.Rules = added
+	return stats, err
+}
+
+// A copy of an item from the backup ready to be added to another feed, with
+// all the IDs cleared so new ones get assigned.
+func detach(item rss.Item, feedID uint) rss.Item {
+	item.ID = 0
+	item.FeedID = feedID
+	item.Enclosures = clearIDs(item.Enclosures, func(e *rss.Enclosure) { e.ID, e.ItemID = 0, 0 })
+	item.Categories = clearIDs(item.Categories, func(c *rss.Category) { c.ID, c.ItemID = 0, 0 })
+	item.Tags = clearIDs(item.Tags, func(t *rss.Tag) { t.ID, t.ItemID = 0, 0 })
+	item.Revisions = clearIDs(item.Revisions, func(r *rss.ItemRevision) { r.ID, r.ItemID = 0, 0 })
+	return item
+}
+
+func clearIDs[T any](list []T, reset func(*T)) []T {
+	if list == nil {
+		return nil
+	}
+	cleared := make([]T, len(list))
+	copy(cleared, list)
+	for i := range cleared {
+		reset(&cleared[i])
+	}
+	return cleared
+}
+
+// Bring an item that's already in the database in line with the backup,
+// reporting whether anything changed.
+func mergeState(tx *gorm.DB, state itemState, item rss.Item) (bool, error) {
+	updated := false
+	if state.Read != item.Read || state.Starred != item.Starred {
+		err := tx.Model(&rss.Item{}).Where("id = ?", state.ID).
+			Updates(map[string]any{"read": item.Read, "starred": item.Starred}).Error
+		if err != nil {
+			return false, err
+		}
+		updated = true
+	}
+	if len(item.Tags) == 0 {
+		return updated, nil
+	}
+	var tags []rss.Tag
+	if err := tx.Where("item_id = ?", state.ID).Find(&tags).Error; err != nil {
+		return false, err
+	}
+	existing := rss.Item{Tags: tags}
+	for _, tag := range item.Tags {
+		existing.AddTag(tag.Name)
+	}
+	for _, tag := range existing.Tags[len(tags):] {
+		tag.ItemID = state.ID
+		if err := tx.Create(&tag).Error; err != nil {
+			return false, err
+		}
+		updated = true
+	}
+	return updated, nil
+}
+
+// Add the rules from the backup that aren't here already. Rules for a
+// single feed are only added if that feed was in the backup too.
+func mergeRules(tx *gorm.DB, backup []rules.Rule, feedIDs map[uint]uint) (int, error) {
+	var existing []rules.Rule
+	if err := tx.Find(&existing).Error; err != nil {
+		return 0, err
+	}
+	added := 0
+	for _, rule := range backup {
+		if rule.FeedID != 0 {
+			feedID, ok := feedIDs[rule.FeedID]
+			if !ok {
+				continue
+			}
+			rule.FeedID = feedID
+		}
+		if containsRule(existing, rule) {
+			continue
+		}
+		rule.ID = 0
+		if err := tx.Create(&rule).Error; err != nil {
+			return added, err
+		}
+		existing = append(existing, rule)
+		added++
+	}
+	return added, nil
+}
+
+func containsRule(list []rules.Rule, rule rules.Rule) bool {
+	for _, r := range list {
+		if r.FeedID == rule.FeedID && r.Field == rule.Field && r.Pattern == rule.Pattern && r.Regex == rule.Regex &&
+			r.Negate == rule.Negate && r.Action == rule.Action && r.Tag == rule.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrSnapshotUnsupported is returned by Snapshot for databases that aren't
+// SQLite.
+var ErrSnapshotUnsupported = fmt.Errorf("snapshots need a SQLite database: %w", errors.ErrUnsupported)
+
+// Snapshot writes a consistent copy of the SQLite database to a new file
+// at path, while other connections carry on reading and writing.
+func (r *FeedRepository) Snapshot(ctx context.Context, path string) error {
+	if r.db.Dialector.Name() != "sqlite" {
+		return ErrSnapshotUnsupported
+	}
+	return r.db.WithContext(ctx).Exec("VACUUM INTO ?", path).Error
+}
@@ -0,0 +1,203 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/rss"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The kinds of state kept in step between devices. The target of a
+// subscription change is the feed URL, for the others it's the item GUID.
+const (
+	ChangeSubscribed = "subscribed"
+	ChangeRead       = "read"
+	ChangeStarred    = "starred"
+)
+
+// Change is the latest known state of one thing kept in step between
+// devices: whether a feed is subscribed to, or whether an item is read or
+// starred. Only the newest change to each is kept, so the table holds one
+// row per feed or item that's been changed.
+type Change struct {
+	ID     uint   `gorm:"primarykey" json:"-"`
+	Kind   string `gorm:"uniqueIndex:idx_change_target" json:"kind"`
+	Target string `gorm:"uniqueIndex:idx_change_target" json:"target"`
+	Value  bool   `json:"value"`
+	// Title of a feed being subscribed to, so it shows up in the list
+	// before the first fetch
+	Title string    `json:"title,omitempty"`
+	At    time.Time `json:"at"`
+	// Device that made the change, empty for changes made here
+	Device string `json:"device"`
+	// Whether the change has been made to the database. Changes to items
+	// that haven't been fetched here yet wait until they have been.
+	Applied bool `json:"-"`
+}
+
+// MergeResult counts what merging changes from other devices did.
+type MergeResult struct {
+	// Changes newer than what was known here
+	Merged int
+	// Changes made to the database, including ones that were waiting
+	// from an earlier merge
+	Applied int
+	// Changes to items that haven't been fetched here yet
+	Pending int
+}
+
+// Databases don't all keep times down to the nanosecond, and a change
+// read back from another device has to compare equal to the stored copy.
+func changeTime() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// Keep the newest state for each target, replacing whatever was there.
+func recordChanges(tx *gorm.DB, kind string, targets []string, value bool, title string) error {
+	if len(targets) == 0 {
+		return nil
+	}
+	at := changeTime()
+	changes := make([]Change, len(targets))
+	for i, target := range targets {
+		changes[i] = Change{Kind: kind, Target: target, Value: value, Title: title, At: at, Applied: true}
+	}
+	return saveChanges(tx, changes)
+}
+
+func saveChanges(tx *gorm.DB, changes []Change) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "kind"}, {Name: "target"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "title", "at", "device", "applied"}),
+	}).CreateInBatches(changes, saveBatchSize).Error
+}
+
+// LocalChanges returns the changes made on this device that haven't since
+// been overridden by a newer change from another device.
+func (r *FeedRepository) LocalChanges(ctx context.Context) ([]Change, error) {
+	var changes []Change
+	err := r.db.WithContext(ctx).Where("device = ?", "").Order("kind, target").Find(&changes).Error
+	return changes, err
+}
+
+// MergeChanges brings in changes from other devices. Each one is kept only
+// if it's newer than what's known about its target here, the last writer
+// wins. Ties go to the device with the greater name, with local changes
+// counting as coming from device. Kept changes are made to the database
+// straight away, apart from ones for items that haven't been fetched yet,
+// which wait and are tried again by each merge.
+func (r *FeedRepository) MergeChanges(ctx context.Context, device string, incoming []Change) (MergeResult, error) {
+	var result MergeResult
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var known []Change
+		if err := tx.Find(&known).Error; err != nil {
+			return err
+		}
+		type key struct{ kind, target string }
+		latest := make(map[key]Change, len(known))
+		for _, change := range known {
+			if change.Device == "" {
+				change.Device = device
+			}
+			latest[key{change.Kind, change.Target}] = change
+		}
+
+		var newer []Change
+		for _, change := range incoming {
+			if change.Device == "" || change.Device == device {
+				continue
+			}
+			k := key{change.Kind, change.Target}
+			if current, ok := latest[k]; ok && !supersedes(change, current) {
+				continue
+			}
+			change.ID = 0
+			change.Applied = false
+			latest[k] = change
+			newer = append(newer, change)
+		}
+		if len(newer) > 0 {
+			if err := saveChanges(tx, newer); err != nil {
+				return err
+			}
+		}
+		result.Merged = len(newer)
+
+		var waiting []Change
+		if err := tx.Where("applied = ?", false).Order("id").Find(&waiting).Error; err != nil {
+			return err
+		}
+		for _, change := range waiting {
+			applied, err := applyChange(tx, change)
+			if err != nil {
+				return err
+			}
+			if !applied {
+				result.Pending++
+				continue
+			}
+			result.Applied++
+			if err := tx.Model(&Change{}).Where("id = ?", change.ID).Update("applied", true).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return MergeResult{}, err
+	}
+	return result, nil
+}
+
+func supersedes(change Change, current Change) bool {
+	if change.At.Equal(current.At) {
+		return change.Device > current.Device
+	}
+	return change.At.After(current.At)
+}
+
+// Make one change to the database, reporting false if what it changes
+// isn't here yet.
+func applyChange(tx *gorm.DB, change Change) (bool, error) {
+	switch change.Kind {
+	case ChangeSubscribed:
+		// Anyone who can write to the sync directory could otherwise have
+		// this device run a command of their choosing
+		if rss.IsLocalSource(change.Target) {
+			return true, nil
+		}
+		if change.Value {
+			feed := rss.Feed{URL: change.Target, Title: change.Title}
+			return true, tx.Where(rss.Feed{URL: change.Target}).FirstOrCreate(&feed).Error
+		}
+		var feed rss.Feed
+		err := tx.Select("id").Where("url = ?", change.Target).Limit(1).Find(&feed).Error
+		if err != nil || feed.ID == 0 {
+			return true, err
+		}
+		return true, tx.Unscoped().Select(clause.Associations).Delete(&feed).Error
+	case ChangeRead, ChangeStarred:
+		values := map[string]any{change.Kind: change.Value}
+		if change.Kind == ChangeRead && change.Value {
+			values["revised"] = false
+		}
+		result := tx.Model(&rss.Item{}).Where("guid = ?", change.Target).Updates(values)
+		return result.RowsAffected > 0, result.Error
+	}
+	// Something a newer feeder wrote that this one doesn't know about
+	return true, nil
+}
+
+// GUIDs of the items a query matches, for recording changes to them.
+func itemGUIDs(query *gorm.DB) ([]string, error) {
+	var guids []string
+	err := query.Session(&gorm.Session{}).Model(&rss.Item{}).Pluck("guid", &guids).Error
+	return guids, err
+}
@@ -0,0 +1,143 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package repository_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/repository"
+	"github.com/mikerowehl/feeder/internal/rss"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	concurrentWriters = 4
+	concurrentReaders = 4
+	writerRounds      = 20
+	itemsPerRound     = 5
+)
+
+// Each repository gets its own connection pool, the same as separate
+// feeder processes sharing the database file.
+func openShared(t *testing.T, filename string) *repository.FeedRepository {
+	t.Helper()
+	r, err := repository.NewFeedRepository(filename)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, r.Close())
+	})
+	return r
+}
+
+func TestRepository_ConcurrentReadersAndWriters(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "shared.db")
+	setup := openShared(t, filename)
+	for w := range concurrentWriters {
+		feed := rss.Feed{URL: fmt.Sprintf("https://example.com/%d.rss", w), Title: fmt.Sprintf("Feed %d", w)}
+		require.NoError(t, setup.Save(t.Context(), &feed))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, (concurrentWriters+concurrentReaders)*writerRounds)
+	for w := range concurrentWriters {
+		r := openShared(t, filename)
+		feedID := uint(w + 1)
+		wg.Go(func() {
+			for round := range writerRounds {
+				var items []rss.Item
+				for i := range itemsPerRound {
+					items = append(items, rss.Item{
+						FeedID: feedID,
+						GUID:   fmt.Sprintf("feed%d-round%d-item%d", feedID, round, i),
+						Title:  fmt.Sprintf("Item %d", i),
+					})
+				}
+				if err := r.SaveItems(t.Context(), items); err != nil {
+					errs <- fmt.Errorf("writer %d saving: %w", feedID, err)
+					return
+				}
+				if err := r.MarkRead(t.Context(), items[0].ID); err != nil {
+					errs <- fmt.Errorf("writer %d marking: %w", feedID, err)
+					return
+				}
+			}
+		})
+	}
+	for range concurrentReaders {
+		r := openShared(t, filename)
+		wg.Go(func() {
+			for range writerRounds {
+				if _, err := r.Unread(t.Context()); err != nil {
+					errs <- fmt.Errorf("reading unread: %w", err)
+					return
+				}
+				if _, err := r.UnreadCounts(t.Context()); err != nil {
+					errs <- fmt.Errorf("reading counts: %w", err)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	counts, err := setup.UnreadCounts(t.Context())
+	require.NoError(t, err)
+	require.Len(t, counts, concurrentWriters)
+	for _, count := range counts {
+		assert.Equal(t, writerRounds*(itemsPerRound-1), count.Unread, count.Title)
+	}
+}
+
+func TestLock_SharedAndExclusive(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "locked.db")
+	wait := 200 * time.Millisecond
+
+	first, err := repository.AcquireLock(t.Context(), filename, false, wait)
+	require.NoError(t, err)
+	second, err := repository.AcquireLock(t.Context(), filename, false, wait)
+	require.NoError(t, err, "readers share the lock")
+
+	_, err = repository.AcquireLock(t.Context(), filename, true, wait)
+	assert.ErrorIs(t, err, repository.ErrLocked)
+
+	require.NoError(t, first.Release())
+	require.NoError(t, second.Release())
+	exclusive, err := repository.AcquireLock(t.Context(), filename, true, wait)
+	require.NoError(t, err)
+
+	_, err = repository.AcquireLock(t.Context(), filename, false, wait)
+	assert.ErrorIs(t, err, repository.ErrLocked, "nothing else runs alongside an exclusive lock")
+	require.NoError(t, exclusive.Release())
+}
+
+func TestLock_WaitsForRelease(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "locked.db")
+	exclusive, err := repository.AcquireLock(t.Context(), filename, true, time.Second)
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		exclusive.Release()
+	}()
+	shared, err := repository.AcquireLock(t.Context(), filename, false, 5*time.Second)
+	require.NoError(t, err)
+	assert.NoError(t, shared.Release())
+}
+
+func TestLock_InMemory(t *testing.T) {
+	lock, err := repository.AcquireLock(t.Context(), ":memory:", true, time.Second)
+	require.NoError(t, err)
+	assert.NoError(t, lock.Release())
+}
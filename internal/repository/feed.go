@@ -6,9 +6,16 @@ See LICENSE in the project root for full license information.
 package repository
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/mikerowehl/feeder/internal/rss"
+	"github.com/mikerowehl/feeder/internal/rules"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -21,71 +28,451 @@ type FeedRepository struct {
 	db *gorm.DB
 }
 
+// How long a connection waits for another process to finish writing before
+// giving up with "database is locked".
+const busyTimeout = 10 * time.Second
+
+// NewFeedRepository opens the SQLite database file, creating it if needed.
+// The database is put in WAL mode so a fetch from cron can write while
+// another process is reading.
 func NewFeedRepository(filename string) (*FeedRepository, error) {
 	db, err := gorm.Open(sqlite.Dialector{
 		DriverName: "sqlite",
-		DSN:        filename,
+		DSN:        sqliteDSN(filename),
 	}, &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
-	db.Exec("PRAGMA foreign_keys = ON")
-	err = db.AutoMigrate(&rss.Feed{}, &rss.Item{})
+	return newFeedRepository(db)
+}
+
+// The pragmas go in the DSN rather than being run once after opening so
+// that every connection in the pool gets them. Transactions start
+// IMMEDIATE, taking the write lock up front, because a transaction that
+// reads and then tries to write fails straight away instead of waiting out
+// the busy timeout when another process got in first.
+func sqliteDSN(filename string) string {
+	params := url.Values{}
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", busyTimeout.Milliseconds()))
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "synchronous(NORMAL)")
+	params.Add("_txlock", "immediate")
+	return filename + "?" + params.Encode()
+}
+
+// Bring the schema up to date on a freshly opened database, whichever kind
+// it is.
+func newFeedRepository(db *gorm.DB) (*FeedRepository, error) {
+	err := migrateItemGUIDs(db)
+	if err == nil {
+		err = db.AutoMigrate(&rss.Feed{}, &rss.Item{}, &rss.Enclosure{}, &rss.Category{}, &rss.ItemRevision{},
+			&rss.Tag{}, &rules.Rule{}, &Change{})
+	}
 	if err != nil {
+		if sqlDb, dbErr := db.DB(); dbErr == nil {
+			sqlDb.Close()
+		}
 		return nil, err
 	}
 	return &FeedRepository{db: db}, nil
 }
 
-func (r *FeedRepository) Save(feed *rss.Feed) error {
-	err := r.db.Save(feed).Error
-	if err != nil {
-		return err
+// Item GUIDs used to be unique across every feed, which stopped two feeds
+// from carrying the same story. They're only unique within a feed now, so
+// drop the old constraint and let AutoMigrate add the index on both columns.
+func migrateItemGUIDs(db *gorm.DB) error {
+	const oldConstraint = "uni_items_guid"
+	m := db.Migrator()
+	if !m.HasTable(&rss.Item{}) || !m.HasConstraint(&rss.Item{}, oldConstraint) {
+		return nil
+	}
+	if err := m.DropConstraint(&rss.Item{}, oldConstraint); err != nil {
+		return fmt.Errorf("error dropping the unique item GUID constraint: %w", err)
 	}
 	return nil
 }
 
-func (r *FeedRepository) Delete(id uint) error {
-	err := r.db.Unscoped().Select(clause.Associations).Delete(&rss.Feed{}, id).Error
-	return err
+// Save writes out the feed and all the items attached to it. Items that are
+// already in the database get updated too, so revised content and read
+// state changes are kept. Saving a new feed counts as subscribing to it,
+// unless it's a file or command on this machine, which other devices don't
+// share.
+func (r *FeedRepository) Save(ctx context.Context, feed *rss.Feed) error {
+	subscribing := feed.ID == 0 && !rss.IsLocalSource(feed.URL)
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Session(&gorm.Session{FullSaveAssociations: true}).Save(feed).Error
+		if err != nil {
+			return err
+		}
+		for i := range feed.Items {
+			if err := pruneRevisions(tx, &feed.Items[i]); err != nil {
+				return err
+			}
+		}
+		if subscribing {
+			return recordChanges(tx, ChangeSubscribed, []string{feed.URL}, true, feed.Title)
+		}
+		return nil
+	})
+}
+
+func (r *FeedRepository) Delete(ctx context.Context, id uint) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var feed rss.Feed
+		if err := tx.Select("id", "url").Limit(1).Find(&feed, id).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Select(clause.Associations).Delete(&rss.Feed{}, id).Error; err != nil {
+			return err
+		}
+		if feed.ID == 0 || rss.IsLocalSource(feed.URL) {
+			return nil
+		}
+		return recordChanges(tx, ChangeSubscribed, []string{feed.URL}, false, "")
+	})
 }
 
-func (r *FeedRepository) All() ([]rss.Feed, error) {
+func (r *FeedRepository) All(ctx context.Context) ([]rss.Feed, error) {
 	var feeds []rss.Feed
-	err := r.db.Preload("Items").Find(&feeds).Error
+	err := r.db.WithContext(ctx).Preload("Items").Find(&feeds).Error
 	return feeds, err
 }
 
-func (r *FeedRepository) AllFeeds() ([]rss.Feed, error) {
+func (r *FeedRepository) AllFeeds(ctx context.Context) ([]rss.Feed, error) {
 	var feeds []rss.Feed
-	err := r.db.Find(&feeds).Error
+	err := r.db.WithContext(ctx).Find(&feeds).Error
 	return feeds, err
 }
 
-func (r *FeedRepository) AllItems() ([]rss.Item, error) {
+func (r *FeedRepository) AllItems(ctx context.Context) ([]rss.Item, error) {
 	var items []rss.Item
-	err := r.db.Find(&items).Error
+	err := r.db.WithContext(ctx).Find(&items).Error
 	return items, err
 }
 
-func (r *FeedRepository) Unread() ([]rss.Feed, error) {
+// ItemFilter narrows down a set of items. Empty fields don't filter
+// anything. Author matches any part of the author name and Category has to
+// match one of the item's categories exactly, both ignoring case. Search
+// looks for the text in the title, the content, and any extracted article.
+type ItemFilter struct {
+	Author   string
+	Category string
+	Search   string
+}
+
+func (f ItemFilter) apply(db *gorm.DB) *gorm.DB {
+	if f.Search != "" {
+		pattern := "%" + strings.ToLower(f.Search) + "%"
+		db = db.Where("LOWER(title) LIKE ? OR LOWER(content) LIKE ? OR LOWER(full_content) LIKE ?",
+			pattern, pattern, pattern)
+	}
+	if f.Author != "" {
+		db = db.Where("LOWER(author) LIKE ?", "%"+strings.ToLower(f.Author)+"%")
+	}
+	if f.Category != "" {
+		db = db.Where("id IN (?)", db.Session(&gorm.Session{NewDB: true}).
+			Model(&rss.Category{}).
+			Select("item_id").
+			Where("LOWER(name) = ?", strings.ToLower(f.Category)))
+	}
+	return db
+}
+
+func (r *FeedRepository) Unread(ctx context.Context) ([]rss.Feed, error) {
+	return r.UnreadFiltered(ctx, ItemFilter{})
+}
+
+// UnreadFiltered is the same as Unread, but only includes the items that
+// match the filter. Feeds are still all returned, possibly with no items.
+func (r *FeedRepository) UnreadFiltered(ctx context.Context, filter ItemFilter) ([]rss.Feed, error) {
+	return r.feedsWithItems(ctx, filter, "read = ?", false)
+}
+
+// Starred returns all the feeds with just their starred items that match the
+// filter, whether they've been read or not.
+func (r *FeedRepository) Starred(ctx context.Context, filter ItemFilter) ([]rss.Feed, error) {
+	return r.feedsWithItems(ctx, filter, "starred = ?", true)
+}
+
+func (r *FeedRepository) feedsWithItems(ctx context.Context, filter ItemFilter, query string, args ...any) ([]rss.Feed, error) {
 	var feeds []rss.Feed
-	err := r.db.Preload("Items", func(db *gorm.DB) *gorm.DB {
-		return db.
-			Where("read = ?", false).
+	err := r.db.WithContext(ctx).Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return filter.apply(db).
+			Where(query, args...).
 			Order("published DESC")
-	}).Find(&feeds).Error
+	}).Preload("Items.Enclosures").Preload("Items.Categories").Preload("Items.Tags").
+		Find(&feeds).Error
 	return feeds, err
 }
 
-func (r *FeedRepository) MarkAll() error {
-	result := r.db.Model(&rss.Item{}).Where("read = ?", false).Update("read", true)
-	return result.Error
+// KnownItem is just enough of a stored item to tell whether a freshly
+// fetched copy is new or changed.
+type KnownItem struct {
+	ID          uint
+	GUID        string
+	ContentHash string
+}
+
+// KnownItems loads the GUID and content hash of every item in a feed, keyed
+// by GUID, without loading any of the content.
+func (r *FeedRepository) KnownItems(ctx context.Context, feedID uint) (map[string]KnownItem, error) {
+	db := r.db.WithContext(ctx)
+	var known []KnownItem
+	err := db.Model(&rss.Item{}).
+		Select("id", "guid", "content_hash").
+		Where("feed_id = ?", feedID).
+		Scan(&known).Error
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]KnownItem, len(known))
+	var unhashed []uint
+	for _, item := range known {
+		if item.ContentHash == "" {
+			unhashed = append(unhashed, item.ID)
+		}
+		result[item.GUID] = item
+	}
+	if len(unhashed) > 0 {
+		// Stored before we tracked hashes, so work them out from the content
+		var items []rss.Item
+		if err := db.Select("id", "guid", "title", "content").Find(&items, unhashed).Error; err != nil {
+			return nil, err
+		}
+		for i := range items {
+			result[items[i].GUID] = KnownItem{ID: items[i].ID, GUID: items[i].GUID, ContentHash: items[i].Hash()}
+		}
+	}
+	return result, nil
+}
+
+// Items loads the items with the given IDs, without their attachments.
+func (r *FeedRepository) Items(ctx context.Context, ids []uint) ([]rss.Item, error) {
+	var items []rss.Item
+	if len(ids) == 0 {
+		return items, nil
+	}
+	err := r.db.WithContext(ctx).Order("id").Find(&items, ids).Error
+	return items, err
+}
+
+// How many rows go into each insert when saving items
+const saveBatchSize = 100
+
+// SaveItems writes out items all in one transaction. Items without an ID
+// are created in batches, along with their enclosures, categories, and
+// tags, and get their IDs filled in. Items that are already stored are
+// updated, and any revisions added to them are created, dropping the
+// oldest beyond rss.MaxRevisions.
+func (r *FeedRepository) SaveItems(ctx context.Context, items []rss.Item) error {
+	var fresh []*rss.Item
+	var existing []*rss.Item
+	for i := range items {
+		if items[i].ID == 0 {
+			fresh = append(fresh, &items[i])
+		} else {
+			existing = append(existing, &items[i])
+		}
+	}
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if len(fresh) > 0 {
+			if err := tx.CreateInBatches(fresh, saveBatchSize).Error; err != nil {
+				return err
+			}
+		}
+		for _, item := range existing {
+			if err := tx.Save(item).Error; err != nil {
+				return err
+			}
+			if err := pruneRevisions(tx, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Drop all but the newest rss.MaxRevisions revisions of an item that's just
+// had some added.
+func pruneRevisions(tx *gorm.DB, item *rss.Item) error {
+	if len(item.Revisions) == 0 {
+		return nil
+	}
+	var cutoff []uint
+	err := tx.Unscoped().Model(&rss.ItemRevision{}).
+		Where("item_id = ?", item.ID).
+		Order("id DESC").
+		Offset(rss.MaxRevisions).
+		Limit(1).
+		Pluck("id", &cutoff).
+		Error
+	if err != nil || len(cutoff) == 0 {
+		return err
+	}
+	return tx.Unscoped().Where("item_id = ? AND id <= ?", item.ID, cutoff[0]).Delete(&rss.ItemRevision{}).Error
+}
+
+// CategoryCount is the number of items (read or not) with a category name.
+type CategoryCount struct {
+	Name  string
+	Count int
+}
+
+// Categories lists all the category names in use along with how many items
+// have each one, most used first.
+func (r *FeedRepository) Categories(ctx context.Context) ([]CategoryCount, error) {
+	var counts []CategoryCount
+	err := r.db.WithContext(ctx).Model(&rss.Category{}).
+		Select("name, COUNT(*) AS count").
+		Group("name").
+		Order("count DESC, name").
+		Scan(&counts).Error
+	return counts, err
+}
+
+// MarkAll marks every item read, and clears the revised flag since the
+// update has now been seen.
+func (r *FeedRepository) MarkAll(ctx context.Context) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		guids, err := itemGUIDs(tx.Where("read = ?", false))
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&rss.Item{}).
+			Where("read = ? OR revised = ?", false, true).
+			Updates(map[string]any{"read": true, "revised": false}).Error
+		if err != nil {
+			return err
+		}
+		return recordChanges(tx, ChangeRead, guids, true, "")
+	})
+}
+
+// MarkRead marks one item read. If the item is part of a cluster every item
+// in the cluster is marked read along with it.
+func (r *FeedRepository) MarkRead(ctx context.Context, id uint) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var item rss.Item
+		if err := tx.Select("id", "cluster_id").First(&item, id).Error; err != nil {
+			return err
+		}
+		query := tx.Model(&rss.Item{}).Where("id = ?", id)
+		if item.ClusterID != 0 {
+			query = query.Or("cluster_id = ?", item.ClusterID)
+		}
+		guids, err := itemGUIDs(query)
+		if err != nil {
+			return err
+		}
+		if err := query.Updates(map[string]any{"read": true, "revised": false}).Error; err != nil {
+			return err
+		}
+		return recordChanges(tx, ChangeRead, guids, true, "")
+	})
+}
+
+// MarkUnread puts one item back in the unread list.
+func (r *FeedRepository) MarkUnread(ctx context.Context, id uint) error {
+	return r.updateItem(ctx, id, ChangeRead, false)
+}
+
+// SetStarred stars or unstars one item.
+func (r *FeedRepository) SetStarred(ctx context.Context, id uint, starred bool) error {
+	return r.updateItem(ctx, id, ChangeStarred, starred)
 }
 
-func (r *FeedRepository) TrimItems(feedId uint, count int) error {
+// The change kinds for items are named after the columns they set.
+func (r *FeedRepository) updateItem(ctx context.Context, id uint, kind string, value bool) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&rss.Item{}).Where("id = ?", id).Update(kind, value)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		guids, err := itemGUIDs(tx.Where("id = ?", id))
+		if err != nil {
+			return err
+		}
+		return recordChanges(tx, kind, guids, value, "")
+	})
+}
+
+// FeedCount is a feed along with how many of its items are unread.
+type FeedCount struct {
+	ID     uint
+	Title  string
+	URL    string
+	Unread int
+}
+
+// UnreadCounts lists all the feeds with the number of unread items in each,
+// ordered by title.
+func (r *FeedRepository) UnreadCounts(ctx context.Context) ([]FeedCount, error) {
+	var counts []FeedCount
+	err := r.db.WithContext(ctx).Model(&rss.Feed{}).
+		Select("feeds.id, feeds.title, feeds.url, COUNT(items.id) AS unread").
+		Joins("LEFT JOIN items ON items.feed_id = feeds.id AND items.read = ? AND items.deleted_at IS NULL", false).
+		Group("feeds.id, feeds.title, feeds.url").
+		Order("LOWER(feeds.title), feeds.id").
+		Scan(&counts).Error
+	return counts, err
+}
+
+// FeedItems loads up to limit of the newest items in a feed, read or not.
+func (r *FeedRepository) FeedItems(ctx context.Context, feedID uint, limit int) ([]rss.Item, error) {
+	var items []rss.Item
+	err := r.db.WithContext(ctx).Where("feed_id = ?", feedID).
+		Order("published DESC").
+		Limit(limit).
+		Preload("Enclosures").Preload("Categories").Preload("Tags").
+		Find(&items).Error
+	return items, err
+}
+
+// RecentItems loads the items created since the given time, with just the
+// fields needed to find duplicates.
+func (r *FeedRepository) RecentItems(ctx context.Context, since time.Time) ([]rss.Item, error) {
+	var items []rss.Item
+	err := r.db.WithContext(ctx).Select("id", "feed_id", "title", "link", "cluster_id", "created_at").
+		Where("created_at >= ?", since).
+		Order("id").
+		Find(&items).Error
+	return items, err
+}
+
+// SetClusters updates the cluster ID for each of the item IDs in the map.
+func (r *FeedRepository) SetClusters(ctx context.Context, clusters map[uint]uint) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for id, clusterID := range clusters {
+			err := tx.Model(&rss.Item{}).Where("id = ?", id).Update("cluster_id", clusterID).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateFeed changes just the given columns for a feed, for things like
+// per-feed settings.
+func (r *FeedRepository) UpdateFeed(ctx context.Context, id uint, values map[string]any) error {
+	result := r.db.WithContext(ctx).Model(&rss.Feed{}).Where("id = ?", id).Updates(values)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *FeedRepository) TrimItems(ctx context.Context, feedId uint, count int) error {
+	db := r.db.WithContext(ctx)
 	var cutoffID uint
-	err := r.db.Unscoped().Model(&rss.Item{}).
+	err := db.Unscoped().Model(&rss.Item{}).
 		Where("feed_id = ?", feedId).
 		Order("published DESC").
 		Offset(count).
@@ -100,19 +487,57 @@ func (r *FeedRepository) TrimItems(feedId uint, count int) error {
 		return err
 	}
 
-	return r.db.Unscoped().Where("feed_id = ? AND id <= ?", feedId, cutoffID).
-		Delete(&rss.Item{}).
-		Error
+	return db.Transaction(func(tx *gorm.DB) error {
+		trimmed := tx.Unscoped().Where("feed_id = ? AND id <= ?", feedId, cutoffID)
+		guids, err := itemGUIDs(trimmed)
+		if err != nil {
+			return err
+		}
+		if err := trimmed.Delete(&rss.Item{}).Error; err != nil {
+			return err
+		}
+		// The items are gone, so there's nothing left for their changes to
+		// apply to
+		for chunk := range slices.Chunk(guids, saveBatchSize) {
+			err := tx.Where("kind IN ? AND target IN ?", []string{ChangeRead, ChangeStarred}, chunk).
+				Delete(&Change{}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *FeedRepository) AddRule(ctx context.Context, rule *rules.Rule) error {
+	return r.db.WithContext(ctx).Create(rule).Error
+}
+
+func (r *FeedRepository) Rules(ctx context.Context) ([]rules.Rule, error) {
+	var all []rules.Rule
+	err := r.db.WithContext(ctx).Order("id").Find(&all).Error
+	return all, err
+}
+
+func (r *FeedRepository) DeleteRule(ctx context.Context, id uint) error {
+	result := r.db.WithContext(ctx).Unscoped().Delete(&rules.Rule{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
 }
 
-func (r *FeedRepository) Vacuum() error {
-	return r.db.Exec("VACUUM").Error
+func (r *FeedRepository) Vacuum(ctx context.Context) error {
+	return r.db.WithContext(ctx).Exec("VACUUM").Error
 }
 
 func (r *FeedRepository) Close() error {
-	sqliteDb, err := r.db.DB()
+	sqlDb, err := r.db.DB()
 	if err != nil {
 		return err
 	}
-	return sqliteDb.Close()
+	return sqlDb.Close()
 }
@@ -6,13 +6,15 @@ See LICENSE in the project root for full license information.
 package repository_test
 
 import (
+	"os"
 	"testing"
-	"time"
 
-	"github.com/google/go-cmp/cmp"
-	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/mikerowehl/feeder/internal/repository"
 	"github.com/mikerowehl/feeder/internal/rss"
+	"github.com/mikerowehl/feeder/pkg/feeder"
+	"github.com/mikerowehl/feeder/pkg/feeder/storetest"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -45,9 +47,9 @@ func TestRepository_BasicSaveAndLoad(t *testing.T) {
 	r := setupRepository(t)
 	feedUrl := "https://test.com/sample.rss"
 	testFeed := rss.Feed{URL: feedUrl}
-	err := r.Save(&testFeed)
+	err := r.Save(t.Context(), &testFeed)
 	require.NoError(t, err)
-	fetchedFeeds, err := r.All()
+	fetchedFeeds, err := r.All(t.Context())
 	require.NoError(t, err)
 	require.Len(t, fetchedFeeds, 1)
 	feed1 := fetchedFeeds[0]
@@ -58,237 +60,48 @@ func TestRepository_UniqueURLViolation(t *testing.T) {
 	r := setupRepository(t)
 	feedUrl := "https://test.com/sample.rss"
 	testFeed1 := rss.Feed{URL: feedUrl}
-	err := r.Save(&testFeed1)
+	err := r.Save(t.Context(), &testFeed1)
 	require.NoError(t, err)
 	testFeed2 := rss.Feed{URL: feedUrl}
-	err = r.Save(&testFeed2)
+	err = r.Save(t.Context(), &testFeed2)
 	require.Error(t, err)
 	// Unfortunately the sqlite driver doesn't return the nice duplicate key
 	// GORM level error, so check the text.
 	assert.Contains(t, err.Error(), "UNIQUE constraint failed")
 }
 
-func TestRepository_FeedWithItems(t *testing.T) {
-	r := setupRepository(t)
-	feeds := []rss.Feed{
-		{Title: "Test Feed 1",
-			URL: "https://test.com/sample.rss",
-			Items: []rss.Item{
-				{GUID: "1", Content: "test item 1", Published: time.Now()},
-			},
-		}}
-	err := r.Save(&(feeds[0]))
-	require.NoError(t, err)
-	fetched, err := r.All()
-	require.NoError(t, err)
-	diff := cmp.Diff(feeds, fetched)
-	if diff != "" {
-		t.Errorf("Mismatch single feed:\n%s", diff)
-	}
+func TestRepository_SQLiteConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) feeder.Store {
+		return setupRepository(t)
+	})
 }
 
-func TestRepository_MultipleFeeds(t *testing.T) {
-	r := setupRepository(t)
-	feeds := []rss.Feed{
-		{Title: "Feed 1", URL: "https://example.com/feed1.rss", Items: []rss.Item{
-			{Title: "Feed 1 Item 1",
-				Link:      "https://feed1.com/i1",
-				Content:   "content for 1/1",
-				GUID:      "guid1",
-				Published: time.Now().Add(time.Duration(-48) * time.Hour)},
-			{Title: "Feed 1 Item 2",
-				Link:      "https://feed1.com/i2",
-				Content:   "content for 1/2",
-				GUID:      "guid2",
-				Published: time.Now().Add(time.Duration(-24) * time.Hour)},
-		}},
-		{Title: "Feed 2", URL: "https://example.com/feed2.rss", Items: []rss.Item{
-			{Title: "Feed 2 Item 1",
-				Link:      "https://feed2.com/i1",
-				Content:   "content for 2/1",
-				GUID:      "guid10",
-				Published: time.Now().Add(time.Duration(-2) * time.Hour)},
-			{Title: "Feed 2 Item 2",
-				Link:      "https://feed2.com/i2",
-				Content:   "content for 2/2",
-				GUID:      "guid11",
-				Published: time.Now().Add(time.Duration(-1) * time.Hour)},
-		}},
+// Set FEEDER_TEST_POSTGRES_DSN to a scratch database to run the same checks
+// against PostgreSQL, CI runs them against a PostgreSQL service container.
+// Every table in the database is dropped before each test, so don't point it
+// at anything you want to keep.
+func TestRepository_PostgresConformance(t *testing.T) {
+	dsn := os.Getenv("FEEDER_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("FEEDER_TEST_POSTGRES_DSN not set")
 	}
-	for _, feed := range feeds {
-		err := r.Save(&feed)
+	storetest.Run(t, func(t *testing.T) feeder.Store {
+		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
 		require.NoError(t, err)
-	}
-	fetched, err := r.All()
-	require.NoError(t, err)
-	diff := cmp.Diff(feeds, fetched,
-		cmpopts.IgnoreFields(rss.Feed{}, "ID", "CreatedAt", "UpdatedAt", "DeletedAt"),
-		cmpopts.IgnoreFields(rss.Item{}, "ID", "CreatedAt", "UpdatedAt", "DeletedAt", "FeedID"),
-		cmpopts.SortSlices(func(a, b rss.Feed) bool {
-			return a.Title < b.Title
-		}),
-		cmpopts.SortSlices(func(a, b rss.Item) bool {
-			return a.Title < b.Title
-		}),
-	)
-	if diff != "" {
-		t.Errorf("Mismatch multiple feeds:\n%s", diff)
-	}
-}
-
-func TestRepository_Delete(t *testing.T) {
-	r := setupRepository(t)
-	feeds := []rss.Feed{
-		{Title: "Feed 1", URL: "https://example.com/feed1.rss", Items: []rss.Item{
-			{Title: "Feed 1 Item 1",
-				Link:      "https://feed1.com/i1",
-				Content:   "content for 1/1",
-				GUID:      "guid1",
-				Published: time.Now().Add(time.Duration(-48) * time.Hour)},
-			{Title: "Feed 1 Item 2",
-				Link:      "https://feed1.com/i2",
-				Content:   "content for 1/2",
-				GUID:      "guid2",
-				Published: time.Now().Add(time.Duration(-24) * time.Hour)},
-		}},
-		{Title: "Feed 2", URL: "https://example.com/feed2.rss", Items: []rss.Item{
-			{Title: "Feed 2 Item 1",
-				Link:      "https://feed2.com/i1",
-				Content:   "content for 2/1",
-				GUID:      "guid10",
-				Published: time.Now().Add(time.Duration(-2) * time.Hour)},
-			{Title: "Feed 2 Item 2",
-				Link:      "https://feed2.com/i2",
-				Content:   "content for 2/2",
-				GUID:      "guid11",
-				Published: time.Now().Add(time.Duration(-1) * time.Hour)},
-		}},
-	}
-	for i := range feeds {
-		err := r.Save(&feeds[i])
+		tables, err := db.Migrator().GetTables()
 		require.NoError(t, err)
-	}
-	err := r.Delete(feeds[0].ID)
-	require.NoError(t, err)
-	fetched, err := r.All()
-	require.NoError(t, err)
-	require.Len(t, fetched, 1)
-	require.Equal(t, fetched[0].Title, "Feed 2")
-	require.Len(t, fetched[0].Items, 2)
-	fetchedItems, err := r.AllItems()
-	require.NoError(t, err)
-	require.Len(t, fetchedItems, 2)
-}
-
-func TestRepository_Unread(t *testing.T) {
-	r := setupRepository(t)
-	feedUrl := "https://test.com/sample.rss"
-	testFeed := rss.Feed{URL: feedUrl}
-	err := r.Save(&testFeed)
-	require.NoError(t, err)
-	feedId := testFeed.ID
-	testItem1 := rss.Item{
-		FeedID:    feedId,
-		GUID:      "1",
-		Content:   "test item 1",
-		Read:      true,
-		Published: time.Now().Add(time.Duration(-3) * time.Hour)}
-	testItem2 := rss.Item{
-		FeedID:    feedId,
-		GUID:      "2",
-		Content:   "test item 2",
-		Read:      false,
-		Published: time.Now().Add(time.Duration(-2) * time.Hour)}
-	testItem3 := rss.Item{
-		FeedID:    feedId,
-		GUID:      "3",
-		Content:   "test item 3",
-		Read:      false,
-		Published: time.Now().Add(time.Duration(-1) * time.Hour)}
-	testFeed.Items = append(testFeed.Items, testItem1, testItem2, testItem3)
-	err = r.Save(&testFeed)
-	require.NoError(t, err)
-	unread, err := r.Unread()
-	require.NoError(t, err)
-	require.Len(t, unread, 1)
-	require.Len(t, unread[0].Items, 2)
-	// Test the ordering, reverse chronological
-	assert.Equal(t, "3", unread[0].Items[0].GUID)
-	assert.Equal(t, "2", unread[0].Items[1].GUID)
-}
-
-func TestRepository_MarkAll(t *testing.T) {
-	r := setupRepository(t)
-	feeds := []rss.Feed{
-		{Title: "Test Feed 1",
-			URL:   "https://test.com/sample.rss",
-			Items: []rss.Item{{GUID: "1", Content: "test item 1"}},
-		}}
-	err := r.Save(&(feeds[0]))
-	require.NoError(t, err)
-	err = r.MarkAll()
-	require.NoError(t, err)
-	fetched, err := r.Unread()
-	require.NoError(t, err)
-	require.Len(t, fetched, 1)
-	require.Len(t, fetched[0].Items, 0)
-}
+		for _, table := range tables {
+			require.NoError(t, db.Migrator().DropTable(table))
+		}
+		sqlDb, err := db.DB()
+		require.NoError(t, err)
+		require.NoError(t, sqlDb.Close())
 
-func TestRepository_TrimItems(t *testing.T) {
-	r := setupRepository(t)
-	feeds := []rss.Feed{
-		{Title: "Feed 1", URL: "https://example.com/feed1.rss", Items: []rss.Item{
-			{Title: "Feed 1 Item 1",
-				Link:      "https://feed1.com/i1",
-				Content:   "content for 1/1",
-				GUID:      "guid1",
-				Published: time.Now().Add(time.Duration(-48) * time.Hour)},
-			{Title: "Feed 1 Item 2",
-				Link:      "https://feed1.com/i2",
-				Content:   "content for 1/2",
-				GUID:      "guid2",
-				Published: time.Now().Add(time.Duration(-24) * time.Hour)},
-			{Title: "Feed 1 Item 3",
-				Link:      "https://feed1.com/i3",
-				Content:   "content for 1/3",
-				GUID:      "guid3",
-				Published: time.Now().Add(time.Duration(-2) * time.Hour)},
-			{Title: "Feed 1 Item 4",
-				Link:      "https://feed1.com/i4",
-				Content:   "content for 1/4",
-				GUID:      "guid4",
-				Published: time.Now().Add(time.Duration(-1) * time.Hour)},
-		}},
-		{Title: "Feed 2", URL: "https://example.com/feed2.rss", Items: []rss.Item{
-			{Title: "Feed 2 Item 1",
-				Link:      "https://feed2.com/i1",
-				Content:   "content for 2/1",
-				GUID:      "guid10",
-				Published: time.Now().Add(time.Duration(-2) * time.Hour)},
-			{Title: "Feed 2 Item 2",
-				Link:      "https://feed2.com/i2",
-				Content:   "content for 2/2",
-				GUID:      "guid11",
-				Published: time.Now().Add(time.Duration(-1) * time.Hour)},
-		}},
-	}
-	for i := range feeds {
-		err := r.Save(&feeds[i])
+		r, err := repository.NewPostgresRepository(dsn)
 		require.NoError(t, err)
-	}
-	err := r.TrimItems(feeds[0].ID, 2)
-	require.NoError(t, err)
-	err = r.TrimItems(feeds[1].ID, 2)
-	require.NoError(t, err)
-	fetched, err := r.All()
-	require.NoError(t, err)
-	require.Len(t, fetched, 2)
-	for i := range fetched {
-		feed := fetched[i]
-		if feed.Title == "Feed 1" {
-			require.Len(t, feed.Items, 2)
-		} else if feed.Title == "Feed 2" {
-			require.Len(t, feed.Items, 2)
-		}
-	}
+		t.Cleanup(func() {
+			assert.NoError(t, r.Close())
+		})
+		return r
+	})
 }
@@ -0,0 +1,72 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// ErrLocked is returned when another process holds the database lock for
+// longer than we're willing to wait.
+var ErrLocked = errors.New("database is in use by another feeder process")
+
+const lockRetryDelay = 100 * time.Millisecond
+
+// Lock is an advisory lock on a SQLite database file, kept in a separate
+// file next to it. SQLite handles concurrent readers and writers itself, so
+// most commands only hold the lock shared. Commands that rewrite the whole
+// file, like the VACUUM after trimming, hold it exclusively so they don't
+// run while anything else has the database open.
+type Lock struct {
+	file *flock.Flock
+}
+
+// LockPath is the lock file used for the database at filename.
+func LockPath(filename string) string {
+	return filename + ".lock"
+}
+
+// AcquireLock takes the lock for the database at filename, waiting up to
+// timeout for other processes to let go of it. An in-memory database can't
+// be shared, so there's nothing to lock and the returned lock does nothing.
+func AcquireLock(ctx context.Context, filename string, exclusive bool, timeout time.Duration) (*Lock, error) {
+	if filename == ":memory:" {
+		return &Lock{}, nil
+	}
+	file := flock.New(LockPath(filename))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var locked bool
+	var err error
+	if exclusive {
+		locked, err = file.TryLockContext(ctx, lockRetryDelay)
+	} else {
+		locked, err = file.TryRLockContext(ctx, lockRetryDelay)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, ErrLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, ErrLocked
+	}
+	return &Lock{file: file}, nil
+}
+
+// Release lets go of the lock. The lock file itself is left in place, since
+// removing it could race with another process locking it.
+func (l *Lock) Release() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
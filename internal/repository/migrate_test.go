@@ -0,0 +1,58 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package repository_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mikerowehl/feeder/internal/repository"
+	"github.com/mikerowehl/feeder/internal/rss"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The items table the way it was when GUIDs had to be unique across every
+// feed
+type uniqueGUIDItem struct {
+	gorm.Model
+	FeedID uint `gorm:"index"`
+	Title  string
+	Link   string
+	GUID   string `gorm:"unique"`
+}
+
+func (uniqueGUIDItem) TableName() string { return "items" }
+
+func TestRepository_MigrateFeedGUIDs(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "old.db")
+	old, err := gorm.Open(sqlite.Dialector{DriverName: "sqlite", DSN: filename}, &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, old.AutoMigrate(&rss.Feed{}, &uniqueGUIDItem{}))
+	require.NoError(t, old.Create(&rss.Feed{URL: "https://example.com/feed.xml"}).Error)
+	require.NoError(t, old.Create(&uniqueGUIDItem{FeedID: 1, Title: "Kept", GUID: "https://example.com/story"}).Error)
+	sqlDb, err := old.DB()
+	require.NoError(t, err)
+	require.NoError(t, sqlDb.Close())
+
+	r, err := repository.NewFeedRepository(filename)
+	require.NoError(t, err)
+	defer r.Close()
+	other := rss.Feed{URL: "https://other.example.com/feed.xml"}
+	require.NoError(t, r.Save(t.Context(), &other))
+	require.NoError(t, r.SaveItems(t.Context(), []rss.Item{{FeedID: other.ID, Title: "Shared", GUID: "https://example.com/story"}}))
+
+	items, err := r.AllItems(t.Context())
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.ElementsMatch(t, []string{"Kept", "Shared"}, []string{items[0].Title, items[1].Title})
+
+	err = r.SaveItems(t.Context(), []rss.Item{{FeedID: other.ID, Title: "Again", GUID: "https://example.com/story"}})
+	assert.Error(t, err, "still unique within a feed")
+}
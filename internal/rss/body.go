@@ -0,0 +1,177 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package rss
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/html/charset"
+)
+
+// DefaultMaxBodySize is the most a feed or page can be, once decompressed,
+// when the context doesn't set a limit.
+const DefaultMaxBodySize int64 = 10 << 20
+
+// ErrBodyTooLarge is returned for a feed or page bigger than the limit.
+var ErrBodyTooLarge = errors.New("response too large")
+
+// Content encodings we can undo, sent with every request. Asking for them
+// ourselves turns off the transparent gzip support in net/http, so gzip is
+// handled here along with the others.
+const acceptEncoding = "gzip, deflate, br"
+
+type maxBodySizeKey struct{}
+
+// WithMaxBodySize sets the biggest feed or page, in bytes, that fetches
+// made with the returned context will read.
+func WithMaxBodySize(ctx context.Context, size int64) context.Context {
+	return context.WithValue(ctx, maxBodySizeKey{}, size)
+}
+
+func maxBodySize(ctx context.Context) int64 {
+	if size, ok := ctx.Value(maxBodySizeKey{}).(int64); ok && size > 0 {
+		return size
+	}
+	return DefaultMaxBodySize
+}
+
+// ReadBody reads a whole web page or other response body the way feeds are
+// read, as UTF-8 and failing with ErrBodyTooLarge past the limit set with
+// WithMaxBodySize.
+func ReadBody(ctx context.Context, resp *http.Response) ([]byte, error) {
+	return readBody(ctx, resp)
+}
+
+// Read a whole response body as UTF-8, undoing any content encoding and
+// stopping with ErrBodyTooLarge once it's bigger than the limit.
+func readBody(ctx context.Context, resp *http.Response) ([]byte, error) {
+	limit := maxBodySize(ctx)
+	tooLarge := fmt.Errorf("%w: more than the limit of %d bytes", ErrBodyTooLarge, limit)
+	if resp.ContentLength > limit && resp.Header.Get("Content-Encoding") == "" {
+		return nil, tooLarge
+	}
+	decoded, err := decodeContent(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+	// The limit applies after decompression, so a small compressed response
+	// can't expand into something huge
+	body, err := io.ReadAll(io.LimitReader(decoded, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, tooLarge
+	}
+	return toUTF8(body, resp.Header.Get("Content-Type"))
+}
+
+// Undo the Content-Encoding, which lists the encodings in the order they
+// were applied.
+func decodeContent(body io.Reader, contentEncoding string) (io.Reader, error) {
+	encodings := strings.Split(contentEncoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var err error
+		switch strings.ToLower(strings.TrimSpace(encodings[i])) {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			body, err = gzip.NewReader(body)
+		case "deflate":
+			body, err = inflate(body)
+		case "br":
+			body = brotli.NewReader(body)
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", encodings[i])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s response: %w", encodings[i], err)
+		}
+	}
+	return body, nil
+}
+
+// Deflate is meant to be zlib wrapped, but some servers send the raw
+// deflate stream, so check for the zlib header.
+func inflate(body io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(body)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+var (
+	bomUTF8    = []byte{0xef, 0xbb, 0xbf}
+	bomUTF16BE = []byte{0xfe, 0xff}
+	bomUTF16LE = []byte{0xff, 0xfe}
+
+	xmlDeclEncoding = regexp.MustCompile(`^(\s*<\?xml[^>]*?\sencoding\s*=\s*)["']([A-Za-z0-9._:-]+)["']`)
+)
+
+// Convert a body to UTF-8 using, in order, a byte order mark, the charset
+// from the Content-Type, or the encoding in the XML declaration. HTML pages
+// without any of those go by their meta tags. A body in an unknown charset
+// is left as it is for the parser to make what it can of.
+func toUTF8(body []byte, contentType string) ([]byte, error) {
+	var label string
+	switch {
+	case bytes.HasPrefix(body, bomUTF8):
+		return body[len(bomUTF8):], nil
+	case bytes.HasPrefix(body, bomUTF16BE):
+		label = "utf-16be"
+	case bytes.HasPrefix(body, bomUTF16LE):
+		label = "utf-16le"
+	default:
+		label = declaredCharset(body, contentType)
+	}
+	if label == "" {
+		return body, nil
+	}
+	enc, name := charset.Lookup(label)
+	if enc == nil || name == "utf-8" {
+		return body, nil
+	}
+	decoded, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return nil, fmt.Errorf("error converting from %s: %w", name, err)
+	}
+	decoded = bytes.TrimPrefix(decoded, []byte("\ufeff"))
+	// The parser goes by the XML declaration, which would have it decode
+	// the already converted text a second time
+	return xmlDeclEncoding.ReplaceAll(decoded, []byte(`${1}"UTF-8"`)), nil
+}
+
+func declaredCharset(body []byte, contentType string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err == nil && params["charset"] != "" {
+		return params["charset"]
+	}
+	if m := xmlDeclEncoding.FindSubmatch(body); m != nil {
+		return string(m[2])
+	}
+	if mediaType == "text/html" {
+		_, name, _ := charset.DetermineEncoding(body, contentType)
+		return name
+	}
+	return ""
+}
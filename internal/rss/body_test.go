@@ -0,0 +1,127 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package rss_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/mikerowehl/feeder/internal/rss"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Serve body as is with the given headers, the way a server would send a
+// precompressed or non UTF-8 file.
+func serveRaw(t *testing.T, body []byte, headers map[string]string) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestFeed_Charsets(t *testing.T) {
+	tests := []struct {
+		file        string
+		contentType string
+		title       string
+		item        string
+	}{
+		{"iso-8859-1.xml", "application/rss+xml", "Café crème", "Señor Müller à Zürich"},
+		{"windows-1252.xml", "application/rss+xml; charset=windows-1252", "“Smart” quotes", "Prices in € – today"},
+		{"shift_jis.xml", "text/xml", "日本語のフィード", "こんにちは世界"},
+		{"utf-16.xml", "application/xml", "Ünïcödé sixteen", "Ελληνικά"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			body, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			require.NoError(t, err)
+			url := serveRaw(t, body, map[string]string{"Content-Type": tt.contentType})
+
+			feed, err := rss.FeedFromURL(t.Context(), url, http.DefaultClient)
+			require.NoError(t, err)
+			assert.Equal(t, tt.title, feed.Title)
+			items, err := rss.FetchItems(t.Context(), url, http.DefaultClient, 10)
+			require.NoError(t, err)
+			require.Len(t, items, 1)
+			assert.Equal(t, tt.item, items[0].Title)
+		})
+	}
+}
+
+func TestFeed_ContentEncodings(t *testing.T) {
+	compress := map[string]func(io.Writer) io.WriteCloser{
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"br":   func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser {
+			return zlib.NewWriter(w)
+		},
+		"raw deflate": func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		},
+	}
+	for name, newWriter := range compress {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newWriter(&buf)
+			_, err := w.Write([]byte(basicFeed))
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			encoding, _, _ := strings.Cut(name, " ")
+			if name == "raw deflate" {
+				encoding = "deflate"
+			}
+			url := serveRaw(t, buf.Bytes(), map[string]string{"Content-Encoding": encoding})
+
+			content, err := rss.FetchFeedContent(t.Context(), url, http.DefaultClient)
+			require.NoError(t, err)
+			assert.Equal(t, basicFeed, content)
+		})
+	}
+
+	url := serveRaw(t, []byte(basicFeed), map[string]string{"Content-Encoding": "compress"})
+	_, err := rss.FetchFeedContent(t.Context(), url, http.DefaultClient)
+	assert.ErrorContains(t, err, "unsupported content encoding")
+}
+
+func TestFeed_MaxBodySize(t *testing.T) {
+	url := serveRaw(t, []byte(basicFeed), nil)
+	ctx := rss.WithMaxBodySize(t.Context(), 100)
+	_, err := rss.FetchFeedContent(ctx, url, http.DefaultClient)
+	require.ErrorIs(t, err, rss.ErrBodyTooLarge)
+
+	content, err := rss.FetchFeedContent(rss.WithMaxBodySize(t.Context(), int64(len(basicFeed))), url, http.DefaultClient)
+	require.NoError(t, err)
+	assert.Equal(t, basicFeed, content)
+
+	// Checked after decompressing, so a small response can't blow up
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err = w.Write(bytes.Repeat([]byte(" "), 1<<20))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Less(t, buf.Len(), 10<<10)
+	url = serveRaw(t, buf.Bytes(), map[string]string{"Content-Encoding": "gzip"})
+	_, err = rss.FetchFeedContent(rss.WithMaxBodySize(t.Context(), 64<<10), url, http.DefaultClient)
+	assert.ErrorIs(t, err, rss.ErrBodyTooLarge)
+}
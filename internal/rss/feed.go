@@ -6,6 +6,10 @@ See LICENSE in the project root for full license information.
 package rss
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
@@ -13,9 +17,11 @@ import (
 	"net/url"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/mikerowehl/feeder/internal/httpclient"
 	"github.com/mmcdole/gofeed"
 	"golang.org/x/net/html"
 	"gorm.io/gorm"
@@ -26,31 +32,190 @@ type Feed struct {
 	URL   string `gorm:"unique"`
 	Title string
 	Items []Item `gorm:"constraint:OnDelete:CASCADE;"`
+	// When an item we already have comes back with different content, put
+	// it back in the unread list.
+	MarkUpdatedUnread bool
+	// Fetch the page each new item links to and extract the article, for
+	// feeds that only publish a summary.
+	FetchFullContent bool
+	// Shell command the fetched content is piped through before parsing,
+	// see Filter
+	Filter string
+	// Selectors for pulling items out of a page that isn't a feed
+	Scrape Scraper `gorm:"embedded;embeddedPrefix:scrape_"`
+	// Send a notification for every new item
+	Notify bool
+	// Leave the feed alone until this time, set when its server asks us to
+	// back off with a Retry-After
+	FetchAfter time.Time
 }
 
 type Item struct {
 	gorm.Model
-	FeedID    uint
-	Title     string
-	Link      string
-	Content   string
-	GUID      string `gorm:"unique"`
-	Published time.Time
-	Read      bool
+	FeedID  uint `gorm:"index;uniqueIndex:idx_items_feed_guid"`
+	Title   string
+	Link    string
+	Content string
+	Summary string
+	// Article extracted from the linked page, when the feed has
+	// FetchFullContent turned on.
+	FullContent string
+	Author      string
+	Image       string
+	// Unique within the feed. Feeds without guids fall back on the link,
+	// so two feeds linking the same article have items with the same GUID.
+	GUID       string `gorm:"uniqueIndex:idx_items_feed_guid"`
+	Published  time.Time
+	Updated    time.Time
+	Read       bool
+	Starred    bool
+	Enclosures []Enclosure `gorm:"constraint:OnDelete:CASCADE;"`
+	Categories []Category  `gorm:"constraint:OnDelete:CASCADE;"`
+	Tags       []Tag       `gorm:"constraint:OnDelete:CASCADE;"`
+	// Hash of the title and content, used to notice when a feed changes an
+	// item we already have. Revised gets set when that happens, and the
+	// earlier versions are kept in Revisions, up to MaxRevisions of them.
+	ContentHash string
+	Revised     bool
+	Revisions   []ItemRevision `gorm:"constraint:OnDelete:CASCADE;"`
+	// Items from other feeds covering the same story share a cluster. The
+	// ID is the ID of the first item in the cluster, zero means none.
+	ClusterID uint `gorm:"index"`
+}
+
+// Tag is a label we put on an item ourselves, as opposed to a Category which
+// comes from the feed.
+type Tag struct {
+	gorm.Model
+	ItemID uint   `gorm:"index"`
+	Name   string `gorm:"index"`
+}
+
+// AddTag adds a tag to the item if it doesn't already have it.
+func (item *Item) AddTag(name string) {
+	for _, tag := range item.Tags {
+		if strings.EqualFold(tag.Name, name) {
+			return
+		}
+	}
+	item.Tags = append(item.Tags, Tag{Name: name})
+}
+
+// ItemRevision is an earlier version of an item that's since been changed
+// by the feed.
+type ItemRevision struct {
+	gorm.Model
+	ItemID      uint `gorm:"index"`
+	Title       string
+	Content     string
+	Summary     string
+	Updated     time.Time
+	ContentHash string
+}
+
+// MaxRevisions is how many earlier versions of an item are kept. Older ones
+// are dropped when the item is saved, so an item that changes on every
+// fetch doesn't grow without end.
+const MaxRevisions = 10
+
+// Hash gives a stable hash of the parts of an item that we consider its
+// content. Only changes to these count as a revision.
+func (item *Item) Hash() string {
+	h := sha256.New()
+	h.Write([]byte(item.Title))
+	h.Write([]byte{0})
+	h.Write([]byte(item.Content))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Revise replaces the content of an item with a newer version, keeping the
+// current content as a revision.
+func (item *Item) Revise(newer Item, markUnread bool) {
+	if item.ContentHash == "" {
+		item.ContentHash = item.Hash()
+	}
+	item.Revisions = append(item.Revisions, ItemRevision{
+		Title:       item.Title,
+		Content:     item.Content,
+		Summary:     item.Summary,
+		Updated:     item.Updated,
+		ContentHash: item.ContentHash,
+	})
+	item.Title = newer.Title
+	item.Content = newer.Content
+	item.Summary = newer.Summary
+	item.Updated = newer.Updated
+	item.ContentHash = newer.ContentHash
+	item.Revised = true
+	if markUnread {
+		item.Read = false
+	}
+}
+
+// Category is a tag or category the feed assigned to an item. Kept as a
+// separate table so we can look up items by category.
+type Category struct {
+	gorm.Model
+	ItemID uint   `gorm:"index"`
+	Name   string `gorm:"index"`
+}
+
+// StatusError is returned when a feed's server answers with something other
+// than 200 OK. For a 429 or 503 with a Retry-After header, RetryAfter is
+// when the server said to try again.
+type StatusError struct {
+	Status     string
+	StatusCode int
+	RetryAfter time.Time
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected http status: %v", e.Status)
+}
+
+// MaxRetryAfter is the furthest off a Retry-After is followed, so a server
+// asking for something silly doesn't stop a feed for good.
+const MaxRetryAfter = 7 * 24 * time.Hour
+
+// The time a Retry-After header says to come back, either a number of
+// seconds or an HTTP date. Zero if there isn't one or it doesn't parse.
+func retryAfter(value string, now time.Time) time.Time {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}
+	}
+	var when time.Time
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds >= 0 {
+		when = now.Add(time.Duration(min(seconds, int64(MaxRetryAfter/time.Second))) * time.Second)
+	} else if date, err := http.ParseTime(value); err == nil {
+		when = date
+	} else {
+		return time.Time{}
+	}
+	if limit := now.Add(MaxRetryAfter); when.After(limit) {
+		return limit
+	}
+	return when
 }
 
 // Makes the web request to fetch the content of the feed, setting headers and
 // checking the return. If no error, the returned string is the full content
-// of the feed.
+// of the feed, decompressed and converted to UTF-8. Feeds bigger than the
+// limit set with WithMaxBodySize return ErrBodyTooLarge, and any status but
+// 200 returns a StatusError.
 // TODO put in etag and modified check
-func FetchFeedContent(url string, client *http.Client) (string, error) {
-	req, err := http.NewRequest("GET", url, nil)
+func FetchFeedContent(ctx context.Context, url string, client *http.Client) (string, error) {
+	if IsLocalSource(url) {
+		return fetchLocal(ctx, url)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return "", err
 	}
 
 	req.Header.Set("Accept", "application/rss+xml, application/atom+xml, application/xml;q=0.9, text/xml;q=0.8, */*;q=0.7")
-	req.Header.Set("User-Agent", "Feeder/0.0 (+https://github.com/mikerowehl/feeder)")
+	req.Header.Set("User-Agent", httpclient.DefaultUserAgent)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -63,100 +228,224 @@ func FetchFeedContent(url string, client *http.Client) (string, error) {
 	}()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("unexpected http status: %v", resp.Status)
+		statusErr := &StatusError{Status: resp.Status, StatusCode: resp.StatusCode}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			statusErr.RetryAfter = retryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		return "", statusErr
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := readBody(ctx, resp)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("error reading %s: %w", url, err)
 	}
 	return string(body), nil
 }
 
-// Given a URL try to figure out if this is a feed URL, and lok up the feed
-// URL if this isn't a feed already. We do a HEAD request and check the
-// content type returned to try to figure out if this is a feed. If it's not a
-// feed, but it's HTML, parse the HTML and look for a feed alternative link in
-// the document header and return that.
-func GetFeedURL(givenURL string, client *http.Client) (string, error) {
-	req, err := http.NewRequest("HEAD", givenURL, nil)
-	if err != nil {
-		return "", err
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
+// FeedLink is a candidate feed found while trying to discover the feed for a
+// URL given by the user. Title and Type are whatever the page (or the probed
+// feed itself) told us, and may be empty.
+type FeedLink struct {
+	URL   string
+	Title string
+	Type  string
+	// Filter command for the feed added from the link, which has to be run
+	// before the content can be parsed
+	Filter string
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("bad status for http request %v", resp.StatusCode)
-	}
+// Feed types we accept in an alternate link header.
+var feedLinkTypes = []string{
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/feed+json",
+	"application/json",
+}
 
-	contentType := resp.Header.Get("Content-Type")
+// Paths that are commonly used for feeds. When a page doesn't have any
+// alternate links we try each of these relative to the root of the site.
+var CommonFeedPaths = []string{
+	"/feed",
+	"/rss.xml",
+	"/atom.xml",
+	"/index.xml",
+	"/feed.json",
+}
 
-	if strings.Contains(contentType, "application/rss+xml") ||
+func isFeedContentType(contentType string) bool {
+	return strings.Contains(contentType, "application/rss+xml") ||
 		strings.Contains(contentType, "application/atom+xml") ||
+		strings.Contains(contentType, "application/feed+json") ||
 		strings.Contains(contentType, "application/xml") ||
-		strings.Contains(contentType, "text/xml") {
-		return givenURL, nil
+		strings.Contains(contentType, "text/xml")
+}
+
+// Do a HEAD request to find out the content type of a URL. Some servers don't
+// allow HEAD and return 405 (or 501), in that case fall back to a GET and just
+// look at the headers.
+func headContentType(ctx context.Context, givenURL string, client *http.Client) (string, error) {
+	for _, method := range []string{"HEAD", "GET"} {
+		req, err := http.NewRequestWithContext(ctx, method, givenURL, nil)
+		if err != nil {
+			return "", err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			log.Printf("failed to close body: %v", closeErr)
+		}
+
+		if method == "HEAD" && (resp.StatusCode == http.StatusMethodNotAllowed ||
+			resp.StatusCode == http.StatusNotImplemented) {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("bad status for http request %v", resp.StatusCode)
+		}
+		return resp.Header.Get("Content-Type"), nil
+	}
+	return "", fmt.Errorf("unable to determine content type for %s", givenURL)
+}
+
+// Given a URL try to figure out if this is a feed URL, and look up the feed
+// URLs if this isn't a feed already. We do a HEAD request and check the
+// content type returned to try to figure out if this is a feed. If it's a
+// feed the only candidate is the URL itself. If it's HTML, parse the HTML and
+// return all the feed alternative links in the document header. Files and
+// commands are always the feed itself.
+func FeedCandidates(ctx context.Context, givenURL string, client *http.Client) ([]FeedLink, error) {
+	if IsLocalSource(givenURL) {
+		return []FeedLink{{URL: givenURL}}, nil
+	}
+	contentType, err := headContentType(ctx, givenURL, client)
+	if err != nil {
+		return nil, err
+	}
+
+	if isFeedContentType(contentType) {
+		return []FeedLink{{URL: givenURL, Type: contentType}}, nil
 	}
 
 	if strings.Contains(contentType, "text/html") {
-		return DiscoverFeed(givenURL, client)
+		return DiscoverFeeds(ctx, givenURL, client)
 	}
 
-	return "", fmt.Errorf("unexpected content type: %s", contentType)
+	return nil, fmt.Errorf("unexpected content type: %s", contentType)
 }
 
-// Look for an alternative link header in the HTML content of a page. This is
-// called after we do a HEAD on the URL given and we know it's HTML, so we
-// just need to fetch it and try to parse.
-func DiscoverFeed(givenURL string, client *http.Client) (string, error) {
-	req, err := http.NewRequest("GET", givenURL, nil)
+// Given a URL try to figure out if this is a feed URL, and look up the feed
+// URL if this isn't a feed already. If the page lists more than one feed the
+// first one is returned.
+func GetFeedURL(ctx context.Context, givenURL string, client *http.Client) (string, error) {
+	candidates, err := FeedCandidates(ctx, givenURL, client)
 	if err != nil {
 		return "", err
 	}
+	return candidates[0].URL, nil
+}
+
+// Look for alternative link headers in the HTML content of a page. This is
+// called after we do a HEAD on the URL given and we know it's HTML, so we
+// just need to fetch it and try to parse. If there aren't any links in the
+// page we fall back to probing the common feed paths on the same site.
+func DiscoverFeeds(ctx context.Context, givenURL string, client *http.Client) ([]FeedLink, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", givenURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept-Encoding", acceptEncoding)
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	feedURL, err := FindFeedLink(resp.Body)
+	base, err := url.Parse(givenURL)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	base, err := url.Parse(givenURL)
+	page, err := readBody(ctx, resp)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("error reading %s: %w", givenURL, err)
+	}
+	links, err := FindFeedLinks(bytes.NewReader(page))
+	if err != nil {
+		return nil, err
+	}
+	if len(links) == 0 {
+		links = ProbeFeeds(ctx, givenURL, client)
+		if len(links) == 0 {
+			return nil, fmt.Errorf("no feed found")
+		}
+		return links, nil
 	}
-	feed, err := url.Parse(feedURL)
+
+	for i := range links {
+		link, err := url.Parse(links[i].URL)
+		if err != nil {
+			return nil, err
+		}
+		links[i].URL = base.ResolveReference(link).String()
+	}
+	return links, nil
+}
+
+// Look for an alternative link header in the HTML content of a page and
+// return the first feed URL found.
+func DiscoverFeed(ctx context.Context, givenURL string, client *http.Client) (string, error) {
+	links, err := DiscoverFeeds(ctx, givenURL, client)
 	if err != nil {
 		return "", err
 	}
+	return links[0].URL, nil
+}
 
-	return base.ResolveReference(feed).String(), nil
+// Try each of the common feed paths on the site the given URL is on. Only
+// paths that return something we can parse as a feed are returned.
+func ProbeFeeds(ctx context.Context, givenURL string, client *http.Client) []FeedLink {
+	base, err := url.Parse(givenURL)
+	if err != nil {
+		return nil
+	}
+	var found []FeedLink
+	for _, path := range CommonFeedPaths {
+		probeURL := base.ResolveReference(&url.URL{Path: path}).String()
+		content, err := FetchFeedContent(ctx, probeURL, client)
+		if err != nil {
+			continue
+		}
+		parsed, err := gofeed.NewParser().ParseString(content)
+		if err != nil {
+			continue
+		}
+		found = append(found, FeedLink{
+			URL:   probeURL,
+			Title: parsed.Title,
+			Type:  parsed.FeedType,
+		})
+	}
+	return found
 }
 
-// Parse the content of a page looking for the alternate link.
-func FindFeedLink(r io.Reader) (string, error) {
+// Parse the content of a page looking for all the alternate links that point
+// to feeds, in document order.
+func FindFeedLinks(r io.Reader) ([]FeedLink, error) {
 	doc, err := html.Parse(r)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var feedURL string
+	var links []FeedLink
 	var f func(*html.Node)
 	f = func(n *html.Node) {
-		if feedURL != "" {
-			return // Already found
-		}
-
 		if n.Type == html.ElementNode && n.Data == "link" {
-			var rel, typ, href string
+			var rel, typ, href, title string
 			for _, attr := range n.Attr {
 				switch attr.Key {
 				case "rel":
@@ -165,15 +454,16 @@ func FindFeedLink(r io.Reader) (string, error) {
 					typ = attr.Val
 				case "href":
 					href = attr.Val
+				case "title":
+					title = attr.Val
 				}
 			}
 
 			// Check if it's an alternate feed link
-			if rel == "alternate" &&
-				(typ == "application/rss+xml" || typ == "application/atom+xml") &&
+			if slices.Contains(strings.Fields(strings.ToLower(rel)), "alternate") &&
+				slices.Contains(feedLinkTypes, strings.ToLower(typ)) &&
 				href != "" {
-				feedURL = href
-				return
+				links = append(links, FeedLink{URL: href, Title: title, Type: typ})
 			}
 		}
 
@@ -183,11 +473,21 @@ func FindFeedLink(r io.Reader) (string, error) {
 	}
 	f(doc)
 
-	if feedURL == "" {
+	return links, nil
+}
+
+// Parse the content of a page looking for the alternate link.
+func FindFeedLink(r io.Reader) (string, error) {
+	links, err := FindFeedLinks(r)
+	if err != nil {
+		return "", err
+	}
+
+	if len(links) == 0 {
 		return "", fmt.Errorf("no feed found")
 	}
 
-	return feedURL, nil
+	return links[0].URL, nil
 }
 
 // Initially fetch a feed given a URL. Updates just the metadata necessary to
@@ -196,16 +496,27 @@ func FindFeedLink(r io.Reader) (string, error) {
 // first we do a HEAD request and look at the content type. If needed we try
 // to determine the feed URL from the content URL. That means the URL that
 // ends up in the Feed entry in the DB might not match what the user put in.
-func FeedFromURL(url string, client *http.Client) (Feed, error) {
-	feedUrl, err := GetFeedURL(url, client)
+func FeedFromURL(ctx context.Context, url string, client *http.Client) (Feed, error) {
+	feedUrl, err := GetFeedURL(ctx, url, client)
 	if err != nil {
 		feedUrl = url
 	}
-	feed := Feed{URL: feedUrl}
-	content, err := FetchFeedContent(feedUrl, client)
+	return FeedFromLink(ctx, FeedLink{URL: feedUrl, Title: url}, client)
+}
+
+// Fetch the feed for a candidate link and fill in the metadata. If the feed
+// doesn't have a title we use the title from the link instead.
+func FeedFromLink(ctx context.Context, link FeedLink, client *http.Client) (Feed, error) {
+	feed := Feed{URL: link.URL, Filter: link.Filter}
+	content, err := FetchFeedContent(ctx, link.URL, client)
 	if err != nil {
 		return feed, err
 	}
+	if link.Filter != "" {
+		if content, err = Filter(ctx, link.Filter, link.URL, content); err != nil {
+			return feed, err
+		}
+	}
 	fp := gofeed.NewParser()
 	parsed, err := fp.ParseString(content)
 	if err != nil {
@@ -213,13 +524,17 @@ func FeedFromURL(url string, client *http.Client) (Feed, error) {
 	}
 	if parsed.Title != "" {
 		feed.Title = parsed.Title
+	} else if link.Title != "" {
+		feed.Title = link.Title
 	} else {
-		feed.Title = url
+		feed.Title = link.URL
 	}
 	return feed, nil
 }
 
-// Turn a gofeed version of an item into our item.
+// Turn a gofeed version of an item into our item. Content falls back to the
+// description if there's no full content, and Summary is always the
+// description, so we keep both when a feed gives us both.
 func ParsedToItem(parsed *gofeed.Item) Item {
 	guid := parsed.GUID
 	if guid == "" {
@@ -235,47 +550,182 @@ func ParsedToItem(parsed *gofeed.Item) Item {
 	} else {
 		published = time.Now()
 	}
-	return Item{
-		Title:     parsed.Title,
-		Link:      parsed.Link,
-		Content:   content,
-		GUID:      guid,
-		Published: published,
-		Read:      false,
+	updated := published
+	if parsed.UpdatedParsed != nil {
+		updated = *parsed.UpdatedParsed
+	}
+	item := Item{
+		Title:      parsed.Title,
+		Link:       parsed.Link,
+		Content:    content,
+		Summary:    parsed.Description,
+		Author:     parsedAuthor(parsed),
+		Image:      parsedImage(parsed),
+		GUID:       guid,
+		Published:  published,
+		Updated:    updated,
+		Read:       false,
+		Enclosures: parsedEnclosures(parsed),
+		Categories: parsedCategories(parsed),
+	}
+	item.ContentHash = item.Hash()
+	return item
+}
+
+// Join together the names of all the authors. If an author only has an email
+// address we use that, and if there's no author at all try Dublin Core.
+func parsedAuthor(parsed *gofeed.Item) string {
+	var names []string
+	for _, person := range parsed.Authors {
+		if person == nil {
+			continue
+		}
+		name := strings.TrimSpace(person.Name)
+		if name == "" {
+			name = strings.TrimSpace(person.Email)
+		}
+		if name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 && parsed.DublinCoreExt != nil {
+		names = parsed.DublinCoreExt.Creator
 	}
+	return strings.Join(names, ", ")
 }
 
-func (feed *Feed) Fetch(client *http.Client, maxItems int) error {
-	content, err := FetchFeedContent(feed.URL, client)
+func parsedImage(parsed *gofeed.Item) string {
+	if parsed.Image != nil && parsed.Image.URL != "" {
+		return parsed.Image.URL
+	}
+	if parsed.ITunesExt != nil {
+		return parsed.ITunesExt.Image
+	}
+	return ""
+}
+
+func parsedCategories(parsed *gofeed.Item) []Category {
+	var categories []Category
+	seen := make(map[string]bool)
+	for _, name := range parsed.Categories {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		categories = append(categories, Category{Name: name})
+	}
+	return categories
+}
+
+// Fetch gets the current content of the feed and merges it into the items
+// attached to the feed, see Process.
+func (feed *Feed) Fetch(ctx context.Context, client *http.Client, maxItems int) error {
+	items, err := FetchFeedItems(ctx, feed, client, maxItems)
 	if err != nil {
 		return err
 	}
+	feed.Merge(items)
+	return nil
+}
+
+// FetchFeedItems is FetchItems for a stored feed, running the content
+// through the feed's filter command if it has one, and scraping the items
+// from it for a page that isn't a feed. Scraped pages are taken to list the
+// newest items first.
+func FetchFeedItems(ctx context.Context, feed *Feed, client *http.Client, maxItems int) ([]Item, error) {
+	content, err := FetchFeedContent(ctx, feed.URL, client)
+	if err != nil {
+		return nil, err
+	}
+	return feed.ParseContent(ctx, content, maxItems)
+}
 
-	return feed.Process(content, maxItems)
+// ParseContent turns content already fetched for a feed, or pushed to us by
+// a hub, into items the same way FetchFeedItems does.
+func (feed *Feed) ParseContent(ctx context.Context, content string, maxItems int) ([]Item, error) {
+	var err error
+	if feed.Filter != "" {
+		if content, err = Filter(ctx, feed.Filter, feed.URL, content); err != nil {
+			return nil, err
+		}
+	}
+	if feed.Scrape.Enabled() {
+		items, err := Scrape(content, feed.URL, feed.Scrape)
+		if len(items) > maxItems {
+			items = items[:maxItems]
+		}
+		return items, err
+	}
+	return ParseItems(content, maxItems)
 }
 
-// Process the current content of the feed and parse into items. If there are
-// already items in the list attached to the feed we only create new items for
-// the entries we don't have. New items are populated with Read set to false.
-func (feed *Feed) Process(content string, maxItems int) error {
+// FetchItems gets the current content of a feed and parses up to maxItems of
+// the newest entries, without comparing them to anything we already have.
+func FetchItems(ctx context.Context, url string, client *http.Client, maxItems int) ([]Item, error) {
+	content, err := FetchFeedContent(ctx, url, client)
+	if err != nil {
+		return nil, err
+	}
+	return ParseItems(content, maxItems)
+}
+
+// ParseItems parses the content of a feed into new items with Read set to
+// false, keeping just the newest maxItems if there are more than that.
+func ParseItems(content string, maxItems int) ([]Item, error) {
 	fp := gofeed.NewParser()
 	parsed, err := fp.ParseString(content)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	useItems := parsed.Items
 	if len(useItems) > maxItems {
 		sort.Sort(parsed)
 		useItems = parsed.Items[len(parsed.Items)-maxItems:]
 	}
+	items := make([]Item, 0, len(useItems))
 	for _, parsedItem := range useItems {
-		item := ParsedToItem(parsedItem)
-		found := slices.IndexFunc(feed.Items, func(search Item) bool {
-			return search.GUID == item.GUID
-		})
-		if found == -1 {
+		items = append(items, ParsedToItem(parsedItem))
+	}
+	return items, nil
+}
+
+// Process the current content of the feed and parse into items, merging them
+// into the items already attached to the feed.
+func (feed *Feed) Process(content string, maxItems int) error {
+	items, err := ParseItems(content, maxItems)
+	if err != nil {
+		return err
+	}
+	feed.Merge(items)
+	return nil
+}
+
+// Merge adds freshly parsed items to the feed. If there are already items in
+// the list attached to the feed we only add the entries we don't have.
+// Entries we already have are checked for changes, and if the content is
+// different the item is revised (and marked unread if the feed wants that).
+func (feed *Feed) Merge(items []Item) {
+	byGUID := make(map[string]int, len(feed.Items))
+	for i := range feed.Items {
+		if _, ok := byGUID[feed.Items[i].GUID]; !ok {
+			byGUID[feed.Items[i].GUID] = i
+		}
+	}
+	for _, item := range items {
+		found, ok := byGUID[item.GUID]
+		if !ok {
+			byGUID[item.GUID] = len(feed.Items)
 			feed.Items = append(feed.Items, item)
+			continue
+		}
+		existing := &feed.Items[found]
+		if existing.ContentHash == "" {
+			// Stored before we tracked hashes
+			existing.ContentHash = existing.Hash()
+		}
+		if existing.ContentHash != item.ContentHash {
+			existing.Revise(item, feed.MarkUpdatedUnread)
 		}
 	}
-	return nil
 }
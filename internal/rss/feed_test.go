@@ -7,9 +7,12 @@ package rss_test
 
 import (
 	"context"
+	"io"
+	"net/http"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/mikerowehl/feeder/internal/rss"
 	"github.com/mikerowehl/feeder/test/mock"
@@ -72,7 +75,7 @@ func TestFeed_EmptyFeed(t *testing.T) {
 func TestFeed_FetchSimple(t *testing.T) {
 	client := mock.NewMockClient(basicFeed, 200)
 	feed := rss.Feed{URL: "https://testing.com/dummyfeed.rss"}
-	err := feed.Fetch(client, 25)
+	err := feed.Fetch(context.Background(), client, 25)
 	require.NoError(t, err)
 	assert.Len(t, feed.Items, 2)
 	DateSortItems(feed.Items)
@@ -83,21 +86,52 @@ func TestFeed_FetchSimple(t *testing.T) {
 func TestFeed_FetchInvalidRSS(t *testing.T) {
 	client := mock.NewMockClient("This isn't a feed", 200)
 	feed := rss.Feed{URL: "https://testing.com/dummyfeed.rss"}
-	err := feed.Fetch(client, 25)
+	err := feed.Fetch(context.Background(), client, 25)
 	require.Error(t, err)
 }
 
 func TestFeed_FetchBadHTTPStatus(t *testing.T) {
 	client := mock.NewMockClient(basicFeed, 404)
 	feed := rss.Feed{URL: "https://testing.com/dummyfeed.rss"}
-	err := feed.Fetch(client, 25)
+	err := feed.Fetch(context.Background(), client, 25)
 	require.Error(t, err)
 }
 
+func TestFeed_FetchRetryAfter(t *testing.T) {
+	fetch := func(status int, retryAfter string) *rss.StatusError {
+		t.Helper()
+		client := &http.Client{Transport: mock.MockRoundTripper(func(req *http.Request) (*http.Response, error) {
+			header := make(http.Header)
+			if retryAfter != "" {
+				header.Set("Retry-After", retryAfter)
+			}
+			return &http.Response{StatusCode: status, Status: http.StatusText(status), Header: header, Body: io.NopCloser(strings.NewReader(""))}, nil
+		})}
+		feed := rss.Feed{URL: "https://testing.com/dummyfeed.rss"}
+		err := feed.Fetch(context.Background(), client, 25)
+		var statusErr *rss.StatusError
+		require.ErrorAs(t, err, &statusErr)
+		assert.Equal(t, status, statusErr.StatusCode)
+		return statusErr
+	}
+
+	err := fetch(http.StatusTooManyRequests, "120")
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), err.RetryAfter, 5*time.Second)
+	when := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	err = fetch(http.StatusServiceUnavailable, when.Format(http.TimeFormat))
+	assert.Equal(t, when, err.RetryAfter.UTC())
+	err = fetch(http.StatusTooManyRequests, "31536000")
+	assert.WithinDuration(t, time.Now().Add(rss.MaxRetryAfter), err.RetryAfter, 5*time.Second, "capped")
+
+	assert.True(t, fetch(http.StatusTooManyRequests, "soon").RetryAfter.IsZero())
+	assert.True(t, fetch(http.StatusTooManyRequests, "").RetryAfter.IsZero())
+	assert.True(t, fetch(http.StatusNotFound, "120").RetryAfter.IsZero(), "only for 429 and 503")
+}
+
 func TestFeed_FetchNetworkError(t *testing.T) {
 	client := mock.NewMockClientWithError(context.DeadlineExceeded)
 	feed := rss.Feed{URL: "https://testing.com/dummyfeed.rss"}
-	err := feed.Fetch(client, 25)
+	err := feed.Fetch(context.Background(), client, 25)
 	require.Error(t, err)
 }
 
@@ -106,3 +140,200 @@ func TestFeed_FindFeedLink(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "https://example.com/testfeed.xml", feedUrl)
 }
+
+var multiHtml = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <title>Feeder Test Html</title>
+  <link rel="alternate" type="application/rss+xml" title="Posts" href="/posts.xml">
+  <link rel="stylesheet" href="https://example.com/style.css">
+  <link rel="alternate" type="application/atom+xml" title="Comments" href="/comments.atom">
+  <link rel="alternate" type="application/feed+json" title="JSON" href="/feed.json">
+</head>
+<body></body>
+</html>`
+
+func TestFeed_FindFeedLinks(t *testing.T) {
+	links, err := rss.FindFeedLinks(strings.NewReader(multiHtml))
+	require.NoError(t, err)
+	require.Len(t, links, 3)
+	assert.Equal(t, rss.FeedLink{URL: "/posts.xml", Title: "Posts", Type: "application/rss+xml"}, links[0])
+	assert.Equal(t, "Comments", links[1].Title)
+	assert.Equal(t, "/feed.json", links[2].URL)
+}
+
+// Mock client that serves content based on the path of the request. Anything
+// not in the map is a 404. HEAD requests get a 405 to make sure we fall back.
+func routedClient(routes map[string]string, contentTypes map[string]string) *http.Client {
+	return &http.Client{Transport: mock.MockRoundTripper(func(req *http.Request) (*http.Response, error) {
+		header := make(http.Header)
+		body, ok := routes[req.URL.Path]
+		status := http.StatusOK
+		switch {
+		case req.Method == "HEAD":
+			status = http.StatusMethodNotAllowed
+		case !ok:
+			status = http.StatusNotFound
+		}
+		header.Set("Content-Type", contentTypes[req.URL.Path])
+		return &http.Response{
+			StatusCode: status,
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Header:     header,
+		}, nil
+	})}
+}
+
+func TestFeed_FeedCandidatesHeadNotAllowed(t *testing.T) {
+	client := routedClient(
+		map[string]string{"/page": multiHtml},
+		map[string]string{"/page": "text/html; charset=utf-8"})
+	links, err := rss.FeedCandidates(context.Background(), "https://example.com/page", client)
+	require.NoError(t, err)
+	require.Len(t, links, 3)
+	assert.Equal(t, "https://example.com/posts.xml", links[0].URL)
+	assert.Equal(t, "https://example.com/comments.atom", links[1].URL)
+}
+
+func TestFeed_FeedCandidatesProbe(t *testing.T) {
+	client := routedClient(
+		map[string]string{"/blog/": "<html><head></head></html>", "/atom.xml": basicFeed},
+		map[string]string{"/blog/": "text/html", "/atom.xml": "application/xml"})
+	links, err := rss.FeedCandidates(context.Background(), "https://example.com/blog/", client)
+	require.NoError(t, err)
+	require.Len(t, links, 1)
+	assert.Equal(t, "https://example.com/atom.xml", links[0].URL)
+	assert.Equal(t, "Simple RSS Feed", links[0].Title)
+}
+
+var podcastFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd">
+  <channel>
+    <title>Test Podcast</title>
+    <item>
+      <title>Episode 1</title>
+      <guid>ep1</guid>
+      <enclosure url="https://example.com/ep1.mp3" length="12345" type="audio/mpeg"/>
+      <itunes:duration>00:42:17</itunes:duration>
+      <itunes:image href="https://example.com/ep1.jpg"/>
+    </item>
+  </channel>
+</rss>`
+
+var videoFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom" xmlns:media="http://search.yahoo.com/mrss/">
+  <title>Test Channel</title>
+  <entry>
+    <id>yt:video:abc</id>
+    <title>A Video</title>
+    <link rel="alternate" href="https://www.youtube.com/watch?v=abc"/>
+    <media:group>
+      <media:title>A Video</media:title>
+      <media:content url="https://www.youtube.com/v/abc?version=3" type="application/x-shockwave-flash" width="640" height="390"/>
+      <media:thumbnail url="https://i.ytimg.com/vi/abc/hqdefault.jpg" width="480" height="360"/>
+    </media:group>
+  </entry>
+</feed>`
+
+func TestFeed_PodcastEnclosures(t *testing.T) {
+	feed := rss.Feed{}
+	err := feed.Process(podcastFeed, 25)
+	require.NoError(t, err)
+	require.Len(t, feed.Items, 1)
+	require.Len(t, feed.Items[0].Enclosures, 1)
+	enclosure := feed.Items[0].Enclosures[0]
+	assert.Equal(t, "https://example.com/ep1.mp3", enclosure.URL)
+	assert.Equal(t, "audio/mpeg", enclosure.Type)
+	assert.Equal(t, int64(12345), enclosure.Length)
+	assert.Equal(t, "00:42:17", enclosure.Duration)
+	assert.Equal(t, "https://example.com/ep1.jpg", enclosure.Image)
+	assert.Equal(t, "audio", enclosure.Kind())
+}
+
+func TestFeed_MediaGroupEnclosures(t *testing.T) {
+	feed := rss.Feed{}
+	err := feed.Process(videoFeed, 25)
+	require.NoError(t, err)
+	require.Len(t, feed.Items, 1)
+	require.Len(t, feed.Items[0].Enclosures, 1)
+	enclosure := feed.Items[0].Enclosures[0]
+	assert.Equal(t, "https://www.youtube.com/v/abc?version=3", enclosure.URL)
+	assert.Equal(t, "https://i.ytimg.com/vi/abc/hqdefault.jpg", enclosure.Image)
+	assert.Equal(t, "other", enclosure.Kind())
+}
+
+var metadataFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Metadata Feed</title>
+  <entry>
+    <id>tag:example.com,2025:1</id>
+    <title>Post With Metadata</title>
+    <link rel="alternate" href="https://example.com/post"/>
+    <author><name>Jane Writer</name></author>
+    <author><name>Sam Editor</name></author>
+    <category term="Go"/>
+    <category term="go"/>
+    <category term="Tools"/>
+    <published>2025-11-01T10:00:00Z</published>
+    <updated>2025-11-02T12:30:00Z</updated>
+    <summary>Short version</summary>
+    <content type="html">&lt;p&gt;The long version&lt;/p&gt;</content>
+  </entry>
+</feed>`
+
+func TestFeed_ItemMetadata(t *testing.T) {
+	feed := rss.Feed{}
+	err := feed.Process(metadataFeed, 25)
+	require.NoError(t, err)
+	require.Len(t, feed.Items, 1)
+	item := feed.Items[0]
+	assert.Equal(t, "Jane Writer, Sam Editor", item.Author)
+	assert.Equal(t, "Short version", item.Summary)
+	assert.Equal(t, "<p>The long version</p>", item.Content)
+	assert.Equal(t, "2025-11-02T12:30:00Z", item.Updated.Format(time.RFC3339))
+	assert.True(t, item.Updated.After(item.Published))
+	require.Len(t, item.Categories, 2)
+	assert.Equal(t, "Go", item.Categories[0].Name)
+	assert.Equal(t, "Tools", item.Categories[1].Name)
+}
+
+func TestFeed_RevisedItem(t *testing.T) {
+	feed := rss.Feed{}
+	err := feed.Process(basicFeed, 25)
+	require.NoError(t, err)
+	require.Len(t, feed.Items, 2)
+	for i := range feed.Items {
+		feed.Items[i].Read = true
+	}
+
+	// Same content again doesn't change anything
+	err = feed.Process(basicFeed, 25)
+	require.NoError(t, err)
+	require.Len(t, feed.Items, 2)
+	for _, item := range feed.Items {
+		assert.False(t, item.Revised)
+		assert.Empty(t, item.Revisions)
+	}
+
+	revised := strings.Replace(basicFeed, "This is the first post in the feed.", "This is the corrected first post.", 1)
+	err = feed.Process(revised, 25)
+	require.NoError(t, err)
+	require.Len(t, feed.Items, 2)
+	DateSortItems(feed.Items)
+	first := feed.Items[1]
+	assert.True(t, first.Revised)
+	assert.True(t, first.Read, "only marked unread when the feed asks for it")
+	assert.Equal(t, "This is the corrected first post.", first.Content)
+	require.Len(t, first.Revisions, 1)
+	assert.Equal(t, "This is the first post in the feed.", first.Revisions[0].Content)
+	assert.False(t, feed.Items[0].Revised)
+
+	feed.MarkUpdatedUnread = true
+	revised = strings.Replace(revised, "corrected", "twice corrected", 1)
+	err = feed.Process(revised, 25)
+	require.NoError(t, err)
+	DateSortItems(feed.Items)
+	first = feed.Items[1]
+	assert.False(t, first.Read)
+	require.Len(t, first.Revisions, 2)
+}
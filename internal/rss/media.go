@@ -0,0 +1,109 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package rss
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+	"gorm.io/gorm"
+)
+
+// Enclosure is a media file attached to an item, like a podcast episode or a
+// video. Duration and Image come from the iTunes or Media RSS extensions when
+// the feed includes them.
+type Enclosure struct {
+	gorm.Model
+	ItemID   uint
+	URL      string
+	Type     string
+	Length   int64
+	Duration string
+	Image    string
+}
+
+// Kind gives the broad type of media for the enclosure, one of "audio",
+// "video", "image", or "other". Used to decide how to render it.
+func (e Enclosure) Kind() string {
+	mediaType, _, _ := strings.Cut(e.Type, "/")
+	switch mediaType {
+	case "audio", "video", "image":
+		return mediaType
+	}
+	return "other"
+}
+
+// Pull together all the enclosures for an item. Regular RSS enclosures come
+// first, then any media:content entries (either directly on the item or
+// inside a media:group, which is what YouTube uses) that point somewhere new.
+func parsedEnclosures(parsed *gofeed.Item) []Enclosure {
+	var duration, image string
+	if parsed.ITunesExt != nil {
+		duration = parsed.ITunesExt.Duration
+		image = parsed.ITunesExt.Image
+	}
+
+	var enclosures []Enclosure
+	seen := make(map[string]bool)
+	for _, e := range parsed.Enclosures {
+		if e == nil || e.URL == "" || seen[e.URL] {
+			continue
+		}
+		seen[e.URL] = true
+		length, _ := strconv.ParseInt(e.Length, 10, 64)
+		enclosures = append(enclosures, Enclosure{
+			URL:      e.URL,
+			Type:     e.Type,
+			Length:   length,
+			Duration: duration,
+			Image:    image,
+		})
+	}
+
+	media := parsed.Extensions["media"]
+	if media == nil {
+		return enclosures
+	}
+	groups := []map[string][]ext.Extension{media}
+	for _, group := range media["group"] {
+		groups = append(groups, group.Children)
+	}
+	for _, group := range groups {
+		thumbnail := image
+		for _, t := range group["thumbnail"] {
+			if t.Attrs["url"] != "" {
+				thumbnail = t.Attrs["url"]
+				break
+			}
+		}
+		for _, c := range group["content"] {
+			contentURL := c.Attrs["url"]
+			if contentURL == "" || seen[contentURL] {
+				continue
+			}
+			seen[contentURL] = true
+			length, _ := strconv.ParseInt(c.Attrs["fileSize"], 10, 64)
+			contentDuration := duration
+			if c.Attrs["duration"] != "" {
+				contentDuration = c.Attrs["duration"]
+			}
+			contentType := c.Attrs["type"]
+			if contentType == "" && c.Attrs["medium"] != "" {
+				contentType = c.Attrs["medium"] + "/*"
+			}
+			enclosures = append(enclosures, Enclosure{
+				URL:      contentURL,
+				Type:     contentType,
+				Length:   length,
+				Duration: contentDuration,
+				Image:    thumbnail,
+			})
+		}
+	}
+	return enclosures
+}
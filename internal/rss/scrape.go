@@ -0,0 +1,337 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package rss
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+)
+
+// Scraper turns a web page without a feed, like a changelog or a status
+// page, into items using CSS selectors. Item picks out the element holding
+// each item, and the others are looked for inside it. Any of the others can
+// end in @name to take that attribute of the element instead of its text,
+// like "time@datetime". Left empty, the title is the first heading or link,
+// the link is the first link, and the content is the whole item element.
+type Scraper struct {
+	Item    string
+	Title   string
+	Link    string
+	Date    string
+	Content string
+}
+
+// Enabled reports whether the feed is scraped rather than parsed as a feed.
+func (s Scraper) Enabled() bool {
+	return s.Item != ""
+}
+
+var ErrNoScrapedItems = errors.New("no items found on the page")
+
+// A selector with the attribute to take, if any.
+type field struct {
+	selector cascadia.Matcher
+	attr     string
+}
+
+type compiledScraper struct {
+	item                       cascadia.Matcher
+	title, link, date, content *field
+}
+
+var (
+	// Where the title comes from when there's no title selector
+	headingSel = cascadia.MustCompile("h1, h2, h3, h4, h5, h6, a")
+	linkSel    = cascadia.MustCompile("a[href]")
+	pageTitle  = cascadia.MustCompile("title")
+)
+
+var selectorAttr = regexp.MustCompile(`^(.*?)@([A-Za-z_:][-A-Za-z0-9_:.]*)$`)
+
+func compileField(name string, spec string) (*field, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var f field
+	if m := selectorAttr.FindStringSubmatch(spec); m != nil {
+		spec, f.attr = strings.TrimSpace(m[1]), m[2]
+	}
+	if spec == "" {
+		// Just an attribute, of the item element itself
+		return &f, nil
+	}
+	sel, err := cascadia.Compile(spec)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s selector %q: %w", name, spec, err)
+	}
+	f.selector = sel
+	return &f, nil
+}
+
+func (s Scraper) compile() (*compiledScraper, error) {
+	if s.Item == "" {
+		return nil, errors.New("an item selector is needed to scrape a page")
+	}
+	item, err := cascadia.Compile(s.Item)
+	if err != nil {
+		return nil, fmt.Errorf("bad item selector %q: %w", s.Item, err)
+	}
+	c := &compiledScraper{item: item}
+	for _, f := range []struct {
+		name string
+		spec string
+		dest **field
+	}{
+		{"title", s.Title, &c.title},
+		{"link", s.Link, &c.link},
+		{"date", s.Date, &c.date},
+		{"content", s.Content, &c.content},
+	} {
+		if *f.dest, err = compileField(f.name, f.spec); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Validate checks the selectors without scraping anything.
+func (s Scraper) Validate() error {
+	_, err := s.compile()
+	return err
+}
+
+// Find the element for a field in an item, the item itself for a bare
+// attribute.
+func (f *field) find(item *html.Node) *html.Node {
+	if f.selector == nil {
+		return item
+	}
+	return cascadia.Query(item, f.selector)
+}
+
+// The value of a field, the attribute if one was asked for, otherwise the
+// text.
+func (f *field) value(item *html.Node) string {
+	node := f.find(item)
+	if node == nil {
+		return ""
+	}
+	if f.attr != "" {
+		return strings.TrimSpace(attr(node, f.attr))
+	}
+	return nodeText(node)
+}
+
+func attr(node *html.Node, name string) string {
+	for _, a := range node.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// Text of a node with the whitespace collapsed.
+func nodeText(node *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+			b.WriteByte(' ')
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(node)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func innerHTML(node *html.Node) (string, error) {
+	var b strings.Builder
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(&b, c); err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// The link for an item. A link selector pointing at something around the
+// link, rather than the link itself, takes the first link inside it.
+func (c *compiledScraper) itemLink(node *html.Node) string {
+	if c.link == nil {
+		if node.Data != "a" {
+			node = cascadia.Query(node, linkSel)
+		}
+	} else {
+		node = c.link.find(node)
+		if node != nil && c.link.attr != "" {
+			return attr(node, c.link.attr)
+		}
+		if node != nil && node.Data != "a" {
+			node = cascadia.Query(node, linkSel)
+		}
+	}
+	if node == nil {
+		return ""
+	}
+	return attr(node, "href")
+}
+
+// Layouts tried for scraped dates, after the datetime attribute of a time
+// element.
+var scrapeDateLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822Z,
+	time.RFC822,
+	time.DateTime,
+	time.DateOnly,
+	"2006/01/02",
+	"January 2, 2006",
+	"Jan 2, 2006",
+	"2 January 2006",
+	"2 Jan 2006",
+	"Monday, January 2, 2006",
+	"Mon, Jan 2, 2006",
+}
+
+func parseScrapedDate(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range scrapeDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Scrape picks the items out of a page, in the order they're on the page.
+// Links are resolved against pageURL. Items without a link get a GUID made
+// from the page URL and their title, so an item whose content changes under
+// the same title is revised rather than added again.
+func Scrape(content string, pageURL string, s Scraper) ([]Item, error) {
+	c, err := s.compile()
+	if err != nil {
+		return nil, err
+	}
+	doc, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	seen := make(map[string]bool)
+	var items []Item
+	for _, node := range cascadia.QueryAll(doc, c.item) {
+		item := Item{Published: now}
+		if c.title != nil {
+			item.Title = c.title.value(node)
+		} else if heading := cascadia.Query(node, headingSel); heading != nil {
+			item.Title = nodeText(heading)
+		}
+
+		link := c.itemLink(node)
+		if link = strings.TrimSpace(link); link != "" {
+			if ref, err := url.Parse(link); err == nil {
+				item.Link = base.ResolveReference(ref).String()
+			}
+		}
+
+		if c.date != nil {
+			dateNode := c.date.find(node)
+			value := c.date.value(node)
+			if c.date.attr == "" && dateNode != nil && attr(dateNode, "datetime") != "" {
+				value = attr(dateNode, "datetime")
+			}
+			if published, ok := parseScrapedDate(value); ok {
+				item.Published = published
+			}
+		}
+		item.Updated = item.Published
+
+		contentNode := node
+		if c.content != nil {
+			if c.content.attr != "" {
+				item.Content = c.content.value(node)
+				contentNode = nil
+			} else {
+				contentNode = c.content.find(node)
+			}
+		}
+		if contentNode != nil {
+			if item.Content, err = innerHTML(contentNode); err != nil {
+				return nil, err
+			}
+		}
+		if item.Title == "" && item.Content == "" {
+			continue
+		}
+
+		item.GUID = item.Link
+		if item.GUID == "" || seen[item.GUID] {
+			sum := sha256.Sum256([]byte(item.Title))
+			item.GUID = base.String() + "#" + hex.EncodeToString(sum[:8])
+		}
+		if seen[item.GUID] {
+			continue
+		}
+		seen[item.GUID] = true
+		item.ContentHash = item.Hash()
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// FetchScraped fetches a page and scrapes the items from it.
+func FetchScraped(ctx context.Context, pageURL string, s Scraper, client *http.Client) ([]Item, error) {
+	content, err := FetchFeedContent(ctx, pageURL, client)
+	if err != nil {
+		return nil, err
+	}
+	return Scrape(content, pageURL, s)
+}
+
+// FeedFromScrape fetches a page and checks the scraper finds items on it,
+// returning a feed for it titled after the page.
+func FeedFromScrape(ctx context.Context, pageURL string, s Scraper, client *http.Client) (Feed, error) {
+	feed := Feed{URL: pageURL, Scrape: s}
+	content, err := FetchFeedContent(ctx, pageURL, client)
+	if err != nil {
+		return feed, err
+	}
+	items, err := Scrape(content, pageURL, s)
+	if err != nil {
+		return feed, err
+	}
+	if len(items) == 0 {
+		return feed, fmt.Errorf("%w with item selector %q", ErrNoScrapedItems, s.Item)
+	}
+	feed.Title = pageURL
+	if doc, err := html.Parse(strings.NewReader(content)); err == nil {
+		if title := cascadia.Query(doc, pageTitle); title != nil && nodeText(title) != "" {
+			feed.Title = nodeText(title)
+		}
+	}
+	return feed, nil
+}
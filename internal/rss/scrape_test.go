@@ -0,0 +1,94 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package rss_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/rss"
+	"github.com/mikerowehl/feeder/test/mock"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const changelogURL = "https://example.com/changelog"
+
+func changelog(t *testing.T) string {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join("..", "..", "test", "feeds", "changelog.html"))
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestScrape_Selectors(t *testing.T) {
+	items, err := rss.Scrape(changelog(t), changelogURL, rss.Scraper{
+		Item:    "section.release",
+		Title:   "h2",
+		Date:    "time, .date",
+		Content: ".notes",
+	})
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+
+	assert.Equal(t, "Version 2.1.0", items[0].Title)
+	assert.Equal(t, "https://example.com/releases/2.1.0", items[0].Link)
+	assert.Equal(t, items[0].Link, items[0].GUID)
+	assert.Equal(t, time.Date(2025, 11, 3, 12, 0, 0, 0, time.UTC), items[0].Published.UTC(), "from the datetime attribute")
+	assert.Equal(t, "<p>Added <strong>dark mode</strong>.</p>", items[0].Content)
+	assert.NotEmpty(t, items[0].ContentHash)
+
+	assert.Equal(t, time.Date(2025, 10, 20, 0, 0, 0, 0, time.UTC), items[1].Published, "from the text")
+
+	assert.Empty(t, items[2].Link)
+	assert.Contains(t, items[2].GUID, changelogURL+"#", "no link, so made from the page and title")
+	assert.Equal(t, time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC), items[2].Published)
+}
+
+func TestScrape_Defaults(t *testing.T) {
+	before := time.Now()
+	items, err := rss.Scrape(changelog(t), changelogURL, rss.Scraper{Item: "section.release"})
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	assert.Equal(t, "Version 2.1.0", items[0].Title, "the first heading")
+	assert.Equal(t, "https://example.com/releases/2.1.0", items[0].Link, "the first link")
+	assert.Contains(t, items[0].Content, "<h2>", "the whole item")
+	assert.False(t, items[0].Published.Before(before), "no date selector, so the time of the fetch")
+
+	items, err = rss.Scrape(changelog(t), changelogURL, rss.Scraper{Item: "section.release", Link: "h2 a@href", Title: "@class"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/releases/2.0.1", items[1].Link)
+	assert.Equal(t, "release", items[1].Title)
+}
+
+func TestScrape_BadSelectors(t *testing.T) {
+	_, err := rss.Scrape(changelog(t), changelogURL, rss.Scraper{})
+	assert.ErrorContains(t, err, "item selector")
+	_, err = rss.Scrape(changelog(t), changelogURL, rss.Scraper{Item: "section[", Title: "h2"})
+	assert.ErrorContains(t, err, "bad item selector")
+	assert.ErrorContains(t, rss.Scraper{Item: "section", Date: "time["}.Validate(), "bad date selector")
+}
+
+func TestScrape_Feed(t *testing.T) {
+	client := mock.NewMockClient(changelog(t), http.StatusOK)
+	scraper := rss.Scraper{Item: "section.release", Title: "h2", Content: ".notes"}
+
+	feed, err := rss.FeedFromScrape(t.Context(), changelogURL, scraper, client)
+	require.NoError(t, err)
+	assert.Equal(t, "Widget Changelog", feed.Title)
+	assert.Equal(t, scraper, feed.Scrape)
+
+	require.NoError(t, feed.Fetch(t.Context(), client, 2))
+	require.Len(t, feed.Items, 2, "the first ones on the page")
+	assert.Equal(t, "Version 2.1.0", feed.Items[0].Title)
+
+	_, err = rss.FeedFromScrape(t.Context(), changelogURL, rss.Scraper{Item: "article"}, client)
+	assert.ErrorIs(t, err, rss.ErrNoScrapedItems)
+}
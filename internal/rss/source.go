@@ -0,0 +1,168 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package rss
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Feeds that don't come from the web. A file:// URL reads a feed some other
+// tool writes to disk, and exec: runs a shell command and reads the feed from
+// its output, like newsboat's exec: URLs.
+const (
+	FileScheme = "file://"
+	ExecPrefix = "exec:"
+)
+
+// CommandTimeout is how long an exec: source or a filter gets to finish.
+const CommandTimeout = 2 * time.Minute
+
+// How much of a failed command's error output goes into the error.
+const maxCommandStderr = 4 << 10
+
+// IsLocalSource reports whether a feed URL is a file or command on this
+// machine rather than something on the web.
+func IsLocalSource(feedURL string) bool {
+	return strings.HasPrefix(feedURL, FileScheme) || strings.HasPrefix(feedURL, ExecPrefix)
+}
+
+// Read a feed from a file or command, with the same size limit and charset
+// handling as one fetched over HTTP.
+func fetchLocal(ctx context.Context, feedURL string) (string, error) {
+	var body io.Reader
+	if command, ok := strings.CutPrefix(feedURL, ExecPrefix); ok {
+		output, err := runCommand(ctx, command, nil, feedURL, maxBodySize(ctx))
+		if err != nil {
+			return "", err
+		}
+		body = bytes.NewReader(output)
+	} else {
+		u, err := url.Parse(feedURL)
+		if err != nil {
+			return "", err
+		}
+		if u.Host != "" && u.Host != "localhost" {
+			return "", fmt.Errorf("file URL %s isn't on this machine", feedURL)
+		}
+		file, err := os.Open(u.Path)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		body = file
+	}
+	limit := maxBodySize(ctx)
+	content, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(content)) > limit {
+		return "", fmt.Errorf("%w: more than the limit of %d bytes", ErrBodyTooLarge, limit)
+	}
+	content, err = toUTF8(content, "")
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// Filter pipes the content of a feed through a shell command, which writes
+// the content to parse to its output. The command gets the feed URL in the
+// FEEDER_URL environment variable, like newsboat's filter: scripts get it
+// as an argument.
+func Filter(ctx context.Context, command string, feedURL string, content string) (string, error) {
+	output, err := runCommand(ctx, command, strings.NewReader(content), feedURL, maxBodySize(ctx))
+	if err != nil {
+		return "", fmt.Errorf("filter: %w", err)
+	}
+	converted, err := toUTF8(output, "")
+	if err != nil {
+		return "", fmt.Errorf("filter: %w", err)
+	}
+	return string(converted), nil
+}
+
+// Run a command through the shell, returning what it wrote to its output.
+// A command that writes more than limit bytes is stopped, failing with
+// ErrBodyTooLarge. The start of whatever it wrote to its error output is
+// included in the error if it fails.
+func runCommand(ctx context.Context, command string, stdin io.Reader, feedURL string, limit int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, CommandTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Stdin = stdin
+	cmd.Env = append(os.Environ(), "FEEDER_URL="+feedURL)
+	stderr := &HeadBuffer{Max: maxCommandStderr}
+	cmd.Stderr = stderr
+	// Anything the command started that's still holding its output open
+	// doesn't keep us waiting once the command itself is gone
+	cmd.WaitDelay = time.Second
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("command %q failed: %w", command, err)
+	}
+	output, readErr := io.ReadAll(io.LimitReader(stdout, limit+1))
+	tooLarge := int64(len(output)) > limit
+	if tooLarge {
+		// Kill it rather than read any more. Closing the pipe stops anything
+		// it started writing to it too.
+		_ = stdout.Close()
+		cancel()
+	}
+	err = cmd.Wait()
+	switch {
+	case tooLarge:
+		return nil, fmt.Errorf("command %q: %w: more than the limit of %d bytes", command, ErrBodyTooLarge, limit)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return nil, fmt.Errorf("command %q didn't finish within %v", command, CommandTimeout)
+	case err == nil && readErr != nil:
+		err = readErr
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("command %q failed: %w: %s", command, err, msg)
+		}
+		return nil, fmt.Errorf("command %q failed: %w", command, err)
+	}
+	return output, nil
+}
+
+// HeadBuffer keeps the first Max bytes written to it and throws away the
+// rest, so a command can't fill memory through its output.
+type HeadBuffer struct {
+	Max int
+	buf bytes.Buffer
+}
+
+func (b *HeadBuffer) Write(p []byte) (int, error) {
+	if room := b.Max - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// String returns what was kept.
+func (b *HeadBuffer) String() string {
+	return b.buf.String()
+}
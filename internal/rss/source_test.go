@@ -0,0 +1,108 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package rss_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/rss"
+	"github.com/mikerowehl/feeder/test/mock"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func skipWithoutShell(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are written for sh")
+	}
+}
+
+func TestFeed_FileSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feed.xml")
+	require.NoError(t, os.WriteFile(path, []byte(basicFeed), 0o644))
+	feedURL := "file://" + filepath.ToSlash(path)
+
+	links, err := rss.FeedCandidates(t.Context(), feedURL, http.DefaultClient)
+	require.NoError(t, err)
+	assert.Equal(t, []rss.FeedLink{{URL: feedURL}}, links)
+	feed, err := rss.FeedFromURL(t.Context(), feedURL, http.DefaultClient)
+	require.NoError(t, err)
+	assert.Equal(t, "Simple RSS Feed", feed.Title)
+	require.NoError(t, feed.Fetch(t.Context(), http.DefaultClient, 10))
+	assert.Len(t, feed.Items, 2)
+
+	// Converted the same as a feed from the web
+	latin1, err := os.ReadFile(filepath.Join("testdata", "iso-8859-1.xml"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, latin1, 0o644))
+	feed, err = rss.FeedFromURL(t.Context(), feedURL, http.DefaultClient)
+	require.NoError(t, err)
+	assert.Equal(t, "Café crème", feed.Title)
+
+	_, err = rss.FetchFeedContent(t.Context(), "file://"+filepath.ToSlash(filepath.Join(t.TempDir(), "missing.xml")), http.DefaultClient)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = rss.FetchFeedContent(rss.WithMaxBodySize(t.Context(), 10), feedURL, http.DefaultClient)
+	assert.ErrorIs(t, err, rss.ErrBodyTooLarge)
+}
+
+func TestFeed_ExecSource(t *testing.T) {
+	skipWithoutShell(t)
+	path := filepath.Join(t.TempDir(), "feed.xml")
+	require.NoError(t, os.WriteFile(path, []byte(basicFeed), 0o644))
+
+	feed, err := rss.FeedFromURL(t.Context(), "exec:cat '"+path+"'", http.DefaultClient)
+	require.NoError(t, err)
+	assert.Equal(t, "Simple RSS Feed", feed.Title)
+	assert.Equal(t, "exec:cat '"+path+"'", feed.URL)
+
+	_, err = rss.FetchFeedContent(t.Context(), "exec:echo broken >&2; exit 3", http.DefaultClient)
+	assert.ErrorContains(t, err, "broken")
+	assert.ErrorContains(t, err, "exit status 3")
+}
+
+// A command that doesn't stop writing is stopped at the size limit, and
+// only the start of its error output is kept
+func TestFeed_ExecSourceLimits(t *testing.T) {
+	skipWithoutShell(t)
+	ctx := rss.WithMaxBodySize(t.Context(), 1000)
+	start := time.Now()
+	_, err := rss.FetchFeedContent(ctx, "exec:yes", http.DefaultClient)
+	assert.ErrorIs(t, err, rss.ErrBodyTooLarge)
+	_, err = rss.FetchFeedContent(ctx, "exec:yes | cat", http.DefaultClient)
+	assert.ErrorIs(t, err, rss.ErrBodyTooLarge)
+	_, err = rss.Filter(ctx, "yes", "https://example.com/rss.xml", basicFeed)
+	assert.ErrorIs(t, err, rss.ErrBodyTooLarge)
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	_, err = rss.FetchFeedContent(ctx, "exec:head -c 1000000 /dev/zero | tr '\\0' x >&2; exit 1", http.DefaultClient)
+	require.ErrorContains(t, err, "exit status 1")
+	assert.Contains(t, err.Error(), "xxxx")
+	assert.Less(t, len(err.Error()), 5000)
+}
+
+func TestFeed_Filter(t *testing.T) {
+	skipWithoutShell(t)
+	client := mock.NewMockClient(basicFeed, 200)
+	filter := `sed "s|First Post|First post from $FEEDER_URL|"`
+
+	feed, err := rss.FeedFromLink(t.Context(), rss.FeedLink{URL: "https://example.com/rss.xml", Filter: filter}, client)
+	require.NoError(t, err)
+	assert.Equal(t, filter, feed.Filter)
+	require.NoError(t, feed.Fetch(t.Context(), client, 10))
+	require.Len(t, feed.Items, 2)
+	assert.Equal(t, "First post from https://example.com/rss.xml", feed.Items[0].Title)
+
+	feed.Filter = "false"
+	err = feed.Fetch(t.Context(), client, 10)
+	assert.ErrorContains(t, err, "filter")
+}
@@ -0,0 +1,205 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+// Kill-file style rules that get applied to new items as they come in. Each
+// rule checks one field of an item against a substring or a regular
+// expression, and if it matches takes an action like skipping the item
+// entirely, marking it read, or sending a notification about it.
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/mikerowehl/feeder/internal/rss"
+	"gorm.io/gorm"
+)
+
+// Fields a rule can match against. FieldAny matches if any of the others do.
+const (
+	FieldFeed    = "feed"
+	FieldTitle   = "title"
+	FieldContent = "content"
+	FieldAuthor  = "author"
+	FieldLink    = "link"
+	FieldAny     = "any"
+)
+
+// Actions a rule can take when it matches.
+const (
+	ActionSkip = "skip"
+	ActionRead = "read"
+	ActionStar = "star"
+	ActionTag  = "tag"
+	// Notifications are sent once the new items are saved, see Notify
+	ActionNotify = "notify"
+)
+
+var Fields = []string{FieldFeed, FieldTitle, FieldContent, FieldAuthor, FieldLink, FieldAny}
+var Actions = []string{ActionSkip, ActionRead, ActionStar, ActionTag, ActionNotify}
+
+type Rule struct {
+	gorm.Model
+	// Only apply to items from this feed, zero means every feed
+	FeedID  uint
+	Field   string
+	Pattern string
+	// Pattern is a regular expression instead of a substring. Substrings
+	// always ignore case, regular expressions can use (?i).
+	Regex bool
+	// Take the action for items that don't match instead of ones that do
+	Negate bool
+	Action string
+	// Name of the tag to add for ActionTag
+	Tag string
+
+	compiled *regexp.Regexp
+}
+
+// ParsePattern accepts the /pattern/flags form people tend to type for
+// regular expressions and turns it into a Go pattern, so "/sponsored/i"
+// becomes "(?i)sponsored". Anything else is returned as is.
+func ParsePattern(s string) (string, bool) {
+	if len(s) < 2 || s[0] != '/' {
+		return s, false
+	}
+	end := strings.LastIndex(s, "/")
+	if end == 0 {
+		return s, false
+	}
+	flags := s[end+1:]
+	if strings.Trim(flags, "imsU") != "" {
+		return s, false
+	}
+	pattern := s[1:end]
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	return pattern, true
+}
+
+// Validate makes sure the field, action, and pattern all make sense.
+func (r *Rule) Validate() error {
+	if !slices.Contains(Fields, r.Field) {
+		return fmt.Errorf("unknown field %q, should be one of %s", r.Field, strings.Join(Fields, ", "))
+	}
+	if !slices.Contains(Actions, r.Action) {
+		return fmt.Errorf("unknown action %q, should be one of %s", r.Action, strings.Join(Actions, ", "))
+	}
+	if r.Action == ActionTag && r.Tag == "" {
+		return fmt.Errorf("tag action needs a tag name")
+	}
+	if r.Pattern == "" {
+		return fmt.Errorf("rule needs a pattern to match")
+	}
+	if r.Regex {
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("bad regular expression: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) matchString(s string) bool {
+	if r.Regex {
+		if r.compiled == nil {
+			compiled, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				return false
+			}
+			r.compiled = compiled
+		}
+		return r.compiled.MatchString(s)
+	}
+	return strings.Contains(strings.ToLower(s), strings.ToLower(r.Pattern))
+}
+
+// Matches checks an item (and the feed it's from) against the rule. This
+// accounts for Negate, so true always means the action should be taken.
+func (r *Rule) Matches(feed *rss.Feed, item *rss.Item) bool {
+	if r.FeedID != 0 && r.FeedID != item.FeedID && (feed == nil || r.FeedID != feed.ID) {
+		return false
+	}
+	var feedTitle string
+	if feed != nil {
+		feedTitle = feed.Title
+	}
+	var values []string
+	switch r.Field {
+	case FieldFeed:
+		values = []string{feedTitle}
+	case FieldTitle:
+		values = []string{item.Title}
+	case FieldContent:
+		values = []string{item.Content, item.Summary, item.FullContent}
+	case FieldAuthor:
+		values = []string{item.Author}
+	case FieldLink:
+		values = []string{item.Link}
+	case FieldAny:
+		values = []string{feedTitle, item.Title, item.Content, item.Summary, item.FullContent,
+			item.Author, item.Link}
+	}
+	matched := slices.ContainsFunc(values, r.matchString)
+	return matched != r.Negate
+}
+
+// Describe gives a short human readable version of the rule.
+func (r *Rule) Describe() string {
+	scope := "all feeds"
+	if r.FeedID != 0 {
+		scope = fmt.Sprintf("feed %d", r.FeedID)
+	}
+	verb := "contains"
+	if r.Regex {
+		verb = "matches"
+	}
+	if r.Negate {
+		verb = "doesn't contain"
+		if r.Regex {
+			verb = "doesn't match"
+		}
+	}
+	action := r.Action
+	if r.Action == ActionTag {
+		action = "tag " + r.Tag
+	}
+	return fmt.Sprintf("%s: %s if %s %s %q", scope, action, r.Field, verb, r.Pattern)
+}
+
+// Apply runs all the rules against an item, changing it as the actions say.
+// Returns false if the item should be skipped and not stored at all.
+func Apply(rules []Rule, feed *rss.Feed, item *rss.Item) bool {
+	keep := true
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.Matches(feed, item) {
+			continue
+		}
+		switch rule.Action {
+		case ActionSkip:
+			keep = false
+		case ActionRead:
+			item.Read = true
+		case ActionStar:
+			item.Starred = true
+		case ActionTag:
+			item.AddTag(rule.Tag)
+		}
+	}
+	return keep
+}
+
+// Notify reports whether any of the notify rules match an item.
+func Notify(rules []Rule, feed *rss.Feed, item *rss.Item) bool {
+	for i := range rules {
+		if rules[i].Action == ActionNotify && rules[i].Matches(feed, item) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package rules_test
+
+import (
+	"testing"
+
+	"github.com/mikerowehl/feeder/internal/rss"
+	"github.com/mikerowehl/feeder/internal/rules"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRules_ParsePattern(t *testing.T) {
+	pattern, isRegex := rules.ParsePattern("/sponsored/i")
+	assert.True(t, isRegex)
+	assert.Equal(t, "(?i)sponsored", pattern)
+
+	pattern, isRegex = rules.ParsePattern("/a/b/")
+	assert.True(t, isRegex)
+	assert.Equal(t, "a/b", pattern)
+
+	pattern, isRegex = rules.ParsePattern("/usr/local")
+	assert.False(t, isRegex)
+	assert.Equal(t, "/usr/local", pattern)
+}
+
+func TestRules_Validate(t *testing.T) {
+	assert.NoError(t, (&rules.Rule{Field: "title", Pattern: "x", Action: "skip"}).Validate())
+	assert.Error(t, (&rules.Rule{Field: "body", Pattern: "x", Action: "skip"}).Validate())
+	assert.Error(t, (&rules.Rule{Field: "title", Pattern: "x", Action: "delete"}).Validate())
+	assert.Error(t, (&rules.Rule{Field: "title", Pattern: "x", Action: "tag"}).Validate())
+	assert.Error(t, (&rules.Rule{Field: "title", Pattern: "(", Regex: true, Action: "skip"}).Validate())
+}
+
+func TestRules_Matches(t *testing.T) {
+	feed := &rss.Feed{Title: "Go Weekly"}
+	feed.ID = 12
+	item := &rss.Item{FeedID: 12, Title: "Sponsored: buy things", Author: "Alice", Link: "https://example.com/a"}
+
+	tests := []struct {
+		name  string
+		rule  rules.Rule
+		match bool
+	}{
+		{"substring ignores case", rules.Rule{Field: "title", Pattern: "SPONSORED"}, true},
+		{"regex", rules.Rule{Field: "title", Pattern: "(?i)^sponsored:", Regex: true}, true},
+		{"regex case", rules.Rule{Field: "title", Pattern: "^sponsored:", Regex: true}, false},
+		{"other feed", rules.Rule{FeedID: 13, Field: "title", Pattern: "sponsored"}, false},
+		{"this feed", rules.Rule{FeedID: 12, Field: "title", Pattern: "sponsored"}, true},
+		{"feed title", rules.Rule{Field: "feed", Pattern: "weekly"}, true},
+		{"author", rules.Rule{Field: "author", Pattern: "bob"}, false},
+		{"any", rules.Rule{Field: "any", Pattern: "example.com"}, true},
+		{"negate", rules.Rule{Field: "title", Pattern: "Go", Negate: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.match, tt.rule.Matches(feed, item))
+		})
+	}
+}
+
+func TestRules_Apply(t *testing.T) {
+	ruleset := []rules.Rule{
+		{Field: "title", Pattern: "release", Action: rules.ActionStar},
+		{Field: "title", Pattern: "release", Action: rules.ActionTag, Tag: "releases"},
+		{Field: "author", Pattern: "bot", Action: rules.ActionRead},
+		{Field: "title", Pattern: "sponsored", Action: rules.ActionSkip},
+	}
+	item := rss.Item{Title: "v1.2 release", Author: "release-bot"}
+	keep := rules.Apply(ruleset, nil, &item)
+	assert.True(t, keep)
+	assert.True(t, item.Starred)
+	assert.True(t, item.Read)
+	require.Len(t, item.Tags, 1)
+	assert.Equal(t, "releases", item.Tags[0].Name)
+
+	// Applying again doesn't duplicate the tag
+	rules.Apply(ruleset, nil, &item)
+	assert.Len(t, item.Tags, 1)
+
+	item = rss.Item{Title: "Sponsored post"}
+	assert.False(t, rules.Apply(ruleset, nil, &item))
+}
+
+func TestRules_Notify(t *testing.T) {
+	ruleset := []rules.Rule{
+		{Field: "title", Pattern: "release", Action: rules.ActionStar},
+		{FeedID: 2, Field: "title", Pattern: "security", Action: rules.ActionNotify},
+	}
+	require.NoError(t, ruleset[1].Validate())
+	item := rss.Item{FeedID: 2, Title: "Security release"}
+	assert.True(t, rules.Notify(ruleset, nil, &item))
+	assert.True(t, rules.Apply(ruleset, nil, &item), "notify doesn't change whether the item is kept")
+
+	item = rss.Item{FeedID: 3, Title: "Security release"}
+	assert.False(t, rules.Notify(ruleset, nil, &item), "only for feed 2")
+	item = rss.Item{FeedID: 2, Title: "Just a release"}
+	assert.False(t, rules.Notify(ruleset, nil, &item), "star rules don't notify")
+}
@@ -0,0 +1,205 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+// Keeps subscriptions and read and starred state in step between devices
+// through a shared directory, like a Syncthing or Dropbox folder. Each
+// device writes its own changes to its own file in the directory, named
+// after the device, and reads everyone else's. Nothing is ever written to
+// another device's file, so the file sync tool never has to resolve a
+// conflict. The files are JSON lines, a header followed by one change per
+// line.
+package statesync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/repository"
+)
+
+// Format identifies a feeder sync file.
+const Format = "feeder-sync"
+
+// Version is the version of the sync file format written.
+const Version = 1
+
+const fileSuffix = ".jsonl"
+
+var ErrDevice = errors.New("device names can only use letters, numbers, '.', '-', and '_'")
+
+var deviceName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Header is the first line of a sync file.
+type Header struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Device  string    `json:"device"`
+	Written time.Time `json:"written"`
+}
+
+// Store is what syncing needs from the database.
+type Store interface {
+	LocalChanges(ctx context.Context) ([]repository.Change, error)
+	MergeChanges(ctx context.Context, device string, changes []repository.Change) (repository.MergeResult, error)
+}
+
+// Result says what a sync did.
+type Result struct {
+	// Changes written to this device's file
+	Exported int
+	// Devices whose files were read
+	Devices []string
+	repository.MergeResult
+	// Files in the directory that couldn't be read, and why. They're
+	// skipped so one bad file doesn't hold up syncing with everyone else.
+	Skipped map[string]error
+}
+
+// DefaultDevice names this device after the host, with anything that can't
+// go in a file name replaced.
+func DefaultDevice() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "feeder"
+	}
+	host, _, _ = strings.Cut(host, ".")
+	return regexp.MustCompile(`[^A-Za-z0-9_-]`).ReplaceAllString(host, "-")
+}
+
+// Sync writes this device's changes to its file in dir, then merges in the
+// changes from every other device's file.
+func Sync(ctx context.Context, store Store, dir string, device string) (Result, error) {
+	var result Result
+	if !deviceName.MatchString(device) {
+		return result, fmt.Errorf("%w: %q", ErrDevice, device)
+	}
+	local, err := store.LocalChanges(ctx)
+	if err != nil {
+		return result, err
+	}
+	if err := Export(dir, device, local); err != nil {
+		return result, err
+	}
+	result.Exported = len(local)
+
+	incoming, devices, skipped, err := ReadOthers(dir, device)
+	if err != nil {
+		return result, err
+	}
+	result.Devices = devices
+	result.Skipped = skipped
+	result.MergeResult, err = store.MergeChanges(ctx, device, incoming)
+	return result, err
+}
+
+// Export replaces the file for device in dir with the given changes. The
+// file is written to a temporary name and renamed into place, so the file
+// sync tool never picks up a half written file.
+func Export(dir string, device string, changes []repository.Change) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+device+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := writeChanges(tmp, device, changes); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, device+fileSuffix))
+}
+
+func writeChanges(w io.Writer, device string, changes []repository.Change) error {
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	err := encoder.Encode(Header{Format: Format, Version: Version, Device: device, Written: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		change.Device = device
+		if err := encoder.Encode(change); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadOthers reads the changes from every sync file in dir other than the
+// one for device. The device each file belongs to comes from its header
+// rather than the file name, so conflict copies made by the file sync tool
+// are read too. Files that can't be read are returned in skipped.
+func ReadOthers(dir string, device string) ([]repository.Change, []string, map[string]error, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+fileSuffix))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var changes []repository.Change
+	var devices []string
+	skipped := make(map[string]error)
+	for _, path := range paths {
+		header, fileChanges, err := readFile(path)
+		if err != nil {
+			skipped[filepath.Base(path)] = err
+			continue
+		}
+		if header.Device == device {
+			continue
+		}
+		if !slices.Contains(devices, header.Device) {
+			devices = append(devices, header.Device)
+		}
+		changes = append(changes, fileChanges...)
+	}
+	slices.Sort(devices)
+	return changes, devices, skipped, nil
+}
+
+func readFile(path string) (Header, []repository.Change, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	var header Header
+	if err := decoder.Decode(&header); err != nil || header.Format != Format {
+		return Header{}, nil, errors.New("not a feeder sync file")
+	}
+	if header.Version < 1 || header.Version > Version {
+		return header, nil, fmt.Errorf("unsupported sync file version %d", header.Version)
+	}
+	if !deviceName.MatchString(header.Device) {
+		return header, nil, fmt.Errorf("%w: %q", ErrDevice, header.Device)
+	}
+	var changes []repository.Change
+	for decoder.More() {
+		var change repository.Change
+		if err := decoder.Decode(&change); err != nil {
+			return header, nil, err
+		}
+		// Only the device can speak for itself
+		change.Device = header.Device
+		changes = append(changes, change)
+	}
+	return header, changes, nil
+}
@@ -0,0 +1,185 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package statesync_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/repository"
+	"github.com/mikerowehl/feeder/internal/rss"
+	"github.com/mikerowehl/feeder/internal/statesync"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const feedURL = "https://example.com/tech.rss"
+
+// A device is a database of its own, syncing through the shared directory.
+type device struct {
+	name string
+	repo *repository.FeedRepository
+}
+
+func newDevice(t *testing.T, name string) *device {
+	t.Helper()
+	repo, err := repository.NewFeedRepository(filepath.Join(t.TempDir(), name+".db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, repo.Close())
+	})
+	return &device{name: name, repo: repo}
+}
+
+func (d *device) sync(t *testing.T, dir string) statesync.Result {
+	t.Helper()
+	result, err := statesync.Sync(t.Context(), d.repo, dir, d.name)
+	require.NoError(t, err)
+	assert.Empty(t, result.Skipped)
+	return result
+}
+
+// Stand in for fetching the feed, which gives each device the same items.
+func (d *device) fetch(t *testing.T) {
+	t.Helper()
+	feeds, err := d.repo.AllFeeds(t.Context())
+	require.NoError(t, err)
+	for _, feed := range feeds {
+		known, err := d.repo.KnownItems(t.Context(), feed.ID)
+		require.NoError(t, err)
+		var items []rss.Item
+		for _, guid := range []string{"item-1", "item-2"} {
+			if _, ok := known[guid]; !ok {
+				items = append(items, rss.Item{FeedID: feed.ID, GUID: guid, Title: guid})
+			}
+		}
+		require.NoError(t, d.repo.SaveItems(t.Context(), items))
+	}
+}
+
+func (d *device) item(t *testing.T, guid string) rss.Item {
+	t.Helper()
+	items, err := d.repo.AllItems(t.Context())
+	require.NoError(t, err)
+	for _, item := range items {
+		if item.GUID == guid {
+			return item
+		}
+	}
+	require.FailNow(t, "no item "+guid)
+	return rss.Item{}
+}
+
+func TestSync_TwoDevices(t *testing.T) {
+	dir := t.TempDir()
+	laptop := newDevice(t, "laptop")
+	desktop := newDevice(t, "desktop")
+
+	require.NoError(t, laptop.repo.Save(t.Context(), &rss.Feed{URL: feedURL, Title: "Tech"}))
+	laptop.fetch(t)
+	require.NoError(t, laptop.repo.MarkRead(t.Context(), laptop.item(t, "item-1").ID))
+	result := laptop.sync(t, dir)
+	assert.Equal(t, 2, result.Exported, "the subscription and the read item")
+	assert.Empty(t, result.Devices)
+
+	result = desktop.sync(t, dir)
+	assert.Equal(t, []string{"laptop"}, result.Devices)
+	assert.Equal(t, 2, result.Merged)
+	assert.Equal(t, 1, result.Pending, "the read item hasn't been fetched here yet")
+	feeds, err := desktop.repo.AllFeeds(t.Context())
+	require.NoError(t, err)
+	require.Len(t, feeds, 1)
+	assert.Equal(t, "Tech", feeds[0].Title)
+
+	desktop.fetch(t)
+	result = desktop.sync(t, dir)
+	assert.Zero(t, result.Merged)
+	assert.Equal(t, 1, result.Applied, "the waiting change is applied once the item is here")
+	assert.Zero(t, result.Pending)
+	assert.True(t, desktop.item(t, "item-1").Read)
+	assert.False(t, desktop.item(t, "item-2").Read)
+
+	require.NoError(t, desktop.repo.SetStarred(t.Context(), desktop.item(t, "item-2").ID, true))
+	require.NoError(t, desktop.repo.MarkUnread(t.Context(), desktop.item(t, "item-1").ID))
+	desktop.sync(t, dir)
+	laptop.sync(t, dir)
+	assert.False(t, laptop.item(t, "item-1").Read)
+	assert.True(t, laptop.item(t, "item-2").Starred)
+
+	// Changed on both, the later change wins everywhere
+	require.NoError(t, desktop.repo.MarkRead(t.Context(), desktop.item(t, "item-2").ID))
+	require.NoError(t, laptop.repo.MarkUnread(t.Context(), laptop.item(t, "item-2").ID))
+	desktop.sync(t, dir)
+	laptop.sync(t, dir)
+	desktop.sync(t, dir)
+	assert.False(t, laptop.item(t, "item-2").Read)
+	assert.False(t, desktop.item(t, "item-2").Read)
+}
+
+func TestSync_Unsubscribe(t *testing.T) {
+	dir := t.TempDir()
+	laptop := newDevice(t, "laptop")
+	desktop := newDevice(t, "desktop")
+
+	feed := rss.Feed{URL: feedURL, Title: "Tech"}
+	require.NoError(t, laptop.repo.Save(t.Context(), &feed))
+	laptop.sync(t, dir)
+	desktop.sync(t, dir)
+
+	require.NoError(t, laptop.repo.Delete(t.Context(), feed.ID))
+	laptop.sync(t, dir)
+	desktop.sync(t, dir)
+	feeds, err := desktop.repo.AllFeeds(t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, feeds)
+
+	// Subscribing again later wins over the old unsubscribe
+	require.NoError(t, desktop.repo.Save(t.Context(), &rss.Feed{URL: feedURL, Title: "Tech again"}))
+	desktop.sync(t, dir)
+	laptop.sync(t, dir)
+	feeds, err = laptop.repo.AllFeeds(t.Context())
+	require.NoError(t, err)
+	require.Len(t, feeds, 1)
+	assert.Equal(t, "Tech again", feeds[0].Title)
+}
+
+func TestSync_BadFiles(t *testing.T) {
+	dir := t.TempDir()
+	laptop := newDevice(t, "laptop")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.jsonl"), []byte("{\"some\":\"thing\"}\n"), 0o644))
+
+	result, err := statesync.Sync(t.Context(), laptop.repo, dir, "laptop")
+	require.NoError(t, err, "a bad file doesn't stop the sync")
+	assert.Contains(t, result.Skipped, "notes.jsonl")
+	assert.FileExists(t, filepath.Join(dir, "laptop.jsonl"))
+
+	_, err = statesync.Sync(t.Context(), laptop.repo, dir, "../laptop")
+	assert.ErrorIs(t, err, statesync.ErrDevice)
+}
+
+// Files and commands are particular to one machine, and running a command
+// because it showed up in the sync directory would be a hole.
+func TestSync_LocalSources(t *testing.T) {
+	dir := t.TempDir()
+	laptop := newDevice(t, "laptop")
+	desktop := newDevice(t, "desktop")
+
+	require.NoError(t, laptop.repo.Save(t.Context(), &rss.Feed{URL: "exec:~/bin/status-feed", Title: "Status"}))
+	require.NoError(t, laptop.repo.Save(t.Context(), &rss.Feed{URL: "file:///home/me/feed.xml", Title: "Local"}))
+	result := laptop.sync(t, dir)
+	assert.Zero(t, result.Exported)
+
+	forged := []repository.Change{{Kind: repository.ChangeSubscribed, Target: "exec:rm -rf ~", Value: true, At: time.Now()}}
+	require.NoError(t, statesync.Export(dir, "laptop", forged))
+	result = desktop.sync(t, dir)
+	assert.Equal(t, 1, result.Merged)
+	feeds, err := desktop.repo.AllFeeds(t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, feeds)
+}
@@ -0,0 +1,484 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package tui
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/mikerowehl/feeder/internal/feeder"
+	lib "github.com/mikerowehl/feeder/pkg/feeder"
+)
+
+// How many of the newest items in a feed show up in the item list
+const maxListItems = 200
+
+type screen int
+
+const (
+	feedsScreen screen = iota
+	itemsScreen
+	itemScreen
+)
+
+var (
+	titleStyle    = lipgloss.NewStyle().Bold(true)
+	selectedStyle = lipgloss.NewStyle().Reverse(true)
+	unreadStyle   = lipgloss.NewStyle().Bold(true)
+	dimStyle      = lipgloss.NewStyle().Faint(true)
+)
+
+var help = map[screen]string{
+	feedsScreen: "enter: open feed  r: refresh  q: quit",
+	itemsScreen: "enter: read  m: read/unread  s: star  o: open link  r: refresh  esc: back  q: quit",
+	itemScreen:  "space/b: page  m: read/unread  s: star  o: open link  n/p: next/prev  esc: back  q: quit",
+}
+
+type fetchDoneMsg struct {
+	err error
+}
+
+type openDoneMsg struct {
+	err error
+}
+
+// Model is the state of the terminal reader. All the reading and marking
+// goes straight through the feed repository, so it always agrees with what
+// the other commands see.
+type Model struct {
+	ctx    context.Context
+	f      *feeder.Feeder
+	screen screen
+	width  int
+	height int
+
+	feeds      []lib.FeedCount
+	feedCursor int
+	items      []lib.Item
+	itemCursor int
+	lines      []string
+	scroll     int
+
+	status   string
+	fetching bool
+	// Anything the feeder prints while we own the screen ends up here
+	log *bytes.Buffer
+}
+
+// New creates the reader with the list of feeds loaded. The context covers
+// everything the reader does, including refreshing the feeds.
+func New(ctx context.Context, f *feeder.Feeder) (*Model, error) {
+	m := &Model{ctx: ctx, f: f, width: 80, height: 24, log: &bytes.Buffer{}}
+	if err := m.loadFeeds(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Model) loadFeeds() error {
+	feeds, err := m.f.Db.UnreadCounts(m.ctx)
+	if err != nil {
+		return fmt.Errorf("Error loading feeds: %w", err)
+	}
+	m.feeds = feeds
+	m.feedCursor = clamp(m.feedCursor, len(m.feeds))
+	return nil
+}
+
+func (m *Model) loadItems() error {
+	if len(m.feeds) == 0 {
+		m.items = nil
+		return nil
+	}
+	items, err := m.f.Db.FeedItems(m.ctx, m.feeds[m.feedCursor].ID, maxListItems)
+	if err != nil {
+		return fmt.Errorf("Error loading items: %w", err)
+	}
+	m.items = items
+	m.itemCursor = clamp(m.itemCursor, len(m.items))
+	return nil
+}
+
+func clamp(cursor int, length int) int {
+	return max(0, min(cursor, length-1))
+}
+
+func (m *Model) currentItem() *lib.Item {
+	if m.screen == feedsScreen || len(m.items) == 0 {
+		return nil
+	}
+	return &m.items[m.itemCursor]
+}
+
+// Rows available for a list or the text of an item, leaving space for the
+// title, status, and help lines.
+func (m *Model) rows() int {
+	return max(1, m.height-3)
+}
+
+func (m *Model) Init() tea.Cmd {
+	return nil
+}
+
+func (m *Model) setStatus(err error, format string, args ...any) {
+	if err != nil {
+		m.status = err.Error()
+		return
+	}
+	m.status = fmt.Sprintf(format, args...)
+}
+
+func (m *Model) toggleRead() {
+	item := m.currentItem()
+	if item == nil {
+		return
+	}
+	var err error
+	if item.Read {
+		err = m.f.Db.MarkUnread(m.ctx, item.ID)
+	} else {
+		err = m.f.Db.MarkRead(m.ctx, item.ID)
+	}
+	if err == nil {
+		item.Read = !item.Read
+		err = m.loadFeeds()
+	}
+	if item.Read {
+		m.setStatus(err, "Marked read")
+	} else {
+		m.setStatus(err, "Marked unread")
+	}
+}
+
+func (m *Model) markRead() {
+	item := m.currentItem()
+	if item == nil || item.Read {
+		return
+	}
+	err := m.f.Db.MarkRead(m.ctx, item.ID)
+	if err == nil {
+		item.Read = true
+		err = m.loadFeeds()
+	}
+	m.setStatus(err, "")
+}
+
+func (m *Model) toggleStar() {
+	item := m.currentItem()
+	if item == nil {
+		return
+	}
+	err := m.f.Db.SetStarred(m.ctx, item.ID, !item.Starred)
+	if err == nil {
+		item.Starred = !item.Starred
+	}
+	if item.Starred {
+		m.setStatus(err, "Starred")
+	} else {
+		m.setStatus(err, "Unstarred")
+	}
+}
+
+func (m *Model) openLink() tea.Cmd {
+	item := m.currentItem()
+	if item == nil || item.Link == "" {
+		return nil
+	}
+	link := item.Link
+	m.status = "Opening " + link
+	return func() tea.Msg {
+		return openDoneMsg{err: m.f.Open(link)}
+	}
+}
+
+func (m *Model) refresh() tea.Cmd {
+	if m.fetching {
+		return nil
+	}
+	m.fetching = true
+	m.status = "Fetching feeds..."
+	m.log.Reset()
+	return func() tea.Msg {
+		return fetchDoneMsg{err: m.f.Fetch(m.ctx)}
+	}
+}
+
+// Lay out the text of the current item for the terminal width.
+func (m *Model) renderItem() {
+	item := m.currentItem()
+	if item == nil {
+		m.lines = nil
+		return
+	}
+	var b strings.Builder
+	b.WriteString(item.Title + "\n")
+	meta := []string{m.feeds[m.feedCursor].Title}
+	if item.Author != "" {
+		meta = append(meta, item.Author)
+	}
+	if !item.Published.IsZero() {
+		meta = append(meta, item.Published.Format("Jan 2, 2006 15:04"))
+	}
+	b.WriteString(strings.Join(meta, " | ") + "\n")
+	if item.Link != "" {
+		b.WriteString(item.Link + "\n")
+	}
+	b.WriteString("\n")
+	body := item.FullContent
+	if body == "" {
+		body = item.Content
+	}
+	b.WriteString(lib.RenderText(body, m.width))
+	for _, enclosure := range item.Enclosures {
+		fmt.Fprintf(&b, "\n\n%s attachment: %s", enclosure.Kind(), enclosure.URL)
+	}
+	m.lines = strings.Split(b.String(), "\n")
+	m.scroll = 0
+}
+
+func (m *Model) openItem() {
+	m.screen = itemScreen
+	m.renderItem()
+	m.markRead()
+}
+
+func (m *Model) moveCursor(delta int) {
+	switch m.screen {
+	case feedsScreen:
+		m.feedCursor = clamp(m.feedCursor+delta, len(m.feeds))
+	case itemsScreen:
+		m.itemCursor = clamp(m.itemCursor+delta, len(m.items))
+	case itemScreen:
+		m.scroll = max(0, min(m.scroll+delta, len(m.lines)-m.rows()))
+	}
+}
+
+func (m *Model) enter() {
+	switch m.screen {
+	case feedsScreen:
+		if len(m.feeds) == 0 {
+			return
+		}
+		m.itemCursor = 0
+		if err := m.loadItems(); err != nil {
+			m.status = err.Error()
+			return
+		}
+		m.screen = itemsScreen
+	case itemsScreen:
+		if len(m.items) > 0 {
+			m.openItem()
+		}
+	}
+}
+
+func (m *Model) back() {
+	switch m.screen {
+	case itemsScreen:
+		m.screen = feedsScreen
+	case itemScreen:
+		m.screen = itemsScreen
+	}
+}
+
+func (m *Model) key(msg tea.KeyMsg) tea.Cmd {
+	switch msg.String() {
+	case "ctrl+c", "q":
+		return tea.Quit
+	case "down", "j":
+		m.moveCursor(1)
+	case "up", "k":
+		m.moveCursor(-1)
+	case "pgdown", " ", "f":
+		m.moveCursor(m.rows())
+	case "pgup", "b":
+		m.moveCursor(-m.rows())
+	case "home", "g":
+		m.moveCursor(-len(m.lines) - len(m.items) - len(m.feeds))
+	case "end", "G":
+		m.moveCursor(len(m.lines) + len(m.items) + len(m.feeds))
+	case "enter", "right", "l":
+		m.enter()
+	case "esc", "left", "h", "backspace":
+		m.back()
+	case "n", "p":
+		if m.screen == itemScreen {
+			delta := 1
+			if msg.String() == "p" {
+				delta = -1
+			}
+			next := clamp(m.itemCursor+delta, len(m.items))
+			if next != m.itemCursor {
+				m.itemCursor = next
+				m.openItem()
+			}
+		}
+	case "m":
+		m.toggleRead()
+	case "s":
+		m.toggleStar()
+	case "o":
+		return m.openLink()
+	case "r":
+		return m.refresh()
+	}
+	return nil
+}
+
+func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		if m.screen == itemScreen {
+			scroll := m.scroll
+			m.renderItem()
+			m.scroll = max(0, min(scroll, len(m.lines)-m.rows()))
+		}
+	case tea.KeyMsg:
+		return m, m.key(msg)
+	case fetchDoneMsg:
+		m.fetching = false
+		err := msg.err
+		if err == nil {
+			err = m.loadFeeds()
+		}
+		if err == nil && m.screen != feedsScreen {
+			err = m.loadItems()
+		}
+		problems := strings.Count(strings.TrimSpace(m.log.String()), "Error")
+		switch {
+		case err != nil:
+			m.status = err.Error()
+		case problems > 0:
+			m.status = fmt.Sprintf("Feeds refreshed, %d problems: %s", problems,
+				strings.TrimSpace(strings.SplitN(strings.TrimSpace(m.log.String()), "\n", 2)[0]))
+		default:
+			m.status = "Feeds refreshed"
+		}
+	case openDoneMsg:
+		m.setStatus(msg.err, "")
+	}
+	return m, nil
+}
+
+// Cut a line down to the screen width.
+func fit(s string, width int) string {
+	r := []rune(s)
+	if len(r) > width {
+		return string(r[:max(0, width-1)]) + "…"
+	}
+	return s
+}
+
+// The slice of a list to show so the cursor stays on screen.
+func window(cursor int, length int, rows int) (int, int) {
+	start := 0
+	if cursor >= rows {
+		start = cursor - rows + 1
+	}
+	return start, min(length, start+rows)
+}
+
+func (m *Model) feedList(b *strings.Builder) {
+	if len(m.feeds) == 0 {
+		b.WriteString("No feeds yet, add some with feeder add\n")
+		return
+	}
+	start, end := window(m.feedCursor, len(m.feeds), m.rows())
+	for i := start; i < end; i++ {
+		feed := m.feeds[i]
+		title := feed.Title
+		if title == "" {
+			title = feed.URL
+		}
+		line := fit(fmt.Sprintf("%5d  %s", feed.Unread, title), m.width)
+		switch {
+		case i == m.feedCursor:
+			line = selectedStyle.Render(line)
+		case feed.Unread > 0:
+			line = unreadStyle.Render(line)
+		}
+		b.WriteString(line + "\n")
+	}
+}
+
+func (m *Model) itemList(b *strings.Builder) {
+	if len(m.items) == 0 {
+		b.WriteString("No items in this feed\n")
+		return
+	}
+	start, end := window(m.itemCursor, len(m.items), m.rows())
+	for i := start; i < end; i++ {
+		item := m.items[i]
+		marker := " "
+		if !item.Read {
+			marker = "●"
+		}
+		star := " "
+		if item.Starred {
+			star = "★"
+		}
+		line := fit(fmt.Sprintf("%s%s %-6s  %s", marker, star, item.Published.Format("Jan 2"), item.Title), m.width)
+		switch {
+		case i == m.itemCursor:
+			line = selectedStyle.Render(line)
+		case !item.Read:
+			line = unreadStyle.Render(line)
+		}
+		b.WriteString(line + "\n")
+	}
+}
+
+func (m *Model) itemText(b *strings.Builder) {
+	end := min(len(m.lines), m.scroll+m.rows())
+	for _, line := range m.lines[m.scroll:end] {
+		b.WriteString(fit(line, m.width) + "\n")
+	}
+}
+
+func (m *Model) View() string {
+	var b strings.Builder
+	title := "Feeds"
+	switch m.screen {
+	case itemsScreen:
+		title = m.feeds[m.feedCursor].Title
+	case itemScreen:
+		title = fmt.Sprintf("%s (%d/%d)", m.feeds[m.feedCursor].Title, m.itemCursor+1, len(m.items))
+	}
+	b.WriteString(titleStyle.Render(fit("feeder: "+title, m.width)) + "\n")
+	switch m.screen {
+	case feedsScreen:
+		m.feedList(&b)
+	case itemsScreen:
+		m.itemList(&b)
+	case itemScreen:
+		m.itemText(&b)
+	}
+	// Push the status and help to the bottom of the screen
+	if lines := strings.Count(b.String(), "\n"); lines < m.height-2 {
+		b.WriteString(strings.Repeat("\n", m.height-2-lines))
+	}
+	b.WriteString(fit(m.status, m.width) + "\n")
+	b.WriteString(dimStyle.Render(fit(help[m.screen], m.width)))
+	return b.String()
+}
+
+// Run takes over the terminal until the reader quits. Anything the feeder
+// prints in the meantime is captured so it doesn't draw over the screen.
+func Run(ctx context.Context, f *feeder.Feeder, opts ...tea.ProgramOption) error {
+	m, err := New(ctx, f)
+	if err != nil {
+		return err
+	}
+	restore := f.SetOutput(m.log, m.log)
+	defer restore()
+	_, err = tea.NewProgram(m, append([]tea.ProgramOption{tea.WithAltScreen(), tea.WithContext(ctx)}, opts...)...).Run()
+	return err
+}
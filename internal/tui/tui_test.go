@@ -0,0 +1,169 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package tui_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/mikerowehl/feeder/internal/feeder"
+	"github.com/mikerowehl/feeder/internal/tui"
+	lib "github.com/mikerowehl/feeder/pkg/feeder"
+	"github.com/mikerowehl/feeder/test/mock"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const refreshedFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+  <channel>
+    <title>Tech</title>
+    <item>
+      <title>Brand New Post</title>
+      <link>https://example.com/new</link>
+      <guid>tech-new</guid>
+      <description>Fresh content</description>
+      <pubDate>Wed, 05 Mar 2025 12:00:00 GMT</pubDate>
+    </item>
+  </channel>
+</rss>`
+
+func setupFeeder(t *testing.T) *feeder.Feeder {
+	t.Helper()
+	f, err := feeder.NewFeeder(":memory:", &bytes.Buffer{}, &bytes.Buffer{}, strings.NewReader(""))
+	require.NoError(t, err)
+	t.Cleanup(f.Close)
+
+	published := time.Date(2025, 3, 4, 12, 0, 0, 0, time.UTC)
+	feeds := []lib.Feed{
+		{Title: "Tech", URL: "https://example.com/tech.rss", Items: []lib.Item{
+			{Title: "Second Post", GUID: "tech-2", Link: "https://example.com/2", Published: published,
+				Author: "Jane", Content: `<p>Some <b>bold</b> words and a <a href="https://example.com/ref">link</a></p>`},
+			{Title: "First Post", GUID: "tech-1", Link: "https://example.com/1", Published: published.Add(-time.Hour)},
+		}},
+		{Title: "Art", URL: "https://example.com/art.rss"},
+	}
+	for i := range feeds {
+		require.NoError(t, f.Db.Save(t.Context(), &feeds[i]))
+	}
+	return f
+}
+
+func press(t *testing.T, m tea.Model, keys ...string) (tea.Model, tea.Cmd) {
+	t.Helper()
+	var cmd tea.Cmd
+	for _, key := range keys {
+		var msg tea.KeyMsg
+		switch key {
+		case "enter":
+			msg = tea.KeyMsg{Type: tea.KeyEnter}
+		case "esc":
+			msg = tea.KeyMsg{Type: tea.KeyEsc}
+		case "down":
+			msg = tea.KeyMsg{Type: tea.KeyDown}
+		default:
+			msg = tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(key)}
+		}
+		m, cmd = m.Update(msg)
+	}
+	return m, cmd
+}
+
+func unreadCounts(t *testing.T, f *feeder.Feeder) map[string]int {
+	t.Helper()
+	counts, err := f.Db.UnreadCounts(t.Context())
+	require.NoError(t, err)
+	result := make(map[string]int)
+	for _, count := range counts {
+		result[count.Title] = count.Unread
+	}
+	return result
+}
+
+func TestTUI_FeedList(t *testing.T) {
+	f := setupFeeder(t)
+	m, err := tui.New(t.Context(), f)
+	require.NoError(t, err)
+	model, _ := m.Update(tea.WindowSizeMsg{Width: 60, Height: 10})
+
+	view := model.View()
+	assert.Contains(t, view, "0  Art")
+	assert.Contains(t, view, "2  Tech")
+	assert.Len(t, strings.Split(view, "\n"), 10, "view fills the screen")
+}
+
+func TestTUI_ReadItem(t *testing.T) {
+	f := setupFeeder(t)
+	m, err := tui.New(t.Context(), f)
+	require.NoError(t, err)
+	model, _ := m.Update(tea.WindowSizeMsg{Width: 60, Height: 20})
+
+	model, _ = press(t, model, "j", "enter")
+	view := model.View()
+	assert.Contains(t, view, "feeder: Tech")
+	assert.Contains(t, view, "Second Post")
+	assert.Contains(t, view, "First Post")
+
+	model, _ = press(t, model, "enter")
+	view = model.View()
+	assert.Contains(t, view, "Tech (1/2)")
+	assert.Contains(t, view, "Tech | Jane")
+	assert.Contains(t, view, "Some bold words and a link [1]")
+	assert.Contains(t, view, "[1] https://example.com/ref")
+	assert.Equal(t, 1, unreadCounts(t, f)["Tech"], "reading an item marks it read")
+
+	model, _ = press(t, model, "m")
+	assert.Equal(t, 2, unreadCounts(t, f)["Tech"])
+	assert.Contains(t, model.View(), "Marked unread")
+
+	model, _ = press(t, model, "s")
+	starred, err := f.Db.Starred(t.Context(), lib.ItemFilter{})
+	require.NoError(t, err)
+	var titles []string
+	for _, feed := range starred {
+		for _, item := range feed.Items {
+			titles = append(titles, item.Title)
+		}
+	}
+	assert.Equal(t, []string{"Second Post"}, titles)
+
+	model, _ = press(t, model, "n")
+	assert.Contains(t, model.View(), "Tech (2/2)")
+	assert.Equal(t, 1, unreadCounts(t, f)["Tech"])
+
+	model, _ = press(t, model, "esc", "esc")
+	assert.Contains(t, model.View(), "1  Tech")
+}
+
+func TestTUI_Refresh(t *testing.T) {
+	f := setupFeeder(t)
+	f.Client = mock.NewMockClient(refreshedFeed, 200)
+	m, err := tui.New(t.Context(), f)
+	require.NoError(t, err)
+
+	model, cmd := press(t, m, "r")
+	require.NotNil(t, cmd)
+	assert.Contains(t, model.View(), "Fetching feeds")
+	model, _ = model.Update(cmd())
+	assert.Contains(t, model.View(), "Feeds refreshed")
+	assert.Equal(t, 3, unreadCounts(t, f)["Tech"])
+
+	model, _ = press(t, model, "j", "enter")
+	assert.Contains(t, model.View(), "Brand New Post")
+}
+
+func TestTUI_Quit(t *testing.T) {
+	f := setupFeeder(t)
+	m, err := tui.New(t.Context(), f)
+	require.NoError(t, err)
+	_, cmd := press(t, m, "q")
+	require.NotNil(t, cmd)
+	assert.Equal(t, tea.Quit(), cmd())
+}
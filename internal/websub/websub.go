@@ -0,0 +1,517 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+
+// Package websub subscribes to feeds that publish through a WebSub
+// (formerly PubSubHubbub) hub, so new items are pushed to us as soon as
+// they're published instead of waiting for the next poll.
+package websub
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/httpclient"
+	"github.com/mikerowehl/feeder/internal/rss"
+	"golang.org/x/net/html/charset"
+)
+
+// ErrNoHub is returned by Discover for a feed that doesn't name a hub.
+var ErrNoHub = errors.New("feed doesn't advertise a hub")
+
+// Defaults for a Subscriber
+const (
+	DefaultLease         = 7 * 24 * time.Hour
+	DefaultCheckInterval = time.Minute
+	// How long to wait before trying a failed renewal again
+	RetryDelay = 5 * time.Minute
+)
+
+// Hub is where a feed publishes, and the topic URL it publishes under,
+// which can differ from the URL the feed was fetched from.
+type Hub struct {
+	URL   string
+	Topic string
+}
+
+// Discover fetches a feed and finds its hub, from the Link headers on the
+// response or, failing that, the rel="hub" and rel="self" links in the feed
+// itself. The topic is the feed URL if there's no self link.
+func Discover(ctx context.Context, feedURL string, client *http.Client) (Hub, error) {
+	hub := Hub{Topic: feedURL}
+	if rss.IsLocalSource(feedURL) {
+		return hub, ErrNoHub
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", feedURL, nil)
+	if err != nil {
+		return hub, err
+	}
+	req.Header.Set("User-Agent", httpclient.DefaultUserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return hub, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return hub, fmt.Errorf("unexpected http status: %v", resp.Status)
+	}
+	base := resp.Request.URL
+
+	hubURL, self := headerLinks(resp.Header.Values("Link"))
+	if hubURL == "" {
+		hubURL, self = feedLinks(io.LimitReader(resp.Body, rss.DefaultMaxBodySize), resp.Header.Get("Content-Type"))
+	}
+	if hubURL == "" {
+		return hub, ErrNoHub
+	}
+	if hub.URL, err = resolve(base, hubURL); err != nil {
+		return hub, fmt.Errorf("bad hub link %q: %w", hubURL, err)
+	}
+	if self != "" {
+		if hub.Topic, err = resolve(base, self); err != nil {
+			return hub, fmt.Errorf("bad self link %q: %w", self, err)
+		}
+	}
+	return hub, nil
+}
+
+func resolve(base *url.URL, link string) (string, error) {
+	ref, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+var (
+	linkValue = regexp.MustCompile(`<([^>]*)>([^<]*)`)
+	linkRel   = regexp.MustCompile(`(?i);\s*rel\s*=\s*(?:"([^"]*)"|([^\s;,]+))`)
+)
+
+// The hub and self links from Link headers, like
+// `<https://hub.example.com/>; rel="hub"`.
+func headerLinks(values []string) (hub string, self string) {
+	for _, value := range values {
+		for _, m := range linkValue.FindAllStringSubmatch(value, -1) {
+			rel := linkRel.FindStringSubmatch(m[2])
+			if rel == nil {
+				continue
+			}
+			for _, r := range strings.Fields(strings.ToLower(rel[1] + rel[2])) {
+				if r == "hub" && hub == "" {
+					hub = m[1]
+				} else if r == "self" && self == "" {
+					self = m[1]
+				}
+			}
+		}
+	}
+	return hub, self
+}
+
+// The hub and self links at the top of an Atom or RSS feed. Only the links
+// before the first entry count, the ones in entries are about the entries.
+func feedLinks(body io.Reader, contentType string) (hub string, self string) {
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+		if r, err := charset.NewReaderLabel(params["charset"], body); err == nil {
+			body = r
+		}
+	}
+	dec := xml.NewDecoder(body)
+	dec.Strict = false
+	dec.CharsetReader = charset.NewReaderLabel
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return hub, self
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "item", "entry":
+			return hub, self
+		case "link":
+			var rel, href string
+			for _, a := range start.Attr {
+				switch a.Name.Local {
+				case "rel":
+					rel = a.Value
+				case "href":
+					href = a.Value
+				}
+			}
+			for _, r := range strings.Fields(strings.ToLower(rel)) {
+				if r == "hub" && hub == "" {
+					hub = href
+				} else if r == "self" && self == "" {
+					self = href
+				}
+			}
+		}
+	}
+}
+
+// IngestFunc saves the content a hub pushed for a feed.
+type IngestFunc func(ctx context.Context, feed *rss.Feed, content string) error
+
+// Subscriber holds the subscriptions for a set of feeds and serves the
+// callback URL hubs talk to: it answers the hubs checking that we asked for
+// a subscription, checks the signature on content they push, and hands the
+// content to Ingest. Each feed gets its own callback, Callback with the feed
+// ID added to the path, and its own secret. The spec only allows a secret
+// with an HTTPS callback, so with a plain HTTP one there's no secret and
+// pushes can't be checked.
+type Subscriber struct {
+	Client *http.Client
+	// The public URL the hubs reach ServeHTTP at
+	Callback string
+	// The lease asked for, hubs can give less
+	Lease time.Duration
+	// How often to check for leases that need renewing
+	CheckInterval time.Duration
+	// The biggest push accepted, in bytes
+	MaxBodySize int64
+	Ingest      IngestFunc
+	// Where to report what's happening, nothing is reported if nil
+	Logf func(format string, args ...any)
+
+	mu   sync.Mutex
+	subs map[uint]*subscription
+}
+
+type subscription struct {
+	feed   rss.Feed
+	hub    Hub
+	secret string
+	// The mode we've asked the hub for and are waiting to be asked about
+	pending string
+	// Set once the hub confirms the subscription
+	active bool
+	// When the lease runs out, and when to renew it, zero for a lease
+	// that doesn't run out
+	expires time.Time
+	renewAt time.Time
+}
+
+// Subscription describes one feed's subscription, for reporting.
+type Subscription struct {
+	FeedID uint
+	Hub    Hub
+	Active bool
+	// Zero if the lease doesn't run out
+	Expires time.Time
+}
+
+// NewSubscriber creates a Subscriber with the default lease and check
+// interval. A nil client means http.DefaultClient.
+func NewSubscriber(client *http.Client, callback string, ingest IngestFunc) *Subscriber {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Subscriber{
+		Client:        client,
+		Callback:      callback,
+		Lease:         DefaultLease,
+		CheckInterval: DefaultCheckInterval,
+		MaxBodySize:   rss.DefaultMaxBodySize,
+		Ingest:        ingest,
+		subs:          make(map[uint]*subscription),
+	}
+}
+
+func (s *Subscriber) logf(format string, args ...any) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	}
+}
+
+// Secure reports whether a callback URL is HTTPS, which the hubs need for
+// it to be given a secret to sign pushes with.
+func Secure(callback string) bool {
+	u, err := url.Parse(callback)
+	return err == nil && strings.EqualFold(u.Scheme, "https")
+}
+
+func (s *Subscriber) callbackFor(feedID uint) (string, error) {
+	return url.JoinPath(s.Callback, strconv.FormatUint(uint64(feedID), 10))
+}
+
+// Subscribe asks the hub to push a feed to us. The hub confirms it by
+// calling back, so the subscription isn't active until ServeHTTP has
+// answered that.
+func (s *Subscriber) Subscribe(ctx context.Context, feed rss.Feed, hub Hub) error {
+	var secret string
+	if Secure(s.Callback) {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		secret = hex.EncodeToString(b)
+	}
+	s.mu.Lock()
+	sub := &subscription{feed: feed, hub: hub, secret: secret, pending: "subscribe"}
+	s.subs[feed.ID] = sub
+	s.mu.Unlock()
+	if err := s.request(ctx, sub); err != nil {
+		s.mu.Lock()
+		if s.subs[feed.ID] == sub {
+			delete(s.subs, feed.ID)
+		}
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Send a subscription request to the hub. The hub might check with us
+// before it responds, so the subscription isn't locked while waiting.
+func (s *Subscriber) request(ctx context.Context, sub *subscription) error {
+	s.mu.Lock()
+	callback, err := s.callbackFor(sub.feed.ID)
+	form := url.Values{
+		"hub.mode":     {"subscribe"},
+		"hub.topic":    {sub.hub.Topic},
+		"hub.callback": {callback},
+	}
+	if sub.secret != "" {
+		form.Set("hub.secret", sub.secret)
+	}
+	if s.Lease > 0 {
+		form.Set("hub.lease_seconds", strconv.Itoa(int(s.Lease.Seconds())))
+	}
+	hubURL := sub.hub.URL
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", hubURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", httpclient.DefaultUserAgent)
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if text := strings.TrimSpace(string(msg)); text != "" {
+			return fmt.Errorf("hub %s refused the subscription: %v: %s", hubURL, resp.Status, text)
+		}
+		return fmt.Errorf("hub %s refused the subscription: %v", hubURL, resp.Status)
+	}
+	return nil
+}
+
+// Subscriptions lists the feeds we've asked hubs for, ordered by feed ID.
+func (s *Subscriber) Subscriptions() []Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Subscription, 0, len(s.subs))
+	for id, sub := range s.subs {
+		list = append(list, Subscription{FeedID: id, Hub: sub.hub, Active: sub.active, Expires: sub.expires})
+	}
+	slices.SortFunc(list, func(a, b Subscription) int {
+		return cmp.Compare(a.FeedID, b.FeedID)
+	})
+	return list
+}
+
+// Run renews leases before they run out, until the context is cancelled.
+// Leases are renewed once nine tenths of them have gone by.
+func (s *Subscriber) Run(ctx context.Context) error {
+	interval := s.CheckInterval
+	if interval <= 0 {
+		interval = DefaultCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			s.renew(ctx, now)
+		}
+	}
+}
+
+func (s *Subscriber) renew(ctx context.Context, now time.Time) {
+	var due []*subscription
+	s.mu.Lock()
+	for _, sub := range s.subs {
+		if !sub.renewAt.IsZero() && !now.Before(sub.renewAt) {
+			// Tried again later if the hub doesn't confirm this one
+			sub.pending = "subscribe"
+			sub.renewAt = now.Add(RetryDelay)
+			due = append(due, sub)
+		}
+	}
+	s.mu.Unlock()
+	for _, sub := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := s.request(ctx, sub); err != nil {
+			s.logf("Error renewing subscription to %s: %v\n", sub.hub.Topic, err)
+			continue
+		}
+		s.logf("Renewing subscription to %s\n", sub.hub.Topic)
+	}
+}
+
+// ServeHTTP handles the requests hubs make to the callback URLs: a GET to
+// check a subscription we asked for, or a POST with new content.
+func (s *Subscriber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(path.Base(r.URL.Path), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.verify(w, r, uint(id))
+	case http.MethodPost:
+		s.push(w, r, uint(id))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Answer a hub checking we really want a subscription by echoing the
+// challenge, but only for the topic and mode we asked it for.
+func (s *Subscriber) verify(w http.ResponseWriter, r *http.Request, id uint) {
+	query := r.URL.Query()
+	mode := query.Get("hub.mode")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[id]
+	if !ok || query.Get("hub.topic") != sub.hub.Topic {
+		http.NotFound(w, r)
+		return
+	}
+	if mode == "denied" {
+		s.logf("Hub %s denied the subscription to %s: %s\n", sub.hub.URL, sub.hub.Topic, query.Get("hub.reason"))
+		delete(s.subs, id)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	challenge := query.Get("hub.challenge")
+	if mode != sub.pending || challenge == "" {
+		http.NotFound(w, r)
+		return
+	}
+	sub.pending = ""
+	sub.active = true
+	sub.expires, sub.renewAt = time.Time{}, time.Time{}
+	now := time.Now()
+	if seconds, err := strconv.Atoi(query.Get("hub.lease_seconds")); err == nil && seconds > 0 {
+		lease := time.Duration(seconds) * time.Second
+		sub.expires = now.Add(lease)
+		sub.renewAt = now.Add(lease * 9 / 10)
+	}
+	s.logf("Subscribed to %s through %s\n", sub.hub.Topic, sub.hub.URL)
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = io.WriteString(w, challenge)
+}
+
+// Take content pushed by a hub. For a subscription with a secret, content
+// without a good signature is dropped, but the hub is still told it arrived, as the spec asks, so
+// someone forging pushes can't tell whether it worked.
+func (s *Subscriber) push(w http.ResponseWriter, r *http.Request, id uint) {
+	s.mu.Lock()
+	sub, ok := s.subs[id]
+	var feed rss.Feed
+	var secret string
+	if ok {
+		feed, secret = sub.feed, sub.secret
+	}
+	s.mu.Unlock()
+	if !ok {
+		// Gone tells the hub to stop sending
+		http.Error(w, "no such subscription", http.StatusGone)
+		return
+	}
+	limit := s.MaxBodySize
+	if limit <= 0 {
+		limit = rss.DefaultMaxBodySize
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "content too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "error reading content", http.StatusBadRequest)
+		return
+	}
+	if secret != "" && !validSignature(r.Header.Get("X-Hub-Signature"), secret, body) {
+		s.logf("Ignoring content for %s without a valid signature\n", feed.URL)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	// Finish saving even if the hub hangs up
+	ctx := context.WithoutCancel(r.Context())
+	if err := s.Ingest(ctx, &feed, string(body)); err != nil {
+		s.logf("Error saving content pushed for %s: %v\n", feed.URL, err)
+		http.Error(w, "error saving content", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+var signatureHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// Check an X-Hub-Signature header, like "sha256=<hex HMAC of the body>".
+func validSignature(header string, secret string, body []byte) bool {
+	method, sig, ok := strings.Cut(header, "=")
+	if !ok {
+		return false
+	}
+	newHash, ok := signatureHashes[strings.ToLower(method)]
+	if !ok {
+		return false
+	}
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want)
+}
@@ -0,0 +1,264 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package websub_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/rss"
+	"github.com/mikerowehl/feeder/internal/websub"
+	"github.com/mikerowehl/feeder/test/mock"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+const atomFeed = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Pushed</title>
+  <link rel="self" href="/topic.atom"/>
+  <link rel="hub" href="https://hub.example.com/"/>
+  <entry>
+    <title>First</title>
+    <link rel="hub" href="https://wrong.example.com/"/>
+  </entry>
+</feed>`
+
+const rssFeed = `<?xml version="1.0"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom">
+  <channel>
+    <title>Pushed</title>
+    <atom:link rel="hub" href="https://hub.example.com/rss"/>
+    <link>https://example.com/</link>
+    <item><title>First</title></item>
+  </channel>
+</rss>`
+
+func serveFeed(t *testing.T, body string, link string) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if link != "" {
+			w.Header().Add("Link", link)
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/feed"
+}
+
+func TestDiscover(t *testing.T) {
+	feedURL := serveFeed(t, atomFeed, "")
+	hub, err := websub.Discover(t.Context(), feedURL, http.DefaultClient)
+	require.NoError(t, err)
+	assert.Equal(t, "https://hub.example.com/", hub.URL)
+	u, _ := url.Parse(feedURL)
+	assert.Equal(t, u.Scheme+"://"+u.Host+"/topic.atom", hub.Topic, "relative self link is resolved")
+
+	feedURL = serveFeed(t, rssFeed, "")
+	hub, err = websub.Discover(t.Context(), feedURL, http.DefaultClient)
+	require.NoError(t, err)
+	assert.Equal(t, "https://hub.example.com/rss", hub.URL)
+	assert.Equal(t, feedURL, hub.Topic, "the feed URL is the topic without a self link")
+
+	// Headers win over the feed
+	feedURL = serveFeed(t, atomFeed, `<https://example.com/self>; rel="self", <https://push.example.com/>; rel="hub"`)
+	hub, err = websub.Discover(t.Context(), feedURL, http.DefaultClient)
+	require.NoError(t, err)
+	assert.Equal(t, websub.Hub{URL: "https://push.example.com/", Topic: "https://example.com/self"}, hub)
+
+	feedURL = serveFeed(t, `<rss version="2.0"><channel><title>Polled</title></channel></rss>`, "")
+	_, err = websub.Discover(t.Context(), feedURL, http.DefaultClient)
+	assert.ErrorIs(t, err, websub.ErrNoHub)
+	_, err = websub.Discover(t.Context(), "file:///tmp/feed.xml", http.DefaultClient)
+	assert.ErrorIs(t, err, websub.ErrNoHub)
+}
+
+// Collects what the subscriber hands over to be saved.
+type ingested struct {
+	mu       sync.Mutex
+	contents []string
+}
+
+func (in *ingested) ingest(ctx context.Context, feed *rss.Feed, content string) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.contents = append(in.contents, content)
+	return nil
+}
+
+func (in *ingested) all() []string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return append([]string(nil), in.contents...)
+}
+
+// The subscriber is served over TLS, so it gives the hubs secrets
+func startSubscriber(t *testing.T, in *ingested) (*websub.Subscriber, *httptest.Server) {
+	t.Helper()
+	sub := websub.NewSubscriber(nil, "", in.ingest)
+	server := httptest.NewTLSServer(sub)
+	t.Cleanup(server.Close)
+	sub.Callback = server.URL + "/websub/"
+	return sub, server
+}
+
+func TestSubscriber_Push(t *testing.T) {
+	hub := mock.NewHub(t)
+	in := &ingested{}
+	sub, server := startSubscriber(t, in)
+	hub.Client = server.Client()
+	topic := "https://example.com/feed.atom"
+	require.NoError(t, sub.Subscribe(t.Context(), rss.Feed{Model: gorm.Model{ID: 7}, URL: topic}, websub.Hub{URL: hub.URL, Topic: topic}))
+	verified := hub.Verified(t)
+	assert.Contains(t, verified.Callback, "/websub/7")
+	assert.NotEmpty(t, verified.Secret)
+	subs := sub.Subscriptions()
+	require.Len(t, subs, 1)
+	assert.True(t, subs[0].Active)
+	assert.True(t, subs[0].Expires.IsZero(), "no lease was given")
+
+	status, err := hub.Publish(topic, atomFeed)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, []string{atomFeed}, in.all())
+
+	// sha1 is still allowed
+	mac := hmac.New(sha1.New, []byte(verified.Secret))
+	mac.Write([]byte(rssFeed))
+	status, err = hub.PublishSigned(topic, rssFeed, "sha1="+hex.EncodeToString(mac.Sum(nil)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Len(t, in.all(), 2)
+
+	// Forged or unsigned pushes are acknowledged but dropped
+	for _, signature := range []string{"", "sha256=00", "md5=abc", "sha256=" + hex.EncodeToString(mac.Sum(nil))} {
+		status, err = hub.PublishSigned(topic, "forged", signature)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusAccepted, status)
+	}
+	assert.Len(t, in.all(), 2)
+}
+
+// Secrets are only for HTTPS callbacks, so over plain HTTP pushes go
+// through unsigned
+func TestSubscriber_PlainCallback(t *testing.T) {
+	hub := mock.NewHub(t)
+	in := &ingested{}
+	sub := websub.NewSubscriber(nil, "", in.ingest)
+	server := httptest.NewServer(sub)
+	t.Cleanup(server.Close)
+	sub.Callback = server.URL + "/websub/"
+	topic := "https://example.com/feed.atom"
+	require.NoError(t, sub.Subscribe(t.Context(), rss.Feed{Model: gorm.Model{ID: 2}, URL: topic}, websub.Hub{URL: hub.URL, Topic: topic}))
+	verified := hub.Verified(t)
+	assert.Empty(t, verified.Secret)
+
+	status, err := hub.Publish(topic, atomFeed)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, []string{atomFeed}, in.all())
+
+	assert.False(t, websub.Secure(sub.Callback))
+	assert.True(t, websub.Secure("HTTPS://feeds.example.com/websub/"))
+}
+
+func TestSubscriber_Verify(t *testing.T) {
+	in := &ingested{}
+	sub, server := startSubscriber(t, in)
+	hubServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Accepts without checking back, so the tests do the checking
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(hubServer.Close)
+	topic := "https://example.com/feed.atom"
+	require.NoError(t, sub.Subscribe(t.Context(), rss.Feed{Model: gorm.Model{ID: 3}, URL: topic}, websub.Hub{URL: hubServer.URL, Topic: topic}))
+
+	check := func(id string, params url.Values) (int, string) {
+		t.Helper()
+		resp, err := server.Client().Get(server.URL + "/websub/" + id + "?" + params.Encode())
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var body [64]byte
+		n, _ := resp.Body.Read(body[:])
+		return resp.StatusCode, string(body[:n])
+	}
+	params := func(mode string, topic string) url.Values {
+		return url.Values{"hub.mode": {mode}, "hub.topic": {topic}, "hub.challenge": {"abc123"}, "hub.lease_seconds": {"3600"}}
+	}
+
+	status, _ := check("3", params("subscribe", "https://example.com/other"))
+	assert.Equal(t, http.StatusNotFound, status, "wrong topic")
+	status, _ = check("3", params("unsubscribe", topic))
+	assert.Equal(t, http.StatusNotFound, status, "we didn't ask to unsubscribe")
+	status, _ = check("4", params("subscribe", topic))
+	assert.Equal(t, http.StatusNotFound, status, "unknown feed")
+	assert.False(t, sub.Subscriptions()[0].Active)
+
+	status, body := check("3", params("subscribe", topic))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "abc123", body)
+	subs := sub.Subscriptions()
+	require.Len(t, subs, 1)
+	assert.True(t, subs[0].Active)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), subs[0].Expires, time.Minute)
+
+	// Only answered once per request
+	status, _ = check("3", params("subscribe", topic))
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _ = check("3", url.Values{"hub.mode": {"denied"}, "hub.topic": {topic}, "hub.reason": {"nope"}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, sub.Subscriptions())
+	resp, err := server.Client().Post(server.URL+"/websub/3", "application/atom+xml", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode, "pushes for a dropped subscription")
+}
+
+func TestSubscriber_Refused(t *testing.T) {
+	hubServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "topic not allowed", http.StatusForbidden)
+	}))
+	t.Cleanup(hubServer.Close)
+	sub, _ := startSubscriber(t, &ingested{})
+	err := sub.Subscribe(t.Context(), rss.Feed{Model: gorm.Model{ID: 1}}, websub.Hub{URL: hubServer.URL, Topic: "https://example.com/"})
+	assert.ErrorContains(t, err, "topic not allowed")
+	assert.Empty(t, sub.Subscriptions())
+}
+
+func TestSubscriber_Renew(t *testing.T) {
+	hub := mock.NewHub(t)
+	hub.LeaseSeconds = 1
+	sub, server := startSubscriber(t, &ingested{})
+	hub.Client = server.Client()
+	sub.CheckInterval = 20 * time.Millisecond
+	topic := "https://example.com/feed.atom"
+	require.NoError(t, sub.Subscribe(t.Context(), rss.Feed{Model: gorm.Model{ID: 1}, URL: topic}, websub.Hub{URL: hub.URL, Topic: topic}))
+	first := hub.Verified(t)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error)
+	go func() {
+		done <- sub.Run(ctx)
+	}()
+	renewed := hub.Verified(t)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.GreaterOrEqual(t, hub.Requests(), 2)
+	assert.Equal(t, first.Secret, renewed.Secret)
+	assert.True(t, sub.Subscriptions()[0].Active)
+}
@@ -0,0 +1,34 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package feeder
+
+import (
+	"io"
+
+	"github.com/mikerowehl/feeder/internal/backup"
+)
+
+// BackupVersion is the archive format version WriteBackup writes.
+const BackupVersion = backup.Version
+
+// Errors from ReadBackup for files that can't be restored from.
+var (
+	ErrNotBackup      = backup.ErrFormat
+	ErrBackupVersion  = backup.ErrVersion
+	ErrBackupChecksum = backup.ErrChecksum
+)
+
+// WriteBackup writes the contents of a store, from Store.Dump, as a
+// compressed archive with a checksum.
+func WriteBackup(w io.Writer, data Backup) error {
+	return backup.Write(w, data)
+}
+
+// ReadBackup reads an archive written by WriteBackup, ready to pass to
+// Store.Restore. The checksum is verified before anything is decoded.
+func ReadBackup(r io.Reader) (BackupHeader, Backup, error) {
+	return backup.Read(r)
+}
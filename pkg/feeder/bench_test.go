@@ -0,0 +1,109 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package feeder_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mikerowehl/feeder/pkg/feeder"
+	"github.com/mikerowehl/feeder/test/mock"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	benchFeeds = 1000
+	benchItems = 50
+)
+
+func benchURL(feed int) string {
+	return fmt.Sprintf("https://feed%d.example.com/rss", feed)
+}
+
+func benchGUID(feed, item int) string {
+	return fmt.Sprintf("feed%d-item%d", feed, item)
+}
+
+func benchContent(feed, item int) string {
+	return fmt.Sprintf("<p>Item %d of feed %d. %s</p>", item, feed, strings.Repeat("Some filler text. ", 50))
+}
+
+// A client serving each bench feed with a fixed set of items, plus one new
+// item each time the feed is fetched.
+func benchClient() *http.Client {
+	fetches := make(map[string]int)
+	return &http.Client{Transport: mock.MockRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var feed int
+		if _, err := fmt.Sscanf(req.URL.Host, "feed%d.example.com", &feed); err != nil {
+			return nil, err
+		}
+		fetches[req.URL.Host]++
+		var body strings.Builder
+		fmt.Fprintf(&body, `<?xml version="1.0" encoding="UTF-8"?><rss version="2.0"><channel><title>Feed %d</title>`, feed)
+		fmt.Fprintf(&body, "<item><title>Feed %d update %d</title><guid>%s-new%d</guid><description>Fresh</description></item>",
+			feed, fetches[req.URL.Host], req.URL.Host, fetches[req.URL.Host])
+		for j := range benchItems - 1 {
+			fmt.Fprintf(&body, "<item><title>Feed %d item %d</title><link>https://feed%d.example.com/%d</link><guid>%s</guid><description><![CDATA[%s]]></description></item>",
+				feed, j, feed, j, benchGUID(feed, j), benchContent(feed, j))
+		}
+		body.WriteString("</channel></rss>")
+		header := make(http.Header)
+		header.Set("Content-Type", "application/rss+xml")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(body.String())),
+			Header:     header,
+			Request:    req,
+		}, nil
+	})}
+}
+
+// Sets up a file backed store with a thousand feeds of fifty items each,
+// and a fetcher that sees one new item per feed on every refresh.
+func openBenchStore(b *testing.B) (feeder.Store, *feeder.Fetcher) {
+	b.Helper()
+	store, err := feeder.OpenStore(filepath.Join(b.TempDir(), "bench.db"))
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		store.Close()
+	})
+	for i := range benchFeeds {
+		feed := feeder.Feed{Title: fmt.Sprintf("Feed %d", i), URL: benchURL(i)}
+		require.NoError(b, store.Save(b.Context(), &feed))
+	}
+	fetcher := feeder.NewFetcher(benchClient())
+	result, err := fetcher.Refresh(b.Context(), store)
+	require.NoError(b, err)
+	require.Len(b, result.New, benchFeeds*benchItems)
+	return store, fetcher
+}
+
+func BenchmarkFetcher_Refresh(b *testing.B) {
+	store, fetcher := openBenchStore(b)
+	b.ReportAllocs()
+	for b.Loop() {
+		result, err := fetcher.Refresh(b.Context(), store)
+		require.NoError(b, err)
+		require.Len(b, result.New, benchFeeds)
+	}
+}
+
+func BenchmarkStore_KnownItems(b *testing.B) {
+	store, _ := openBenchStore(b)
+	b.ReportAllocs()
+	for b.Loop() {
+		for i := range benchFeeds {
+			known, err := store.KnownItems(b.Context(), uint(i+1))
+			require.NoError(b, err)
+			require.Len(b, known, benchItems)
+		}
+	}
+}
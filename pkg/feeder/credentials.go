@@ -0,0 +1,37 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package feeder
+
+import (
+	"net/http"
+
+	"github.com/mikerowehl/feeder/internal/credentials"
+)
+
+// ErrCredentialsPermissions is returned by LoadCredentials for a file other
+// users can read.
+var ErrCredentialsPermissions = credentials.ErrPermissions
+
+// LoadCredentials reads a credentials file for private feeds. A file that
+// doesn't exist gives empty credentials.
+func LoadCredentials(path string) (*Credentials, error) {
+	return credentials.Load(path)
+}
+
+// WithCredentials returns a copy of client that adds the matching
+// credentials to each request it makes. The credentials are looked up for
+// every request, redirects included, so they only go to the sites they're
+// for.
+func WithCredentials(client *http.Client, creds *Credentials) *http.Client {
+	wrapped := *client
+	wrapped.Transport = &credentials.Transport{Credentials: creds, Base: client.Transport}
+	return &wrapped
+}
+
+// RedactURL takes any username and password out of a feed URL.
+func RedactURL(rawURL string) string {
+	return credentials.Redact(rawURL)
+}
@@ -0,0 +1,486 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package feeder_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikerowehl/feeder/pkg/feeder"
+	"github.com/mikerowehl/feeder/test/mock"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const techFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+  <channel>
+    <title>Tech</title>
+    <item>
+      <title>Go 1.30 released with many new features</title>
+      <link>https://example.com/go</link>
+      <guid>tech-go</guid>
+      <description>&lt;p&gt;Lots of &lt;b&gt;news&lt;/b&gt;&lt;/p&gt;</description>
+    </item>
+    <item>
+      <title>Sponsored: buy things</title>
+      <link>https://example.com/ad</link>
+      <guid>tech-ad</guid>
+      <description>Ad</description>
+    </item>
+  </channel>
+</rss>`
+
+const newsFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+  <channel>
+    <title>News</title>
+    <item>
+      <title>Go 1.30 released with many new features</title>
+      <link>https://news.example.com/go?utm_source=rss</link>
+      <guid>news-go</guid>
+      <description>Same story</description>
+    </item>
+  </channel>
+</rss>`
+
+// Carried by more than one site, with no guid so the link stands in for it
+const syndicatedFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+  <channel>
+    <title>Syndicated</title>
+    <item>
+      <title>Go 1.30 released with many new features</title>
+      <link>https://example.com/go</link>
+      <description>Word for word</description>
+    </item>
+  </channel>
+</rss>`
+
+// A client that serves the test feeds by URL, and fails for anything else.
+func feedClient() *http.Client {
+	feeds := map[string]string{
+		"https://example.com/tech.rss":             techFeed,
+		"https://news.example.com/news.rss":        newsFeed,
+		"https://one.example.com/syndicated.rss":   syndicatedFeed,
+		"https://other.example.com/syndicated.rss": syndicatedFeed,
+	}
+	return &http.Client{Transport: mock.MockRoundTripper(func(req *http.Request) (*http.Response, error) {
+		body, ok := feeds[req.URL.String()]
+		if !ok {
+			return nil, errors.New("connection refused")
+		}
+		header := make(http.Header)
+		header.Set("Content-Type", "application/rss+xml")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Header:     header,
+			Request:    req,
+		}, nil
+	})}
+}
+
+func openStore(t *testing.T) feeder.Store {
+	t.Helper()
+	store, err := feeder.OpenStore(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	return store
+}
+
+func addFeeds(t *testing.T, store feeder.Store, fetcher *feeder.Fetcher, urls ...string) {
+	t.Helper()
+	for _, url := range urls {
+		feed, err := fetcher.FeedFromURL(context.Background(), url)
+		require.NoError(t, err)
+		require.NoError(t, store.Save(t.Context(), &feed))
+	}
+}
+
+func TestFetcher_Refresh(t *testing.T) {
+	store := openStore(t)
+	fetcher := feeder.NewFetcher(feedClient())
+	addFeeds(t, store, fetcher, "https://example.com/tech.rss", "https://news.example.com/news.rss")
+	require.NoError(t, store.Save(t.Context(), &feeder.Feed{Title: "Broken", URL: "https://broken.example.com/feed"}))
+	require.NoError(t, store.AddRule(t.Context(), &feeder.Rule{Field: feeder.FieldTitle, Pattern: "sponsored", Action: feeder.ActionSkip}))
+
+	result, err := fetcher.Refresh(context.Background(), store)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com/tech.rss", "https://news.example.com/news.rss"}, result.Fetched)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, "https://broken.example.com/feed", result.Errors[0].URL)
+	assert.ErrorContains(t, result.Errors[0], "connection refused")
+	assert.Len(t, result.New, 2, "the sponsored item is skipped")
+	assert.Equal(t, 2, result.Duplicates, "both copies of the story are grouped")
+	assert.NoError(t, result.DedupErr)
+
+	counts, err := store.UnreadCounts(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []feeder.FeedCount{
+		{ID: 3, Title: "Broken", URL: "https://broken.example.com/feed", Unread: 0},
+		{ID: 2, Title: "News", URL: "https://news.example.com/news.rss", Unread: 1},
+		{ID: 1, Title: "Tech", URL: "https://example.com/tech.rss", Unread: 1},
+	}, counts)
+
+	result, err = fetcher.Refresh(context.Background(), store)
+	require.NoError(t, err)
+	assert.Empty(t, result.New, "nothing new the second time")
+}
+
+// Two feeds can have items with the same GUID, each feed keeps its own
+func TestFetcher_RefreshSharedGUID(t *testing.T) {
+	store := openStore(t)
+	fetcher := feeder.NewFetcher(feedClient())
+	addFeeds(t, store, fetcher, "https://one.example.com/syndicated.rss", "https://other.example.com/syndicated.rss")
+
+	result, err := fetcher.Refresh(t.Context(), store)
+	require.NoError(t, err)
+	assert.Empty(t, result.Errors)
+	assert.Len(t, result.Fetched, 2)
+	assert.Len(t, result.New, 2)
+
+	counts, err := store.UnreadCounts(t.Context())
+	require.NoError(t, err)
+	require.Len(t, counts, 2)
+	for _, count := range counts {
+		assert.Equal(t, 1, count.Unread, count.URL)
+	}
+
+	result, err = fetcher.Refresh(t.Context(), store)
+	require.NoError(t, err)
+	assert.Empty(t, result.Errors)
+	assert.Empty(t, result.New, "nothing new the second time")
+}
+
+// Word for word copies of a story in two feeds are saved in both and
+// grouped, and reading one reads the other
+func TestFetcher_RefreshSyndicated(t *testing.T) {
+	store := openStore(t)
+	fetcher := feeder.NewFetcher(feedClient())
+	addFeeds(t, store, fetcher, "https://one.example.com/syndicated.rss", "https://other.example.com/syndicated.rss")
+
+	result, err := fetcher.Refresh(t.Context(), store)
+	require.NoError(t, err)
+	assert.Empty(t, result.Errors)
+	assert.Equal(t, 2, result.Duplicates)
+	assert.NoError(t, result.DedupErr)
+
+	items, err := store.AllItems(t.Context())
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.NotEqual(t, items[0].FeedID, items[1].FeedID)
+	assert.NotZero(t, items[0].ClusterID)
+	assert.Equal(t, items[0].ClusterID, items[1].ClusterID)
+
+	require.NoError(t, store.MarkRead(t.Context(), items[1].ID))
+	unread, err := store.Unread(t.Context())
+	require.NoError(t, err)
+	for _, feed := range unread {
+		assert.Empty(t, feed.Items, feed.URL)
+	}
+}
+
+func TestFetcher_MaxFeedSize(t *testing.T) {
+	store := openStore(t)
+	fetcher := feeder.NewFetcher(feedClient())
+	addFeeds(t, store, fetcher, "https://example.com/tech.rss")
+
+	fetcher.MaxFeedSize = 100
+	_, err := fetcher.FeedFromURL(t.Context(), "https://news.example.com/news.rss")
+	require.ErrorIs(t, err, feeder.ErrFeedTooLarge)
+	result, err := fetcher.Refresh(t.Context(), store)
+	require.NoError(t, err)
+	require.Len(t, result.Errors, 1)
+	assert.ErrorIs(t, result.Errors[0], feeder.ErrFeedTooLarge)
+}
+
+// The host rate spaces out feed fetches, but not other requests like
+// articles
+func TestFetcher_HostRate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/feed.xml" {
+			w.Header().Set("Content-Type", "application/rss+xml")
+			fmt.Fprint(w, `<rss version="2.0"><channel><title>Feed</title><link>https://example.com/</link></channel></rss>`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><article><p>An article long enough to count as the content of the page.</p></article></body></html>`)
+	}))
+	defer server.Close()
+
+	cfg := feeder.DefaultHTTPConfig()
+	cfg.HostRate = 10
+	cfg.HostBurst = 1
+	client, err := feeder.NewHTTPClient(cfg)
+	require.NoError(t, err)
+	fetcher := feeder.NewFetcher(client)
+
+	start := time.Now()
+	for range 10 {
+		_, err = fetcher.Article(t.Context(), server.URL+"/article.html")
+		require.NoError(t, err)
+	}
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "articles aren't limited")
+
+	start = time.Now()
+	for range 3 {
+		_, err = fetcher.FeedFromURL(t.Context(), server.URL+"/feed.xml")
+		require.NoError(t, err)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond, "feeds are")
+}
+
+func TestFetcher_RefreshRevised(t *testing.T) {
+	store := openStore(t)
+	body := techFeed
+	client := &http.Client{Transport: mock.MockRoundTripper(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Header:     http.Header{"Content-Type": {"application/rss+xml"}},
+			Request:    req,
+		}, nil
+	})}
+	fetcher := feeder.NewFetcher(client)
+	addFeeds(t, store, fetcher, "https://example.com/tech.rss")
+	require.NoError(t, store.UpdateFeed(t.Context(), 1, map[string]any{"mark_updated_unread": true}))
+	_, err := fetcher.Refresh(t.Context(), store)
+	require.NoError(t, err)
+	require.NoError(t, store.MarkAll(t.Context()))
+
+	body = strings.Replace(techFeed, "Lots of", "Even more", 1)
+	result, err := fetcher.Refresh(t.Context(), store)
+	require.NoError(t, err)
+	assert.Empty(t, result.New, "a changed item isn't a new one")
+
+	unread, err := store.Unread(t.Context())
+	require.NoError(t, err)
+	require.Len(t, unread, 1)
+	require.Len(t, unread[0].Items, 1)
+	assert.Contains(t, unread[0].Items[0].Content, "Even more")
+	assert.True(t, unread[0].Items[0].Revised)
+	all, err := store.AllItems(t.Context())
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+}
+
+func TestFetcher_RefreshCancelled(t *testing.T) {
+	store := openStore(t)
+	fetcher := feeder.NewFetcher(feedClient())
+	addFeeds(t, store, fetcher, "https://example.com/tech.rss")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := fetcher.Refresh(ctx, store)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, result.Fetched)
+}
+
+func TestFetcher_RefreshInterrupted(t *testing.T) {
+	store := openStore(t)
+	addFeeds(t, store, feeder.NewFetcher(feedClient()), "https://example.com/tech.rss", "https://news.example.com/news.rss")
+
+	// Cancel while the second feed is being fetched, like a Ctrl-C
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	requests := 0
+	client := &http.Client{Transport: mock.MockRoundTripper(func(req *http.Request) (*http.Response, error) {
+		requests++
+		if requests == 2 {
+			cancel()
+			return nil, req.Context().Err()
+		}
+		return feedClient().Transport.RoundTrip(req)
+	})}
+	result, err := feeder.NewFetcher(client).Refresh(ctx, store)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, result.Fetched, 1)
+	assert.Empty(t, result.Errors, "the interrupted feed isn't reported as broken")
+	require.NotEmpty(t, result.New)
+
+	unread, err := store.Unread(t.Context())
+	require.NoError(t, err)
+	var saved []string
+	for _, feed := range unread {
+		for _, item := range feed.Items {
+			saved = append(saved, item.GUID)
+		}
+	}
+	var fetched []string
+	for _, item := range result.New {
+		fetched = append(fetched, item.GUID)
+	}
+	assert.ElementsMatch(t, fetched, saved, "what was fetched before the interruption is kept")
+}
+
+func TestFetcher_RetryAfter(t *testing.T) {
+	store := openStore(t)
+	addFeeds(t, store, feeder.NewFetcher(feedClient()), "https://example.com/tech.rss", "https://news.example.com/news.rss")
+	require.NoError(t, store.Save(t.Context(), &feeder.Feed{Title: "Tech Again", URL: "https://example.com/more.rss"}))
+
+	// example.com is busy, news.example.com isn't
+	busy := 0
+	client := &http.Client{Transport: mock.MockRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "example.com" {
+			busy++
+			return &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Status:     "429 Too Many Requests",
+				Body:       io.NopCloser(strings.NewReader("")),
+				Header:     http.Header{"Retry-After": {"3600"}},
+				Request:    req,
+			}, nil
+		}
+		return feedClient().Transport.RoundTrip(req)
+	})}
+	fetcher := feeder.NewFetcher(client)
+
+	result, err := fetcher.Refresh(t.Context(), store)
+	require.NoError(t, err)
+	assert.Equal(t, 1, busy, "the second feed on the site isn't asked for")
+	assert.Equal(t, []string{"https://news.example.com/news.rss"}, result.Fetched)
+	require.Len(t, result.Errors, 1)
+	var status *feeder.StatusError
+	require.ErrorAs(t, result.Errors[0], &status)
+	assert.Equal(t, http.StatusTooManyRequests, status.StatusCode)
+	require.Len(t, result.Deferred, 1)
+	assert.Equal(t, "https://example.com/more.rss", result.Deferred[0].URL)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), result.Deferred[0].Until, time.Minute)
+
+	feeds, err := store.AllFeeds(t.Context())
+	require.NoError(t, err)
+	for _, feed := range feeds {
+		if feed.URL == "https://news.example.com/news.rss" {
+			assert.True(t, feed.FetchAfter.IsZero())
+		} else {
+			assert.WithinDuration(t, time.Now().Add(time.Hour), feed.FetchAfter, time.Minute, feed.URL)
+		}
+	}
+
+	// Later runs leave the site alone too, until the time is up
+	result, err = fetcher.Refresh(t.Context(), store)
+	require.NoError(t, err)
+	assert.Equal(t, 1, busy)
+	assert.Empty(t, result.Errors)
+	assert.Len(t, result.Deferred, 2)
+	assert.Equal(t, []string{"https://news.example.com/news.rss"}, result.Fetched)
+
+	require.NoError(t, store.UpdateFeed(t.Context(), 1, map[string]any{"fetch_after": time.Now().Add(-time.Minute)}))
+	_, err = fetcher.Refresh(t.Context(), store)
+	require.NoError(t, err)
+	assert.Equal(t, 2, busy)
+}
+
+// Items pushed by a hub are saved like fetched ones, rules and all
+func TestFetcher_Push(t *testing.T) {
+	store := openStore(t)
+	fetcher := feeder.NewFetcher(feedClient())
+	addFeeds(t, store, fetcher, "https://example.com/tech.rss")
+	require.NoError(t, store.AddRule(t.Context(), &feeder.Rule{Field: feeder.FieldTitle, Pattern: "sponsored", Action: feeder.ActionSkip}))
+	_, err := fetcher.DiscoverHub(t.Context(), "https://example.com/tech.rss")
+	require.ErrorIs(t, err, feeder.ErrNoHub)
+
+	hub := mock.NewHub(t)
+	sub := fetcher.NewPushSubscriber(store, "")
+	sub.Client = http.DefaultClient
+	server := httptest.NewServer(sub)
+	t.Cleanup(server.Close)
+	sub.Callback = server.URL
+	feeds, err := store.AllFeeds(t.Context())
+	require.NoError(t, err)
+	topic := feeds[0].URL
+	require.NoError(t, sub.Subscribe(t.Context(), feeds[0], feeder.Hub{URL: hub.URL, Topic: topic}))
+	hub.Verified(t)
+
+	status, err := hub.Publish(topic, techFeed)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, status)
+	status, err = hub.Publish(topic, techFeed)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, status)
+
+	unread, err := store.Unread(t.Context())
+	require.NoError(t, err)
+	require.Len(t, unread, 1)
+	require.Len(t, unread[0].Items, 1, "the sponsored item is skipped and the repeat push adds nothing")
+	assert.Equal(t, "tech-go", unread[0].Items[0].GUID)
+
+	status, err = hub.Publish(topic, "not a feed")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, status, "the hub should try again")
+}
+
+func TestRenderHTML(t *testing.T) {
+	store := openStore(t)
+	fetcher := feeder.NewFetcher(feedClient())
+	addFeeds(t, store, fetcher, "https://example.com/tech.rss", "https://news.example.com/news.rss")
+	_, err := fetcher.Refresh(context.Background(), store)
+	require.NoError(t, err)
+
+	unread, err := store.Unread(t.Context())
+	require.NoError(t, err)
+	var page bytes.Buffer
+	require.NoError(t, feeder.RenderHTML(t.Context(), &page, unread, feeder.HTMLOptions{}))
+	assert.Contains(t, page.String(), "Lots of <b>news</b>")
+	assert.Equal(t, 1, strings.Count(page.String(), "Go 1.30 released"), "duplicates are collapsed")
+
+	var book bytes.Buffer
+	require.NoError(t, feeder.RenderEpub(t.Context(), &book, unread, feeder.EpubOptions{Title: "Test"}))
+	assert.True(t, bytes.HasPrefix(book.Bytes(), []byte("PK")))
+}
+
+func ExampleRenderText() {
+	text := feeder.RenderText(`<p>Read <a href="https://example.com/">the post</a></p><ul><li>One</li><li>Two</li></ul>`, 40)
+	fmt.Println(text)
+	// Output:
+	// Read the post [1]
+	//
+	// * One
+	// * Two
+	//
+	// [1] https://example.com/
+}
+
+func ExampleFetcher_Refresh() {
+	ctx := context.Background()
+	store, err := feeder.OpenStore(":memory:")
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+
+	fetcher := feeder.NewFetcher(feedClient())
+	feed, err := fetcher.FeedFromURL(ctx, "https://example.com/tech.rss")
+	if err != nil {
+		panic(err)
+	}
+	if err := store.Save(ctx, &feed); err != nil {
+		panic(err)
+	}
+
+	result, err := fetcher.Refresh(ctx, store)
+	if err != nil {
+		panic(err)
+	}
+	for _, item := range result.New {
+		fmt.Println(item.Title)
+	}
+	// Output:
+	// Go 1.30 released with many new features
+	// Sponsored: buy things
+}
@@ -0,0 +1,368 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package feeder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/dedup"
+	"github.com/mikerowehl/feeder/internal/extract"
+	"github.com/mikerowehl/feeder/internal/httpclient"
+	"github.com/mikerowehl/feeder/internal/rss"
+	"github.com/mikerowehl/feeder/internal/rules"
+)
+
+// Defaults for a Fetcher
+const (
+	DefaultMaxItems    = 100
+	DefaultDedupWindow = 72 * time.Hour
+	DefaultMaxFeedSize = rss.DefaultMaxBodySize
+)
+
+var (
+	// ErrFeedTooLarge is returned when a feed is bigger than
+	// Fetcher.MaxFeedSize.
+	ErrFeedTooLarge = rss.ErrBodyTooLarge
+	// ErrNoScrapedItems is returned when a scraper doesn't find any items.
+	ErrNoScrapedItems = rss.ErrNoScrapedItems
+)
+
+// Fetcher retrieves feeds over HTTP. All the requests go through Client, so
+// timeouts, proxies, and the like are set up there, and each call stops
+// early if its context is cancelled.
+type Fetcher struct {
+	Client *http.Client
+	// The most items taken from one fetch of a feed
+	MaxItems int
+	// How far back to look for other coverage of the same story
+	DedupWindow time.Duration
+	// The biggest feed or page read, in bytes once decompressed
+	MaxFeedSize int64
+}
+
+// NewFetcher creates a Fetcher with the default settings. A nil client
+// means http.DefaultClient.
+func NewFetcher(client *http.Client) *Fetcher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Fetcher{
+		Client:      client,
+		MaxItems:    DefaultMaxItems,
+		DedupWindow: DefaultDedupWindow,
+		MaxFeedSize: DefaultMaxFeedSize,
+	}
+}
+
+// Fetches through the returned context stop at MaxFeedSize, and are spaced
+// out per host when the client has a host rate set.
+func (f *Fetcher) limit(ctx context.Context) context.Context {
+	return httpclient.WithHostLimit(rss.WithMaxBodySize(ctx, f.MaxFeedSize))
+}
+
+// Candidates works out which feeds a URL refers to. A feed URL is its own
+// only candidate, a web page gives the feeds it links to, or if it doesn't
+// link any the feeds found at common paths on the site.
+func (f *Fetcher) Candidates(ctx context.Context, url string) ([]FeedLink, error) {
+	return rss.FeedCandidates(f.limit(ctx), url, f.Client)
+}
+
+// NewFeed fetches a feed for the first time and fills in its details, ready
+// to be saved. No items are added until the feed is updated.
+func (f *Fetcher) NewFeed(ctx context.Context, link FeedLink) (Feed, error) {
+	return rss.FeedFromLink(f.limit(ctx), link, f.Client)
+}
+
+// FeedFromURL is NewFeed for a URL that might be a page instead of a feed,
+// taking the first feed the page links to.
+func (f *Fetcher) FeedFromURL(ctx context.Context, url string) (Feed, error) {
+	return rss.FeedFromURL(f.limit(ctx), url, f.Client)
+}
+
+// NewScrapedFeed is NewFeed for a web page that isn't a feed, with the
+// items picked out of it by the scraper's selectors. It fails with
+// ErrNoScrapedItems if the selectors don't find anything.
+func (f *Fetcher) NewScrapedFeed(ctx context.Context, url string, scraper Scraper) (Feed, error) {
+	return rss.FeedFromScrape(f.limit(ctx), url, scraper, f.Client)
+}
+
+// Scrape fetches a page and returns the items the scraper finds on it,
+// without saving anything, for trying out selectors.
+func (f *Fetcher) Scrape(ctx context.Context, url string, scraper Scraper) ([]Item, error) {
+	return rss.FetchScraped(f.limit(ctx), url, scraper, f.Client)
+}
+
+// Update fetches the current content of a feed and merges it into the
+// feed's items. New items have a zero ID until the feed is saved. If the
+// feed wants full content, the articles for new items are fetched too, and
+// any that fail are returned as FetchErrors without failing the update.
+func (f *Fetcher) Update(ctx context.Context, feed *Feed) ([]FetchError, error) {
+	if err := feed.Fetch(f.limit(ctx), f.Client, f.MaxItems); err != nil {
+		return nil, err
+	}
+	if !feed.FetchFullContent {
+		return nil, nil
+	}
+	return f.articles(ctx, feed.Items), nil
+}
+
+// Fill in the full content of the new items that link to an article.
+func (f *Fetcher) articles(ctx context.Context, items []Item) []FetchError {
+	var problems []FetchError
+	for i := range items {
+		item := &items[i]
+		if item.ID != 0 || item.Link == "" || item.FullContent != "" {
+			continue
+		}
+		article, err := f.Article(ctx, item.Link)
+		if err != nil {
+			problems = append(problems, FetchError{URL: item.Link, Err: err})
+			continue
+		}
+		item.FullContent = article
+	}
+	return problems
+}
+
+// Article fetches a web page and extracts the main article from it as HTML.
+// Pages bigger than MaxFeedSize fail with ErrFeedTooLarge.
+func (f *Fetcher) Article(ctx context.Context, link string) (string, error) {
+	return extract.FetchArticle(rss.WithMaxBodySize(ctx, f.MaxFeedSize), link, f.Client)
+}
+
+// FetchError is a problem with one URL that didn't stop the rest of the
+// work.
+type FetchError struct {
+	URL string
+	Err error
+}
+
+func (e FetchError) Error() string {
+	return fmt.Sprintf("%s: %v", e.URL, e.Err)
+}
+
+func (e FetchError) Unwrap() error {
+	return e.Err
+}
+
+// RefreshResult describes what happened during Refresh.
+type RefreshResult struct {
+	// URLs of the feeds that were fetched and saved
+	Fetched []string
+	// Items that were new in this refresh, after the rules were applied
+	New []Item
+	// Number of new items found to be duplicates of other stories
+	Duplicates int
+	// Feeds that couldn't be fetched or saved
+	Errors []FetchError
+	// Articles that couldn't be fetched for feeds that want full content
+	ArticleErrors []FetchError
+	// Set if finding duplicate stories failed, the items are still saved
+	DedupErr error
+	// Feeds left alone because their server asked us to back off
+	Deferred []DeferredFeed
+}
+
+// DeferredFeed is a feed Refresh skipped, and when it will be fetched again.
+type DeferredFeed struct {
+	URL   string
+	Until time.Time
+}
+
+// Refresh updates every feed in the store, applies the store's rules to the
+// new items, saves the results, and groups new items with other coverage of
+// the same story. A feed that fails doesn't stop the others. If the context
+// is cancelled part way through, the feeds that were already fetched are
+// still saved and grouped, the rest are skipped, and the context's error is
+// returned along with the partial result.
+//
+// A feed whose server answers 429 or 503 with a Retry-After is left alone
+// until then, along with the feeds after it on the same site, in this
+// refresh and later ones. They show up in Deferred.
+//
+// Only the GUIDs and content hashes of the stored items are loaded to check
+// the fetched ones against, plus the full items that have changed, so a
+// refresh doesn't need to hold the whole store in memory.
+func (f *Fetcher) Refresh(ctx context.Context, store Store) (RefreshResult, error) {
+	var result RefreshResult
+	feeds, err := store.AllFeeds(ctx)
+	if err != nil {
+		return result, fmt.Errorf("Error fetching feeds: %w", err)
+	}
+	ruleset, err := store.Rules(ctx)
+	if err != nil {
+		return result, fmt.Errorf("Error loading rules: %w", err)
+	}
+	// Whatever has been fetched gets saved, even once we've been told to stop
+	saveCtx := context.WithoutCancel(ctx)
+	// Sites that asked us to back off during this refresh
+	backoff := make(map[string]time.Time)
+	for i := range feeds {
+		if ctx.Err() != nil {
+			break
+		}
+		feed := &feeds[i]
+		now := time.Now()
+		until := feed.FetchAfter
+		if hostUntil := backoff[feedHost(feed.URL)]; hostUntil.After(until) {
+			until = hostUntil
+		}
+		if until.After(now) {
+			if until.After(feed.FetchAfter) {
+				if err := f.deferFeed(saveCtx, store, feed, until); err != nil {
+					result.Errors = append(result.Errors, FetchError{URL: feed.URL, Err: err})
+				}
+			}
+			result.Deferred = append(result.Deferred, DeferredFeed{URL: feed.URL, Until: until})
+			continue
+		}
+		fetched, err := rss.FetchFeedItems(f.limit(ctx), feed, f.Client, f.MaxItems)
+		if err != nil {
+			if ctx.Err() == nil {
+				result.Errors = append(result.Errors, FetchError{URL: feed.URL, Err: err})
+			}
+			var status *rss.StatusError
+			if errors.As(err, &status) && status.RetryAfter.After(now) {
+				backoff[feedHost(feed.URL)] = status.RetryAfter
+				if err := f.deferFeed(saveCtx, store, feed, status.RetryAfter); err != nil {
+					result.Errors = append(result.Errors, FetchError{URL: feed.URL, Err: err})
+				}
+			}
+			continue
+		}
+		fresh, problems, err := f.saveItems(ctx, saveCtx, store, ruleset, feed, fetched)
+		if ctx.Err() == nil {
+			result.ArticleErrors = append(result.ArticleErrors, problems...)
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, FetchError{URL: feed.URL, Err: err})
+			continue
+		}
+		result.New = append(result.New, fresh...)
+		result.Fetched = append(result.Fetched, feed.URL)
+	}
+	result.Duplicates, result.DedupErr = f.cluster(saveCtx, store, result.New)
+	return result, ctx.Err()
+}
+
+// Record that a feed isn't to be fetched again until a time, so later runs
+// skip it too.
+func (f *Fetcher) deferFeed(ctx context.Context, store Store, feed *Feed, until time.Time) error {
+	if err := store.UpdateFeed(ctx, feed.ID, map[string]any{"fetch_after": until}); err != nil {
+		return fmt.Errorf("error saving when to fetch again: %w", err)
+	}
+	feed.FetchAfter = until
+	return nil
+}
+
+// The site a feed is on, for backing off all the feeds on a site together.
+// Empty for feeds that aren't on the web.
+func feedHost(feedURL string) string {
+	if rss.IsLocalSource(feedURL) {
+		return ""
+	}
+	u, err := url.Parse(feedURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
+
+// Check the items just fetched for a feed against the ones already stored.
+// New items get their articles fetched and the rules applied, changed ones
+// are revised, and both are saved together. Returns the new items that were
+// kept, with their IDs filled in.
+func (f *Fetcher) saveItems(ctx context.Context, saveCtx context.Context, store Store, ruleset []Rule,
+	feed *Feed, fetched []Item) ([]Item, []FetchError, error) {
+	known, err := store.KnownItems(saveCtx, feed.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var fresh []Item
+	changed := make(map[uint]Item)
+	for _, item := range fetched {
+		stored, ok := known[item.GUID]
+		if !ok {
+			// Mark it known so a feed listing an entry twice only adds it once
+			known[item.GUID] = KnownItem{GUID: item.GUID, ContentHash: item.ContentHash}
+			item.FeedID = feed.ID
+			fresh = append(fresh, item)
+			continue
+		}
+		if stored.ID != 0 && stored.ContentHash != item.ContentHash {
+			changed[stored.ID] = item
+		}
+	}
+
+	var problems []FetchError
+	if feed.FetchFullContent {
+		problems = f.articles(ctx, fresh)
+	}
+	if len(ruleset) > 0 {
+		kept := fresh[:0]
+		for _, item := range fresh {
+			if rules.Apply(ruleset, feed, &item) {
+				kept = append(kept, item)
+			}
+		}
+		fresh = kept
+	}
+
+	var items []Item
+	if len(changed) > 0 {
+		items, err = store.Items(saveCtx, slices.Collect(maps.Keys(changed)))
+		if err != nil {
+			return nil, problems, err
+		}
+		for i := range items {
+			items[i].Revise(changed[items[i].ID], feed.MarkUpdatedUnread)
+		}
+	}
+	revised := len(items)
+	items = append(items, fresh...)
+	if len(items) == 0 {
+		return nil, problems, nil
+	}
+	if err := store.SaveItems(saveCtx, items); err != nil {
+		return nil, problems, err
+	}
+	return items[revised:], problems, nil
+}
+
+// Group the newly fetched items with any recent items from other feeds that
+// cover the same story.
+func (f *Fetcher) cluster(ctx context.Context, store Store, fresh []Item) (int, error) {
+	if len(fresh) == 0 {
+		return 0, nil
+	}
+	recent, err := store.RecentItems(ctx, time.Now().Add(-f.DedupWindow))
+	if err != nil {
+		return 0, err
+	}
+	freshIDs := make(map[uint]bool)
+	for _, item := range fresh {
+		freshIDs[item.ID] = true
+	}
+	existing := recent[:0]
+	for _, item := range recent {
+		if !freshIDs[item.ID] {
+			existing = append(existing, item)
+		}
+	}
+	clusters := dedup.Assign(existing, fresh)
+	if len(clusters) == 0 {
+		return 0, nil
+	}
+	return len(clusters), store.SetClusters(ctx, clusters)
+}
@@ -0,0 +1,32 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package feeder
+
+import (
+	"net/http"
+
+	"github.com/mikerowehl/feeder/internal/httpclient"
+)
+
+// DefaultUserAgent is the User-Agent sent when the client doesn't set one.
+const DefaultUserAgent = httpclient.DefaultUserAgent
+
+// HTTPNoProxy as a proxy setting connects directly, ignoring the proxy
+// environment variables.
+const HTTPNoProxy = httpclient.NoProxy
+
+// DefaultHTTPConfig is the client config the feeder command uses when
+// nothing is configured.
+func DefaultHTTPConfig() HTTPConfig {
+	return httpclient.DefaultConfig()
+}
+
+// NewHTTPClient builds a client for a Fetcher with proxies, extra
+// certificate authorities, a client certificate, and so on. Proxy URLs and
+// certificate files are checked straight away.
+func NewHTTPClient(cfg HTTPConfig) (*http.Client, error) {
+	return httpclient.New(cfg)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package feeder
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/output"
+)
+
+// ImageOptions controls how images are pulled into offline pages and EPUB
+// books.
+type ImageOptions struct {
+	// Used to download the images, http.DefaultClient if nil
+	Client *http.Client
+	// Images bigger than this after resizing are left out. Zero for no
+	// limit.
+	MaxBytes int64
+	// Images wider than this are scaled down. Zero to leave them alone.
+	MaxWidth int
+}
+
+// HTMLOptions controls RenderHTML.
+type HTMLOptions struct {
+	// Pull remote images into the page and strip tracking pixels, so the
+	// page works without a network connection.
+	Offline bool
+	// With Offline, write images into this directory instead of inlining
+	// them, referring to them with AssetsRef as the path prefix.
+	AssetsDir string
+	AssetsRef string
+	Images    ImageOptions
+}
+
+// RenderHTML writes the feeds out as a single HTML page. Item content is
+// sanitized and duplicate stories are collapsed, so the feeds can come
+// straight from a Store. The context stops the image downloads for an
+// offline page.
+func RenderHTML(ctx context.Context, w io.Writer, feeds []Feed, opts HTMLOptions) error {
+	if !opts.Offline {
+		return output.WritePage(w, feeds)
+	}
+	var page bytes.Buffer
+	if err := output.WritePage(&page, feeds); err != nil {
+		return err
+	}
+	return output.MakeOffline(ctx, &page, w, output.OfflineOptions{
+		Client:        opts.Images.Client,
+		AssetsDir:     opts.AssetsDir,
+		AssetsRef:     opts.AssetsRef,
+		MaxImageBytes: opts.Images.MaxBytes,
+		MaxImageWidth: opts.Images.MaxWidth,
+	})
+}
+
+// EpubOptions controls RenderEpub.
+type EpubOptions struct {
+	// Defaults to "Feeder" and the date
+	Title string
+	// Defaults to now
+	Date time.Time
+	// One chapter for each item instead of one for each feed
+	PerItem bool
+	Images  ImageOptions
+}
+
+// RenderEpub writes the feeds out as an EPUB 3 book with the images from
+// the items inside it. Like RenderHTML the feeds can come straight from a
+// Store. The context stops the image downloads.
+func RenderEpub(ctx context.Context, w io.Writer, feeds []Feed, opts EpubOptions) error {
+	feeds, alsoIn := output.CollapseClusters(feeds)
+	return output.WriteEpub(ctx, w, output.SanitizeFeeds(feeds), alsoIn, output.EpubOptions{
+		Title:   opts.Title,
+		Date:    opts.Date,
+		PerItem: opts.PerItem,
+		Images: output.OfflineOptions{
+			Client:        opts.Images.Client,
+			MaxImageBytes: opts.Images.MaxBytes,
+			MaxImageWidth: opts.Images.MaxWidth,
+		},
+	})
+}
+
+// RenderText turns the HTML content of an item into plain text wrapped to
+// width columns, with links numbered and listed at the end.
+func RenderText(html string, width int) string {
+	return output.HTMLToText(html, width)
+}
+
+// Duplicates keeps one item from each group of duplicate stories and returns
+// the other feeds that had each one kept, keyed by item ID.
+func Duplicates(feeds []Feed) ([]Feed, map[uint][]AlsoIn) {
+	return output.CollapseClusters(feeds)
+}
+
+// SanitizeHTML cleans up HTML from a feed or web page so it's safe to put in
+// a page, keeping only a known safe set of elements and attributes.
+func SanitizeHTML(html string) string {
+	return output.SanitizeHTML(html)
+}
@@ -0,0 +1,137 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package feeder
+
+import (
+	"context"
+	"time"
+
+	"github.com/mikerowehl/feeder/internal/repository"
+	"gorm.io/gorm"
+)
+
+// ErrNotFound is returned when updating or deleting something by ID that
+// isn't in the store.
+var ErrNotFound = gorm.ErrRecordNotFound
+
+// Store keeps feeds, their items, and the rules applied to new items.
+// Feeds returned with their items only include the items that matched, but
+// every feed is returned, possibly with no items. Each call stops and
+// returns the context's error if the context is cancelled first.
+type Store interface {
+	// Save creates or updates a feed along with all of its items.
+	Save(ctx context.Context, feed *Feed) error
+	// Delete removes a feed and all of its items.
+	Delete(ctx context.Context, id uint) error
+	// All returns every feed with all of its items.
+	All(ctx context.Context) ([]Feed, error)
+	// AllFeeds returns every feed without loading any items.
+	AllFeeds(ctx context.Context) ([]Feed, error)
+	AllItems(ctx context.Context) ([]Item, error)
+	Unread(ctx context.Context) ([]Feed, error)
+	UnreadFiltered(ctx context.Context, filter ItemFilter) ([]Feed, error)
+	// Starred returns starred items whether they've been read or not.
+	Starred(ctx context.Context, filter ItemFilter) ([]Feed, error)
+	Categories(ctx context.Context) ([]CategoryCount, error)
+	UnreadCounts(ctx context.Context) ([]FeedCount, error)
+	// FeedItems returns up to limit of the newest items in one feed.
+	FeedItems(ctx context.Context, feedID uint, limit int) ([]Item, error)
+	// RecentItems returns the items stored since a time, for finding
+	// duplicate stories.
+	RecentItems(ctx context.Context, since time.Time) ([]Item, error)
+	// KnownItems returns the ID and content hash of every item in a feed,
+	// keyed by GUID, to check fetched items against.
+	KnownItems(ctx context.Context, feedID uint) (map[string]KnownItem, error)
+	// Items returns the items with the given IDs, without their enclosures,
+	// categories, or tags.
+	Items(ctx context.Context, ids []uint) ([]Item, error)
+	// SaveItems creates the items that don't have an ID yet, filling in
+	// their IDs, and updates the rest, all in one transaction. Items with
+	// new revisions keep only the newest MaxRevisions of them.
+	SaveItems(ctx context.Context, items []Item) error
+
+	MarkAll(ctx context.Context) error
+	// MarkRead marks an item read, along with any duplicates of it.
+	MarkRead(ctx context.Context, id uint) error
+	// MarkUnread and SetStarred return ErrNotFound for an unknown item.
+	MarkUnread(ctx context.Context, id uint) error
+	SetStarred(ctx context.Context, id uint, starred bool) error
+	// SetClusters groups items as duplicates, keyed by item ID.
+	SetClusters(ctx context.Context, clusters map[uint]uint) error
+	// UpdateFeed changes feed settings, keyed by column name. It returns
+	// ErrNotFound for an unknown feed.
+	UpdateFeed(ctx context.Context, id uint, values map[string]any) error
+	// TrimItems drops all but the newest count items in a feed.
+	TrimItems(ctx context.Context, feedID uint, count int) error
+
+	AddRule(ctx context.Context, rule *Rule) error
+	Rules(ctx context.Context) ([]Rule, error)
+	// DeleteRule returns ErrNotFound if there's no rule with the ID.
+	DeleteRule(ctx context.Context, id uint) error
+
+	// LocalChanges returns the subscription, read, and starred changes made
+	// through this store that haven't been overridden from another device.
+	LocalChanges(ctx context.Context) ([]Change, error)
+	// MergeChanges brings in changes from other devices, keeping whichever
+	// change to each feed or item is newest. device names this one, for
+	// breaking ties.
+	MergeChanges(ctx context.Context, device string, changes []Change) (MergeResult, error)
+
+	// Dump returns everything in the store, for a backup.
+	Dump(ctx context.Context) (Backup, error)
+	// Restore loads a backup, either replacing everything in the store or
+	// merging it in. Merging adds the feeds, items, and rules that are
+	// missing and copies read, starred, and tag state onto items that are
+	// already there. Nothing changes if it fails.
+	Restore(ctx context.Context, backup Backup, replace bool) (RestoreStats, error)
+	// Snapshot copies the store to a new database file at path while other
+	// processes keep using it. Only SQLite stores support it, others return
+	// an error wrapping errors.ErrUnsupported.
+	Snapshot(ctx context.Context, path string) error
+
+	// Vacuum compacts the underlying storage.
+	Vacuum(ctx context.Context) error
+	Close() error
+}
+
+var _ Store = (*repository.FeedRepository)(nil)
+
+// OpenStore opens (creating it if needed) the SQLite database at path. The
+// name ":memory:" gives a private in-memory database.
+func OpenStore(path string) (Store, error) {
+	r, err := repository.NewFeedRepository(path)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ErrStoreLocked is returned by LockStore when another process keeps hold
+// of the lock for longer than the timeout.
+var ErrStoreLocked = repository.ErrLocked
+
+// StoreLock is an advisory lock shared between processes using the same
+// SQLite database file.
+type StoreLock = repository.Lock
+
+// LockStore takes the advisory lock for the SQLite database at path,
+// waiting up to timeout for other processes. Hold it shared for normal use,
+// and exclusive for anything that rewrites the whole file, like Vacuum.
+// Release it with Release once finished with the store.
+func LockStore(ctx context.Context, path string, exclusive bool, timeout time.Duration) (*StoreLock, error) {
+	return repository.AcquireLock(ctx, path, exclusive, timeout)
+}
+
+// OpenPostgresStore connects to a PostgreSQL database using dsn, which can be
+// a postgres:// URL or key=value connection settings. The tables are
+// created if needed, so an empty database is fine.
+func OpenPostgresStore(dsn string) (Store, error) {
+	r, err := repository.NewPostgresRepository(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,835 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+
+// Package storetest is a conformance suite for feeder.Store implementations.
+// Every backend feeder ships is run through it, and it can be used to check
+// a custom Store before handing it to feeder.
+package storetest
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/mikerowehl/feeder/pkg/feeder"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run checks the store returned by open against everything feeder expects of
+// a Store, each check as its own subtest. open is called once per subtest
+// and has to return an empty store, and arrange for it to be closed when the
+// subtest is done.
+func Run(t *testing.T, open func(t *testing.T) feeder.Store) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s feeder.Store)
+	}{
+		{"SaveAndLoad", testSaveAndLoad},
+		{"UniqueURL", testUniqueURL},
+		{"FeedWithItems", testFeedWithItems},
+		{"MultipleFeeds", testMultipleFeeds},
+		{"Delete", testDelete},
+		{"Unread", testUnread},
+		{"MarkAll", testMarkAll},
+		{"TrimItems", testTrimItems},
+		{"Enclosures", testEnclosures},
+		{"UnreadFiltered", testUnreadFiltered},
+		{"SaveRevisedItem", testSaveRevisedItem},
+		{"UpdateFeed", testUpdateFeed},
+		{"MarkReadCluster", testMarkReadCluster},
+		{"Starred", testStarred},
+		{"ItemState", testItemState},
+		{"Rules", testRules},
+		{"KnownItems", testKnownItems},
+		{"SharedGUID", testSharedGUID},
+		{"SaveItems", testSaveItems},
+		{"RevisionLimit", testRevisionLimit},
+		{"LocalChanges", testLocalChanges},
+		{"MergeChanges", testMergeChanges},
+		{"BackupReplace", testBackupReplace},
+		{"BackupMerge", testBackupMerge},
+		{"Snapshot", testSnapshot},
+		{"Vacuum", testVacuum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, open(t))
+		})
+	}
+}
+
+// Databases don't all keep times down to the nanosecond.
+var approxTime = cmpopts.EquateApproxTime(time.Millisecond)
+
+func saveAll(t *testing.T, s feeder.Store, feeds []feeder.Feed) {
+	t.Helper()
+	for i := range feeds {
+		require.NoError(t, s.Save(t.Context(), &feeds[i]))
+	}
+}
+
+func titles(feeds []feeder.Feed) []string {
+	var result []string
+	for _, feed := range feeds {
+		for _, item := range feed.Items {
+			result = append(result, item.Title)
+		}
+	}
+	return result
+}
+
+func twoFeeds() []feeder.Feed {
+	return []feeder.Feed{
+		{Title: "Feed 1", URL: "https://example.com/feed1.rss", Items: []feeder.Item{
+			{Title: "Feed 1 Item 1",
+				Link:      "https://feed1.com/i1",
+				Content:   "content for 1/1",
+				GUID:      "guid1",
+				Published: time.Now().Add(-48 * time.Hour)},
+			{Title: "Feed 1 Item 2",
+				Link:      "https://feed1.com/i2",
+				Content:   "content for 1/2",
+				GUID:      "guid2",
+				Published: time.Now().Add(-24 * time.Hour)},
+		}},
+		{Title: "Feed 2", URL: "https://example.com/feed2.rss", Items: []feeder.Item{
+			{Title: "Feed 2 Item 1",
+				Link:      "https://feed2.com/i1",
+				Content:   "content for 2/1",
+				GUID:      "guid10",
+				Published: time.Now().Add(-2 * time.Hour)},
+			{Title: "Feed 2 Item 2",
+				Link:      "https://feed2.com/i2",
+				Content:   "content for 2/2",
+				GUID:      "guid11",
+				Published: time.Now().Add(-1 * time.Hour)},
+		}},
+	}
+}
+
+func testSaveAndLoad(t *testing.T, s feeder.Store) {
+	feed := feeder.Feed{URL: "https://test.com/sample.rss"}
+	require.NoError(t, s.Save(t.Context(), &feed))
+	assert.NotZero(t, feed.ID, "saving fills in the ID")
+	fetched, err := s.All(t.Context())
+	require.NoError(t, err)
+	require.Len(t, fetched, 1)
+	assert.Equal(t, "https://test.com/sample.rss", fetched[0].URL)
+}
+
+func testUniqueURL(t *testing.T, s feeder.Store) {
+	require.NoError(t, s.Save(t.Context(), &feeder.Feed{URL: "https://test.com/sample.rss"}))
+	assert.Error(t, s.Save(t.Context(), &feeder.Feed{URL: "https://test.com/sample.rss"}))
+}
+
+func testFeedWithItems(t *testing.T, s feeder.Store) {
+	feeds := []feeder.Feed{
+		{Title: "Test Feed 1",
+			URL: "https://test.com/sample.rss",
+			Items: []feeder.Item{
+				{GUID: "1", Content: "test item 1", Published: time.Now()},
+			},
+		}}
+	saveAll(t, s, feeds)
+	fetched, err := s.All(t.Context())
+	require.NoError(t, err)
+	if diff := cmp.Diff(feeds, fetched, approxTime); diff != "" {
+		t.Errorf("Mismatch single feed:\n%s", diff)
+	}
+}
+
+func testMultipleFeeds(t *testing.T, s feeder.Store) {
+	feeds := twoFeeds()
+	saveAll(t, s, feeds)
+	fetched, err := s.All(t.Context())
+	require.NoError(t, err)
+	diff := cmp.Diff(feeds, fetched, approxTime,
+		cmpopts.SortSlices(func(a, b feeder.Feed) bool {
+			return a.Title < b.Title
+		}),
+		cmpopts.SortSlices(func(a, b feeder.Item) bool {
+			return a.Title < b.Title
+		}),
+	)
+	if diff != "" {
+		t.Errorf("Mismatch multiple feeds:\n%s", diff)
+	}
+}
+
+func testDelete(t *testing.T, s feeder.Store) {
+	feeds := twoFeeds()
+	saveAll(t, s, feeds)
+	require.NoError(t, s.Delete(t.Context(), feeds[0].ID))
+	fetched, err := s.All(t.Context())
+	require.NoError(t, err)
+	require.Len(t, fetched, 1)
+	assert.Equal(t, "Feed 2", fetched[0].Title)
+	assert.Len(t, fetched[0].Items, 2)
+	items, err := s.AllItems(t.Context())
+	require.NoError(t, err)
+	assert.Len(t, items, 2)
+}
+
+func testUnread(t *testing.T, s feeder.Store) {
+	feed := feeder.Feed{URL: "https://test.com/sample.rss", Items: []feeder.Item{
+		{GUID: "1", Content: "test item 1", Read: true, Published: time.Now().Add(-3 * time.Hour)},
+		{GUID: "2", Content: "test item 2", Published: time.Now().Add(-2 * time.Hour)},
+		{GUID: "3", Content: "test item 3", Published: time.Now().Add(-1 * time.Hour)},
+	}}
+	require.NoError(t, s.Save(t.Context(), &feed))
+	unread, err := s.Unread(t.Context())
+	require.NoError(t, err)
+	require.Len(t, unread, 1)
+	require.Len(t, unread[0].Items, 2)
+	// Newest first
+	assert.Equal(t, "3", unread[0].Items[0].GUID)
+	assert.Equal(t, "2", unread[0].Items[1].GUID)
+}
+
+func testMarkAll(t *testing.T, s feeder.Store) {
+	feed := feeder.Feed{Title: "Test Feed 1", URL: "https://test.com/sample.rss",
+		Items: []feeder.Item{{GUID: "1", Content: "test item 1"}}}
+	require.NoError(t, s.Save(t.Context(), &feed))
+	require.NoError(t, s.MarkAll(t.Context()))
+	unread, err := s.Unread(t.Context())
+	require.NoError(t, err)
+	require.Len(t, unread, 1, "feeds are still listed without unread items")
+	assert.Empty(t, unread[0].Items)
+}
+
+func testTrimItems(t *testing.T, s feeder.Store) {
+	feeds := twoFeeds()
+	feeds[0].Items = append(feeds[0].Items,
+		feeder.Item{Title: "Feed 1 Item 3", GUID: "guid3", Published: time.Now().Add(-2 * time.Hour)},
+		feeder.Item{Title: "Feed 1 Item 4", GUID: "guid4", Published: time.Now().Add(-1 * time.Hour)},
+	)
+	saveAll(t, s, feeds)
+	require.NoError(t, s.TrimItems(t.Context(), feeds[0].ID, 2))
+	require.NoError(t, s.TrimItems(t.Context(), feeds[1].ID, 2))
+	require.NoError(t, s.TrimItems(t.Context(), feeds[1].ID+1, 2), "trimming an empty feed is fine")
+
+	items, err := s.FeedItems(t.Context(), feeds[0].ID, 10)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.Equal(t, "Feed 1 Item 4", items[0].Title)
+	assert.Equal(t, "Feed 1 Item 3", items[1].Title)
+	items, err = s.FeedItems(t.Context(), feeds[1].ID, 10)
+	require.NoError(t, err)
+	assert.Len(t, items, 2)
+}
+
+func testEnclosures(t *testing.T, s feeder.Store) {
+	feed := feeder.Feed{Title: "Podcast", URL: "https://test.com/podcast.rss", Items: []feeder.Item{
+		{GUID: "ep1", Title: "Episode 1",
+			Enclosures: []feeder.Enclosure{
+				{URL: "https://test.com/ep1.mp3", Type: "audio/mpeg", Length: 1000, Duration: "10:00"},
+			},
+			Categories: []feeder.Category{{Name: "Audio"}},
+			Tags:       []feeder.Tag{{Name: "later"}}},
+	}}
+	require.NoError(t, s.Save(t.Context(), &feed))
+	unread, err := s.Unread(t.Context())
+	require.NoError(t, err)
+	require.Len(t, unread, 1)
+	require.Len(t, unread[0].Items, 1)
+	item := unread[0].Items[0]
+	require.Len(t, item.Enclosures, 1)
+	assert.Equal(t, "https://test.com/ep1.mp3", item.Enclosures[0].URL)
+	assert.Equal(t, int64(1000), item.Enclosures[0].Length)
+	assert.Equal(t, "10:00", item.Enclosures[0].Duration)
+	require.Len(t, item.Categories, 1)
+	assert.Equal(t, "Audio", item.Categories[0].Name)
+	require.Len(t, item.Tags, 1)
+	assert.Equal(t, "later", item.Tags[0].Name)
+
+	require.NoError(t, s.Delete(t.Context(), feed.ID))
+	items, err := s.AllItems(t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, items)
+	counts, err := s.Categories(t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, counts, "deleting a feed takes its items' categories with it")
+}
+
+func testUnreadFiltered(t *testing.T, s feeder.Store) {
+	feeds := []feeder.Feed{
+		{Title: "Feed 1", URL: "https://example.com/feed1.rss", Items: []feeder.Item{
+			{Title: "Go Post", GUID: "guid1", Author: "Jane Writer", Content: "All about generics",
+				Categories: []feeder.Category{{Name: "Go"}, {Name: "Tools"}}},
+			{Title: "Rust Post", GUID: "guid2", Author: "Sam Editor",
+				Categories: []feeder.Category{{Name: "Rust"}}},
+		}},
+		{Title: "Feed 2", URL: "https://example.com/feed2.rss", Items: []feeder.Item{
+			{Title: "Other Go Post", GUID: "guid10", Author: "Sam Editor", FullContent: "More GENERICS",
+				Categories: []feeder.Category{{Name: "go"}}},
+		}},
+	}
+	saveAll(t, s, feeds)
+
+	unread, err := s.UnreadFiltered(t.Context(), feeder.ItemFilter{Category: "GO"})
+	require.NoError(t, err)
+	assert.Len(t, unread, 2)
+	assert.ElementsMatch(t, []string{"Go Post", "Other Go Post"}, titles(unread))
+
+	unread, err = s.UnreadFiltered(t.Context(), feeder.ItemFilter{Author: "sam"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"Rust Post", "Other Go Post"}, titles(unread))
+
+	unread, err = s.UnreadFiltered(t.Context(), feeder.ItemFilter{Author: "sam", Category: "go"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"Other Go Post"}, titles(unread))
+
+	unread, err = s.UnreadFiltered(t.Context(), feeder.ItemFilter{Search: "Generics"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"Go Post", "Other Go Post"}, titles(unread))
+
+	counts, err := s.Categories(t.Context())
+	require.NoError(t, err)
+	assert.Contains(t, counts, feeder.CategoryCount{Name: "Rust", Count: 1})
+	assert.Contains(t, counts, feeder.CategoryCount{Name: "Tools", Count: 1})
+}
+
+func testSaveRevisedItem(t *testing.T, s feeder.Store) {
+	feed := feeder.Feed{Title: "Feed 1", URL: "https://example.com/feed1.rss", Items: []feeder.Item{
+		{Title: "Advisory", GUID: "guid1", Content: "original", Published: time.Now()},
+	}}
+	require.NoError(t, s.Save(t.Context(), &feed))
+	require.NoError(t, s.MarkAll(t.Context()))
+
+	fetched, err := s.All(t.Context())
+	require.NoError(t, err)
+	require.Len(t, fetched, 1)
+	require.Len(t, fetched[0].Items, 1)
+	fetched[0].Items[0].Revise(feeder.Item{Title: "Advisory", Content: "revised"}, true)
+	require.NoError(t, s.Save(t.Context(), &fetched[0]))
+
+	unread, err := s.Unread(t.Context())
+	require.NoError(t, err)
+	require.Len(t, unread[0].Items, 1)
+	assert.Equal(t, "revised", unread[0].Items[0].Content)
+	assert.True(t, unread[0].Items[0].Revised)
+
+	require.NoError(t, s.MarkAll(t.Context()))
+	items, err := s.AllItems(t.Context())
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.True(t, items[0].Read)
+	assert.False(t, items[0].Revised)
+}
+
+func testUpdateFeed(t *testing.T, s feeder.Store) {
+	feed := feeder.Feed{URL: "https://example.com/feed1.rss"}
+	require.NoError(t, s.Save(t.Context(), &feed))
+	require.NoError(t, s.UpdateFeed(t.Context(), feed.ID, map[string]any{"mark_updated_unread": true}))
+	feeds, err := s.AllFeeds(t.Context())
+	require.NoError(t, err)
+	require.Len(t, feeds, 1)
+	assert.True(t, feeds[0].MarkUpdatedUnread)
+	assert.ErrorIs(t, s.UpdateFeed(t.Context(), feed.ID+1, map[string]any{"mark_updated_unread": true}), feeder.ErrNotFound)
+}
+
+func testMarkReadCluster(t *testing.T, s feeder.Store) {
+	feeds := []feeder.Feed{
+		{Title: "Feed 1", URL: "https://example.com/feed1.rss", Items: []feeder.Item{
+			{Title: "Story", GUID: "guid1"},
+			{Title: "Unrelated", GUID: "guid2"},
+		}},
+		{Title: "Feed 2", URL: "https://example.com/feed2.rss", Items: []feeder.Item{
+			{Title: "Same story", GUID: "guid10"},
+		}},
+	}
+	saveAll(t, s, feeds)
+	story := feeds[0].Items[0].ID
+	require.NoError(t, s.SetClusters(t.Context(), map[uint]uint{story: story, feeds[1].Items[0].ID: story}))
+
+	recent, err := s.RecentItems(t.Context(), time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Len(t, recent, 3)
+	for _, item := range recent {
+		assert.Equal(t, item.Title != "Unrelated", item.ClusterID == story, item.Title)
+	}
+	recent, err = s.RecentItems(t.Context(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, recent)
+
+	require.NoError(t, s.MarkRead(t.Context(), feeds[1].Items[0].ID))
+	items, err := s.AllItems(t.Context())
+	require.NoError(t, err)
+	for _, item := range items {
+		assert.Equal(t, item.Title != "Unrelated", item.Read, item.Title)
+	}
+}
+
+func testStarred(t *testing.T, s feeder.Store) {
+	feed := feeder.Feed{Title: "Feed 1", URL: "https://example.com/feed1.rss", Items: []feeder.Item{
+		{Title: "Starred Unread", GUID: "guid1", Starred: true},
+		{Title: "Starred Read", GUID: "guid2", Starred: true, Read: true},
+		{Title: "Plain", GUID: "guid3"},
+	}}
+	require.NoError(t, s.Save(t.Context(), &feed))
+
+	starred, err := s.Starred(t.Context(), feeder.ItemFilter{})
+	require.NoError(t, err)
+	require.Len(t, starred, 1)
+	assert.ElementsMatch(t, []string{"Starred Unread", "Starred Read"}, titles(starred))
+
+	starred, err = s.Starred(t.Context(), feeder.ItemFilter{Search: "unread"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Starred Unread"}, titles(starred))
+}
+
+func testItemState(t *testing.T, s feeder.Store) {
+	feeds := []feeder.Feed{
+		{Title: "b feed", URL: "https://example.com/b.rss", Items: []feeder.Item{
+			{Title: "Old", GUID: "guid1", Published: time.Now().Add(-time.Hour)},
+			{Title: "New", GUID: "guid2", Published: time.Now()},
+			{Title: "Done", GUID: "guid3", Read: true},
+		}},
+		{Title: "A feed", URL: "https://example.com/a.rss"},
+	}
+	saveAll(t, s, feeds)
+
+	counts, err := s.UnreadCounts(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []feeder.FeedCount{
+		{ID: feeds[1].ID, Title: "A feed", URL: "https://example.com/a.rss", Unread: 0},
+		{ID: feeds[0].ID, Title: "b feed", URL: "https://example.com/b.rss", Unread: 2},
+	}, counts, "ordered by title ignoring case")
+
+	items, err := s.FeedItems(t.Context(), feeds[0].ID, 2)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.Equal(t, "New", items[0].Title)
+	assert.Equal(t, "Old", items[1].Title)
+
+	require.NoError(t, s.MarkRead(t.Context(), items[0].ID))
+	require.NoError(t, s.SetStarred(t.Context(), items[0].ID, true))
+	require.NoError(t, s.MarkUnread(t.Context(), feeds[0].Items[2].ID))
+	counts, err = s.UnreadCounts(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, 2, counts[1].Unread)
+
+	starred, err := s.Starred(t.Context(), feeder.ItemFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"New"}, titles(starred))
+
+	require.NoError(t, s.SetStarred(t.Context(), items[0].ID, false))
+	starred, err = s.Starred(t.Context(), feeder.ItemFilter{})
+	require.NoError(t, err)
+	assert.Empty(t, titles(starred))
+
+	missing := feeds[0].Items[2].ID + 1000
+	assert.ErrorIs(t, s.SetStarred(t.Context(), missing, true), feeder.ErrNotFound)
+	assert.ErrorIs(t, s.MarkUnread(t.Context(), missing), feeder.ErrNotFound)
+}
+
+func testRules(t *testing.T, s feeder.Store) {
+	skip := feeder.Rule{Field: feeder.FieldTitle, Pattern: "sponsored", Action: feeder.ActionSkip}
+	star := feeder.Rule{Field: feeder.FieldAuthor, Pattern: "jane", Action: feeder.ActionStar}
+	require.NoError(t, s.AddRule(t.Context(), &skip))
+	require.NoError(t, s.AddRule(t.Context(), &star))
+	assert.NotZero(t, skip.ID)
+
+	all, err := s.Rules(t.Context())
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal(t, skip.ID, all[0].ID, "rules come back in the order they were added")
+	assert.Equal(t, "sponsored", all[0].Pattern)
+	assert.Equal(t, feeder.ActionStar, all[1].Action)
+
+	require.NoError(t, s.DeleteRule(t.Context(), skip.ID))
+	assert.ErrorIs(t, s.DeleteRule(t.Context(), skip.ID), feeder.ErrNotFound)
+	all, err = s.Rules(t.Context())
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	assert.Equal(t, star.ID, all[0].ID)
+}
+
+func changeValues(t *testing.T, s feeder.Store) map[string]bool {
+	t.Helper()
+	changes, err := s.LocalChanges(t.Context())
+	require.NoError(t, err)
+	values := make(map[string]bool)
+	for _, change := range changes {
+		assert.Empty(t, change.Device)
+		assert.WithinDuration(t, time.Now(), change.At, time.Minute)
+		values[change.Kind+" "+change.Target] = change.Value
+	}
+	return values
+}
+
+func testLocalChanges(t *testing.T, s feeder.Store) {
+	feeds := twoFeeds()
+	saveAll(t, s, feeds)
+	require.NoError(t, s.MarkRead(t.Context(), feeds[0].Items[0].ID))
+	require.NoError(t, s.SetStarred(t.Context(), feeds[1].Items[0].ID, true))
+	assert.Equal(t, map[string]bool{
+		"subscribed https://example.com/feed1.rss": true,
+		"subscribed https://example.com/feed2.rss": true,
+		"read guid1":     true,
+		"starred guid10": true,
+	}, changeValues(t, s))
+
+	require.NoError(t, s.MarkUnread(t.Context(), feeds[0].Items[0].ID))
+	require.NoError(t, s.MarkAll(t.Context()))
+	require.NoError(t, s.Delete(t.Context(), feeds[1].ID))
+	assert.Equal(t, map[string]bool{
+		"subscribed https://example.com/feed1.rss": true,
+		"subscribed https://example.com/feed2.rss": false,
+		"read guid1":     true,
+		"read guid2":     true,
+		"read guid10":    true,
+		"read guid11":    true,
+		"starred guid10": true,
+	}, changeValues(t, s), "only the latest change to each is kept")
+
+	require.NoError(t, s.TrimItems(t.Context(), feeds[0].ID, 1))
+	assert.NotContains(t, changeValues(t, s), "read guid1", "trimmed items don't keep their changes")
+}
+
+func testMergeChanges(t *testing.T, s feeder.Store) {
+	feeds := twoFeeds()
+	saveAll(t, s, feeds)
+	require.NoError(t, s.MarkRead(t.Context(), feeds[0].Items[0].ID))
+	later := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	earlier := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+
+	result, err := s.MergeChanges(t.Context(), "here", []feeder.Change{
+		{Kind: feeder.ChangeRead, Target: "guid1", Value: false, At: earlier, Device: "other"},
+		{Kind: feeder.ChangeStarred, Target: "guid2", Value: true, At: earlier, Device: "other"},
+		{Kind: feeder.ChangeRead, Target: "guid10", Value: true, At: later, Device: "other"},
+		{Kind: feeder.ChangeRead, Target: "not-fetched", Value: true, At: later, Device: "other"},
+		{Kind: feeder.ChangeSubscribed, Target: "https://example.com/new.rss", Title: "New", Value: true, At: later,
+			Device: "other"},
+		{Kind: feeder.ChangeRead, Target: "guid11", Value: true, At: later, Device: "here"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, feeder.MergeResult{Merged: 4, Applied: 3, Pending: 1}, result,
+		"older changes and ones claiming to be from this device are ignored")
+
+	items, err := s.AllItems(t.Context())
+	require.NoError(t, err)
+	state := make(map[string][2]bool)
+	for _, item := range items {
+		state[item.GUID] = [2]bool{item.Read, item.Starred}
+	}
+	assert.Equal(t, map[string][2]bool{
+		"guid1":  {true, false},
+		"guid2":  {false, true},
+		"guid10": {true, false},
+		"guid11": {false, false},
+	}, state)
+	feedList, err := s.AllFeeds(t.Context())
+	require.NoError(t, err)
+	require.Len(t, feedList, 3)
+	assert.Equal(t, "New", feedList[2].Title)
+
+	local := changeValues(t, s)
+	assert.Contains(t, local, "read guid1")
+	assert.NotContains(t, local, "read guid10", "overridden by the other device")
+
+	result, err = s.MergeChanges(t.Context(), "here", nil)
+	require.NoError(t, err)
+	assert.Equal(t, feeder.MergeResult{Pending: 1}, result, "still waiting for the item")
+}
+
+// Feeds with everything a backup has to carry: settings, read and starred
+// state, attachments, a cluster, and rules.
+func backupFixture(t *testing.T, s feeder.Store) {
+	t.Helper()
+	feeds := twoFeeds()
+	feeds[0].MarkUpdatedUnread = true
+	feeds[0].Items[0].Read = true
+	feeds[0].Items[1].Starred = true
+	feeds[0].Items[1].Enclosures = []feeder.Enclosure{{URL: "https://feed1.com/i2.mp3", Type: "audio/mpeg", Length: 1234}}
+	feeds[0].Items[1].Categories = []feeder.Category{{Name: "Go"}}
+	feeds[0].Items[1].Tags = []feeder.Tag{{Name: "later"}}
+	feeds[1].FetchFullContent = true
+	saveAll(t, s, feeds)
+	require.NoError(t, s.SetClusters(t.Context(), map[uint]uint{
+		feeds[0].Items[0].ID: feeds[0].Items[0].ID,
+		feeds[1].Items[0].ID: feeds[0].Items[0].ID,
+	}))
+	require.NoError(t, s.AddRule(t.Context(), &feeder.Rule{Field: feeder.FieldTitle, Pattern: "sponsored", Action: feeder.ActionSkip}))
+	require.NoError(t, s.AddRule(t.Context(), &feeder.Rule{FeedID: feeds[1].ID, Field: feeder.FieldAny, Pattern: "go",
+		Action: feeder.ActionTag, Tag: "golang"}))
+}
+
+func dump(t *testing.T, s feeder.Store) feeder.Backup {
+	t.Helper()
+	backup, err := s.Dump(t.Context())
+	require.NoError(t, err)
+	return backup
+}
+
+func testBackupReplace(t *testing.T, s feeder.Store) {
+	backupFixture(t, s)
+	backup := dump(t, s)
+	require.Len(t, backup.Feeds, 2)
+	require.Len(t, backup.Feeds[0].Items, 2)
+	require.Len(t, backup.Rules, 2)
+
+	require.NoError(t, s.Save(t.Context(), &feeder.Feed{URL: "https://example.com/extra.rss"}))
+	require.NoError(t, s.MarkAll(t.Context()))
+	require.NoError(t, s.Delete(t.Context(), backup.Feeds[1].ID))
+
+	stats, err := s.Restore(t.Context(), backup, true)
+	require.NoError(t, err)
+	assert.Equal(t, feeder.RestoreStats{Feeds: 2, Items: 4, Rules: 2}, stats)
+	restored := dump(t, s)
+	if diff := cmp.Diff(backup, restored, approxTime, cmpopts.IgnoreUnexported(feeder.Rule{})); diff != "" {
+		t.Errorf("restore doesn't match the backup (-backup +restored):\n%s", diff)
+	}
+
+	feed := feeder.Feed{URL: "https://example.com/after.rss"}
+	require.NoError(t, s.Save(t.Context(), &feed))
+	assert.Greater(t, feed.ID, backup.Feeds[1].ID, "new IDs carry on after the restored ones")
+}
+
+func testBackupMerge(t *testing.T, s feeder.Store) {
+	backupFixture(t, s)
+	backup := dump(t, s)
+
+	// Rebuilt from scratch: the second feed added first this time, and
+	// everything fetched again as unread
+	for _, feed := range backup.Feeds {
+		require.NoError(t, s.Delete(t.Context(), feed.ID))
+	}
+	rules, err := s.Rules(t.Context())
+	require.NoError(t, err)
+	require.NoError(t, s.DeleteRule(t.Context(), rules[1].ID))
+	rebuilt := twoFeeds()[1:]
+	saveAll(t, s, rebuilt)
+
+	stats, err := s.Restore(t.Context(), backup, false)
+	require.NoError(t, err)
+	assert.Equal(t, feeder.RestoreStats{Feeds: 1, Items: 2, Rules: 1}, stats)
+
+	merged := dump(t, s)
+	require.Len(t, merged.Feeds, 2)
+	assert.Equal(t, rebuilt[0].ID, merged.Feeds[0].ID, "feeds already there are kept")
+	assert.True(t, merged.Feeds[1].MarkUpdatedUnread)
+	require.Len(t, merged.Feeds[1].Items, 2)
+	first, second := merged.Feeds[1].Items[0], merged.Feeds[1].Items[1]
+	assert.True(t, first.Read)
+	assert.True(t, second.Starred)
+	require.Len(t, second.Enclosures, 1)
+	assert.Equal(t, "https://feed1.com/i2.mp3", second.Enclosures[0].URL)
+	require.Len(t, second.Tags, 1)
+	assert.Equal(t, "later", second.Tags[0].Name)
+	assert.Equal(t, first.ID, first.ClusterID)
+	require.Len(t, merged.Rules, 2)
+	assert.Equal(t, merged.Feeds[0].ID, merged.Rules[1].FeedID, "feed rules follow the feed's new ID")
+
+	require.NoError(t, s.MarkAll(t.Context()))
+	stats, err = s.Restore(t.Context(), backup, false)
+	require.NoError(t, err)
+	assert.Equal(t, feeder.RestoreStats{Updated: 3}, stats, "merging again only puts back the read state")
+	unread, err := s.Unread(t.Context())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"Feed 1 Item 2", "Feed 2 Item 1", "Feed 2 Item 2"}, titles(unread))
+}
+
+func testSnapshot(t *testing.T, s feeder.Store) {
+	backupFixture(t, s)
+	path := filepath.Join(t.TempDir(), "snapshot.db")
+	err := s.Snapshot(t.Context(), path)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("store doesn't support snapshots")
+	}
+	require.NoError(t, err)
+
+	copied, err := feeder.OpenStore(path)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, copied.Close())
+	}()
+	if diff := cmp.Diff(dump(t, s), dump(t, copied), approxTime, cmpopts.IgnoreUnexported(feeder.Rule{})); diff != "" {
+		t.Errorf("snapshot doesn't match (-store +snapshot):\n%s", diff)
+	}
+	assert.Error(t, s.Snapshot(t.Context(), path), "an existing file isn't overwritten")
+}
+
+func testVacuum(t *testing.T, s feeder.Store) {
+	feeds := twoFeeds()
+	saveAll(t, s, feeds)
+	require.NoError(t, s.Delete(t.Context(), feeds[0].ID))
+	require.NoError(t, s.Vacuum(t.Context()))
+	items, err := s.AllItems(t.Context())
+	require.NoError(t, err)
+	assert.Len(t, items, 2)
+}
+
+func testKnownItems(t *testing.T, s feeder.Store) {
+	hashed := feeder.Item{Title: "Hashed", GUID: "guid1", Content: "one"}
+	hashed.ContentHash = hashed.Hash()
+	unhashed := feeder.Item{Title: "Unhashed", GUID: "guid2", Content: "two"}
+	feeds := []feeder.Feed{
+		{Title: "Feed 1", URL: "https://example.com/feed1.rss", Items: []feeder.Item{hashed, unhashed}},
+		{Title: "Feed 2", URL: "https://example.com/feed2.rss", Items: []feeder.Item{{Title: "Other", GUID: "guid10"}}},
+	}
+	saveAll(t, s, feeds)
+
+	known, err := s.KnownItems(t.Context(), feeds[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]feeder.KnownItem{
+		"guid1": {ID: feeds[0].Items[0].ID, GUID: "guid1", ContentHash: hashed.ContentHash},
+		"guid2": {ID: feeds[0].Items[1].ID, GUID: "guid2", ContentHash: unhashed.Hash()},
+	}, known, "items stored without a hash get one worked out")
+
+	known, err = s.KnownItems(t.Context(), feeds[1].ID+1)
+	require.NoError(t, err)
+	assert.Empty(t, known)
+}
+
+// GUIDs only have to be unique within a feed, two feeds can carry the same
+// story under the same one
+func testSharedGUID(t *testing.T, s feeder.Store) {
+	feeds := []feeder.Feed{
+		{Title: "Feed 1", URL: "https://example.com/feed1.rss", Items: []feeder.Item{
+			{Title: "Story", GUID: "https://example.com/story"},
+		}},
+		{Title: "Feed 2", URL: "https://example.com/feed2.rss", Items: []feeder.Item{
+			{Title: "Story Again", GUID: "https://example.com/story"},
+		}},
+		{Title: "Feed 3", URL: "https://example.com/feed3.rss"},
+	}
+	saveAll(t, s, feeds)
+	require.NoError(t, s.SaveItems(t.Context(), []feeder.Item{
+		{FeedID: feeds[2].ID, Title: "Story Once More", GUID: "https://example.com/story"},
+	}))
+
+	for i, feed := range feeds {
+		known, err := s.KnownItems(t.Context(), feed.ID)
+		require.NoError(t, err)
+		require.Len(t, known, 1, feed.URL)
+		if i < 2 {
+			assert.Equal(t, feed.Items[0].ID, known["https://example.com/story"].ID, feed.URL)
+		}
+	}
+	unread, err := s.Unread(t.Context())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"Story", "Story Again", "Story Once More"}, titles(unread))
+
+	err = s.SaveItems(t.Context(), []feeder.Item{
+		{FeedID: feeds[0].ID, Title: "Duplicate", GUID: "https://example.com/story"},
+	})
+	assert.Error(t, err, "still unique within a feed")
+
+	// Merging a backup puts the state back on the item in the same feed
+	require.NoError(t, s.MarkRead(t.Context(), feeds[0].Items[0].ID))
+	backup := dump(t, s)
+	require.NoError(t, s.MarkUnread(t.Context(), feeds[0].Items[0].ID))
+	stats, err := s.Restore(t.Context(), backup, false)
+	require.NoError(t, err)
+	assert.Equal(t, feeder.RestoreStats{Updated: 1}, stats)
+	unread, err = s.Unread(t.Context())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"Story Again", "Story Once More"}, titles(unread))
+}
+
+func testSaveItems(t *testing.T, s feeder.Store) {
+	feed := feeder.Feed{Title: "Feed 1", URL: "https://example.com/feed1.rss", Items: []feeder.Item{
+		{Title: "Existing", GUID: "guid1", Content: "original", Read: true},
+	}}
+	require.NoError(t, s.Save(t.Context(), &feed))
+
+	existing, err := s.Items(t.Context(), []uint{feed.Items[0].ID})
+	require.NoError(t, err)
+	require.Len(t, existing, 1)
+	existing[0].Revise(feeder.Item{Title: "Existing", Content: "revised"}, true)
+	items := existing
+	for i := range 250 {
+		items = append(items, feeder.Item{FeedID: feed.ID, Title: "New", GUID: "new-" + strconv.Itoa(i),
+			Categories: []feeder.Category{{Name: "Batch"}}})
+	}
+	require.NoError(t, s.SaveItems(t.Context(), items))
+	for _, item := range items {
+		assert.NotZero(t, item.ID)
+	}
+
+	unread, err := s.Unread(t.Context())
+	require.NoError(t, err)
+	require.Len(t, unread, 1)
+	assert.Len(t, unread[0].Items, 251)
+	counts, err := s.Categories(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []feeder.CategoryCount{{Name: "Batch", Count: 250}}, counts)
+
+	all, err := s.All(t.Context())
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	for _, item := range all[0].Items {
+		if item.GUID == "guid1" {
+			assert.Equal(t, "revised", item.Content)
+			assert.True(t, item.Revised)
+			assert.False(t, item.Read)
+		}
+	}
+	require.NoError(t, s.SaveItems(t.Context(), nil))
+
+	// A failure part way through leaves nothing half saved
+	failing := []feeder.Item{existing[0]}
+	failing[0].GUID = "new-0"
+	for i := range 250 {
+		failing = append(failing, feeder.Item{FeedID: feed.ID, Title: "Fine", GUID: "fine-" + strconv.Itoa(i)})
+	}
+	failing = append(failing, feeder.Item{FeedID: feed.ID, Title: "Clashes", GUID: "guid1"})
+	require.Error(t, s.SaveItems(t.Context(), failing[1:]), "new item clashes")
+	require.Error(t, s.SaveItems(t.Context(), failing[:len(failing)-1]), "updated item clashes")
+	known, err := s.KnownItems(t.Context(), feed.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 251, len(known))
+	assert.NotContains(t, known, "fine-0")
+}
+
+func testRevisionLimit(t *testing.T, s feeder.Store) {
+	feed := feeder.Feed{Title: "Feed 1", URL: "https://example.com/feed1.rss", Items: []feeder.Item{
+		{Title: "Changing", GUID: "guid1", Content: "version 0"},
+		{Title: "Other", GUID: "guid2", Content: "version 0"},
+	}}
+	require.NoError(t, s.Save(t.Context(), &feed))
+	ids := []uint{feed.Items[0].ID, feed.Items[1].ID}
+	for i := range feeder.MaxRevisions + 5 {
+		items, err := s.Items(t.Context(), ids)
+		require.NoError(t, err)
+		require.Len(t, items, 2)
+		items[0].Revise(feeder.Item{Title: "Changing", Content: "version " + strconv.Itoa(i+1)}, false)
+		if i < 2 {
+			items[1].Revise(feeder.Item{Title: "Other", Content: "version " + strconv.Itoa(i+1)}, false)
+		}
+		require.NoError(t, s.SaveItems(t.Context(), items))
+	}
+	// Saving the whole feed keeps to the limit too
+	all, err := s.All(t.Context())
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	for i := range all[0].Items {
+		if all[0].Items[i].GUID == "guid1" {
+			all[0].Items[i].Revise(feeder.Item{Title: "Changing", Content: "latest"}, false)
+		}
+	}
+	require.NoError(t, s.Save(t.Context(), &all[0]))
+
+	backup := dump(t, s)
+	require.Len(t, backup.Feeds, 1)
+	revisions := make(map[string][]string)
+	for _, item := range backup.Feeds[0].Items {
+		for _, revision := range item.Revisions {
+			revisions[item.GUID] = append(revisions[item.GUID], revision.Content)
+		}
+	}
+	require.Len(t, revisions["guid1"], feeder.MaxRevisions)
+	assert.Equal(t, "version 6", revisions["guid1"][0], "the oldest are dropped")
+	assert.Equal(t, "version 15", revisions["guid1"][feeder.MaxRevisions-1])
+	assert.Equal(t, []string{"version 0", "version 1"}, revisions["guid2"], "other items keep theirs")
+}
@@ -0,0 +1,31 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package feeder
+
+import (
+	"context"
+
+	"github.com/mikerowehl/feeder/internal/statesync"
+)
+
+// ErrSyncDevice is returned by Sync for a device name that can't be used
+// as a file name.
+var ErrSyncDevice = statesync.ErrDevice
+
+// Sync keeps subscriptions and read and starred state in step with other
+// devices through dir, a directory shared between them by something like
+// Syncthing or Dropbox. This device's changes are written to a file in dir
+// named after device, then the files from every other device are merged
+// in, with the newest change to each feed or item winning.
+func Sync(ctx context.Context, store Store, dir string, device string) (SyncResult, error) {
+	return statesync.Sync(ctx, store, dir, device)
+}
+
+// DefaultSyncDevice is the device name to sync as if none is configured,
+// based on the host name.
+func DefaultSyncDevice() string {
+	return statesync.DefaultDevice()
+}
@@ -0,0 +1,126 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+// Package feeder is the public API for embedding feeder in other tools. It
+// covers storing feeds and items (Store), fetching and refreshing feeds
+// (Fetcher), and rendering items as a page, an EPUB book, or plain text.
+// The feeder command line tool is built on the same API.
+//
+// Everything exported here follows semantic versioning along with the
+// module: within a major version names aren't removed or changed, and new
+// fields and methods are only added in ways that don't break callers. The
+// exception is the Store interface, which can grow new methods in a minor
+// release, so embed it rather than implementing it from scratch if you wrap
+// a store.
+package feeder
+
+import (
+	"slices"
+
+	"github.com/mikerowehl/feeder/internal/backup"
+	"github.com/mikerowehl/feeder/internal/credentials"
+	"github.com/mikerowehl/feeder/internal/httpclient"
+	"github.com/mikerowehl/feeder/internal/output"
+	"github.com/mikerowehl/feeder/internal/repository"
+	"github.com/mikerowehl/feeder/internal/rss"
+	"github.com/mikerowehl/feeder/internal/rules"
+	"github.com/mikerowehl/feeder/internal/statesync"
+	"github.com/mikerowehl/feeder/internal/websub"
+)
+
+// The data types are the same ones the store persists, so values can be
+// passed between the store, the fetcher, and the renderers without copying.
+type (
+	Feed         = rss.Feed
+	Item         = rss.Item
+	Enclosure    = rss.Enclosure
+	Category     = rss.Category
+	Tag          = rss.Tag
+	ItemRevision = rss.ItemRevision
+	// A candidate feed found on a page, see Fetcher.Candidates
+	FeedLink = rss.FeedLink
+	// Selectors for a page scraped into items, see Fetcher.NewScrapedFeed
+	Scraper = rss.Scraper
+	// A feed server's answer other than 200 OK
+	StatusError = rss.StatusError
+
+	// Narrows down the items returned from a store
+	ItemFilter    = repository.ItemFilter
+	CategoryCount = repository.CategoryCount
+	FeedCount     = repository.FeedCount
+	// The parts of a stored item needed to check a fetched copy against it
+	KnownItem = repository.KnownItem
+	// Everything in a store, see Store.Dump and WriteBackup
+	Backup       = repository.Backup
+	RestoreStats = repository.RestoreStats
+	BackupHeader = backup.Header
+	// State shared between devices, see Sync
+	Change      = repository.Change
+	MergeResult = repository.MergeResult
+	SyncResult  = statesync.Result
+	// Credentials for private feeds, see LoadCredentials
+	Credentials      = credentials.Credentials
+	CredentialsEntry = credentials.Entry
+	// Settings for the HTTP client, see NewHTTPClient
+	HTTPConfig = httpclient.Config
+	HTTPProxy  = httpclient.FeedProxy
+	// WebSub subscriptions, see Fetcher.NewPushSubscriber
+	Hub              = websub.Hub
+	PushSubscriber   = websub.Subscriber
+	PushSubscription = websub.Subscription
+
+	// A rule applied to new items as they're fetched
+	Rule = rules.Rule
+
+	// Another feed that had the same story, see Duplicates
+	AlsoIn = output.AlsoIn
+)
+
+// Fields a Rule can match against.
+const (
+	FieldFeed    = rules.FieldFeed
+	FieldTitle   = rules.FieldTitle
+	FieldContent = rules.FieldContent
+	FieldAuthor  = rules.FieldAuthor
+	FieldLink    = rules.FieldLink
+	FieldAny     = rules.FieldAny
+)
+
+// Actions a Rule can take on a matching item.
+const (
+	ActionSkip   = rules.ActionSkip
+	ActionRead   = rules.ActionRead
+	ActionStar   = rules.ActionStar
+	ActionTag    = rules.ActionTag
+	ActionNotify = rules.ActionNotify
+)
+
+// The kinds of Change kept in step between devices.
+const (
+	ChangeSubscribed = repository.ChangeSubscribed
+	ChangeRead       = repository.ChangeRead
+	ChangeStarred    = repository.ChangeStarred
+)
+
+// MaxRevisions is how many earlier versions of an item a Store keeps.
+const MaxRevisions = rss.MaxRevisions
+
+// RuleFields lists all the fields a Rule can match against.
+func RuleFields() []string {
+	return slices.Clone(rules.Fields)
+}
+
+// RuleActions lists all the actions a Rule can take.
+func RuleActions() []string {
+	return slices.Clone(rules.Actions)
+}
+
+// ParsePattern turns the /pattern/flags form of a regular expression into a
+// Go pattern for a Rule, so "/sponsored/i" becomes "(?i)sponsored". The
+// second return is false, and the string is returned as is, if it isn't in
+// that form.
+func ParsePattern(s string) (string, bool) {
+	return rules.ParsePattern(s)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package feeder
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/mikerowehl/feeder/internal/rss"
+	"github.com/mikerowehl/feeder/internal/websub"
+)
+
+// DefaultPushLease is how long a push subscriber asks hubs to keep its
+// subscriptions for.
+const DefaultPushLease = websub.DefaultLease
+
+// ErrNoHub is returned by DiscoverHub for a feed that doesn't publish
+// through a WebSub hub.
+var ErrNoHub = websub.ErrNoHub
+
+// DiscoverHub finds the WebSub hub a feed publishes through, from the Link
+// headers it's served with or the links in the feed.
+func (f *Fetcher) DiscoverHub(ctx context.Context, url string) (Hub, error) {
+	return websub.Discover(ctx, url, f.Client)
+}
+
+// Ingest saves content pushed for a feed the same way Refresh saves what it
+// fetches: the rules are applied to the new items, changed ones are
+// revised, and the new items are grouped with other coverage of the same
+// story.
+func (f *Fetcher) Ingest(ctx context.Context, store Store, feed *Feed, content string) (RefreshResult, error) {
+	var result RefreshResult
+	ruleset, err := store.Rules(ctx)
+	if err != nil {
+		return result, fmt.Errorf("Error loading rules: %w", err)
+	}
+	items, err := feed.ParseContent(f.limit(ctx), content, f.MaxItems)
+	if err != nil {
+		return result, err
+	}
+	fresh, problems, err := f.saveItems(ctx, ctx, store, ruleset, feed, items)
+	result.ArticleErrors = problems
+	if err != nil {
+		return result, err
+	}
+	result.New = fresh
+	result.Fetched = []string{feed.URL}
+	result.Duplicates, result.DedupErr = f.cluster(ctx, store, fresh)
+	return result, nil
+}
+
+// NewPushSubscriber creates a subscriber that saves whatever the hubs push
+// to store. Hubs reach it at callback, the public URL its ServeHTTP is
+// served at. Pushes are saved one at a time. The hubs are only given a
+// secret to sign pushes with when callback is HTTPS, as the spec asks, so
+// over plain HTTP anyone who can reach the callback can push.
+func (f *Fetcher) NewPushSubscriber(store Store, callback string) *PushSubscriber {
+	var mu sync.Mutex
+	var sub *PushSubscriber
+	sub = websub.NewSubscriber(f.Client, callback, func(ctx context.Context, feed *rss.Feed, content string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		result, err := f.Ingest(ctx, store, feed, content)
+		if err != nil {
+			return err
+		}
+		if sub.Logf != nil {
+			sub.Logf("Pushed %d new items for %s\n", len(result.New), feed.URL)
+			if result.DedupErr != nil {
+				sub.Logf("Error finding duplicate items: %v\n", result.DedupErr)
+			}
+		}
+		return nil
+	})
+	sub.MaxBodySize = f.MaxFeedSize
+	return sub
+}
@@ -6,10 +6,21 @@ See LICENSE in the project root for full license information.
 package integration
 
 import (
+	"archive/zip"
 	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/mikerowehl/feeder/cmd"
+	"github.com/mikerowehl/feeder/pkg/feeder"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -17,6 +28,13 @@ import (
 
 func executeCommand(t *testing.T, args ...string) (string, string, error) {
 	t.Helper()
+	return executeCommandInput(t, "", args...)
+}
+
+// Same as executeCommand but with the given string available on standard
+// input, for commands that read from it.
+func executeCommandInput(t *testing.T, input string, args ...string) (string, string, error) {
+	t.Helper()
 
 	viper.Reset()
 	rootCmd := cmd.NewRootCommand(true)
@@ -25,6 +43,7 @@ func executeCommand(t *testing.T, args ...string) (string, string, error) {
 	rootCmd.SetOut(stdoutBuf)
 	stderrBuf := new(bytes.Buffer)
 	rootCmd.SetErr(stderrBuf)
+	rootCmd.SetIn(strings.NewReader(input))
 	rootCmd.SetArgs(args)
 
 	err := rootCmd.Execute()
@@ -33,7 +52,7 @@ func executeCommand(t *testing.T, args ...string) (string, string, error) {
 
 // Just make sure the help for each command outputs a Usage section
 func TestIntegration_Help(t *testing.T) {
-	commands := []string{"add", "config", "daily", "delete", "export", "fetch", "import", "list", "mark", "read", "trim"}
+	commands := []string{"add", "backup", "categories", "config", "daily", "delete", "download", "export", "fetch", "import", "list", "mark", "push", "read", "restore", "rules", "scrape", "set", "sync", "trim", "tui"}
 
 	for _, cmd := range commands {
 		t.Run(cmd, func(t *testing.T) {
@@ -77,3 +96,588 @@ func TestIntegration_AddDiscovery(t *testing.T) {
 	require.NoError(t, err)
 	assert.Contains(t, stdout, "Feeder Basic Integration Test")
 }
+
+// A page that lists several feeds can have one picked with --pick
+func TestIntegration_AddPick(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	contentURL := getTestFeedURL(server, "multi.html")
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db"}
+
+	_, _, err := executeCommand(t, append(testArgs, "add", "--pick", "2", contentURL)...)
+	require.NoError(t, err)
+
+	stdout, _, err := executeCommand(t, append(testArgs, "list")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Feeder Comments Integration Test Feed")
+	assert.NotContains(t, stdout, "Feeder Basic Integration Test Feed")
+}
+
+// Without --pick the candidates are listed and the choice is read from input
+func TestIntegration_AddPrompt(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	contentURL := getTestFeedURL(server, "multi.html")
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db"}
+
+	stdout, _, err := executeCommandInput(t, "1\n", append(testArgs, "add", contentURL)...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Comments")
+
+	stdout, _, err = executeCommand(t, append(testArgs, "list")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Feeder Basic Integration Test Feed")
+
+	_, _, err = executeCommand(t, append(testArgs, "add", contentURL)...)
+	require.Error(t, err, "no input to pick from should fail")
+}
+
+// A feed served as plain text can't be found by its content type, so it's
+// added as it is, unless --pick asked for one of the feeds found
+func TestIntegration_AddUndiscovered(t *testing.T) {
+	tmpDir := t.TempDir()
+	content, err := os.ReadFile("../feeds/basic.xml")
+	require.NoError(t, err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write(content)
+	}))
+	t.Cleanup(server.Close)
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db"}
+
+	_, _, err = executeCommand(t, append(testArgs, "add", "--pick", "1", server.URL+"/feed")...)
+	require.ErrorContains(t, err, "unexpected content type")
+
+	_, _, err = executeCommand(t, append(testArgs, "add", server.URL+"/feed")...)
+	require.NoError(t, err)
+	stdout, _, err := executeCommand(t, append(testArgs, "list")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Feeder Basic Integration Test")
+}
+
+// A page without any alternate links falls back to probing common paths. The
+// root of the test server is a directory listing, and index.xml is there.
+func TestIntegration_AddProbe(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db"}
+
+	_, _, err := executeCommand(t, append(testArgs, "add", server.URL+"/")...)
+	require.NoError(t, err)
+
+	stdout, _, err := executeCommand(t, append(testArgs, "list")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Feeder Probe Integration Test Feed")
+}
+
+// Fetch the items for a feed and write out only the ones in one category
+func TestIntegration_ReadCategory(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	feedURL := getTestFeedURL(server, "basic.xml")
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db"}
+
+	_, _, err := executeCommand(t, append(testArgs, "add", feedURL)...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "fetch")...)
+	require.NoError(t, err)
+
+	stdout, _, err := executeCommand(t, append(testArgs, "categories")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Testing (1)")
+
+	stdout, _, err = executeCommand(t, append(testArgs, "--output", "-", "read", "--category", "testing")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Test Article 1")
+	assert.Contains(t, stdout, "This is a test article")
+	assert.NotContains(t, stdout, "Test Article 2")
+}
+
+// A skip rule keeps matching items from being stored at all, and rules test
+// previews what a rule matches
+func TestIntegration_Rules(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	feedURL := getTestFeedURL(server, "basic.xml")
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db"}
+
+	_, _, err := executeCommand(t, append(testArgs, "add", feedURL)...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "rules", "add", "--field", "title", "--match", "/article 1$/i")...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "rules", "add", "--match", "another", "--action", "tag", "--tag", "second")...)
+	require.NoError(t, err)
+
+	stdout, _, err := executeCommand(t, append(testArgs, "rules", "list")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, `1: all feeds: skip if title matches "(?i)article 1$"`)
+
+	_, _, err = executeCommand(t, append(testArgs, "fetch")...)
+	require.NoError(t, err)
+
+	stdout, _, err = executeCommand(t, append(testArgs, "--output", "-", "read")...)
+	require.NoError(t, err)
+	assert.NotContains(t, stdout, "Test Article 1")
+	assert.Contains(t, stdout, "Test Article 2")
+	assert.Contains(t, stdout, `<span class="tag">second</span>`)
+
+	stdout, _, err = executeCommand(t, append(testArgs, "rules", "test", "--field", "author", "--match", "alice")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "0 of 1 items matched")
+}
+
+// The same story from two feeds only shows up once in the page, with a link
+// to the other feed
+func TestIntegration_Duplicates(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db"}
+
+	for _, name := range []string{"basic.xml", "duplicate.xml"} {
+		_, _, err := executeCommand(t, append(testArgs, "add", getTestFeedURL(server, name))...)
+		require.NoError(t, err)
+	}
+	_, _, err := executeCommand(t, append(testArgs, "fetch")...)
+	require.NoError(t, err)
+
+	stdout, _, err := executeCommand(t, append(testArgs, "--output", "-", "read")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Test Article 1")
+	assert.NotContains(t, stdout, "Someone else wrote about article 1")
+	assert.Contains(t, stdout, "Feeder Duplicate Integration Test Feed</a>")
+}
+
+// Syndicated copies often have the same link and no guid, so the items in
+// both feeds end up with the same GUID
+func TestIntegration_DuplicatesSharedLink(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db"}
+
+	for _, name := range []string{"basic.xml", "syndicated.xml"} {
+		_, _, err := executeCommand(t, append(testArgs, "add", getTestFeedURL(server, name))...)
+		require.NoError(t, err)
+	}
+	_, stderr, err := executeCommand(t, append(testArgs, "fetch")...)
+	require.NoError(t, err)
+	assert.NotContains(t, stderr, "UNIQUE")
+
+	stdout, _, err := executeCommand(t, append(testArgs, "--output", "-", "read")...)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(stdout, "Test Article 1"))
+	assert.Contains(t, stdout, "Feeder Syndicated Integration Test Feed</a>")
+}
+
+// Per-feed settings can be changed, but only for feeds that exist
+func TestIntegration_Set(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db"}
+
+	_, _, err := executeCommand(t, append(testArgs, "add", getTestFeedURL(server, "basic.xml"))...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "set", "1", "--full-content", "--updated-unread")...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "set", "2", "--full-content")...)
+	require.Error(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "set", "1")...)
+	require.Error(t, err, "no settings given")
+}
+
+// Starred items can be written out as an EPUB book, read or not
+func TestIntegration_ReadEpub(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db"}
+
+	_, _, err := executeCommand(t, append(testArgs, "add", getTestFeedURL(server, "basic.xml"))...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "rules", "add", "--match", "article 2", "--action", "star")...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "fetch")...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "mark")...)
+	require.NoError(t, err)
+
+	_, _, err = executeCommand(t, append(testArgs, "read", "--format", "pdf")...)
+	require.Error(t, err)
+
+	bookFile := filepath.Join(tmpDir, "starred.epub")
+	_, _, err = executeCommand(t, append(testArgs, "--output", bookFile, "read", "--format", "epub", "--starred")...)
+	require.NoError(t, err)
+
+	book, err := zip.OpenReader(bookFile)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, book.Close())
+	}()
+	require.NotEmpty(t, book.File)
+	assert.Equal(t, "mimetype", book.File[0].Name)
+	var chapter string
+	for _, file := range book.File {
+		if file.Name == "OEBPS/chapter-1.xhtml" {
+			rc, err := file.Open()
+			require.NoError(t, err)
+			content, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			chapter = string(content)
+		}
+	}
+	assert.Contains(t, chapter, "Test Article 2")
+	assert.NotContains(t, chapter, "Test Article 1")
+}
+
+// Trim vacuums the database file so it waits for the lock that other feeder
+// processes hold, while normal commands can share it
+func TestIntegration_TrimLocked(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db", "--lock-timeout", "200ms"}
+
+	_, _, err := executeCommand(t, append(testArgs, "add", getTestFeedURL(server, "basic.xml"))...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "set", "2", "--full-content")...)
+	require.Error(t, err, "a failed command still lets go of the lock")
+
+	other, err := feeder.LockStore(t.Context(), filepath.Join(tmpDir, "test.db"), false, time.Second)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "fetch")...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "trim")...)
+	require.ErrorIs(t, err, feeder.ErrStoreLocked)
+
+	require.NoError(t, other.Release())
+	_, _, err = executeCommand(t, append(testArgs, "trim")...)
+	require.NoError(t, err)
+}
+
+// Daily only takes the lock around its VACUUM, so another feeder process
+// holding the lock doesn't stop the fetch, the page, or marking read
+func TestIntegration_DailyLocked(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	page := filepath.Join(tmpDir, "daily.html")
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db", "--lock-timeout", "200ms", "--output", page}
+	_, _, err := executeCommand(t, append(testArgs, "add", getTestFeedURL(server, "basic.xml"))...)
+	require.NoError(t, err)
+
+	other, err := feeder.LockStore(t.Context(), filepath.Join(tmpDir, "test.db"), false, time.Second)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, other.Release())
+	}()
+	// Nothing to open the page with, so it stops at the very end
+	t.Setenv("PATH", t.TempDir())
+	_, _, err = executeCommand(t, append(testArgs, "daily")...)
+	require.ErrorContains(t, err, "open command")
+	assert.FileExists(t, page)
+	stdout, _, err := executeCommand(t, append(testArgs, "list")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Feeder Basic Integration Test")
+	_, _, err = executeCommand(t, append(testArgs, "read", "--output", filepath.Join(tmpDir, "again.html"))...)
+	require.NoError(t, err)
+	again, err := os.ReadFile(filepath.Join(tmpDir, "again.html"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(again), "Test Article 1", "daily marked everything read")
+}
+
+// The hubs can't reach a listener on every address, so push needs a
+// callback URL for those
+func TestIntegration_PushCallback(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db"}
+	_, _, err := executeCommand(t, append(testArgs, "add", getTestFeedURL(server, "basic.xml"))...)
+	require.NoError(t, err)
+
+	_, _, err = executeCommand(t, append(testArgs, "push")...)
+	require.ErrorContains(t, err, "--callback")
+	_, _, err = executeCommand(t, append(testArgs, "push", "--listen", "0.0.0.0:0")...)
+	require.ErrorContains(t, err, "--callback")
+	_, _, err = executeCommand(t, append(testArgs, "push", "--listen", "[::]:0")...)
+	require.ErrorContains(t, err, "--callback")
+
+	// Either is fine, so it gets as far as finding the feed has no hub
+	_, stderr, err := executeCommand(t, append(testArgs, "push", "--listen", "127.0.0.1:0")...)
+	require.ErrorContains(t, err, "none of the feeds publish through a hub")
+	assert.Contains(t, stderr, "isn't HTTPS")
+	_, stderr, err = executeCommand(t, append(testArgs, "push", "--listen", ":0", "--callback", "https://feeds.example.com/websub/")...)
+	require.ErrorContains(t, err, "none of the feeds publish through a hub")
+	assert.NotContains(t, stderr, "isn't HTTPS")
+}
+
+// Read state survives rebuilding the database by restoring a backup, either
+// merged into a freshly fetched database or replacing it
+func TestIntegration_BackupRestore(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	feedURL := getTestFeedURL(server, "basic.xml")
+	oldArgs := []string{"--db-dir", tmpDir, "--db-file", "old.db"}
+	backupFile := filepath.Join(tmpDir, "feeds.backup")
+
+	_, _, err := executeCommand(t, append(oldArgs, "add", feedURL)...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(oldArgs, "fetch")...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(oldArgs, "mark")...)
+	require.NoError(t, err)
+	stdout, _, err := executeCommand(t, append(oldArgs, "backup", backupFile)...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Backed up 1 feeds")
+
+	newArgs := []string{"--db-dir", tmpDir, "--db-file", "new.db"}
+	_, _, err = executeCommandInput(t, feedURL+"\n", append(newArgs, "import")...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(newArgs, "fetch")...)
+	require.NoError(t, err)
+	stdout, _, err = executeCommand(t, append(newArgs, "--output", "-", "read")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Test Article 1", "everything is unread after rebuilding")
+
+	_, _, err = executeCommand(t, append(newArgs, "restore", backupFile)...)
+	require.NoError(t, err)
+	stdout, _, err = executeCommand(t, append(newArgs, "--output", "-", "read")...)
+	require.NoError(t, err)
+	assert.NotContains(t, stdout, "Test Article 1", "read state comes back from the backup")
+
+	replaceArgs := []string{"--db-dir", tmpDir, "--db-file", "replace.db"}
+	_, _, err = executeCommand(t, append(replaceArgs, "add", getTestFeedURL(server, "comments.xml"))...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(replaceArgs, "restore", "--replace", backupFile)...)
+	require.NoError(t, err)
+	stdout, _, err = executeCommand(t, append(replaceArgs, "list")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Feeder Basic Integration Test")
+	assert.NotContains(t, stdout, "Comments")
+
+	snapshot := filepath.Join(tmpDir, "snapshot.db")
+	_, _, err = executeCommand(t, append(oldArgs, "backup", "--snapshot", snapshot)...)
+	require.NoError(t, err)
+	stdout, _, err = executeCommand(t, "--db-dir", tmpDir, "--db-file", "snapshot.db", "list")
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Feeder Basic Integration Test")
+}
+
+// Two databases stand in for two devices sharing a sync directory
+func TestIntegration_Sync(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	syncDir := filepath.Join(tmpDir, "shared")
+	laptopArgs := []string{"--db-dir", tmpDir, "--db-file", "laptop.db"}
+	desktopArgs := []string{"--db-dir", tmpDir, "--db-file", "desktop.db"}
+
+	_, _, err := executeCommand(t, append(laptopArgs, "sync")...)
+	require.Error(t, err, "needs a directory")
+
+	_, _, err = executeCommand(t, append(laptopArgs, "add", getTestFeedURL(server, "basic.xml"))...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(laptopArgs, "fetch")...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(laptopArgs, "mark")...)
+	require.NoError(t, err)
+	stdout, _, err := executeCommand(t, append(laptopArgs, "sync", "--dir", syncDir, "--device", "laptop")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "No other devices")
+
+	stdout, _, err = executeCommand(t, append(desktopArgs, "sync", "--dir", syncDir, "--device", "desktop")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "from laptop")
+	assert.Contains(t, stdout, "waiting for items")
+	_, _, err = executeCommand(t, append(desktopArgs, "fetch")...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(desktopArgs, "sync", "--dir", syncDir, "--device", "desktop")...)
+	require.NoError(t, err)
+
+	stdout, _, err = executeCommand(t, append(desktopArgs, "list")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Feeder Basic Integration Test")
+	stdout, _, err = executeCommand(t, append(desktopArgs, "--output", "-", "read")...)
+	require.NoError(t, err)
+	assert.NotContains(t, stdout, "Test Article 1", "read on the laptop")
+}
+
+// A private feed works with credentials from the credentials file or in the
+// URL, and export leaves the ones in the URL out.
+func TestIntegration_Credentials(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("FEEDER_TEST_PASSWORD", "secret")
+	server := startAuthFeedServer(t, "me", "secret")
+	credsFile := filepath.Join(tmpDir, "credentials.yaml")
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db", "--credentials", credsFile}
+
+	_, _, err := executeCommand(t, append(testArgs, "add", getTestFeedURL(server, "basic.xml"))...)
+	require.Error(t, err, "no credentials yet")
+
+	creds := "feeds:\n  - match: " + server.URL + "/basic.xml\n    username: me\n    password: env:FEEDER_TEST_PASSWORD\n"
+	require.NoError(t, os.WriteFile(credsFile, []byte(creds), 0o644))
+	_, _, err = executeCommand(t, append(testArgs, "add", getTestFeedURL(server, "basic.xml"))...)
+	require.ErrorIs(t, err, feeder.ErrCredentialsPermissions)
+
+	require.NoError(t, os.Chmod(credsFile, 0o600))
+	_, _, err = executeCommand(t, append(testArgs, "add", getTestFeedURL(server, "basic.xml"))...)
+	require.NoError(t, err)
+	inURL := strings.Replace(getTestFeedURL(server, "comments.xml"), "://", "://me:secret@", 1)
+	_, _, err = executeCommand(t, append(testArgs, "add", inURL)...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "fetch")...)
+	require.NoError(t, err)
+
+	stdout, _, err := executeCommand(t, append(testArgs, "export")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, getTestFeedURL(server, "basic.xml"))
+	assert.Contains(t, stdout, getTestFeedURL(server, "comments.xml"))
+	assert.NotContains(t, stdout, "secret")
+}
+
+// The HTTP client settings reach the requests the commands make
+func TestIntegration_HTTPConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	var agents []string
+	feeds := http.FileServer(http.Dir("../feeds"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.UserAgent())
+		feeds.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db"}
+
+	_, _, err := executeCommand(t, append(testArgs, "--user-agent", "Corporate/1.0", "add", getTestFeedURL(server, "basic.xml"))...)
+	require.NoError(t, err)
+	require.NotEmpty(t, agents)
+	for _, agent := range agents {
+		assert.Equal(t, "Corporate/1.0", agent)
+	}
+
+	_, _, err = executeCommand(t, append(testArgs, "--http-proxy", "ftp://proxy.example.com", "fetch")...)
+	assert.ErrorContains(t, err, "bad proxy")
+}
+
+// Feeds from a file and a command, and a filter changing a feed's content
+// before it's parsed
+func TestIntegration_LocalSources(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are written for sh")
+	}
+	tmpDir := t.TempDir()
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db"}
+	feedPath, err := filepath.Abs("../feeds/basic.xml")
+	require.NoError(t, err)
+
+	_, _, err = executeCommand(t, append(testArgs, "add", "file://"+filepath.ToSlash(feedPath))...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "add", "--filter", "sed s/Comments/Filtered/",
+		"exec:cat '"+filepath.Join(filepath.Dir(feedPath), "comments.xml")+"'")...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "fetch")...)
+	require.NoError(t, err)
+
+	stdout, _, err := executeCommand(t, append(testArgs, "list")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Feeder Basic Integration Test")
+	assert.Contains(t, stdout, "Filtered")
+	assert.NotContains(t, stdout, "Comments")
+
+	_, _, err = executeCommand(t, append(testArgs, "set", "2", "--filter", "exit 1")...)
+	require.NoError(t, err)
+	stdout, _, err = executeCommand(t, append(testArgs, "fetch")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "filter")
+}
+
+// Preview a scraper, then follow the page and read the scraped items
+func TestIntegration_Scrape(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	pageURL := getTestFeedURL(server, "changelog.html")
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db"}
+	selectors := []string{"--item", "section.release", "--title", "h2", "--date", "time, .date", "--content", ".notes"}
+
+	stdout, _, err := executeCommand(t, append(append(testArgs, "scrape", "test", pageURL), selectors...)...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Found 3 items")
+	assert.Contains(t, stdout, "Version 2.0.1")
+	assert.Contains(t, stdout, server.URL+"/releases/2.1.0")
+	assert.Contains(t, stdout, "Fixed a crash on startup.")
+
+	_, _, err = executeCommand(t, append(testArgs, "scrape", "add", pageURL, "--item", "article")...)
+	require.ErrorIs(t, err, feeder.ErrNoScrapedItems)
+	_, _, err = executeCommand(t, append(testArgs, "scrape", "add", pageURL, "--item", "section[")...)
+	require.ErrorContains(t, err, "bad item selector")
+
+	_, _, err = executeCommand(t, append(append(testArgs, "scrape", "add", pageURL), selectors...)...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "fetch")...)
+	require.NoError(t, err)
+	stdout, _, err = executeCommand(t, append(testArgs, "list")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Widget Changelog")
+	stdout, _, err = executeCommand(t, append(testArgs, "--output", "-", "read")...)
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "Version 2.1.0")
+	assert.Contains(t, stdout, "First stable release.")
+}
+
+// Notifications for every new item in one feed and for the items a rule
+// picks out of another
+func TestIntegration_Notify(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	var titles []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Title string `json:"title"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		titles = append(titles, body.Title)
+	}))
+	defer hook.Close()
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db"}
+
+	_, _, err := executeCommand(t, append(testArgs, "add", getTestFeedURL(server, "basic.xml"))...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "add", getTestFeedURL(server, "comments.xml"))...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "set", "1", "--notify")...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "rules", "add", "--feed", "2", "--field", "title",
+		"--match", "article 2", "--action", "notify")...)
+	require.NoError(t, err)
+
+	_, _, err = executeCommand(t, append(testArgs, "fetch", "--notify-webhook", "json="+hook.URL)...)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"Test Article 1", "Test Article 2", "Test Article 2"}, titles)
+
+	_, _, err = executeCommand(t, append(testArgs, "fetch", "--notify-webhook", hook.URL)...)
+	require.NoError(t, err)
+	assert.Len(t, titles, 3, "nothing new the second time")
+
+	_, _, err = executeCommand(t, append(testArgs, "fetch", "--notify-webhook", "teams="+hook.URL)...)
+	assert.ErrorContains(t, err, "unknown webhook format")
+}
+
+// Daily notifies about new items the same as fetch
+func TestIntegration_DailyNotify(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := startTestFeedServer(t)
+	var titles []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Title string `json:"title"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		titles = append(titles, body.Title)
+	}))
+	defer hook.Close()
+	testArgs := []string{"--db-dir", tmpDir, "--db-file", "test.db", "--output", filepath.Join(tmpDir, "daily.html")}
+
+	_, _, err := executeCommand(t, append(testArgs, "add", getTestFeedURL(server, "basic.xml"))...)
+	require.NoError(t, err)
+	_, _, err = executeCommand(t, append(testArgs, "set", "1", "--notify")...)
+	require.NoError(t, err)
+	// Nothing to open the page with, so it stops at the very end
+	t.Setenv("PATH", t.TempDir())
+	_, _, err = executeCommand(t, append(testArgs, "daily", "--notify-webhook", hook.URL)...)
+	require.ErrorContains(t, err, "open command")
+	assert.ElementsMatch(t, []string{"Test Article 1", "Test Article 2"}, titles)
+}
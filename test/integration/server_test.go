@@ -28,3 +28,25 @@ func startTestFeedServer(t *testing.T) *httptest.Server {
 func getTestFeedURL(server *httptest.Server, filename string) string {
 	return server.URL + "/" + filename
 }
+
+// Same as startTestFeedServer, but everything needs the given basic auth
+// username and password.
+func startAuthFeedServer(t *testing.T, username string, password string) *httptest.Server {
+	t.Helper()
+
+	fs := http.FileServer(http.Dir("../feeds"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != username || pass != password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fs.ServeHTTP(w, r)
+	}))
+
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	return server
+}
@@ -0,0 +1,163 @@
+/*
+Copyright (c) Mike Rowehl <mikerowehl@gmail.com>
+This software may be modified and distributed under the terms of the MIT license.
+See LICENSE in the project root for full license information.
+*/
+package mock
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// HubSubscription is a subscription a Hub has checked with the subscriber.
+type HubSubscription struct {
+	Topic    string
+	Callback string
+	Secret   string
+}
+
+// Hub stands in for a WebSub hub. It takes subscription requests, checks
+// each one with the subscriber by sending it a challenge to echo, the way
+// a real hub does, and publishes content to the subscribers it checked.
+type Hub struct {
+	*httptest.Server
+	// The lease granted to subscribers, in seconds, none if 0
+	LeaseSeconds int
+	// Used to call the subscribers back, for ones served over TLS
+	Client *http.Client
+
+	mu       sync.Mutex
+	subs     map[string]HubSubscription
+	requests int
+	verified chan HubSubscription
+}
+
+// NewHub starts a hub that's shut down at the end of the test.
+func NewHub(t *testing.T) *Hub {
+	t.Helper()
+	h := &Hub{Client: http.DefaultClient, subs: make(map[string]HubSubscription), verified: make(chan HubSubscription, 16)}
+	h.Server = httptest.NewServer(http.HandlerFunc(h.subscribe))
+	t.Cleanup(h.Close)
+	return h
+}
+
+func (h *Hub) subscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil || r.PostForm.Get("hub.mode") != "subscribe" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	sub := HubSubscription{
+		Topic:    r.PostForm.Get("hub.topic"),
+		Callback: r.PostForm.Get("hub.callback"),
+		Secret:   r.PostForm.Get("hub.secret"),
+	}
+	h.mu.Lock()
+	h.requests++
+	h.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+	go h.verify(sub)
+}
+
+// Send the subscriber a challenge, and keep the subscription if it's
+// echoed back.
+func (h *Hub) verify(sub HubSubscription) {
+	u, err := url.Parse(sub.Callback)
+	if err != nil {
+		return
+	}
+	challenge := strconv.FormatInt(time.Now().UnixNano(), 36)
+	query := u.Query()
+	query.Set("hub.mode", "subscribe")
+	query.Set("hub.topic", sub.Topic)
+	query.Set("hub.challenge", challenge)
+	if h.LeaseSeconds > 0 {
+		query.Set("hub.lease_seconds", strconv.Itoa(h.LeaseSeconds))
+	}
+	u.RawQuery = query.Encode()
+	resp, err := h.Client.Get(u.String())
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != challenge {
+		return
+	}
+	h.mu.Lock()
+	h.subs[sub.Topic] = sub
+	h.mu.Unlock()
+	h.verified <- sub
+}
+
+// Verified waits for the hub to check a subscription with its subscriber.
+func (h *Hub) Verified(t *testing.T) HubSubscription {
+	t.Helper()
+	select {
+	case sub := <-h.verified:
+		return sub
+	case <-time.After(5 * time.Second):
+		t.Fatal("hub didn't verify a subscription")
+		return HubSubscription{}
+	}
+}
+
+// Requests is how many subscription requests the hub has had.
+func (h *Hub) Requests() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requests
+}
+
+// Publish pushes content to the subscriber for a topic, signed with its
+// secret if it gave one, returning the status the subscriber answered with.
+func (h *Hub) Publish(topic string, content string) (int, error) {
+	h.mu.Lock()
+	sub, ok := h.subs[topic]
+	h.mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("no subscriber for %s", topic)
+	}
+	if sub.Secret == "" {
+		return h.PublishSigned(topic, content, "")
+	}
+	mac := hmac.New(sha256.New, []byte(sub.Secret))
+	mac.Write([]byte(content))
+	return h.PublishSigned(topic, content, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+// PublishSigned is Publish with the signature given, for checking that bad
+// ones are turned away.
+func (h *Hub) PublishSigned(topic string, content string, signature string) (int, error) {
+	h.mu.Lock()
+	sub, ok := h.subs[topic]
+	h.mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("no subscriber for %s", topic)
+	}
+	req, err := http.NewRequest("POST", sub.Callback, strings.NewReader(content))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/atom+xml")
+	if signature != "" {
+		req.Header.Set("X-Hub-Signature", signature)
+	}
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}